@@ -278,9 +278,28 @@ func InitBlockIndex(lis IListener) *BlockIndex {
 		if err != nil {
 			panic(err)
 		}
-		err = bi.LoadAll(-1, func(pv uint) {
-			LogInfof("load block main chian progress = %d%%", pv)
-		})
+		err = bi.fee.Load(bi.feeFile())
+		if err != nil {
+			LogError("load fee estimate error", err)
+		}
+		if *IsReindex {
+			err = bi.Reindex(func(pv uint) {
+				LogInfof("reindex block main chain progress = %d%%", pv)
+			})
+		} else {
+			err = bi.LoadAll(-1, func(pv uint) {
+				LogInfof("load block main chian progress = %d%%", pv)
+			})
+		}
+		//恢复上次中断的区块写入
+		if err == nil || err == ErrEmptyBlockChain {
+			if rerr := bi.recoverJournal(); rerr != nil {
+				panic(rerr)
+			}
+			if bi.Len() > 0 {
+				err = nil
+			}
+		}
 		if err == ErrEmptyBlockChain {
 			LinkGenesis(bi)
 		} else if err == ErrArriveFirstBlock {
@@ -288,6 +307,8 @@ func InitBlockIndex(lis IListener) *BlockIndex {
 		} else if err != nil {
 			panic(err)
 		}
+		//后台建立或者删除可选索引
+		bi.idx.start(bi)
 		midx = bi
 	})
 	return midx
@@ -303,6 +324,13 @@ type BlockIndex struct {
 	imap  map[HASH256]*list.Element //按id缓存
 	lru   *lru.Cache                //lru缓存
 	blkdb IBlkStore                 //区块存储和索引
+	fee   *FeeEstimator             //交易费估算
+	idx   *indexer                  //可选索引
+	cpt   *compactor                //数据库合并
+	dir   string                    //数据目录,为空使用配置目录
+	ps    *PubSub                   //发布订阅,为空使用全局
+	avh   *assumeheaders            //连接到assume-valid区块的区块头链
+	jhook func(step int)            //测试时在写入区块的每一步调用,用来模拟进程中断
 }
 
 //NewMsgTxMerkle 返回某个交易的merkle验证树
@@ -334,6 +362,7 @@ func (bi *BlockIndex) NewMsgTxMerkle(id HASH256) (*MsgTxMerkle, error) {
 	}
 	msg := &MsgTxMerkle{}
 	msg.TxID = id
+	msg.BlkID = txv.BlkID
 	msg.Hashs = tree.Hashs()
 	msg.Trans = VarInt(tree.Trans())
 	msg.Bits = tree.Bits().Bytes()
@@ -677,7 +706,10 @@ func (bi *BlockIndex) LoadAll(limit int, fn func(pv uint)) error {
 	}
 	bv := bi.GetBestValue()
 	LogInfof("load finished block , best height=%d,best id=%v", bv.Height, bv.ID)
-	return bi.txp.Load(bi, TxPoolFile)
+	if hv, err := bi.UtxoHash(bv.Height); err == nil {
+		LogInfof("best utxo hash=%v", hv)
+	}
+	return bi.txp.Load(bi, bi.txpFile())
 }
 
 //HasSync 是否有需要下载的区块
@@ -760,16 +792,24 @@ func (bi *BlockIndex) Unlink(hds Headers) error {
 	if len(ls) == 0 {
 		return nil
 	}
-	//从分叉高度开始检测证据区块头是否合法
-	err := ls.Check(lp.Height, bi)
-	if err != nil {
-		return err
+	//不能回退到已经通过的检查点之前
+	if cph, has := conf.LastCheckpoint(bi.Height()); has && lp.Height < cph {
+		return fmt.Errorf("%w fork height %d checkpoint height %d", ErrCheckpointFork, lp.Height, cph)
 	}
 	//获取需要回退到id的数量
 	num, err := bi.UnlinkCount(lp.ID)
 	if err != nil {
 		return err
 	}
+	//不能超过最大回退深度
+	if err := bi.checkReorg(num); err != nil {
+		return err
+	}
+	//从分叉高度开始检测证据区块头是否合法
+	err = ls.Check(lp.Height, bi)
+	if err != nil {
+		return err
+	}
 	//如果证据区块头不足
 	if num >= uint32(len(ls)) {
 		return ErrHeadersTooLow
@@ -780,19 +820,32 @@ func (bi *BlockIndex) Unlink(hds Headers) error {
 
 //UnlinkTo 必须从最后开始断开，回退到指定id,不包括id
 func (bi *BlockIndex) UnlinkTo(id HASH256) error {
+	blks, err := bi.unlinkTo(id)
+	//释放锁之后再广播,订阅者处理事件时可能需要读取链
+	bi.pubUnlink(blks...)
+	return err
+}
+
+//返回已经断开的区块
+func (bi *BlockIndex) unlinkTo(id HASH256) ([]*BlockInfo, error) {
 	bi.rwm.Lock()
 	defer bi.rwm.Unlock()
 	count, err := bi.unlinkCount(id)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	if err := bi.checkReorg(count); err != nil {
+		return nil, err
+	}
+	blks := []*BlockInfo{}
 	for ; count > 0; count-- {
-		err := bi.unlinkLast()
+		blk, err := bi.unlinkLast()
 		if err != nil {
-			return err
+			return blks, err
 		}
+		blks = append(blks, blk)
 	}
-	return nil
+	return blks, nil
 }
 
 //获取区块头
@@ -897,6 +950,10 @@ func (bi *BlockIndex) LoadTxValue(id HASH256) (*TxValue, error) {
 	vv := &TxValue{}
 	vb, err := bi.blkdb.Index().Get(TxsPrefix, id[:])
 	if err != nil {
+		//没有完整的交易索引时已经消费的交易不存在
+		if ierr := bi.CheckIndex(TxIndexName); ierr != nil {
+			return nil, fmt.Errorf("%w %v", ierr, err)
+		}
 		return nil, err
 	}
 	err = vv.Decode(NewReader(vb))
@@ -974,33 +1031,52 @@ func (bi *BlockIndex) cleancache(blk *BlockInfo) {
 	}
 }
 
+//UnlinkBlockEvent 区块断开事件
+type UnlinkBlockEvent struct {
+	Blk *BlockInfo
+}
+
 //UnlinkLast 断开最后一个区块
 func (bi *BlockIndex) UnlinkLast() error {
 	bi.rwm.Lock()
-	defer bi.rwm.Unlock()
-	return bi.unlinkLast()
+	blk, err := bi.unlinkLast()
+	bi.rwm.Unlock()
+	if err != nil {
+		return err
+	}
+	bi.pubUnlink(blk)
+	return nil
+}
+
+//广播断开了区块,调用时不能持有链的锁
+func (bi *BlockIndex) pubUnlink(blks ...*BlockInfo) {
+	for _, blk := range blks {
+		bi.GetPubSub().Pub(&UnlinkBlockEvent{Blk: blk}, UnlinkBlockTopic)
+	}
 }
 
-//断开最后一个
-func (bi *BlockIndex) unlinkLast() error {
+//断开最后一个,返回断开的区块
+func (bi *BlockIndex) unlinkLast() (*BlockInfo, error) {
 	last := bi.last()
 	if last == nil {
-		return errors.New("last block miss")
+		return nil, errors.New("last block miss")
 	}
 	id, err := last.ID()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	blk, err := bi.loadblock(id)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	bi.lptr.OnUnlinkBlock(blk)
 	err = bi.unlink(blk)
-	if err == nil {
-		bi.cleancache(blk)
+	if err != nil {
+		return nil, err
 	}
-	return err
+	bi.cpt.touch()
+	bi.cleancache(blk)
+	return blk, nil
 }
 
 //断开一个区块
@@ -1033,6 +1109,13 @@ func (bi *BlockIndex) unlink(bp *BlockInfo) error {
 	if err != nil {
 		return fmt.Errorf("load rev batch error %w", err)
 	}
+	//修正可选索引
+	if err := bi.unlinkIndex(bp, bt); err != nil {
+		return err
+	}
+	//后台补全的状态不在回退数据中
+	bt.Del(UtxoPrefix, bp.EndianHeight())
+	bt.Del(CFilterPrefix, bp.EndianHeight())
 	//回退后会由回退数据设置bestvalue
 	//删除区块头
 	bt.Del(BlockPrefix, id[:])
@@ -1047,7 +1130,7 @@ func (bi *BlockIndex) unlink(bp *BlockInfo) error {
 }
 
 //NewMsgHeaders 创建证据区块头信息
-//默认获取30个区块头，如果分叉超过30个区块需要另外处理
+//默认获取30个区块头，分叉超过最大回退深度的证据会被拒绝
 func (bi *BlockIndex) NewMsgHeaders(msg *MsgGetBlock) *MsgHeaders {
 	iter := bi.NewIter()
 	//返回上次的参数
@@ -1171,6 +1254,9 @@ func (bi *BlockIndex) ListTxs(addr Address, limit ...int) (TxIndexs, error) {
 
 //ListTxsWithID 获取交易
 func (bi *BlockIndex) ListTxsWithID(id HASH160, limit ...int) (TxIndexs, error) {
+	if err := bi.CheckIndex(AddrIndexName); err != nil {
+		return nil, err
+	}
 	//和id相关的交易
 	prefix := GetDBKey(TxpPrefix, id[:])
 	idxs := TxIndexs{}
@@ -1312,6 +1398,10 @@ func (bi *BlockIndex) linkblk(blk *BlockInfo) error {
 	//是否能连接到主链后
 	phv, pid, isok := bi.islinkback(meta)
 	if !isok {
+		//上一个区块还没有收到
+		if _, has := bi.imap[meta.Prev]; !has && !meta.Prev.IsZero() {
+			return fmt.Errorf("%w can't link to chain last, hash=%v", ErrOrphanBlock, bid)
+		}
 		return fmt.Errorf("can't link to chain last, hash=%v", bid)
 	}
 	//第一个必须是创世区块
@@ -1332,6 +1422,10 @@ func (bi *BlockIndex) linkblk(blk *BlockInfo) error {
 	if !CheckProofOfWork(bid, meta.Bits) {
 		return errors.New("block header bits check error")
 	}
+	//必须和检查点一致
+	if err := conf.CheckPoint(nexth, bid); err != nil {
+		return err
+	}
 	ele := NewTBEle(meta, nexth, bi)
 	blk.Meta = ele
 	//设置交易数量
@@ -1345,13 +1439,17 @@ func (bi *BlockIndex) LinkBlk(blk *BlockInfo) error {
 	if err != nil {
 		return err
 	}
+	//assume-valid区块之前的历史区块只检查金额,不验证签名和执行脚本
+	sig := !bi.IsAssumeValid(blk.Meta.Height, blk.MustID())
 	//检测区块数据
-	err = blk.Check(bi, true)
+	err = blk.check(bi, true, sig)
 	if err != nil {
 		return err
 	}
 	//执行交易脚本检测,返回错误不能打包
-	err = blk.ExecScript(bi)
+	if sig {
+		err = blk.ExecScript(bi)
+	}
 	if err != nil {
 		return err
 	}
@@ -1360,15 +1458,59 @@ func (bi *BlockIndex) LinkBlk(blk *BlockInfo) error {
 	if err != nil {
 		return err
 	}
+	bi.cpt.touch()
 	//连接必定不能出错
 	bi.LinkBack(blk.Meta)
+	//统计交易池中的交易确认用了多少个区块
+	bi.fee.ProcessBlock(bi.txp, blk)
 	//删除交易池中存在这个区块中的交易
 	bi.txp.DelTxs(bi, blk.Txs)
 	//事件通知
 	bi.lptr.OnLinkBlock(blk)
+	//广播更新了区块数据
+	bi.GetPubSub().Pub(blk, NewLinkBlockTopic)
 	return nil
 }
 
+//GetPubSub 获取链使用的发布订阅,没有单独设置使用全局
+func (bi *BlockIndex) GetPubSub() *PubSub {
+	if bi.ps != nil {
+		return bi.ps
+	}
+	return GetPubSub()
+}
+
+//数据目录,没有单独设置使用配置目录
+func (bi *BlockIndex) dataDir() string {
+	if bi.dir != "" {
+		return bi.dir
+	}
+	return conf.DataDir
+}
+
+//交易费估算数据文件
+func (bi *BlockIndex) feeFile() string {
+	return bi.dataDir() + Separator + FeeEstimateFile
+}
+
+//交易池数据文件,没有单独设置数据目录时保存在当前目录
+func (bi *BlockIndex) txpFile() string {
+	if bi.dir != "" {
+		return bi.dir + Separator + TxPoolFile
+	}
+	return TxPoolFile
+}
+
+//GetFeeEstimator 获取交易费估算器
+func (bi *BlockIndex) GetFeeEstimator() *FeeEstimator {
+	return bi.fee
+}
+
+//EstimateFee 估算在target个区块内确认需要的费率(每千字节)
+func (bi *BlockIndex) EstimateFee(target int) (Amount, error) {
+	return bi.fee.EstimateFee(target)
+}
+
 //GetTxPool 获取内存交易池
 func (bi *BlockIndex) GetTxPool() *TxPool {
 	return bi.txp
@@ -1376,9 +1518,14 @@ func (bi *BlockIndex) GetTxPool() *TxPool {
 
 //Close 关闭链数据
 func (bi *BlockIndex) Close() {
+	bi.idx.stop()
+	bi.cpt.stop()
 	bi.rwm.Lock()
 	defer bi.rwm.Unlock()
 	bi.lptr.OnClose()
+	if err := bi.fee.Dump(bi.feeFile()); err != nil {
+		LogError("dump fee estimate error", err)
+	}
 	bi.blkdb.Close()
 	bi.lis.Init()
 	bi.txp.Close()
@@ -1388,17 +1535,28 @@ func (bi *BlockIndex) Close() {
 
 //NewBlockIndex 创建区块链
 func NewBlockIndex(lis IListener) *BlockIndex {
+	return newBlockIndex(lis, "")
+}
+
+//创建区块链,dir不为空时数据保存在dir目录
+func newBlockIndex(lis IListener, dir string) *BlockIndex {
 	blru, err := lru.New(256 * opt.MiB)
 	if err != nil {
 		panic(err)
 	}
-	return &BlockIndex{
+	bi := &BlockIndex{
 		txp:   NewTxPool(),
 		lptr:  lis,
 		lis:   list.New(),
 		hmap:  map[uint32]*list.Element{},
 		imap:  map[HASH256]*list.Element{},
-		blkdb: NewLevelDBStore(conf.DataDir + "/blks"),
+		blkdb: conf.NewBlkStoreAt(dir),
 		lru:   blru,
+		fee:   NewFeeEstimator(),
+		idx:   &indexer{},
+		cpt:   &compactor{},
+		dir:   dir,
 	}
+	bi.txp.SetFile(bi.txpFile())
+	return bi
 }
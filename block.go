@@ -307,6 +307,9 @@ func (hs *Headers) Decode(r IReader) error {
 	if err := num.Decode(r); err != nil {
 		return err
 	}
+	if err := checkCount(r, uint64(num), MaxHeadersCount); err != nil {
+		return err
+	}
 	vs := make([]BlockHeader, num)
 	for i := range vs {
 		v := BlockHeader{}
@@ -343,12 +346,15 @@ func (hs Headers) checkpow(h uint32, bh BlockHeader, bi *BlockIndex) error {
 		return errors.New("height bits error")
 	}
 	//重新计算id，id必须符合当前难度
-	if id, err := bh.ResetID(); err != nil {
+	id, err := bh.ResetID()
+	if err != nil {
 		return err
-	} else if !CheckProofOfWork(id, bh.Bits) {
+	}
+	if !CheckProofOfWork(id, bh.Bits) {
 		return errors.New("header bits error")
 	}
-	return nil
+	//必须和检查点一致
+	return conf.CheckPoint(h, id)
 }
 
 //Check 检测区块头列表高度从height开始
@@ -388,6 +394,7 @@ type BlockInfo struct {
 	Txs    []*TX       //交易记录，类似比特币
 	Meta   *TBEle      //指向链节点
 	merkel HashCacher  //merkel hash 缓存
+	blkc   *BlkChunk   //已经保存的区块数据位置,重建索引时不再重复写入
 }
 
 //遍历区块中输出脚本
@@ -411,7 +418,7 @@ func (blk *BlockInfo) GetTx(idx int) (*TX, error) {
 	return blk.Txs[idx], nil
 }
 
-func (blk *BlockInfo) Write(bi *BlockIndex) error {
+func (blk *BlockInfo) Write(bi *BlockIndex) (err error) {
 	bid, err := blk.ID()
 	if err != nil {
 		return err
@@ -423,6 +430,9 @@ func (blk *BlockInfo) Write(bi *BlockIndex) error {
 	if buf.Len() > MaxBlockSize {
 		return fmt.Errorf("block %v too big", bid)
 	}
+	//写入期间可选索引状态不能改变
+	bi.idx.mu.Lock()
+	defer bi.idx.mu.Unlock()
 	//写入索引数据
 	bt := bi.blkdb.Index().NewBatch()
 	rt := bt.NewRev()
@@ -440,22 +450,48 @@ func (blk *BlockInfo) Write(bi *BlockIndex) error {
 	if bt.Len() > MaxLogSize || rt.Len() > MaxLogSize {
 		return errors.New("opts state logs too big > MAX_LOG_SIZE")
 	}
+	//写入数据文件前记录日志,中断后启动时恢复
+	jn, err := bi.beginJournal(bid, blk.Meta.Height)
+	if err != nil {
+		return err
+	}
+	//写入失败时回滚数据文件
+	defer func() {
+		if err == nil {
+			return
+		}
+		if rerr := bi.rollbackJournal(jn); rerr != nil {
+			LogError("rollback block write error", rerr)
+		}
+	}()
 	//保存回退日志
 	blk.Meta.Rev, err = bi.blkdb.Rev().Write(rt.Dump())
 	if err != nil {
 		return err
 	}
+	bi.journalStep(journalRev)
 	//保存区块数据
-	blk.Meta.Blk, err = bi.blkdb.Blk().Write(buf.Bytes())
-	if err != nil {
+	if blk.blkc != nil {
+		blk.Meta.Blk = *blk.blkc
+	} else if blk.Meta.Blk, err = bi.blkdb.Blk().Write(buf.Bytes()); err != nil {
 		return err
 	}
+	bi.journalStep(journalBlk)
+	//区块数据完整后可以重新连接
+	jn.Chunk = blk.Meta.Blk
+	if err := jn.save(bi); err != nil {
+		return err
+	}
+	bi.journalStep(journalChunk)
 	//保存区块头数据
 	hbs, err := blk.Meta.Bytes()
 	if err != nil {
 		return err
 	}
 	bt.Put(BlockPrefix, bid[:], hbs)
+	//和索引一起删除日志
+	bt.Del(JournalKey)
+	bi.journalStep(journalIndex)
 	//写入索引数据
 	return bi.blkdb.Index().Write(bt)
 }
@@ -512,6 +548,20 @@ func (blk *BlockInfo) WriteTxsIdx(bi *BlockIndex, bt *Batch) error {
 	}
 	//当前区块高度作为排序key
 	hb := blk.EndianHeight()
+	//可选索引是否需要写入
+	txfull, err := bi.linkIndex(bt, TxIndexName, blk.Meta.Height)
+	if err != nil {
+		return err
+	}
+	addr, err := bi.linkIndex(bt, AddrIndexName, blk.Meta.Height)
+	if err != nil {
+		return err
+	}
+	//连接前的金额集合状态
+	mh, err := bi.prevMuHash(blk.Meta.Height)
+	if err != nil {
+		return err
+	}
 	//交易所在的区块信息和金额信息索引
 	for idx, tx := range blk.Txs {
 		id, err := tx.ID()
@@ -526,21 +576,36 @@ func (blk *BlockInfo) WriteTxsIdx(bi *BlockIndex, bt *Batch) error {
 		if err != nil {
 			return err
 		}
-		//交易对应的区块和位置
+		//交易对应的区块和位置,查找输入引用的输出需要使用
 		bt.Put(TxsPrefix, id[:], vbys)
 		//这里存储交易和哪些地址有关系
 		vps := map[HASH160]bool{}
 		//写入金额和索引
-		err = tx.writeTxIndex(bi, blk, vps, bt)
+		err = tx.writeTxIndex(bi, blk, vps, mh, bt)
 		if err != nil {
 			return err
 		}
 		//写入账户相关的交易
+		if !addr {
+			continue
+		}
 		for pkh := range vps {
 			bt.Put(TxpPrefix, pkh[:], hb, id[:], vbys)
 		}
 	}
-	return nil
+	//保存连接后的金额集合状态,断开时由回退数据删除
+	//之前的状态没有补全时不保存
+	if mh != nil {
+		bt.Put(UtxoPrefix, hb, mh.Bytes())
+	}
+	//区块过滤器,断开时同样由回退数据删除
+	if err := bi.writeCFilter(blk, bt); err != nil {
+		return err
+	}
+	if txfull {
+		return nil
+	}
+	return blk.pruneTxsIdx(bi, bt)
 }
 
 //GetMerkle 获取默克尔树
@@ -716,6 +781,11 @@ func (blk *BlockInfo) GetIncome(bi *BlockIndex) (Amount, error) {
 //csp 是否检查消费金额是否存在，只有消费此输出得时候才检查，如果对应
 //的区块已经连接到主链，输出必定被消费了，只需要检查签名
 func (blk *BlockInfo) CheckTxs(bi *BlockIndex, csp bool) error {
+	return blk.checkTxs(bi, csp, true)
+}
+
+//sig 是否验证交易签名
+func (blk *BlockInfo) checkTxs(bi *BlockIndex, csp bool, sig bool) error {
 	//必须有交易
 	if len(blk.Txs) == 0 {
 		return errors.New("txs miss, too little")
@@ -731,7 +801,7 @@ func (blk *BlockInfo) CheckTxs(bi *BlockIndex, csp bool) error {
 			return errors.New("coinbase tx miss")
 		}
 		//检测每个交易
-		if err := tx.Check(bi, csp); err != nil {
+		if err := tx.check(bi, csp, sig); err != nil {
 			return err
 		}
 	}
@@ -832,6 +902,11 @@ func (blk BlockInfo) ExecScript(bi *BlockIndex) error {
 //Check 检查区块数据
 //csp 是否检查消费输出
 func (blk *BlockInfo) Check(bi *BlockIndex, csp bool) error {
+	return blk.check(bi, csp, true)
+}
+
+//sig 是否验证交易签名
+func (blk *BlockInfo) check(bi *BlockIndex, csp bool, sig bool) error {
 	//检测工作难度
 	bits := bi.CalcBits(blk.Meta.Height)
 	if bits != blk.Header.Bits {
@@ -854,7 +929,7 @@ func (blk *BlockInfo) Check(bi *BlockIndex, csp bool) error {
 		return err
 	}
 	//检查所有的交易
-	return blk.CheckTxs(bi, csp)
+	return blk.checkTxs(bi, csp, sig)
 }
 
 //Encode 编码区块数据
@@ -882,6 +957,9 @@ func (blk *BlockInfo) Decode(r IReader) error {
 	if err := txn.Decode(r); err != nil {
 		return err
 	}
+	if err := checkCount(r, uint64(txn), MaxPackageSize); err != nil {
+		return err
+	}
 	blk.Txs = make([]*TX, txn)
 	for i := range blk.Txs {
 		tx := &TX{}
@@ -1334,7 +1412,7 @@ func (tx *TX) IsCoinBase() bool {
 }
 
 //写入交易信息索引和回退索引
-func (tx *TX) writeTxIndex(bi *BlockIndex, blk *BlockInfo, vps map[HASH160]bool, bt *Batch) error {
+func (tx *TX) writeTxIndex(bi *BlockIndex, blk *BlockInfo, vps map[HASH160]bool, mh *MuHash, bt *Batch) error {
 	rt := bt.GetRev()
 	if rt == nil {
 		return fmt.Errorf("batch miss rev")
@@ -1366,6 +1444,9 @@ func (tx *TX) writeTxIndex(bi *BlockIndex, blk *BlockInfo, vps map[HASH160]bool,
 		}
 		//被消费删除
 		bt.Del(coin.MustKey())
+		if mh != nil {
+			mh.Remove(append(coin.MustKey(), coin.MustValue()...))
+		}
 		//添加回退日志用来恢复,如果是引用本区块的忽略
 		rt.Put(coin.MustKey(), coin.MustValue())
 	}
@@ -1387,6 +1468,9 @@ func (tx *TX) writeTxIndex(bi *BlockIndex, blk *BlockInfo, vps map[HASH160]bool,
 		}
 		tk.Height = VarUInt(blk.Meta.Height)
 		bt.Put(tk.MustKey(), tk.MustValue())
+		if mh != nil {
+			mh.Add(append(tk.MustKey(), tk.MustValue()...))
+		}
 		vps[pkh] = true //交易相关的pkh
 	}
 	return nil
@@ -1567,6 +1651,11 @@ func (tx *TX) HasRepTxIn(bi *BlockIndex, csp bool) bool {
 //csp是否检测输出金额是否已经被消费,如果交易已经打包进区块，输入引用的输出肯定被消费,coin将不存在
 //clk 是否检查seqlock
 func (tx *TX) Check(bi *BlockIndex, csp bool) error {
+	return tx.check(bi, csp, true)
+}
+
+//sig 是否验证签名
+func (tx *TX) check(bi *BlockIndex, csp bool, sig bool) error {
 	//至少有一个交易
 	if len(tx.Ins) == 0 {
 		return fmt.Errorf("tx ins too slow")
@@ -1626,6 +1715,9 @@ func (tx *TX) Check(bi *BlockIndex, csp bool) error {
 	if itv < 0 || otv < 0 || otv > itv {
 		return fmt.Errorf("ins amount must >= outs amount")
 	}
+	if !sig {
+		return nil
+	}
 	//检查签名
 	return tx.Verify(bi)
 }
@@ -1668,6 +1760,9 @@ func (tx *TX) Decode(r IReader) error {
 	if err := inum.Decode(r); err != nil {
 		return err
 	}
+	if err := checkCount(r, uint64(inum), MaxPackageSize); err != nil {
+		return err
+	}
 	tx.Ins = make([]*TxIn, inum)
 	for i := range tx.Ins {
 		in := &TxIn{}
@@ -1681,6 +1776,9 @@ func (tx *TX) Decode(r IReader) error {
 	if err := onum.Decode(r); err != nil {
 		return err
 	}
+	if err := checkCount(r, uint64(onum), MaxPackageSize); err != nil {
+		return err
+	}
 	tx.Outs = make([]*TxOut, onum)
 	for i := range tx.Outs {
 		out := &TxOut{}
@@ -89,6 +89,66 @@ func (m *MsgGetBlock) Decode(r IReader) error {
 	return nil
 }
 
+//MaxGetHeaders 每次最多获取的区块头数量
+const MaxGetHeaders = 2000
+
+//MsgGetHeaders 轻节点按高度获取区块头
+type MsgGetHeaders struct {
+	Next  uint32 //开始高度
+	Count uint32 //获取数量
+}
+
+//ID 消息ID
+func (m MsgGetHeaders) ID() (MsgID, error) {
+	return ErrMsgID, ErrNotID
+}
+
+//Type 消息类型
+func (m MsgGetHeaders) Type() NTType {
+	return NtGetHeaders
+}
+
+//Encode 编码消息
+func (m MsgGetHeaders) Encode(w IWriter) error {
+	if err := w.TWrite(m.Next); err != nil {
+		return err
+	}
+	if err := w.TWrite(m.Count); err != nil {
+		return err
+	}
+	return nil
+}
+
+//Decode 解码消息
+func (m *MsgGetHeaders) Decode(r IReader) error {
+	if err := r.TRead(&m.Next); err != nil {
+		return err
+	}
+	if err := r.TRead(&m.Count); err != nil {
+		return err
+	}
+	return nil
+}
+
+//NewMsgHeadersFrom 返回从msg.Next高度开始的区块头,最多MaxGetHeaders个
+func (bi *BlockIndex) NewMsgHeadersFrom(msg *MsgGetHeaders) *MsgHeaders {
+	rsg := &MsgHeaders{}
+	rsg.Info.Next = msg.Next
+	rsg.Info.Count = msg.Count
+	numv := int(msg.Count)
+	if numv > MaxGetHeaders {
+		numv = MaxGetHeaders
+	}
+	iter := bi.NewIter()
+	if !iter.SeekHeight(msg.Next) {
+		return rsg
+	}
+	for i := numv; i > 0 && iter.Next(); i-- {
+		rsg.Headers.Add(iter.Curr().BlockHeader)
+	}
+	return rsg
+}
+
 //GetMsgBlock 获取区块数据返回
 func (bi *BlockIndex) GetMsgBlock(id HASH256) (*MsgBlock, error) {
 	blk, err := bi.LoadBlock(id)
@@ -191,16 +251,17 @@ func (m *MsgBlock) Decode(r IReader) error {
 		return err
 	}
 	blk := &BlockInfo{}
-	if m.IsUseBytes() {
-		if err := m.Bytes.Decode(r); err != nil {
+	//和编码顺序一致,优先使用结构数据
+	if m.IsUseBlk() {
+		if err := blk.Decode(r); err != nil {
 			return err
 		}
-		br := NewReader(m.Bytes)
-		if err := blk.Decode(br); err != nil {
+	} else if m.IsUseBytes() {
+		if err := m.Bytes.DecodeLimit(r, MaxBlockSize); err != nil {
 			return err
 		}
-	} else if m.IsUseBlk() {
-		if err := blk.Decode(r); err != nil {
+		br := NewReader(m.Bytes)
+		if err := blk.Decode(br); err != nil {
 			return err
 		}
 	} else {
@@ -116,3 +116,36 @@ func (b *BloomFilter) Has(key []byte) bool {
 	}
 	return true
 }
+
+//OutPointKey 交易输出在过滤器中的key
+func OutPointKey(id HASH256, idx uint32) []byte {
+	key := append([]byte{}, id[:]...)
+	return append(key, EndianUInt32(idx)...)
+}
+
+//MatchTx 检测交易是否匹配过滤器,交易id,输出地址或者输入引用的输出匹配时返回true
+//匹配地址的输出自动加入过滤器,之后花费这个输出的交易也能匹配
+func (b *BloomFilter) MatchTx(tx *TX) (bool, error) {
+	id, err := tx.ID()
+	if err != nil {
+		return false, err
+	}
+	match := b.Has(id[:])
+	for i, out := range tx.Outs {
+		pkh, err := out.Script.GetPkh()
+		if err != nil || !b.Has(pkh[:]) {
+			continue
+		}
+		b.Add(OutPointKey(id, uint32(i)))
+		match = true
+	}
+	if match || tx.IsCoinBase() {
+		return match, nil
+	}
+	for _, in := range tx.Ins {
+		if b.Has(OutPointKey(in.OutHash, in.OutIndex.ToUInt32())) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -2,6 +2,7 @@ package xginx
 
 import (
 	"log"
+	"sync"
 	"testing"
 )
 
@@ -44,3 +45,71 @@ func TestBloomFilter(t *testing.T) {
 		t.Errorf("new load bloom error")
 	}
 }
+
+func (suite *BlockTestSuite) TestBloomMatchTx() {
+	req := suite.Require()
+	bi := suite.bi
+	blk, err := bi.LoadBlock(bi.GetBestValue().ID)
+	req.NoError(err)
+	cb := blk.Txs[0]
+	cid := cb.MustID()
+	pkh, err := GetTestListener(bi).MinerAddr().GetPkh()
+	req.NoError(err)
+	size, funcs := CalcBloomFilterSize(10, 0.0001)
+	blm, err := NewBloomFilter(funcs, 1, make([]byte, size))
+	req.NoError(err)
+	//花费coinbase输出的交易
+	wits := GetTestListener(bi).GetAccount(0).NewWitnessScript(DefaultInputScript)
+	script, err := wits.ToScript()
+	req.NoError(err)
+	spend := &TX{Ver: 1}
+	spend.Ins = []*TxIn{{OutHash: cid, OutIndex: 0, Script: script}}
+	match, err := blm.MatchTx(spend)
+	req.NoError(err)
+	req.False(match)
+	//匹配输出地址后自动加入输出
+	blm.Add(pkh[:])
+	match, err = blm.MatchTx(cb)
+	req.NoError(err)
+	req.True(match)
+	req.True(blm.Has(OutPointKey(cid, 0)))
+	match, err = blm.MatchTx(spend)
+	req.NoError(err)
+	req.True(match)
+	//只包含匹配交易的merkle区块
+	msg, err := NewMsgMerkleBlock(blk, blm)
+	req.NoError(err)
+	req.Equal(1, len(msg.Txs))
+	req.NoError(msg.Verify())
+	w := NewWriter()
+	req.NoError(msg.Encode(w))
+	rsg := &MsgMerkleBlock{}
+	req.NoError(rsg.Decode(NewReader(w.Bytes())))
+	req.NoError(rsg.Verify())
+	req.Equal(blk.Header.MustID(), rsg.Header.MustID())
+	rsg.Txs = []*TX{spend}
+	req.Error(rsg.Verify())
+	rsg.Txs = nil
+	req.Error(rsg.Verify())
+	//连接设置过滤器后才过滤
+	c := &Client{vmap: &sync.Map{}, proto: ProtocolVersion}
+	_, ok := c.FilterMsg(NewMsgTx(cb))
+	req.False(ok)
+	req.NoError(c.LoadFilter(funcs, 2, make([]byte, size)))
+	fm, ok := c.FilterMsg(NewMsgTx(cb))
+	req.True(ok)
+	req.Nil(fm)
+	req.NoError(c.FilterAdd(pkh[:]))
+	fm, ok = c.FilterMsg(NewMsgTx(cb))
+	req.True(ok)
+	req.Equal(NtTx, fm.Type())
+	fm, ok = c.FilterMsg(&MsgBlock{Blk: blk})
+	req.True(ok)
+	req.Equal(NtMerkleBlock, fm.Type())
+	//旧版本节点不支持merkle区块
+	c.proto = MinProtocolVersion
+	_, ok = c.FilterMsg(&MsgBlock{Blk: blk})
+	req.False(ok)
+	_, ok = c.FilterMsg(&MsgAlert{})
+	req.False(ok)
+}
@@ -0,0 +1,202 @@
+package xginx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+//引导文件格式 文件头 + (数据长度uint32 + 区块数据)...
+//文件头 标识(4) + 版本(1) + 网络标识(4) + 创世区块id(32)
+var (
+	bootstrapMagic = []byte{'X', 'B', 'O', 'T'}
+)
+
+//引导文件版本和文件头长度
+const (
+	bootstrapVer      = 1
+	bootstrapHeadSize = 4 + 1 + 4 + 32
+)
+
+//BootstrapHeader 引导文件头
+type BootstrapHeader struct {
+	Ver     uint8
+	Flags   [4]byte //网络标识
+	Genesis HASH256 //创世区块id
+}
+
+//Encode 编码文件头
+func (h BootstrapHeader) Encode(w IWriter) error {
+	if err := w.WriteFull(bootstrapMagic); err != nil {
+		return err
+	}
+	if err := w.TWrite(h.Ver); err != nil {
+		return err
+	}
+	if err := w.TWrite(h.Flags); err != nil {
+		return err
+	}
+	return h.Genesis.Encode(w)
+}
+
+//Decode 解码文件头
+func (h *BootstrapHeader) Decode(r IReader) error {
+	magic := make([]byte, len(bootstrapMagic))
+	if err := r.ReadFull(magic); err != nil {
+		return err
+	}
+	if !bytes.Equal(magic, bootstrapMagic) {
+		return errors.New("bootstrap file magic error")
+	}
+	if err := r.TRead(&h.Ver); err != nil {
+		return err
+	}
+	if err := r.TRead(&h.Flags); err != nil {
+		return err
+	}
+	return h.Genesis.Decode(r)
+}
+
+//Check 检查是否是当前网络的引导文件
+func (h BootstrapHeader) Check() error {
+	if h.Ver != bootstrapVer {
+		return fmt.Errorf("bootstrap file ver %d error", h.Ver)
+	}
+	if !bytes.Equal(h.Flags[:], conf.flags[:]) {
+		return errors.New("bootstrap file network flags error")
+	}
+	if !conf.IsGenesisID(h.Genesis) {
+		return fmt.Errorf("bootstrap file genesis %v error", h.Genesis)
+	}
+	return nil
+}
+
+//ExportBootstrap 按高度导出主链所有区块到引导文件,返回导出的区块数量
+//fn进度回调 0-100
+func (bi *BlockIndex) ExportBootstrap(file string, fn func(pv uint)) (int, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	bw := bufio.NewWriter(f)
+	hw := NewWriter()
+	hdr := BootstrapHeader{Ver: bootstrapVer, Flags: conf.flags, Genesis: conf.genesis}
+	if err := hdr.Encode(hw); err != nil {
+		return 0, err
+	}
+	if _, err := bw.Write(hw.Bytes()); err != nil {
+		return 0, err
+	}
+	num := 0
+	height := bi.Height()
+	if bi.Len() == 0 {
+		return 0, bw.Flush()
+	}
+	pg := &progress{fn: fn, total: int(height) + 1}
+	for h := uint32(0); h <= height; h++ {
+		bi.rwm.RLock()
+		ele := bi.gethele(h)
+		bi.rwm.RUnlock()
+		if ele == nil || !ele.HasBlk() {
+			break
+		}
+		id, err := ele.ID()
+		if err != nil {
+			return num, err
+		}
+		bb, err := bi.ReadBlock(id)
+		if err != nil {
+			return num, fmt.Errorf("export block %v height %d error %w", id, h, err)
+		}
+		if err := binary.Write(bw, Endian, uint32(len(bb))); err != nil {
+			return num, err
+		}
+		if _, err := bw.Write(bb); err != nil {
+			return num, err
+		}
+		num++
+		pg.step(num)
+	}
+	if err := bw.Flush(); err != nil {
+		return num, err
+	}
+	return num, f.Sync()
+}
+
+//ImportBootstrap 从引导文件导入区块,返回连接的区块数量
+//已经存在的区块跳过,导入中断后可以使用同一个文件继续导入
+//fn进度回调 0-100
+func (bi *BlockIndex) ImportBootstrap(file string, fn func(pv uint)) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	br := bufio.NewReaderSize(f, 1024*1024)
+	hb := make([]byte, bootstrapHeadSize)
+	if _, err := io.ReadFull(br, hb); err != nil {
+		return 0, err
+	}
+	hdr := &BootstrapHeader{}
+	if err := hdr.Decode(NewReader(hb)); err != nil {
+		return 0, err
+	}
+	if err := hdr.Check(); err != nil {
+		return 0, err
+	}
+	num, skip := 0, 0
+	pos := int64(bootstrapHeadSize)
+	pg := &progress{fn: fn, total: int(fi.Size())}
+	for {
+		bl := uint32(0)
+		err := binary.Read(br, Endian, &bl)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return num, fmt.Errorf("bootstrap file offset %d truncated %w", pos, err)
+		}
+		if bl == 0 || bl > MaxBlockSize {
+			return num, fmt.Errorf("bootstrap file offset %d block size %d error", pos, bl)
+		}
+		bb := make([]byte, bl)
+		if _, err := io.ReadFull(br, bb); err != nil {
+			return num, fmt.Errorf("bootstrap file offset %d truncated %w", pos, err)
+		}
+		pos += 4 + int64(bl)
+		//只解码区块头检查是否已经存在
+		hh := BlockHeader{}
+		if err := hh.Decode(NewReader(bb)); err != nil {
+			return num, err
+		}
+		id, err := hh.ID()
+		if err != nil {
+			return num, err
+		}
+		if _, has := bi.HasBlock(id); has {
+			skip++
+			pg.step(int(pos))
+			continue
+		}
+		blk := &BlockInfo{}
+		if err := blk.Decode(NewReader(bb)); err != nil {
+			return num, err
+		}
+		if err := bi.LinkBlk(blk); err != nil {
+			return num, fmt.Errorf("import block %v error %w", id, err)
+		}
+		num++
+		pg.step(int(pos))
+	}
+	LogInfof("import bootstrap file %s finished, link %d blocks, skip %d blocks", file, num, skip)
+	return num, nil
+}
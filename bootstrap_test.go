@@ -0,0 +1,49 @@
+package xginx
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+func (suite *BlockTestSuite) TestBootstrap() {
+	req := suite.Require()
+	bi := suite.bi
+	file := NewTempDir() + ".boot"
+	defer os.Remove(file)
+	bv := bi.GetBestValue()
+	num, err := bi.ExportBootstrap(file, nil)
+	req.NoError(err)
+	req.Equal(bi.Len(), num)
+
+	hdr := &BootstrapHeader{}
+	bb, err := ioutil.ReadFile(file)
+	req.NoError(err)
+	req.NoError(hdr.Decode(NewReader(bb)))
+	req.NoError(hdr.Check())
+
+	//区块都存在时全部跳过
+	num, err = bi.ImportBootstrap(file, nil)
+	req.NoError(err)
+	req.Equal(0, num)
+
+	//断开区块后导入中断,再次导入继续连接
+	for i := 0; i < 5; i++ {
+		req.NoError(bi.UnlinkLast())
+	}
+	part := file + ".part"
+	defer os.Remove(part)
+	req.NoError(ioutil.WriteFile(part, bb[:len(bb)-10], 0644))
+	num, err = bi.ImportBootstrap(part, nil)
+	req.Error(err)
+	req.Equal(4, num)
+	num, err = bi.ImportBootstrap(file, nil)
+	req.NoError(err)
+	req.Equal(1, num)
+	req.Equal(bv, bi.GetBestValue())
+
+	//其他网络的引导文件
+	bb[5] = 'X'
+	req.NoError(ioutil.WriteFile(part, bb, 0644))
+	_, err = bi.ImportBootstrap(part, nil)
+	req.Error(err)
+}
@@ -0,0 +1,271 @@
+package xginx
+
+import (
+	"context"
+	"fmt"
+)
+
+//CFilter 区块过滤器
+//包含区块中所有输出地址和花费的输出,轻节点在本地匹配后决定是否下载区块
+type CFilter struct {
+	BlkID  HASH256  //区块id,也是过滤器key
+	Header HASH256  //过滤器头,和上个区块的过滤器头链接
+	Filter VarBytes //GCS过滤器数据
+}
+
+//Encode 编码
+func (f CFilter) Encode(w IWriter) error {
+	if err := f.BlkID.Encode(w); err != nil {
+		return err
+	}
+	if err := f.Header.Encode(w); err != nil {
+		return err
+	}
+	return f.Filter.Encode(w)
+}
+
+//Decode 解码
+func (f *CFilter) Decode(r IReader) error {
+	if err := f.BlkID.Decode(r); err != nil {
+		return err
+	}
+	if err := f.Header.Decode(r); err != nil {
+		return err
+	}
+	return f.Filter.Decode(r)
+}
+
+//Hash 过滤器数据哈希
+func (f CFilter) Hash() HASH256 {
+	return Hash256From(f.Filter)
+}
+
+//Check 检测过滤器头是否和上个过滤器头链接
+func (f CFilter) Check(prev HASH256) error {
+	if !f.Header.Equal(CFilterHeader(f.Hash(), prev)) {
+		return fmt.Errorf("block %v filter header error", f.BlkID)
+	}
+	return nil
+}
+
+//MatchAny 检测区块是否可能包含任意一个元素
+func (f CFilter) MatchAny(items ...[]byte) (bool, error) {
+	gcs, err := GcsFilterFrom(f.BlkID, f.Filter)
+	if err != nil {
+		return false, err
+	}
+	return gcs.MatchAny(items), nil
+}
+
+//CFilterHeader 计算过滤器头,第一个区块的prev为ZERO256
+func CFilterHeader(fhash HASH256, prev HASH256) HASH256 {
+	return Hash256From(append(fhash[:], prev[:]...))
+}
+
+//NewBlockFilter 创建区块过滤器,包含所有输出地址和花费的输出
+func NewBlockFilter(blk *BlockInfo) (*GcsFilter, error) {
+	bid, err := blk.ID()
+	if err != nil {
+		return nil, err
+	}
+	items := [][]byte{}
+	for _, tx := range blk.Txs {
+		for _, out := range tx.Outs {
+			pkh, err := out.Script.GetPkh()
+			if err != nil {
+				continue
+			}
+			items = append(items, pkh[:])
+		}
+		if tx.IsCoinBase() {
+			continue
+		}
+		for _, in := range tx.Ins {
+			items = append(items, OutPointKey(in.OutHash, in.OutIndex.ToUInt32()))
+		}
+	}
+	return NewGcsFilter(bid, items), nil
+}
+
+//LoadCFilter 获取高度h的区块过滤器
+func (bi *BlockIndex) LoadCFilter(h uint32) (*CFilter, error) {
+	bb, err := bi.blkdb.Index().Get(CFilterPrefix, EndianUInt32(h))
+	if err != nil {
+		return nil, fmt.Errorf("block filter height %d miss %w", h, err)
+	}
+	cf := &CFilter{}
+	if err := cf.Decode(NewReader(bb)); err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
+//后台补全过滤器时每次处理的区块数量
+const backfillBatchNum = 1000
+
+//获取高度h之前的过滤器头
+//升级前连接的区块没有保存时返回false,由后台任务补全后再保存之后区块的过滤器
+func (bi *BlockIndex) prevCFHeader(h uint32) (HASH256, bool, error) {
+	if h == 0 {
+		return ZERO256, true, nil
+	}
+	has, err := bi.blkdb.Index().Has(CFilterPrefix, EndianUInt32(h-1))
+	if err != nil || !has {
+		return ZERO256, false, err
+	}
+	cf, err := bi.LoadCFilter(h - 1)
+	if err != nil {
+		return ZERO256, false, err
+	}
+	return cf.Header, true, nil
+}
+
+//写入区块过滤器,之前的过滤器没有补全时不写入
+func (bi *BlockIndex) writeCFilter(blk *BlockInfo, bt *Batch) error {
+	prev, has, err := bi.prevCFHeader(blk.Meta.Height)
+	if err != nil || !has {
+		return err
+	}
+	bid, err := blk.ID()
+	if err != nil {
+		return err
+	}
+	cf, err := newCFilter(bid, blk, prev)
+	if err != nil {
+		return err
+	}
+	return cf.put(bt, blk.Meta.Height)
+}
+
+//创建区块过滤器
+func newCFilter(bid HASH256, blk *BlockInfo, prev HASH256) (*CFilter, error) {
+	gcs, err := NewBlockFilter(blk)
+	if err != nil {
+		return nil, err
+	}
+	cf := &CFilter{
+		BlkID:  bid,
+		Header: CFilterHeader(gcs.Hash(), prev),
+		Filter: gcs.Bytes(),
+	}
+	return cf, nil
+}
+
+//写入过滤器到批量
+func (f CFilter) put(bt *Batch, h uint32) error {
+	w := NewWriter()
+	if err := f.Encode(w); err != nil {
+		return err
+	}
+	bt.Put(CFilterPrefix, EndianUInt32(h), w.Bytes())
+	return nil
+}
+
+//补全一批升级前连接的区块没有保存的过滤器,next为上次处理到的高度
+//从next之前最后保存的过滤器开始计算,返回下次开始的高度,补全到最高区块后返回true
+func (bi *BlockIndex) backfillCFilterStep(next uint32) (uint32, bool, error) {
+	//连接和断开区块时主链不能改变
+	bi.idx.mu.Lock()
+	defer bi.idx.mu.Unlock()
+	bi.rwm.RLock()
+	defer bi.rwm.RUnlock()
+	bv := bi.GetBestValue()
+	if !bv.IsValid() {
+		return next, true, nil
+	}
+	db := bi.blkdb.Index()
+	if has, err := db.Has(CFilterPrefix, EndianUInt32(bv.Height)); err != nil || has {
+		return next, true, err
+	}
+	if next > bv.Height {
+		next = bv.Height
+	}
+	//查找最后保存的主链区块过滤器
+	prev := ZERO256
+	for ; next > 0; next-- {
+		cf, err := bi.LoadCFilter(next - 1)
+		if ele := bi.gethele(next - 1); err == nil && ele != nil && ele.MustID().Equal(cf.BlkID) {
+			prev = cf.Header
+			break
+		}
+	}
+	LogInfof("block filter height %d miss, rebuild from height %d", bv.Height, next)
+	bt := db.NewBatch()
+	for i := 0; i < backfillBatchNum && next <= bv.Height; i, next = i+1, next+1 {
+		ele := bi.gethele(next)
+		if ele == nil {
+			return next, false, fmt.Errorf("block height %d miss", next)
+		}
+		bid, err := ele.ID()
+		if err != nil {
+			return next, false, err
+		}
+		blk, err := bi.loadblock(bid)
+		if err != nil {
+			return next, false, err
+		}
+		cf, err := newCFilter(bid, blk, prev)
+		if err != nil {
+			return next, false, err
+		}
+		if err := cf.put(bt, next); err != nil {
+			return next, false, err
+		}
+		prev = cf.Header
+	}
+	return next, next > bv.Height, db.Write(bt)
+}
+
+//补全升级前连接的区块没有保存的过滤器
+func (bi *BlockIndex) backfillCFilters(ctx context.Context) error {
+	next := InvalidHeight
+	for ctx.Err() == nil {
+		n, done, err := bi.backfillCFilterStep(next)
+		if err != nil || done {
+			return err
+		}
+		next = n
+	}
+	return ctx.Err()
+}
+
+//NewMsgCFHeaders 返回从msg.Start高度开始的过滤器哈希和之前的过滤器头
+func (bi *BlockIndex) NewMsgCFHeaders(msg *MsgGetCFHeaders) (*MsgCFHeaders, error) {
+	rsg := &MsgCFHeaders{Start: msg.Start}
+	if msg.Start > 0 {
+		cf, err := bi.LoadCFilter(msg.Start - 1)
+		if err != nil {
+			return nil, err
+		}
+		rsg.Prev = cf.Header
+	}
+	num := msg.Count
+	if num > MaxGetCFHeaders {
+		num = MaxGetCFHeaders
+	}
+	for i := uint32(0); i < num; i++ {
+		cf, err := bi.LoadCFilter(msg.Start + i)
+		if err != nil {
+			break
+		}
+		rsg.Hashs = append(rsg.Hashs, cf.Hash())
+	}
+	return rsg, nil
+}
+
+//NewMsgCFilters 返回从msg.Start高度开始的区块过滤器
+func (bi *BlockIndex) NewMsgCFilters(msg *MsgGetCFilters) *MsgCFilters {
+	rsg := &MsgCFilters{Start: msg.Start}
+	num := msg.Count
+	if num > MaxGetCFilters {
+		num = MaxGetCFilters
+	}
+	for i := uint32(0); i < num; i++ {
+		cf, err := bi.LoadCFilter(msg.Start + i)
+		if err != nil {
+			break
+		}
+		rsg.Filters = append(rsg.Filters, cf)
+	}
+	return rsg
+}
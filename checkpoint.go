@@ -0,0 +1,168 @@
+package xginx
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	//ErrCheckpoint 区块和检查点不匹配
+	ErrCheckpoint = errors.New("block not match checkpoint")
+	//ErrCheckpointFork 分叉点低于检查点
+	ErrCheckpointFork = errors.New("fork below last checkpoint")
+)
+
+//Checkpoint 检查点,指定高度的区块id必须匹配
+type Checkpoint struct {
+	Height uint32 `json:"height"` //区块高度
+	Hash   string `json:"hash"`   //区块id
+}
+
+//初始化检查点和assume-valid区块
+func (c *Config) initCheckpoints() {
+	c.checkpoints = map[uint32]HASH256{}
+	for _, cp := range c.Checkpoints {
+		c.SetCheckpoint(cp.Height, NewHASH256(cp.Hash))
+	}
+	if c.AssumeValid != nil && c.AssumeValid.Hash != "" {
+		c.SetAssumeValid(c.AssumeValid.Height, NewHASH256(c.AssumeValid.Hash))
+	}
+}
+
+//SetCheckpoint 设置检查点
+func (c *Config) SetCheckpoint(height uint32, id HASH256) {
+	if c.checkpoints == nil {
+		c.checkpoints = map[uint32]HASH256{}
+	}
+	c.checkpoints[height] = id
+}
+
+//DelCheckpoint 删除检查点
+func (c *Config) DelCheckpoint(height uint32) {
+	delete(c.checkpoints, height)
+}
+
+//SetAssumeValid 设置assume-valid区块,这个区块同时作为检查点
+//初始同步时这个区块和它的祖先区块不验证签名和执行脚本,只检查金额
+func (c *Config) SetAssumeValid(height uint32, id HASH256) {
+	c.assumeh = height
+	c.assumeid = id
+	if !id.IsZero() {
+		c.SetCheckpoint(height, id)
+	}
+}
+
+//CheckPoint 检查高度height的区块id是否和检查点一致,没有检查点返回nil
+func (c *Config) CheckPoint(height uint32, id HASH256) error {
+	cid, has := c.checkpoints[height]
+	if !has || cid.Equal(id) {
+		return nil
+	}
+	return fmt.Errorf("%w height %d id %v expect %v", ErrCheckpoint, height, id, cid)
+}
+
+//LastCheckpoint 获取不高于height的最后一个检查点高度
+func (c *Config) LastCheckpoint(height uint32) (uint32, bool) {
+	last, has := uint32(0), false
+	for h := range c.checkpoints {
+		if h <= height && (!has || h > last) {
+			last, has = h, true
+		}
+	}
+	return last, has
+}
+
+//assume-valid区块头链,从主链连接到assume-valid区块
+type assumeheaders struct {
+	id  HASH256            //assume-valid区块id
+	ids map[HASH256]uint32 //区块头链中的区块id->高度
+}
+
+//AddAssumeHeaders 添加从主链连接到assume-valid区块的区块头链
+//第一个区块头必须连接到主链中的区块,最后一个必须是assume-valid区块
+//区块头链中的区块作为assume-valid区块的祖先,连接时跳过签名和脚本检查
+func (bi *BlockIndex) AddAssumeHeaders(hs Headers) error {
+	aid, ah := conf.assumeid, conf.assumeh
+	if aid.IsZero() {
+		return errors.New("assume valid block not set")
+	}
+	if len(hs) == 0 {
+		return errors.New("empty headers")
+	}
+	bi.rwm.RLock()
+	pele, has := bi.imap[hs[0].Prev]
+	bi.rwm.RUnlock()
+	if !has {
+		return fmt.Errorf("assume headers prev %v not in chain", hs[0].Prev)
+	}
+	ph := pele.Value.(*TBEle).Height
+	if err := hs.Check(ph, bi); err != nil {
+		return err
+	}
+	if lid, err := hs[len(hs)-1].ID(); err != nil || !lid.Equal(aid) || ph+uint32(len(hs)) != ah {
+		return fmt.Errorf("assume headers not end with assume valid block %v height %d", aid, ah)
+	}
+	avh := &assumeheaders{id: aid, ids: map[HASH256]uint32{}}
+	for i, v := range hs {
+		id, err := v.ID()
+		if err != nil {
+			return err
+		}
+		avh.ids[id] = ph + 1 + uint32(i)
+	}
+	bi.rwm.Lock()
+	defer bi.rwm.Unlock()
+	bi.avh = avh
+	return nil
+}
+
+//NeedAssumeHeaders 是否需要获取连接到assume-valid区块的区块头链,返回开始高度
+//assume-valid区块不在主链中并且没有对应的区块头链时需要获取
+func (bi *BlockIndex) NeedAssumeHeaders() (uint32, bool) {
+	aid, ah := conf.assumeid, conf.assumeh
+	if aid.IsZero() {
+		return 0, false
+	}
+	bi.rwm.RLock()
+	defer bi.rwm.RUnlock()
+	lh := bi.lastHeight()
+	if lh == InvalidHeight || lh >= ah {
+		return 0, false
+	}
+	if bi.avh != nil && bi.avh.id.Equal(aid) {
+		return 0, false
+	}
+	return lh + 1, true
+}
+
+//IsAssumeValid 高度height的区块id是否可以跳过签名和脚本检查
+//只有assume-valid区块和最优区块头链上它的祖先区块跳过,无法确定时必须验证
+func (bi *BlockIndex) IsAssumeValid(height uint32, id HASH256) bool {
+	aid, ah := conf.assumeid, conf.assumeh
+	if aid.IsZero() || height > ah {
+		return false
+	}
+	if height == ah {
+		return id.Equal(aid)
+	}
+	bi.rwm.RLock()
+	defer bi.rwm.RUnlock()
+	//assume-valid区块已经在主链中,主链上低于它的区块都是祖先
+	if ele := bi.gethele(ah); ele != nil {
+		if eid, err := ele.ID(); err != nil || !eid.Equal(aid) {
+			return false
+		}
+		cur := bi.gethele(height)
+		if cur == nil {
+			return false
+		}
+		cid, err := cur.ID()
+		return err == nil && cid.Equal(id)
+	}
+	//在连接到assume-valid区块的区块头链中
+	if bi.avh == nil || !bi.avh.id.Equal(aid) {
+		return false
+	}
+	h, has := bi.avh.ids[id]
+	return has && h == height
+}
@@ -0,0 +1,164 @@
+package xginx
+
+import (
+	"errors"
+	"time"
+)
+
+func (suite *BlockTestSuite) TestCheckpoint() {
+	req := suite.Require()
+	bi := suite.bi
+	//和检查点不一致的区块不能连接
+	blk, err := bi.NewBlock(1)
+	req.NoError(err)
+	req.NoError(blk.Finish(bi))
+	calcbits(bi, blk)
+	nh := bi.NextHeight()
+	conf.SetCheckpoint(nh, ZERO256)
+	err = bi.LinkBlk(blk)
+	req.True(errors.Is(err, ErrCheckpoint))
+	conf.SetCheckpoint(nh, blk.MustID())
+	req.NoError(bi.LinkBlk(blk))
+	//证据区块头也必须匹配检查点
+	conf.SetCheckpoint(nh, ZERO256)
+	err = Headers{blk.Header}.Check(nh-1, bi)
+	req.True(errors.Is(err, ErrCheckpoint))
+	conf.DelCheckpoint(nh)
+	req.NoError(Headers{blk.Header}.Check(nh-1, bi))
+	//最后检查点
+	conf.SetCheckpoint(10, bi.gethele(10).MustID())
+	cph, has := conf.LastCheckpoint(bi.Height())
+	req.True(has)
+	req.Equal(uint32(10), cph)
+	_, has = conf.LastCheckpoint(9)
+	req.False(has)
+	conf.DelCheckpoint(10)
+	req.NoError(bi.UnlinkLast())
+}
+
+func (suite *BlockTestSuite) TestAssumeValid() {
+	req := suite.Require()
+	bi := suite.bi
+	a := GetTestListener(bi).GetAccount(0)
+	aaddr, err := a.GetAddress()
+	req.NoError(err)
+	coins, err := bi.ListCoins(aaddr)
+	req.NoError(err)
+	//创建一个签名错误的交易
+	tx := NewTx(DefaultExeLimit, DefaultTxScript)
+	in, err := coins.Coins[0].NewTxIn(a.NewWitnessScript(DefaultInputScript))
+	req.NoError(err)
+	tx.Ins = append(tx.Ins, in)
+	out, err := aaddr.NewTxOut(coins.Coins[0].Value, nil, DefaultLockedScript)
+	req.NoError(err)
+	tx.Outs = append(tx.Outs, out)
+	req.NoError(tx.Sign(bi, newaccsigner(a)))
+	wits, err := tx.Ins[0].Script.ToWitness()
+	req.NoError(err)
+	wits.Sig[0][0] ^= 0xff
+	tx.Ins[0].Script, err = wits.Final()
+	req.NoError(err)
+	req.Error(tx.Verify(bi))
+
+	blk, err := bi.NewBlock(1)
+	req.NoError(err)
+	req.NoError(blk.Finish(bi))
+	blk.Txs = append(blk.Txs, tx)
+	blk.ResetHasher()
+	req.NoError(blk.SetMerkle())
+	calcbits(bi, blk)
+	//默认验证签名
+	req.Error(bi.LinkBlk(blk))
+	//低于assume-valid区块时跳过签名检查
+	nh := bi.NextHeight()
+	conf.SetAssumeValid(nh, blk.MustID())
+	defer func() {
+		conf.SetAssumeValid(0, ZERO256)
+		conf.DelCheckpoint(nh)
+	}()
+	req.NoError(bi.LinkBlk(blk))
+	//金额仍然检查,已经消费的金额不能再次使用
+	_, err = bi.GetCoin(coins.Coins[0].CPkh, coins.Coins[0].TxID, coins.Coins[0].Index)
+	req.Error(err)
+	req.NoError(bi.UnlinkLast())
+
+	//assume-valid区块在下一个高度,不知道区块头链时必须验证
+	next := &BlockInfo{}
+	next.Header = blk.Header
+	next.Header.Prev = blk.MustID()
+	next.Header.Time = blk.Header.Time + 1
+	next.Header.Bits = bi.CalcBits(nh + 1)
+	calcbits(bi, next)
+	conf.SetAssumeValid(nh+1, next.Header.MustID())
+	defer conf.DelCheckpoint(nh + 1)
+	req.False(bi.IsAssumeValid(nh, blk.MustID()))
+	req.Error(bi.LinkBlk(blk))
+	//区块头必须连接到assume-valid区块
+	req.Error(bi.AddAssumeHeaders(Headers{blk.Header}))
+	req.NoError(bi.AddAssumeHeaders(Headers{blk.Header, next.Header}))
+	req.True(bi.IsAssumeValid(nh, blk.MustID()))
+	req.False(bi.IsAssumeValid(nh, next.Header.MustID()))
+	req.NoError(bi.LinkBlk(blk))
+	req.NoError(bi.UnlinkLast())
+}
+
+//新节点同步时获取到assume-valid区块的区块头链,祖先区块跳过签名检查
+func (suite *BlockTestSuite) TestAssumeValidSync() {
+	req := suite.Require()
+	genesis, err := suite.bi.LoadBlock(conf.genesis)
+	req.NoError(err)
+	sn, err := NewSimNet(2, genesis)
+	req.NoError(err)
+	defer sn.Close()
+	n := sn.Nodes[0]
+	bi := n.BlockIndex()
+	_, err = n.Mine(CoinbaseMaturity + 1)
+	req.NoError(err)
+	//创建一个签名错误的交易
+	a := n.Listener().GetAccount(0)
+	aaddr, err := a.GetAddress()
+	req.NoError(err)
+	coins, err := bi.ListCoins(aaddr)
+	req.NoError(err)
+	tx := NewTx(DefaultExeLimit, DefaultTxScript)
+	in, err := coins.Coins[0].NewTxIn(a.NewWitnessScript(DefaultInputScript))
+	req.NoError(err)
+	tx.Ins = append(tx.Ins, in)
+	out, err := aaddr.NewTxOut(coins.Coins[0].Value, nil, DefaultLockedScript)
+	req.NoError(err)
+	tx.Outs = append(tx.Outs, out)
+	req.NoError(tx.Sign(bi, newaccsigner(a)))
+	wits, err := tx.Ins[0].Script.ToWitness()
+	req.NoError(err)
+	wits.Sig[0][0] ^= 0xff
+	tx.Ins[0].Script, err = wits.Final()
+	req.NoError(err)
+	lis := n.Listener()
+	lis.SetTime(bi.Time())
+	lis.AddTime(time.Second)
+	blk, err := bi.NewBlock(1)
+	req.NoError(err)
+	req.NoError(blk.Finish(bi))
+	blk.Txs = append(blk.Txs, tx)
+	blk.ResetHasher()
+	req.NoError(blk.SetMerkle())
+	calcbits(bi, blk)
+	req.Error(bi.LinkBlk(blk))
+	//包含签名错误交易的区块作为assume-valid区块
+	nh := bi.NextHeight()
+	conf.SetAssumeValid(nh, blk.MustID())
+	defer func() {
+		conf.SetAssumeValid(0, ZERO256)
+		conf.DelCheckpoint(nh)
+	}()
+	req.NoError(bi.LinkBlk(blk))
+	_, err = n.Mine(2)
+	req.NoError(err)
+	//新节点只能通过区块头链确认这个区块可以跳过签名检查
+	req.NoError(sn.Connect(0, 1))
+	req.NoError(sn.WaitConverge(time.Second * 30))
+	best := sn.Nodes[1].Best()
+	req.Equal(nh+2, best.Height)
+	_, err = sn.Nodes[1].BlockIndex().LoadBlock(blk.MustID())
+	req.NoError(err)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path"
@@ -13,6 +14,9 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+
+	"github.com/cxuhua/lzma"
+	"github.com/golang/snappy"
 )
 
 //BlkChunk 文件数据状态
@@ -200,16 +204,168 @@ type sstore struct {
 	ext   string            //扩展名称
 	size  int64             //单个文件最大长度
 	dir   string            //目录名称
+	codec uint8             //数据记录压缩方式
 }
 
 //错误
 var (
 	//需要切换到下一个文件存储
 	ErrNextFile = errors.New("next file")
+	//ErrChunkChecksum 数据记录校验和错误
+	ErrChunkChecksum = errors.New("chunk checksum error")
+	//ErrChunkNeedMigrate 旧格式的数据文件,需要迁移后使用
+	ErrChunkNeedMigrate = errors.New("chunk file format old, need migrate")
 )
 
-//获取文件头标识和版本
-func sfileHeaderBytes() []byte {
+//数据记录压缩方式
+const (
+	ChunkCodecNone   = uint8(0)
+	ChunkCodecLzma   = uint8(1)
+	ChunkCodecSnappy = uint8(2)
+)
+
+//数据记录头长度 压缩方式(1)+数据长度(4)+校验和(4)
+const chunkHeadSize = 9
+
+//数据文件格式标识,旧格式文件头没有此标识
+var chunkFileMagic = []byte{'C', 'H', 'K', 1}
+
+//ParseChunkCodec 根据名称获取压缩方式 none lzma snappy
+func ParseChunkCodec(name string) (uint8, error) {
+	switch name {
+	case "", "none":
+		return ChunkCodecNone, nil
+	case "lzma":
+		return ChunkCodecLzma, nil
+	case "snappy":
+		return ChunkCodecSnappy, nil
+	default:
+		return 0, fmt.Errorf("chunk codec %s error", name)
+	}
+}
+
+//编码数据记录,压缩后数据没有变小时不压缩
+func encodeChunk(codec uint8, b []byte) ([]byte, error) {
+	var zb []byte
+	var err error
+	switch codec {
+	case ChunkCodecNone:
+		zb = b
+	case ChunkCodecLzma:
+		zb, err = lzma.Compress(b)
+	case ChunkCodecSnappy:
+		zb = snappy.Encode(nil, b)
+	default:
+		err = fmt.Errorf("chunk codec %d error", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(zb) >= len(b) {
+		codec, zb = ChunkCodecNone, b
+	}
+	w := NewWriter()
+	if err := w.TWrite(codec); err != nil {
+		return nil, err
+	}
+	if err := w.TWrite(uint32(len(zb))); err != nil {
+		return nil, err
+	}
+	if err := w.TWrite(crc32.ChecksumIEEE(zb)); err != nil {
+		return nil, err
+	}
+	if err := w.WriteFull(zb); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+//解码数据记录头,返回压缩方式和数据长度
+func decodeChunkHead(b []byte) (uint8, int, uint32, error) {
+	if len(b) < chunkHeadSize {
+		return 0, 0, 0, errors.New("chunk head miss")
+	}
+	r := NewReader(b)
+	codec, dl, sum := uint8(0), uint32(0), uint32(0)
+	if err := r.TRead(&codec); err != nil {
+		return 0, 0, 0, err
+	}
+	if err := r.TRead(&dl); err != nil {
+		return 0, 0, 0, err
+	}
+	if err := r.TRead(&sum); err != nil {
+		return 0, 0, 0, err
+	}
+	return codec, int(dl), sum, nil
+}
+
+//解码数据记录,检查校验和并解压
+func decodeChunk(b []byte) ([]byte, error) {
+	codec, dl, sum, err := decodeChunkHead(b)
+	if err != nil {
+		return nil, err
+	}
+	if chunkHeadSize+dl != len(b) {
+		return nil, errors.New("chunk length error")
+	}
+	zb := b[chunkHeadSize:]
+	if crc32.ChecksumIEEE(zb) != sum {
+		return nil, ErrChunkChecksum
+	}
+	switch codec {
+	case ChunkCodecNone:
+		return zb, nil
+	case ChunkCodecLzma:
+		return lzma.Uncompress(zb)
+	case ChunkCodecSnappy:
+		return snappy.Decode(nil, zb)
+	default:
+		return nil, fmt.Errorf("chunk codec %d error", codec)
+	}
+}
+
+//遍历文件中的所有记录,off为第一个记录在文件中的位置,size为文件长度
+//每次只读取一个记录,校验失败的记录跳过,文件结尾不完整的记录忽略
+func walkChunks(id uint32, off int, size int, read func(off int, b []byte) error, fn func(st BlkChunk, b []byte) error) error {
+	hb := make([]byte, chunkHeadSize)
+	for pos := off; pos < size; {
+		if pos+chunkHeadSize > size {
+			LogErrorf("chunk file %d offset %d incomplete", id, pos)
+			return nil
+		}
+		if err := read(pos, hb); err != nil {
+			return err
+		}
+		_, dl, _, err := decodeChunkHead(hb)
+		if err != nil || dl > MaxBlockSize || pos+chunkHeadSize+dl > size {
+			LogErrorf("chunk file %d offset %d incomplete", id, pos)
+			return nil
+		}
+		rl := chunkHeadSize + dl
+		st := BlkChunk{
+			ID:  VarUInt(id),
+			Off: VarUInt(pos),
+			Len: VarUInt(rl),
+		}
+		bb := make([]byte, rl)
+		if err := read(pos, bb); err != nil {
+			return err
+		}
+		pos += rl
+		b, err := decodeChunk(bb)
+		if err != nil {
+			LogErrorf("chunk file %d offset %d error %v", id, st.Off, err)
+			continue
+		}
+		if err := fn(st, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//获取旧格式文件头标识和版本
+func sfileLegacyHeaderBytes() []byte {
 	w := NewWriter()
 	err := w.TWrite(conf.flags[:])
 	if err != nil {
@@ -222,6 +378,11 @@ func sfileHeaderBytes() []byte {
 	return w.Bytes()
 }
 
+//获取文件头标识,版本和格式标识
+func sfileHeaderBytes() []byte {
+	return append(sfileLegacyHeaderBytes(), chunkFileMagic...)
+}
+
 //存储文件
 type sfile struct {
 	rwm sync.Mutex
@@ -329,22 +490,26 @@ func (s *sstore) ID() uint32 {
 func (s *sstore) checkmeta(id uint32, sf *sfile) (*sfile, error) {
 	hbytes := sfileHeaderBytes()
 	if err := sf.read(0, hbytes); err != nil {
-		_ = sf.Close()
+		sf.close()
 		return nil, err
 	}
 	r := NewReader(hbytes)
 	if err := r.TRead(&sf.flags); err != nil {
-		_ = sf.Close()
+		sf.close()
 		return nil, err
 	}
 	if err := r.TRead(&sf.ver); err != nil {
-		_ = sf.Close()
+		sf.close()
 		return nil, err
 	}
 	if !bytes.Equal(sf.flags, conf.flags[:]) {
-		_ = sf.Close()
+		sf.close()
 		return nil, errors.New("file meta error")
 	}
+	if !bytes.Equal(hbytes[len(hbytes)-len(chunkFileMagic):], chunkFileMagic) {
+		sf.close()
+		return nil, ErrChunkNeedMigrate
+	}
 	s.files[id] = sf
 	return sf, nil
 }
@@ -379,16 +544,116 @@ func (s *sstore) openfile(id uint32) (*sfile, error) {
 	return sf, nil
 }
 
+//Walk 按文件顺序遍历所有数据记录
+func (s *sstore) Walk(fn func(st BlkChunk, b []byte) error) error {
+	hl := len(sfileHeaderBytes())
+	for id := uint32(0); id <= s.ID(); id++ {
+		if !s.exists(s.fileIDPath(id)) {
+			continue
+		}
+		f, err := s.openfile(id)
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		read := func(off int, b []byte) error {
+			return f.read(uint32(off), b)
+		}
+		if err := walkChunks(id, hl, int(fi.Size()), read, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Files 获取所有数据文件
+func (s *sstore) Files() ([]ChunkFile, error) {
+	fs := []ChunkFile{}
+	for id := uint32(0); id <= s.ID(); id++ {
+		fi, err := os.Stat(s.fileIDPath(id))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, ChunkFile{ID: id, Size: fi.Size()})
+	}
+	return fs, nil
+}
+
+//Remove 删除数据文件,不能删除正在写入的文件
+func (s *sstore) Remove(id uint32) error {
+	if id >= s.ID() {
+		return fmt.Errorf("chunk file %d in use", id)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.files[id]; ok {
+		f.close()
+		delete(s.files, id)
+	}
+	err := os.Remove(s.fileIDPath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//Tail 获取当前写入位置
+func (s *sstore) Tail() (ChunkFile, error) {
+	id := s.ID()
+	fi, err := os.Stat(s.fileIDPath(id))
+	if os.IsNotExist(err) {
+		return ChunkFile{ID: id}, nil
+	}
+	if err != nil {
+		return ChunkFile{}, err
+	}
+	return ChunkFile{ID: id, Size: fi.Size()}, nil
+}
+
+//Truncate 截断到写入位置,删除之后写入的数据
+func (s *sstore) Truncate(pos ChunkFile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := s.ID(); ; id-- {
+		if f, ok := s.files[id]; ok {
+			f.close()
+			delete(s.files, id)
+		}
+		spath := s.fileIDPath(id)
+		var err error
+		if id > pos.ID || pos.Size == 0 {
+			err = os.Remove(spath)
+		} else {
+			err = os.Truncate(spath, pos.Size)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if id <= pos.ID {
+			break
+		}
+	}
+	atomic.StoreUint32(&s.id, pos.ID)
+	return nil
+}
+
+//Read 读取数据记录,检查校验和并解压
 func (s *sstore) Read(st BlkChunk) ([]byte, error) {
-	if st.Len > MaxBlockSize {
-		return nil, errors.New("data too big")
+	if st.Len > MaxBlockSize+chunkHeadSize || st.Len < chunkHeadSize {
+		return nil, errors.New("data size error")
 	}
 	bb := make([]byte, st.Len)
 	err := s.read(st.ID.ToUInt32(), st.Off.ToUInt32(), bb)
 	if err != nil {
 		return nil, err
 	}
-	return bb, nil
+	return decodeChunk(bb)
 }
 
 //读取数据
@@ -400,6 +665,7 @@ func (s *sstore) read(id uint32, off uint32, b []byte) error {
 	return f.read(off, b)
 }
 
+//Write 写入数据记录,使用存储设置的方式压缩
 func (s *sstore) Write(b []byte) (BlkChunk, error) {
 	fs := BlkChunk{
 		ID:  VarUInt(s.ID()),
@@ -409,7 +675,12 @@ func (s *sstore) Write(b []byte) (BlkChunk, error) {
 	if fs.Len > MaxBlockSize {
 		return fs, errors.New("data too big")
 	}
-	off, err := s.write(b)
+	rb, err := encodeChunk(s.codec, b)
+	if err != nil {
+		return fs, err
+	}
+	fs.Len = VarUInt(len(rb))
+	off, err := s.write(rb)
 	if err != nil {
 		return fs, err
 	}
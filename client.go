@@ -57,11 +57,21 @@ type Client struct {
 	ping    int
 	pt      *time.Timer
 	vt      *time.Timer
-	isopen  bool      //收到msgversion算打开成功
-	Ver     uint32    //节点版本
-	Service uint32    //节点提供的服务
-	Height  uint32    //节点区块高度
-	vmap    *sync.Map //属性存储器
+	it      *time.Timer //库存通报定时器
+	itset   bool        //通报定时器是否已经启动
+	invmu   sync.Mutex
+	invq    []Inventory //等待通报的库存
+	known   *invSet     //对方已经有的库存
+	vtime   time.Time   //开始统计超过限制的时间
+	violate int32       //窗口时间内超过限制的次数
+	dropped int32       //超过限制丢弃的消息数量
+	isopen  bool        //收到msgversion算打开成功
+	Ver     uint32      //节点版本
+	proto   uint32      //双方使用的协议版本,使用原子操作读写
+	acked   int32       //握手是否完成,使用原子操作读写
+	Service uint32      //节点提供的服务
+	Height  uint32      //节点区块高度
+	vmap    *sync.Map   //属性存储器
 }
 
 func (c *Client) ID() uint64 {
@@ -122,6 +132,45 @@ func (c *Client) FilterHas(key []byte) bool {
 	return true
 }
 
+//FilterMsg 设置过滤器的连接只转发匹配的交易,区块转为merkle区块
+//连接没有过滤器或者消息不需要过滤时返回false
+func (c *Client) FilterMsg(m MsgIO) (MsgIO, bool) {
+	blm, has := c.GetFilter()
+	if !has {
+		return nil, false
+	}
+	switch msg := m.(type) {
+	case *MsgTx:
+		rsg := &MsgTx{}
+		for _, tx := range msg.Txs {
+			match, err := blm.MatchTx(tx)
+			if err != nil {
+				LogError("filter tx error", err)
+				continue
+			}
+			if match {
+				rsg.Add(tx)
+			}
+		}
+		if len(rsg.Txs) == 0 {
+			return nil, true
+		}
+		return rsg, true
+	case *MsgBlock:
+		//旧版本节点不支持merkle区块,按原来的方式广播
+		if !c.IsSupportMsg(NtMerkleBlock) {
+			return nil, false
+		}
+		rsg, err := NewMsgMerkleBlock(msg.Blk, blm)
+		if err != nil {
+			LogError("new merkle block error", err)
+			return nil, true
+		}
+		return rsg, true
+	}
+	return nil, false
+}
+
 //Equal 是否是相同的客户端
 //检测节点id是否一致
 func (c *Client) Equal(b *Client) bool {
@@ -140,7 +189,7 @@ func (c *Client) IsOut() bool {
 
 //当收到新的区块请求时
 func (c *Client) reqMsgBlock(msg *MsgGetBlock) {
-	bi := GetBlockIndex()
+	bi := c.ss.blockIndex()
 	iter := bi.NewIter()
 	//如果请求的下个区块不存在
 	if !iter.SeekHeight(msg.Next) {
@@ -174,9 +223,12 @@ func (c *Client) reqMsgBlock(msg *MsgGetBlock) {
 }
 
 func (c *Client) processMsg(m MsgIO) error {
-	ps := GetPubSub()
-	bi := GetBlockIndex()
+	bi := c.ss.blockIndex()
+	ps := bi.GetPubSub()
 	typ := m.Type()
+	if err := c.checkRecvMsg(m); err != nil {
+		return err
+	}
 	switch typ {
 	case NtBroadPkg:
 		msg := m.(*MsgBroadPkg)
@@ -196,6 +248,20 @@ func (c *Client) processMsg(m MsgIO) error {
 	case NtGetBlock:
 		msg := m.(*MsgGetBlock)
 		c.reqMsgBlock(msg)
+	case NtGetHeaders:
+		msg := m.(*MsgGetHeaders)
+		c.SendMsg(bi.NewMsgHeadersFrom(msg))
+	case NtGetCFHeaders:
+		msg := m.(*MsgGetCFHeaders)
+		rsg, err := bi.NewMsgCFHeaders(msg)
+		if err != nil {
+			c.SendMsg(NewMsgError(ErrCodeCFilter, err))
+		} else {
+			c.SendMsg(rsg)
+		}
+	case NtGetCFilters:
+		msg := m.(*MsgGetCFilters)
+		c.SendMsg(bi.NewMsgCFilters(msg))
 	case NtGetTxPool:
 		msg := m.(*MsgGetTxPool)
 		tp := bi.GetTxPool()
@@ -206,6 +272,12 @@ func (c *Client) processMsg(m MsgIO) error {
 		tp.PushTxs(bi, msg)
 	case NtTxMerkle:
 		msg := m.(*MsgTxMerkle)
+		//旧版本节点没有区块id,从交易索引获取
+		if msg.BlkID.IsZero() {
+			if txv, err := bi.LoadTxValue(msg.TxID); err == nil {
+				msg.BlkID = txv.BlkID
+			}
+		}
 		err := msg.Verify(bi)
 		if err != nil {
 			LogError("verify txid merkle error", err)
@@ -241,6 +313,11 @@ func (c *Client) processMsg(m MsgIO) error {
 	case NtError:
 		msg := m.(*MsgError)
 		LogError("recv error msg code =", msg.Code, "error =", msg.Error, c.id)
+	case NtInv:
+		msg := m.(*MsgInv)
+		if rsg := c.ss.NewMsgGetInv(c, msg); len(rsg.Invs) > 0 {
+			c.SendMsg(rsg)
+		}
 	case NtGetInv:
 		msg := m.(*MsgGetInv)
 		if len(msg.Invs) == 0 {
@@ -266,6 +343,10 @@ func (c *Client) processMsg(m MsgIO) error {
 		c.SendMsg(rsg)
 	case NtVersion:
 		msg := m.(*MsgVersion)
+		//低于最低协议版本的节点断开
+		if err := c.recvVersion(msg); err != nil {
+			return err
+		}
 		//保存到地址列表
 		if msg.Addr.IsGlobalUnicast() {
 			c.ss.addrs.Set(msg.Addr)
@@ -280,12 +361,17 @@ func (c *Client) processMsg(m MsgIO) error {
 		c.Addr = msg.Addr
 		c.Height = msg.Height
 		c.Ver = msg.Ver
-		c.Service = msg.Service
 		//如果是连入的，返回节点版本信息
 		if c.IsIn() {
-			rsg := bi.NewMsgVersion()
+			rsg := c.ss.NewMsgVersion()
 			c.SendMsg(rsg)
 		}
+		//新版本节点回复确认
+		if c.ProtoVer() >= VerAckVersion {
+			c.SendMsg(&MsgVerAck{})
+		}
+	case NtVerAck:
+		c.setAcked()
 	}
 	//发布消息
 	ps.Pub(NewClientMsg(c, m), NetMsgTopic)
@@ -354,8 +440,7 @@ func (c *Client) connect(addr NetAddr) error {
 	c.Addr = addr
 	c.NetStream = NewNetStream(conn)
 	//主动发送第一个包
-	bi := GetBlockIndex()
-	c.SendMsg(bi.NewMsgVersion())
+	c.SendMsg(c.ss.NewMsgVersion())
 	return nil
 }
 
@@ -391,16 +476,27 @@ func (c *Client) loop() {
 				return
 			}
 		case rp := <-c.rc:
+			//超过限制的消息丢弃
+			if err := c.checkRate(rp); err != nil {
+				LogWarn("check rate", c.id, "error", err)
+				break
+			}
 			if err := c.processMsg(rp); err != nil {
 				LogError("process msg", rp.Type(), "error", err)
 			}
+		case <-c.it.C:
+			if err := c.flushInv(); err != nil {
+				c.err = fmt.Errorf("write inv error %v", err)
+				c.cfun()
+				return
+			}
 		case <-c.vt.C:
-			if !c.isopen {
+			if !c.isopen || !c.IsAcked() {
 				c.Close()
-				LogError("MsgVersion recv timeout,closed")
+				LogError("MsgVersion handshake timeout,closed")
 				break
 			}
-			bi := GetBlockIndex()
+			bi := c.ss.blockIndex()
 			tp := bi.GetTxPool()
 			//获取对方地址列表
 			if c.Service&FullNodeFlag != 0 {
@@ -417,7 +513,7 @@ func (c *Client) loop() {
 				break
 			}
 			//定时ping消息,通报区块高度
-			bi := GetBlockIndex()
+			bi := c.ss.blockIndex()
 			msg := NewMsgPing(bi.BestHeight())
 			c.SendMsg(msg)
 			c.pt.Reset(TimeSecond(int(Rand(40, 60))))
@@ -429,6 +525,11 @@ func (c *Client) loop() {
 
 //SendMsg 发送消息
 func (c *Client) SendMsg(m MsgIO) {
+	//对方不支持的消息不发送
+	if err := c.checkSendMsg(m); err != nil {
+		LogWarn("send msg", m.Type(), "error", err)
+		return
+	}
 	c.wc <- m
 }
 
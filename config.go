@@ -15,6 +15,20 @@ import (
 var (
 	ConfFile = flag.String("conf", "v10000.json", "config file name")
 	IsDebug  = flag.Bool("debug", true, "startup mode")
+	//IsVerifyChain 检查区块链数据后退出
+	IsVerifyChain = flag.Bool("verifychain", false, "verify block chain index and data then exit")
+	//IsReindex 使用区块数据文件重建索引
+	IsReindex = flag.Bool("reindex", false, "rebuild block index from block data files")
+	//IsMigrateStore 升级旧格式的区块数据文件后退出
+	IsMigrateStore = flag.Bool("migratestore", false, "migrate legacy block data files then exit")
+	//ExportFile 导出主链区块到引导文件后退出
+	ExportFile = flag.String("exportblocks", "", "export main chain blocks to bootstrap file then exit")
+	//ImportFile 启动时从引导文件导入区块
+	ImportFile = flag.String("importblocks", "", "import blocks from bootstrap file at startup")
+	//IsStoreStats 输出区块存储统计后退出
+	IsStoreStats = flag.Bool("storestats", false, "print block store stats then exit")
+	//IsPruneRev 删除超过最大回退深度的回退数据文件后退出
+	IsPruneRev = flag.Bool("prunerev", false, "remove rev data files older than max reorg depth then exit")
 )
 
 //Config 配置加载后只读
@@ -23,7 +37,7 @@ type Config struct {
 	Confirms  uint32   `json:"confirms"`  //安全确认数 = 6
 	MinerNum  int      `json:"miner_num"` //挖掘机数量,=0不会启动协程挖矿
 	MaxConn   int      `json:"max_conn"`  //最大激活的连接，包括连入和连出的
-	Seeds     []string `json:"seeds"`     //dns seed服务器
+	Seeds     []string `json:"seeds"`     //dns seed服务器,host:port直接查询种子服务
 	DataDir   string   `json:"data_dir"`  //数据路径
 	Genesis   string   `json:"genesis"`   //第一个区块
 	LogFile   string   `json:"log_file"`  //日志文件路径
@@ -36,10 +50,29 @@ type Config struct {
 	TCPIp     string   `json:"tcp_ip"`    //节点远程连接ip
 	LimitHash UINT256  `json:"-"`         //最小工作难度
 	Nodes     []string `json:"nodes"`     //配置的可用节点
-	flags     [4]byte  //协议标识
-	logFile   *os.File //日志文件
-	genesis   HASH256  //第一个区块id
-	nodeid    uint64   //节点随机id
+	Store     string   `json:"store"`     //区块存储类型 leveldb(默认) memory
+	Compress  string   `json:"compress"`  //区块和回退数据压缩方式 none(默认) lzma snappy
+	//检查点列表,区块头链必须匹配,低于最后检查点的分叉会被拒绝
+	Checkpoints []Checkpoint `json:"checkpoints"`
+	//assume-valid区块,初始同步时这个区块的祖先区块不验证签名和执行脚本
+	AssumeValid *Checkpoint        `json:"assume_valid"`
+	NoTxIndex   bool               `json:"no_txindex"`   //不保存完整的交易索引
+	NoAddrIndex bool               `json:"no_addrindex"` //不保存账户相关交易索引
+	CompactIdle uint               `json:"compact_idle"` //写入区块后空闲多少秒合并索引数据库,=0不合并
+	MaxReorg    uint32             `json:"max_reorg"`    //最大回退区块数量,=0不限制,超过这个深度的回退数据可以删除
+	RateLimits  map[string]float64 `json:"rate_limits"`  //所有连接每种消息每秒最多处理的数量,键为消息名称如NT_TX,=nil使用默认值
+	PeerLimits  map[string]float64 `json:"peer_limits"`  //每个连接每种消息每秒最多处理的数量,=nil使用默认值
+	MaxViolate  int                `json:"max_violate"`  //每分钟超过限制的次数大于这个值断开连接,=0只丢弃消息
+	MinProto    uint32             `json:"min_proto"`    //连接节点的最低协议版本,=0使用MinProtocolVersion
+	StrictMsg   bool               `json:"strict_msg"`   //严格解码网络消息,拒绝解码后有多余数据的消息
+	SeedDomain  string             `json:"seed_domain"`  //host:port格式的种子查询的域名,为空使用DefaultSeedDomain
+	flags       [4]byte            //协议标识
+	logFile     *os.File           //日志文件
+	genesis     HASH256            //第一个区块id
+	nodeid      uint64             //节点随机id
+	checkpoints map[uint32]HASH256 //高度对应的检查点
+	assumeh     uint32             //assume-valid区块高度
+	assumeid    HASH256            //assume-valid区块id
 }
 
 //GetTCPListenAddr 获取服务地址
@@ -121,6 +154,7 @@ func (c *Config) Init() *Config {
 	//设置第一个区块id
 	c.genesis = NewHASH256(c.Genesis)
 	c.LimitHash = NewUINT256(c.PowLimit)
+	c.initCheckpoints()
 	return c
 }
 
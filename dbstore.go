@@ -392,12 +392,13 @@ func (ss *leveldbstore) Sync() {
 }
 
 //新建存储数据库
-func (ss *leveldbstore) newdata(ext string, maxsiz int64) IChunkStore {
+func (ss *leveldbstore) newdata(ext string, maxsiz int64, codec uint8) IChunkStore {
 	fs := &sstore{
 		ext:   ext,
 		files: map[uint32]*sfile{},
 		size:  maxsiz,
 		dir:   ss.dir,
+		codec: codec,
 	}
 	runtime.SetFinalizer(fs, (*sstore).Close)
 	return fs
@@ -414,11 +415,15 @@ func (ss *leveldbstore) Init(arg ...interface{}) {
 		} else {
 			ss.index = db
 		}
-		ss.blk = ss.newdata(".blk", 1024*1024*256)
+		codec, err := ParseChunkCodec(conf.Compress)
+		if err != nil {
+			panic(err)
+		}
+		ss.blk = ss.newdata(".blk", BlkFileMaxSize, codec)
 		if err := ss.blk.Init(); err != nil {
 			panic(err)
 		}
-		ss.rev = ss.newdata(".rev", 1024*1024*64)
+		ss.rev = ss.newdata(".rev", RevFileMaxSize, codec)
 		if err := ss.rev.Init(); err != nil {
 			panic(err)
 		}
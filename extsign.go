@@ -0,0 +1,494 @@
+package xginx
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+//外部签名协议定义
+//每个消息前4字节为消息长度,后面为请求或者应答数据
+const (
+	//ExtSignVer 外部签名协议版本
+	ExtSignVer = 1
+	//ExtSignMaxSize 外部签名消息最大长度
+	ExtSignMaxSize = 1024 * 1024 * 4
+)
+
+//外部签名应答码
+const (
+	//签名成功
+	ExtSignOK = 0
+	//协议版本不支持
+	ExtSignErrVer = 1
+	//签名hash和交易内容不符
+	ExtSignErrHash = 2
+	//没有公钥对应的私钥
+	ExtSignErrKey = 3
+	//签名服务拒绝签名
+	ExtSignErrReject = 4
+)
+
+//ExtSignError 外部签名服务返回的错误
+type ExtSignError struct {
+	Code uint8
+	Msg  string
+}
+
+func (e ExtSignError) Error() string {
+	return fmt.Sprintf("ext sign error code = %d msg = %s", e.Code, e.Msg)
+}
+
+//ExtSignReq 外部签名请求
+//签名服务可以使用Tx,Out,Idx重新计算签名hash,并检查交易内容后决定是否签名
+type ExtSignReq struct {
+	Ver  uint8     //协议版本
+	Seq  uint32    //请求序号,应答中原样返回
+	Hash HASH256   //签名hash GetSigHash
+	Pks  []PKBytes //需要签名的公钥,按顺序返回签名
+	Idx  VarUInt   //签名的输入在交易中的索引
+	Out  *TxOut    //输入引用的输出
+	Tx   *TX       //签名的交易
+}
+
+//SigHash 根据交易内容计算签名hash
+func (req ExtSignReq) SigHash() (HASH256, error) {
+	idx := req.Idx.ToInt()
+	if req.Tx == nil || req.Out == nil || idx < 0 || idx >= len(req.Tx.Ins) {
+		return ZERO256, errors.New("ext sign req tx context error")
+	}
+	sigh, err := NewSigner(req.Tx, req.Out, req.Tx.Ins[idx], idx).GetSigHash()
+	if err != nil {
+		return ZERO256, err
+	}
+	return NewHASH256(sigh), nil
+}
+
+//Encode 编码请求
+func (req ExtSignReq) Encode(w IWriter) error {
+	if err := w.TWrite(req.Ver); err != nil {
+		return err
+	}
+	if err := w.TWrite(req.Seq); err != nil {
+		return err
+	}
+	if err := req.Hash.Encode(w); err != nil {
+		return err
+	}
+	if err := VarUInt(len(req.Pks)).Encode(w); err != nil {
+		return err
+	}
+	for _, pk := range req.Pks {
+		if err := pk.Encode(w); err != nil {
+			return err
+		}
+	}
+	if err := req.Idx.Encode(w); err != nil {
+		return err
+	}
+	if err := req.Out.Encode(w); err != nil {
+		return err
+	}
+	return req.Tx.Encode(w)
+}
+
+//Decode 解码请求,版本不同时只解码版本和序号
+func (req *ExtSignReq) Decode(r IReader) error {
+	if err := r.TRead(&req.Ver); err != nil {
+		return err
+	}
+	if err := r.TRead(&req.Seq); err != nil {
+		return err
+	}
+	if req.Ver != ExtSignVer {
+		return nil
+	}
+	if err := req.Hash.Decode(r); err != nil {
+		return err
+	}
+	num := VarUInt(0)
+	if err := num.Decode(r); err != nil {
+		return err
+	}
+	if num.ToInt() > 0xFF {
+		return errors.New("ext sign req pks num error")
+	}
+	req.Pks = make([]PKBytes, num.ToInt())
+	for i := range req.Pks {
+		if err := req.Pks[i].Decode(r); err != nil {
+			return err
+		}
+	}
+	if err := req.Idx.Decode(r); err != nil {
+		return err
+	}
+	req.Out = &TxOut{}
+	if err := req.Out.Decode(r); err != nil {
+		return err
+	}
+	req.Tx = &TX{}
+	return req.Tx.Decode(r)
+}
+
+//ExtSignRes 外部签名应答
+type ExtSignRes struct {
+	Ver  uint8      //协议版本
+	Seq  uint32     //对应的请求序号
+	Code uint8      //应答码 ExtSignOK 成功
+	Msg  VarBytes   //错误信息
+	Sigs []SigBytes //签名,按请求中公钥的顺序,没有私钥的公钥不返回
+}
+
+//Encode 编码应答
+func (res ExtSignRes) Encode(w IWriter) error {
+	if err := w.TWrite(res.Ver); err != nil {
+		return err
+	}
+	if err := w.TWrite(res.Seq); err != nil {
+		return err
+	}
+	if err := w.TWrite(res.Code); err != nil {
+		return err
+	}
+	if err := res.Msg.Encode(w); err != nil {
+		return err
+	}
+	if err := VarUInt(len(res.Sigs)).Encode(w); err != nil {
+		return err
+	}
+	for _, sig := range res.Sigs {
+		if err := sig.Encode(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Decode 解码应答
+func (res *ExtSignRes) Decode(r IReader) error {
+	if err := r.TRead(&res.Ver); err != nil {
+		return err
+	}
+	if err := r.TRead(&res.Seq); err != nil {
+		return err
+	}
+	if err := r.TRead(&res.Code); err != nil {
+		return err
+	}
+	if err := res.Msg.Decode(r); err != nil {
+		return err
+	}
+	num := VarUInt(0)
+	if err := num.Decode(r); err != nil {
+		return err
+	}
+	if num.ToInt() > 0xFF {
+		return errors.New("ext sign res sigs num error")
+	}
+	res.Sigs = make([]SigBytes, num.ToInt())
+	for i := range res.Sigs {
+		if err := res.Sigs[i].Decode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Error 应答错误,成功返回nil
+func (res ExtSignRes) Error() error {
+	if res.Code == ExtSignOK {
+		return nil
+	}
+	return ExtSignError{Code: res.Code, Msg: string(res.Msg)}
+}
+
+//写入一个消息
+func writeExtSignMsg(w io.Writer, msg interface{ Encode(w IWriter) error }) error {
+	buf := NewWriter()
+	if err := msg.Encode(buf); err != nil {
+		return err
+	}
+	if err := binary.Write(w, Endian, uint32(buf.Len())); err != nil {
+		return err
+	}
+	return WriteFull(w, buf.Bytes())
+}
+
+//读取一个消息
+func readExtSignMsg(r io.Reader, msg interface{ Decode(r IReader) error }) error {
+	bl := uint32(0)
+	if err := binary.Read(r, Endian, &bl); err != nil {
+		return err
+	}
+	if bl == 0 || bl > ExtSignMaxSize {
+		return fmt.Errorf("ext sign msg size %d error", bl)
+	}
+	bb := make([]byte, bl)
+	if err := ReadFull(r, bb); err != nil {
+		return err
+	}
+	return msg.Decode(NewReader(bb))
+}
+
+//ExtSigner 外部签名器,私钥保存在其他进程中
+//通过本地socket或者管道发送签名请求,实现 ISignTx 可以直接用于交易签名
+type ExtSigner struct {
+	mu  sync.Mutex
+	rw  io.ReadWriter
+	seq uint32
+}
+
+//NewExtSigner 使用已经建立的连接创建外部签名器,可以是管道
+func NewExtSigner(rw io.ReadWriter) *ExtSigner {
+	return &ExtSigner{rw: rw}
+}
+
+//DialExtSigner 连接外部签名服务 network = unix or tcp
+func DialExtSigner(network string, addr string) (*ExtSigner, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewExtSigner(conn), nil
+}
+
+//Close 关闭连接
+func (s *ExtSigner) Close() error {
+	if c, ok := s.rw.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+//Request 发送签名请求并等待应答
+func (s *ExtSigner) Request(req *ExtSignReq) (*ExtSignRes, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	req.Ver = ExtSignVer
+	req.Seq = s.seq
+	if err := writeExtSignMsg(s.rw, req); err != nil {
+		return nil, err
+	}
+	res := &ExtSignRes{}
+	if err := readExtSignMsg(s.rw, res); err != nil {
+		return nil, err
+	}
+	if res.Seq != req.Seq {
+		return nil, fmt.Errorf("ext sign res seq %d != %d", res.Seq, req.Seq)
+	}
+	return res, res.Error()
+}
+
+//SignTx 发送签名hash和交易到外部签名服务,验证返回的签名后写入输入脚本
+func (s *ExtSigner) SignTx(signer ISigner, pass ...string) error {
+	tx, in, out, idx := signer.GetObjs()
+	wits, err := in.Script.ToWitness()
+	if err != nil {
+		return err
+	}
+	sigh, err := signer.GetSigHash()
+	if err != nil {
+		return err
+	}
+	req := &ExtSignReq{
+		Hash: NewHASH256(sigh),
+		Pks:  wits.Pks,
+		Idx:  VarUInt(idx),
+		Out:  out,
+		Tx:   tx,
+	}
+	res, err := s.Request(req)
+	if err != nil {
+		return err
+	}
+	if len(res.Sigs) == 0 {
+		return errors.New("ext sign res sigs miss")
+	}
+	//签名必须按公钥顺序并且可以验证
+	k := 0
+	for _, sigb := range res.Sigs {
+		sig, err := NewSigValue(sigb[:])
+		if err != nil {
+			return err
+		}
+		for ; k < len(wits.Pks); k++ {
+			pub, err := NewPublicKey(wits.Pks[k][:])
+			if err != nil {
+				return err
+			}
+			if pub.Verify(sigh, sig) {
+				break
+			}
+		}
+		if k == len(wits.Pks) {
+			return errors.New("ext sign res sigs verify error")
+		}
+		k++
+	}
+	wits.Sig = res.Sigs
+	script, err := wits.Final()
+	if err != nil {
+		return err
+	}
+	in.Script = script
+	return nil
+}
+
+//IExtSignHandler 外部签名服务处理接口
+type IExtSignHandler interface {
+	//按请求中公钥的顺序返回签名,返回 ExtSignError 可以指定应答码
+	SignHash(req *ExtSignReq) ([]SigBytes, error)
+}
+
+//ServeExtSign 处理一个连接上的签名请求,直到连接关闭
+func ServeExtSign(rw io.ReadWriter, h IExtSignHandler) error {
+	for {
+		req := &ExtSignReq{}
+		err := readExtSignMsg(rw, req)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		res := &ExtSignRes{Ver: ExtSignVer, Seq: req.Seq}
+		if req.Ver != ExtSignVer {
+			res.Code = ExtSignErrVer
+			res.Msg = VarBytes(fmt.Sprintf("ver %d not support", req.Ver))
+		} else if sigs, err := h.SignHash(req); err != nil {
+			res.Code = ExtSignErrReject
+			var serr ExtSignError
+			if errors.As(err, &serr) {
+				res.Code = serr.Code
+			}
+			res.Msg = VarBytes(err.Error())
+		} else {
+			res.Sigs = sigs
+		}
+		if err := writeExtSignMsg(rw, res); err != nil {
+			return err
+		}
+	}
+}
+
+//签名服务监听,关闭时断开所有连接并等待处理结束
+type extSignListener struct {
+	net.Listener
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+//Close 关闭监听和所有连接
+func (l *extSignListener) Close() error {
+	err := l.Listener.Close()
+	l.mu.Lock()
+	l.closed = true
+	for conn := range l.conns {
+		_ = conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	return err
+}
+
+func (l *extSignListener) add(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.conns[conn] = true
+	l.wg.Add(1)
+	return true
+}
+
+func (l *extSignListener) del(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, conn)
+	_ = conn.Close()
+}
+
+func (l *extSignListener) serve(h IExtSignHandler) {
+	defer l.wg.Done()
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return
+		}
+		if !l.add(conn) {
+			_ = conn.Close()
+			return
+		}
+		go func() {
+			defer l.wg.Done()
+			defer l.del(conn)
+			if err := ServeExtSign(conn, h); err != nil {
+				LogError("ext sign serve error", err)
+			}
+		}()
+	}
+}
+
+//ListenExtSign 监听本地地址提供签名服务 network = unix or tcp
+//关闭返回的监听会断开所有连接并等待处理结束
+func ListenExtSign(network string, addr string, h IExtSignHandler) (net.Listener, error) {
+	lis, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	el := &extSignListener{Listener: lis, conns: map[net.Conn]bool{}}
+	el.wg.Add(1)
+	go el.serve(h)
+	return el, nil
+}
+
+//StubSigner 参考实现的签名服务,使用内存中的私钥
+//签名前会根据交易内容重新计算签名hash
+type StubSigner struct {
+	keys map[PKBytes]*PrivateKey
+}
+
+//NewStubSigner 创建签名服务
+func NewStubSigner(pris ...*PrivateKey) *StubSigner {
+	s := &StubSigner{keys: map[PKBytes]*PrivateKey{}}
+	for _, pri := range pris {
+		s.keys[pri.PublicKey().GetPks()] = pri
+	}
+	return s
+}
+
+//SignHash 签名
+func (s *StubSigner) SignHash(req *ExtSignReq) ([]SigBytes, error) {
+	hash, err := req.SigHash()
+	if err != nil {
+		return nil, ExtSignError{Code: ExtSignErrHash, Msg: err.Error()}
+	}
+	if !hash.Equal(req.Hash) {
+		return nil, ExtSignError{Code: ExtSignErrHash, Msg: "sig hash not match tx"}
+	}
+	sigs := []SigBytes{}
+	for _, pk := range req.Pks {
+		pri, has := s.keys[pk]
+		if !has {
+			continue
+		}
+		sig, err := pri.Sign(hash[:])
+		if err != nil {
+			return nil, err
+		}
+		sigb := SigBytes{}
+		sigb.Set(sig)
+		sigs = append(sigs, sigb)
+	}
+	if len(sigs) == 0 {
+		return nil, ExtSignError{Code: ExtSignErrKey, Msg: "private key miss"}
+	}
+	return sigs, nil
+}
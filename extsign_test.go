@@ -0,0 +1,103 @@
+package xginx
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+//创建一个待签名的交易,返回签名器
+func newExtSignTestSigner(t *testing.T, acc *Account) ISigner {
+	out := &TxOut{}
+	out.Value = 10 * Coin
+	locked, err := acc.NewLockedScript(nil, DefaultLockedScript)
+	require.NoError(t, err)
+	out.Script = locked
+	in := &TxIn{}
+	in.OutHash = Hash256From([]byte("ext sign test out"))
+	in.OutIndex = 0
+	wits, err := acc.NewWitnessScript(DefaultInputScript).ToScript()
+	require.NoError(t, err)
+	in.Script = wits
+	in.Sequence = FinalSequence
+	tx := NewTx(DefaultExeLimit, DefaultTxScript)
+	tx.Ins = append(tx.Ins, in)
+	tx.Outs = append(tx.Outs, out)
+	return NewSigner(tx, out, in, 0)
+}
+
+func newExtStubSigner(acc *Account) *StubSigner {
+	pris := []*PrivateKey{}
+	for _, pri := range acc.Pris {
+		pris = append(pris, pri)
+	}
+	return NewStubSigner(pris...)
+}
+
+func TestExtSignPipe(t *testing.T) {
+	defer checkGoroutines(t)()
+	acc, err := NewAccount(3, 2, false)
+	require.NoError(t, err)
+	c1, c2 := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		defer c2.Close()
+		_ = ServeExtSign(c2, newExtStubSigner(acc))
+	}()
+	defer func() {
+		_ = c1.Close()
+		<-done
+	}()
+	ext := NewExtSigner(c1)
+	signer := newExtSignTestSigner(t, acc)
+	err = ext.SignTx(signer)
+	require.NoError(t, err)
+	require.NoError(t, signer.VerifySign())
+
+	//签名hash和交易内容不符时拒绝签名
+	tx, _, out, idx := signer.GetObjs()
+	wits, err := acc.NewWitnessScript(DefaultInputScript).ToScript()
+	require.NoError(t, err)
+	tx.Ins[idx].Script = wits
+	req := &ExtSignReq{
+		Hash: Hash256From([]byte("ext sign error hash")),
+		Pks:  acc.GetPks(),
+		Idx:  VarUInt(idx),
+		Out:  out,
+		Tx:   tx,
+	}
+	_, err = ext.Request(req)
+	var serr ExtSignError
+	require.True(t, errors.As(err, &serr))
+	require.Equal(t, uint8(ExtSignErrHash), serr.Code)
+
+	//没有私钥
+	other, err := NewAccount(1, 1, false)
+	require.NoError(t, err)
+	err = ext.SignTx(newExtSignTestSigner(t, other))
+	require.True(t, errors.As(err, &serr))
+	require.Equal(t, uint8(ExtSignErrKey), serr.Code)
+}
+
+func TestExtSignUnixSocket(t *testing.T) {
+	defer checkGoroutines(t)()
+	acc, err := NewAccount(2, 2, false)
+	require.NoError(t, err)
+	file := NewTempDir() + ".sock"
+	defer os.Remove(file)
+	lis, err := ListenExtSign("unix", file, newExtStubSigner(acc))
+	require.NoError(t, err)
+	defer lis.Close()
+	ext, err := DialExtSigner("unix", file)
+	require.NoError(t, err)
+	defer ext.Close()
+	for i := 0; i < 3; i++ {
+		signer := newExtSignTestSigner(t, acc)
+		require.NoError(t, ext.SignTx(signer))
+		require.NoError(t, signer.VerifySign())
+	}
+}
@@ -0,0 +1,244 @@
+package xginx
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+//交易费估算参数
+const (
+	//MaxFeeTarget 估算交易费最大的确认区块数
+	MaxFeeTarget = 25
+	//FeeEstimateFile 交易费估算数据保存文件
+	FeeEstimateFile = "feeest.dat"
+	//最低的分组费率(每千字节)
+	feeMinRate = Amount(1)
+	//最高的分组费率(每千字节)
+	feeMaxRate = 100 * Coin
+	//分组费率增长系数
+	feeSpacing = 1.25
+	//每个区块统计数据衰减系数
+	feeDecay = 0.998
+	//目标区块内确认的比例达到多少认为费率可用
+	feeSuccessRate = 0.85
+	//每个分组需要的最少样本
+	feeMinSamples = 1.0
+	//数据文件版本
+	feeFileVer = 1
+)
+
+//ErrFeeEstimateMiss 没有足够的数据估算交易费
+var ErrFeeEstimateMiss = errors.New("fee estimate data miss")
+
+//FeeEstimator 交易费估算器
+//记录交易池中的交易按费率分组后在多少个区块内被确认,估算在目标区块数内确认需要的费率
+type FeeEstimator struct {
+	mu      sync.RWMutex
+	buckets []Amount         //分组费率下限,升序
+	totals  []float64        //[bucket] 交易总数
+	confs   [][]float64      //[target-1][bucket] target个区块内确认的交易数
+	fails   map[HASH256]bool //已记录为未确认的交易,之后确认不再统计
+}
+
+//NewFeeEstimator 创建交易费估算器
+func NewFeeEstimator() *FeeEstimator {
+	fe := &FeeEstimator{fails: map[HASH256]bool{}}
+	for v := float64(feeMinRate); v <= float64(feeMaxRate); v *= feeSpacing {
+		//费率太低时增长后可能相同
+		if rate := Amount(v); len(fe.buckets) == 0 || rate > fe.buckets[len(fe.buckets)-1] {
+			fe.buckets = append(fe.buckets, rate)
+		}
+	}
+	fe.totals = make([]float64, len(fe.buckets))
+	fe.confs = make([][]float64, MaxFeeTarget)
+	for i := range fe.confs {
+		fe.confs[i] = make([]float64, len(fe.buckets))
+	}
+	return fe
+}
+
+//获取费率所在的分组
+func (fe *FeeEstimator) bucket(rate Amount) int {
+	for i := len(fe.buckets) - 1; i > 0; i-- {
+		if rate >= fe.buckets[i] {
+			return i
+		}
+	}
+	return 0
+}
+
+//记录一个交易在blocks个区块后确认,blocks > MaxFeeTarget 表示没有在目标内确认
+func (fe *FeeEstimator) record(blocks uint32, rate Amount) {
+	b := fe.bucket(rate)
+	fe.totals[b]++
+	for t := blocks; t <= MaxFeeTarget; t++ {
+		fe.confs[t-1][b]++
+	}
+}
+
+//ProcessBlock 区块连接时,统计区块中来自交易池的交易确认用了多少个区块
+//在交易池中等待超过 MaxFeeTarget 个区块的交易记录为未确认
+//需要在交易从交易池移除之前调用
+func (fe *FeeEstimator) ProcessBlock(pool *TxPool, blk *BlockInfo) {
+	if blk.Meta == nil {
+		return
+	}
+	height := blk.Meta.Height
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	for i := range fe.totals {
+		fe.totals[i] *= feeDecay
+		for t := range fe.confs {
+			fe.confs[t][i] *= feeDecay
+		}
+	}
+	ids := map[HASH256]bool{}
+	for _, tx := range blk.Txs {
+		id, err := tx.ID()
+		if err != nil {
+			continue
+		}
+		ids[id] = true
+		//已经记录为未确认
+		if fe.fails[id] {
+			delete(fe.fails, id)
+			continue
+		}
+		ent, has := pool.Entry(id)
+		if !has || height <= ent.Height {
+			continue
+		}
+		fe.record(height-ent.Height, ent.FeeRate())
+	}
+	//移除已经不在交易池中的记录
+	for id := range fe.fails {
+		if _, has := pool.Entry(id); !has {
+			delete(fe.fails, id)
+		}
+	}
+	for _, ent := range pool.Entries() {
+		if !ids[ent.TxID] && height > ent.Height && height-ent.Height == MaxFeeTarget+1 {
+			fe.record(MaxFeeTarget+1, ent.FeeRate())
+			fe.fails[ent.TxID] = true
+		}
+	}
+}
+
+//EstimateFee 估算在target个区块内确认需要的费率(每千字节)
+//从高费率分组开始合并统计,返回确认比例达到要求的最低分组费率
+func (fe *FeeEstimator) EstimateFee(target int) (Amount, error) {
+	if target < 1 {
+		target = 1
+	}
+	if target > MaxFeeTarget {
+		target = MaxFeeTarget
+	}
+	fe.mu.RLock()
+	defer fe.mu.RUnlock()
+	confs := fe.confs[target-1]
+	found := -1
+	total, conf := 0.0, 0.0
+	for b := len(fe.buckets) - 1; b >= 0; b-- {
+		total += fe.totals[b]
+		conf += confs[b]
+		if total < feeMinSamples {
+			continue
+		}
+		if conf/total < feeSuccessRate {
+			break
+		}
+		found = b
+		total, conf = 0, 0
+	}
+	if found < 0 {
+		return 0, ErrFeeEstimateMiss
+	}
+	return fe.buckets[found], nil
+}
+
+//EstimateTxFee 估算size字节的交易在target个区块内确认需要的交易费
+func (fe *FeeEstimator) EstimateTxFee(target int, size int) (Amount, error) {
+	rate, err := fe.EstimateFee(target)
+	if err != nil {
+		return 0, err
+	}
+	fee := rate * Amount(size) / 1000
+	if fee < feeMinRate {
+		fee = feeMinRate
+	}
+	return fee, nil
+}
+
+//Dump 保存数据到文件
+func (fe *FeeEstimator) Dump(file string) error {
+	fe.mu.RLock()
+	defer fe.mu.RUnlock()
+	w := NewWriter()
+	if err := w.TWrite(uint8(feeFileVer)); err != nil {
+		return err
+	}
+	if err := VarUInt(len(fe.buckets)).Encode(w); err != nil {
+		return err
+	}
+	if err := VarUInt(len(fe.confs)).Encode(w); err != nil {
+		return err
+	}
+	if err := w.TWrite(fe.totals); err != nil {
+		return err
+	}
+	for _, confs := range fe.confs {
+		if err := w.TWrite(confs); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(file, w.Bytes(), 0666)
+}
+
+//Load 从数据文件加载,文件不存在忽略
+func (fe *FeeEstimator) Load(file string) error {
+	bb, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	r := NewReader(bb)
+	ver := uint8(0)
+	if err := r.TRead(&ver); err != nil {
+		return err
+	}
+	if ver != feeFileVer {
+		return fmt.Errorf("fee estimate file ver %d error", ver)
+	}
+	bnum, tnum := VarUInt(0), VarUInt(0)
+	if err := bnum.Decode(r); err != nil {
+		return err
+	}
+	if err := tnum.Decode(r); err != nil {
+		return err
+	}
+	//分组改变后数据不可用
+	if bnum.ToInt() != len(fe.buckets) || tnum.ToInt() != len(fe.confs) {
+		return fmt.Errorf("fee estimate file buckets %d targets %d miss", bnum, tnum)
+	}
+	totals := make([]float64, len(fe.buckets))
+	if err := r.TRead(totals); err != nil {
+		return err
+	}
+	confs := make([][]float64, len(fe.confs))
+	for i := range confs {
+		confs[i] = make([]float64, len(fe.buckets))
+		if err := r.TRead(confs[i]); err != nil {
+			return err
+		}
+	}
+	fe.totals = totals
+	fe.confs = confs
+	return nil
+}
@@ -0,0 +1,65 @@
+package xginx
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeeEstimator(t *testing.T) {
+	fe := NewFeeEstimator()
+	_, err := fe.EstimateFee(1)
+	require.Equal(t, ErrFeeEstimateMiss, err)
+	for i := 0; i < 10; i++ {
+		//高费率1个区块内确认
+		fe.record(1, 10*Coin)
+		//中等费率3个区块内确认
+		fe.record(3, 5*Coin)
+		//低费率一直没有确认
+		fe.record(MaxFeeTarget+1, 10)
+	}
+	high, err := fe.EstimateFee(1)
+	require.NoError(t, err)
+	require.Equal(t, fe.buckets[fe.bucket(10*Coin)], high)
+	mid, err := fe.EstimateFee(3)
+	require.NoError(t, err)
+	require.Equal(t, fe.buckets[fe.bucket(5*Coin)], mid)
+	require.True(t, mid < high)
+	//超过最大目标按最大目标估算
+	low, err := fe.EstimateFee(MaxFeeTarget * 2)
+	require.NoError(t, err)
+	require.Equal(t, mid, low)
+	fee, err := fe.EstimateTxFee(1, 500)
+	require.NoError(t, err)
+	require.Equal(t, high/2, fee)
+
+	//保存后加载数据一致
+	file := NewTempDir() + FeeEstimateFile
+	defer os.Remove(file)
+	require.NoError(t, fe.Dump(file))
+	ne := NewFeeEstimator()
+	require.NoError(t, ne.Load(file))
+	v, err := ne.EstimateFee(3)
+	require.NoError(t, err)
+	require.Equal(t, mid, v)
+}
+
+func TestFeeEstimatorLateConfirm(t *testing.T) {
+	fe := NewFeeEstimator()
+	pool := NewTxPool()
+	tx := &TX{Ver: 1, Outs: []*TxOut{{Value: 1}}}
+	id := tx.MustID()
+	pool.tmap[id] = pool.tlis.PushBack(tx)
+	pool.emap[id] = TxEntry{TxID: id, Height: 1, Size: 1000, Fee: 10}
+	b := fe.bucket(10)
+	//超过最大目标记录为未确认
+	fe.ProcessBlock(pool, &BlockInfo{Meta: &TBEle{Height: MaxFeeTarget + 2}})
+	require.InDelta(t, 1.0, fe.totals[b], 0.01)
+	require.True(t, fe.fails[id])
+	//之后确认不再重复统计
+	fe.ProcessBlock(pool, &BlockInfo{Meta: &TBEle{Height: MaxFeeTarget + 3}, Txs: []*TX{tx}})
+	require.InDelta(t, 1.0, fe.totals[b], 0.01)
+	require.Equal(t, 0.0, fe.confs[MaxFeeTarget-1][b])
+	require.False(t, fe.fails[id])
+}
@@ -1,5 +1,9 @@
 package xginx
 
+import (
+	"errors"
+)
+
 //MsgFilterLoad 设置过滤器，调用后client的bloom生效
 //过滤器设置后只会提交符合条件的信息给客户端
 type MsgFilterLoad struct {
@@ -94,3 +98,348 @@ func (m MsgFilterClear) Encode(w IWriter) error {
 func (m *MsgFilterClear) Decode(r IReader) error {
 	return nil
 }
+
+//MsgMerkleBlock 发送给设置过滤器连接的区块
+//只包含匹配过滤器的交易和验证这些交易的merkle树
+type MsgMerkleBlock struct {
+	Header BlockHeader //区块头
+	Trans  VarInt      //区块交易数量
+	Hashs  []HASH256   //基于merkle树的验证hash
+	Bits   VarBytes    //
+	Txs    []*TX       //匹配的交易,和merkle树中的顺序一致
+}
+
+//NewMsgMerkleBlock 使用过滤器创建区块的merkle区块消息
+func NewMsgMerkleBlock(blk *BlockInfo, blm *BloomFilter) (*MsgMerkleBlock, error) {
+	msg := &MsgMerkleBlock{Header: blk.Header}
+	ids := []HASH256{}
+	bs := NewBitSet(len(blk.Txs))
+	for i, tx := range blk.Txs {
+		id, err := tx.ID()
+		if err != nil {
+			return nil, err
+		}
+		match, err := blm.MatchTx(tx)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			bs.Set(i)
+			msg.Txs = append(msg.Txs, tx)
+		}
+		ids = append(ids, id)
+	}
+	tree := NewMerkleTree(len(blk.Txs))
+	tree = tree.Build(ids, bs)
+	if tree.IsBad() {
+		return nil, errors.New("merkle tree bad")
+	}
+	msg.Hashs = tree.Hashs()
+	msg.Trans = VarInt(tree.Trans())
+	msg.Bits = tree.Bits().Bytes()
+	return msg, nil
+}
+
+//Type 消息类型
+func (m MsgMerkleBlock) Type() NTType {
+	return NtMerkleBlock
+}
+
+//ID 消息ID
+func (m MsgMerkleBlock) ID() (MsgID, error) {
+	return ErrMsgID, ErrNotID
+}
+
+//Verify 验证merkle树和区块头一致,并且交易和merkle树中匹配的交易一致
+func (m MsgMerkleBlock) Verify() error {
+	bits := BitSetFrom(m.Bits)
+	nt := GetMerkleTree(m.Trans.ToInt(), m.Hashs, bits)
+	merkle, ids, _ := nt.Extract()
+	if ids == nil {
+		return errors.New("merkle tree extract error")
+	}
+	if !m.Header.Merkle.Equal(merkle) {
+		return errors.New("merkle verify error")
+	}
+	if len(ids) != len(m.Txs) {
+		return errors.New("merkle txs count error")
+	}
+	for i, tx := range m.Txs {
+		id, err := tx.ID()
+		if err != nil {
+			return err
+		}
+		if !id.Equal(ids[i]) {
+			return errors.New("merkle txid not match")
+		}
+	}
+	return nil
+}
+
+//Encode 编码消息
+func (m MsgMerkleBlock) Encode(w IWriter) error {
+	if err := m.Header.Encode(w); err != nil {
+		return err
+	}
+	if err := m.Trans.Encode(w); err != nil {
+		return err
+	}
+	if err := VarInt(len(m.Hashs)).Encode(w); err != nil {
+		return err
+	}
+	for _, v := range m.Hashs {
+		if err := v.Encode(w); err != nil {
+			return err
+		}
+	}
+	if err := m.Bits.Encode(w); err != nil {
+		return err
+	}
+	if err := VarUInt(len(m.Txs)).Encode(w); err != nil {
+		return err
+	}
+	for _, tx := range m.Txs {
+		if err := tx.Encode(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Decode 解码消息
+func (m *MsgMerkleBlock) Decode(r IReader) error {
+	if err := m.Header.Decode(r); err != nil {
+		return err
+	}
+	if err := m.Trans.Decode(r); err != nil {
+		return err
+	}
+	num := VarInt(0)
+	if err := num.Decode(r); err != nil {
+		return err
+	}
+	if err := checkCount(r, uint64(num), MaxPackageSize); err != nil {
+		return err
+	}
+	m.Hashs = make([]HASH256, num.ToInt())
+	for i := range m.Hashs {
+		if err := m.Hashs[i].Decode(r); err != nil {
+			return err
+		}
+	}
+	if err := m.Bits.Decode(r); err != nil {
+		return err
+	}
+	txn := VarUInt(0)
+	if err := txn.Decode(r); err != nil {
+		return err
+	}
+	if err := checkCount(r, uint64(txn), MaxTxsCount); err != nil {
+		return err
+	}
+	m.Txs = make([]*TX, txn.ToInt())
+	for i := range m.Txs {
+		tx := &TX{}
+		if err := tx.Decode(r); err != nil {
+			return err
+		}
+		m.Txs[i] = tx
+	}
+	return nil
+}
+
+//区块过滤器每次最多获取的数量
+const (
+	MaxGetCFHeaders = 2000
+	MaxGetCFilters  = 100
+)
+
+//MsgGetCFHeaders 按高度获取区块过滤器头
+type MsgGetCFHeaders struct {
+	Start uint32 //开始高度
+	Count uint32 //获取数量
+}
+
+//Type 消息类型
+func (m MsgGetCFHeaders) Type() NTType {
+	return NtGetCFHeaders
+}
+
+//ID 消息ID
+func (m MsgGetCFHeaders) ID() (MsgID, error) {
+	return ErrMsgID, ErrNotID
+}
+
+//Encode 编码消息
+func (m MsgGetCFHeaders) Encode(w IWriter) error {
+	if err := w.TWrite(m.Start); err != nil {
+		return err
+	}
+	return w.TWrite(m.Count)
+}
+
+//Decode 解码消息
+func (m *MsgGetCFHeaders) Decode(r IReader) error {
+	if err := r.TRead(&m.Start); err != nil {
+		return err
+	}
+	return r.TRead(&m.Count)
+}
+
+//MsgCFHeaders 返回区块过滤器哈希,使用Prev可以计算出所有过滤器头
+type MsgCFHeaders struct {
+	Start uint32    //开始高度
+	Prev  HASH256   //Start之前的过滤器头
+	Hashs []HASH256 //过滤器哈希
+}
+
+//Type 消息类型
+func (m MsgCFHeaders) Type() NTType {
+	return NtCFHeaders
+}
+
+//ID 消息ID
+func (m MsgCFHeaders) ID() (MsgID, error) {
+	return ErrMsgID, ErrNotID
+}
+
+//Headers 计算过滤器头
+func (m MsgCFHeaders) Headers() []HASH256 {
+	hs := make([]HASH256, len(m.Hashs))
+	prev := m.Prev
+	for i, fh := range m.Hashs {
+		prev = CFilterHeader(fh, prev)
+		hs[i] = prev
+	}
+	return hs
+}
+
+//Encode 编码消息
+func (m MsgCFHeaders) Encode(w IWriter) error {
+	if err := w.TWrite(m.Start); err != nil {
+		return err
+	}
+	if err := m.Prev.Encode(w); err != nil {
+		return err
+	}
+	if err := VarInt(len(m.Hashs)).Encode(w); err != nil {
+		return err
+	}
+	for _, v := range m.Hashs {
+		if err := v.Encode(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Decode 解码消息
+func (m *MsgCFHeaders) Decode(r IReader) error {
+	if err := r.TRead(&m.Start); err != nil {
+		return err
+	}
+	if err := m.Prev.Decode(r); err != nil {
+		return err
+	}
+	num := VarInt(0)
+	if err := num.Decode(r); err != nil {
+		return err
+	}
+	if err := checkCount(r, uint64(num), MaxGetCFHeaders); err != nil {
+		return err
+	}
+	m.Hashs = make([]HASH256, num.ToInt())
+	for i := range m.Hashs {
+		if err := m.Hashs[i].Decode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//MsgGetCFilters 按高度获取区块过滤器
+type MsgGetCFilters struct {
+	Start uint32 //开始高度
+	Count uint32 //获取数量
+}
+
+//Type 消息类型
+func (m MsgGetCFilters) Type() NTType {
+	return NtGetCFilters
+}
+
+//ID 消息ID
+func (m MsgGetCFilters) ID() (MsgID, error) {
+	return ErrMsgID, ErrNotID
+}
+
+//Encode 编码消息
+func (m MsgGetCFilters) Encode(w IWriter) error {
+	if err := w.TWrite(m.Start); err != nil {
+		return err
+	}
+	return w.TWrite(m.Count)
+}
+
+//Decode 解码消息
+func (m *MsgGetCFilters) Decode(r IReader) error {
+	if err := r.TRead(&m.Start); err != nil {
+		return err
+	}
+	return r.TRead(&m.Count)
+}
+
+//MsgCFilters 返回区块过滤器
+type MsgCFilters struct {
+	Start   uint32 //开始高度
+	Filters []*CFilter
+}
+
+//Type 消息类型
+func (m MsgCFilters) Type() NTType {
+	return NtCFilters
+}
+
+//ID 消息ID
+func (m MsgCFilters) ID() (MsgID, error) {
+	return ErrMsgID, ErrNotID
+}
+
+//Encode 编码消息
+func (m MsgCFilters) Encode(w IWriter) error {
+	if err := w.TWrite(m.Start); err != nil {
+		return err
+	}
+	if err := VarInt(len(m.Filters)).Encode(w); err != nil {
+		return err
+	}
+	for _, cf := range m.Filters {
+		if err := cf.Encode(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Decode 解码消息
+func (m *MsgCFilters) Decode(r IReader) error {
+	if err := r.TRead(&m.Start); err != nil {
+		return err
+	}
+	num := VarInt(0)
+	if err := num.Decode(r); err != nil {
+		return err
+	}
+	if err := checkCount(r, uint64(num), MaxGetCFilters); err != nil {
+		return err
+	}
+	m.Filters = make([]*CFilter, num.ToInt())
+	for i := range m.Filters {
+		cf := &CFilter{}
+		if err := cf.Decode(r); err != nil {
+			return err
+		}
+		m.Filters[i] = cf
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+// +build gofuzz
+
+package xginx
+
+import (
+	"bytes"
+	"fmt"
+)
+
+//go-fuzz测试入口,使用 go-fuzz-build 后 go-fuzz -func FuzzXXX 运行
+
+func init() {
+	if conf == nil {
+		NewTestConfig()
+	}
+}
+
+//模糊测试消息解码,解码成功的消息重新编码后再解码必须得到相同的数据
+//返回1表示输入有效,0表示无效,不一致时panic
+func fuzzMsg(typ NTType, data []byte) int {
+	m, err := DecodeMsg(typ, data, true)
+	if err != nil {
+		return 0
+	}
+	b1, err := encodeMsg(m)
+	if err != nil {
+		return 0
+	}
+	m2, err := DecodeMsg(typ, b1, true)
+	if err != nil {
+		panic(fmt.Errorf("type=%v decode encoded error %w", typ, err))
+	}
+	b2, err := encodeMsg(m2)
+	if err != nil {
+		panic(fmt.Errorf("type=%v encode decoded error %w", typ, err))
+	}
+	if !bytes.Equal(b1, b2) {
+		panic(fmt.Errorf("type=%v encode not equal", typ))
+	}
+	return 1
+}
+
+//模糊测试网络数据包解码
+func fuzzPackage(data []byte) int {
+	pd := &NetPackage{}
+	if err := pd.Decode(NewReader(data)); err != nil {
+		return 0
+	}
+	if _, err := DecodeMsg(pd.Type, pd.Bytes, true); err != nil {
+		return 0
+	}
+	return 1
+}
+
+//FuzzPackage 网络数据包解码
+func FuzzPackage(data []byte) int {
+	return fuzzPackage(data)
+}
+
+//FuzzMsgVersion 解码MsgVersion
+func FuzzMsgVersion(data []byte) int {
+	return fuzzMsg(NtVersion, data)
+}
+
+//FuzzMsgVerAck 解码MsgVerAck
+func FuzzMsgVerAck(data []byte) int {
+	return fuzzMsg(NtVerAck, data)
+}
+
+//FuzzMsgPing 解码MsgPing
+func FuzzMsgPing(data []byte) int {
+	return fuzzMsg(NtPing, data)
+}
+
+//FuzzMsgPong 解码MsgPong
+func FuzzMsgPong(data []byte) int {
+	return fuzzMsg(NtPong, data)
+}
+
+//FuzzMsgGetAddrs 解码MsgGetAddrs
+func FuzzMsgGetAddrs(data []byte) int {
+	return fuzzMsg(NtGetAddrs, data)
+}
+
+//FuzzMsgAddrs 解码MsgAddrs
+func FuzzMsgAddrs(data []byte) int {
+	return fuzzMsg(NtAddrs, data)
+}
+
+//FuzzMsgInv 解码MsgInv
+func FuzzMsgInv(data []byte) int {
+	return fuzzMsg(NtInv, data)
+}
+
+//FuzzMsgTx 解码MsgTx
+func FuzzMsgTx(data []byte) int {
+	return fuzzMsg(NtTx, data)
+}
+
+//FuzzMsgBlock 解码MsgBlock
+func FuzzMsgBlock(data []byte) int {
+	return fuzzMsg(NtBlock, data)
+}
+
+//FuzzMsgGetInv 解码MsgGetInv
+func FuzzMsgGetInv(data []byte) int {
+	return fuzzMsg(NtGetInv, data)
+}
+
+//FuzzMsgGetBlock 解码MsgGetBlock
+func FuzzMsgGetBlock(data []byte) int {
+	return fuzzMsg(NtGetBlock, data)
+}
+
+//FuzzMsgHeaders 解码MsgHeaders
+func FuzzMsgHeaders(data []byte) int {
+	return fuzzMsg(NtHeaders, data)
+}
+
+//FuzzMsgGetHeaders 解码MsgGetHeaders
+func FuzzMsgGetHeaders(data []byte) int {
+	return fuzzMsg(NtGetHeaders, data)
+}
+
+//FuzzMsgMerkleBlock 解码MsgMerkleBlock
+func FuzzMsgMerkleBlock(data []byte) int {
+	return fuzzMsg(NtMerkleBlock, data)
+}
+
+//FuzzMsgGetCFHeaders 解码MsgGetCFHeaders
+func FuzzMsgGetCFHeaders(data []byte) int {
+	return fuzzMsg(NtGetCFHeaders, data)
+}
+
+//FuzzMsgCFHeaders 解码MsgCFHeaders
+func FuzzMsgCFHeaders(data []byte) int {
+	return fuzzMsg(NtCFHeaders, data)
+}
+
+//FuzzMsgGetCFilters 解码MsgGetCFilters
+func FuzzMsgGetCFilters(data []byte) int {
+	return fuzzMsg(NtGetCFilters, data)
+}
+
+//FuzzMsgCFilters 解码MsgCFilters
+func FuzzMsgCFilters(data []byte) int {
+	return fuzzMsg(NtCFilters, data)
+}
+
+//FuzzMsgError 解码MsgError
+func FuzzMsgError(data []byte) int {
+	return fuzzMsg(NtError, data)
+}
+
+//FuzzMsgAlert 解码MsgAlert
+func FuzzMsgAlert(data []byte) int {
+	return fuzzMsg(NtAlert, data)
+}
+
+//FuzzMsgFilterClear 解码MsgFilterClear
+func FuzzMsgFilterClear(data []byte) int {
+	return fuzzMsg(NtFilterClear, data)
+}
+
+//FuzzMsgFilterAdd 解码MsgFilterAdd
+func FuzzMsgFilterAdd(data []byte) int {
+	return fuzzMsg(NtFilterAdd, data)
+}
+
+//FuzzMsgFilterLoad 解码MsgFilterLoad
+func FuzzMsgFilterLoad(data []byte) int {
+	return fuzzMsg(NtFilterLoad, data)
+}
+
+//FuzzMsgGetMerkle 解码MsgGetMerkle
+func FuzzMsgGetMerkle(data []byte) int {
+	return fuzzMsg(NtGetMerkle, data)
+}
+
+//FuzzMsgTxMerkle 解码MsgTxMerkle
+func FuzzMsgTxMerkle(data []byte) int {
+	return fuzzMsg(NtTxMerkle, data)
+}
+
+//FuzzMsgGetTxPool 解码MsgGetTxPool
+func FuzzMsgGetTxPool(data []byte) int {
+	return fuzzMsg(NtGetTxPool, data)
+}
+
+//FuzzMsgTxPool 解码MsgTxPool
+func FuzzMsgTxPool(data []byte) int {
+	return fuzzMsg(NtTxPool, data)
+}
+
+//FuzzMsgBroadAck 解码MsgBroadAck
+func FuzzMsgBroadAck(data []byte) int {
+	return fuzzMsg(NtBroadAck, data)
+}
+
+//FuzzMsgBroadPkg 解码MsgBroadPkg
+func FuzzMsgBroadPkg(data []byte) int {
+	return fuzzMsg(NtBroadPkg, data)
+}
@@ -0,0 +1,221 @@
+package xginx
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"sort"
+)
+
+//GCS过滤器参数,和BIP158一致
+const (
+	GcsFilterP = 19
+	GcsFilterM = 784931
+)
+
+//GcsFilter Golomb编码集合过滤器
+//只保存元素哈希的差值编码,可能误判但不会漏判
+type GcsFilter struct {
+	k0   uint64 //siphash key
+	k1   uint64
+	n    uint32 //元素数量
+	data []byte //Golomb-Rice编码数据
+}
+
+//使用key前16字节作为siphash key
+func newGcsFilter(key HASH256, n uint32) *GcsFilter {
+	return &GcsFilter{
+		k0: binary.LittleEndian.Uint64(key[0:8]),
+		k1: binary.LittleEndian.Uint64(key[8:16]),
+		n:  n,
+	}
+}
+
+//NewGcsFilter 使用元素创建过滤器,重复元素只保存一次
+func NewGcsFilter(key HASH256, items [][]byte) *GcsFilter {
+	set := map[string]bool{}
+	for _, item := range items {
+		set[string(item)] = true
+	}
+	f := newGcsFilter(key, uint32(len(set)))
+	vs := make([]uint64, 0, len(set))
+	for item := range set {
+		vs = append(vs, f.hash([]byte(item)))
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		return vs[i] < vs[j]
+	})
+	w := &gcsBitWriter{}
+	last := uint64(0)
+	for _, v := range vs {
+		w.writeGolomb(v - last)
+		last = v
+	}
+	f.data = w.bytes
+	return f
+}
+
+//GcsFilterFrom 从编码数据恢复过滤器,key必须和创建时一致
+func GcsFilterFrom(key HASH256, b []byte) (*GcsFilter, error) {
+	r := NewReader(b)
+	n := VarUInt(0)
+	if err := n.Decode(r); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	f := newGcsFilter(key, n.ToUInt32())
+	f.data = data
+	return f, nil
+}
+
+//元素映射到[0,n*M)范围
+func (f *GcsFilter) hash(item []byte) uint64 {
+	hv, _ := bits.Mul64(SipHash(f.k0, f.k1, item), uint64(f.n)*GcsFilterM)
+	return hv
+}
+
+//N 元素数量
+func (f *GcsFilter) N() uint32 {
+	return f.n
+}
+
+//Bytes 编码过滤器,元素数量+编码数据
+func (f *GcsFilter) Bytes() []byte {
+	w := NewWriter()
+	if err := VarUInt(f.n).Encode(w); err != nil {
+		panic(err)
+	}
+	if err := w.WriteFull(f.data); err != nil {
+		panic(err)
+	}
+	return w.Bytes()
+}
+
+//Hash 过滤器哈希
+func (f *GcsFilter) Hash() HASH256 {
+	return Hash256From(f.Bytes())
+}
+
+//Match 检测元素是否可能在集合中
+func (f *GcsFilter) Match(item []byte) bool {
+	return f.MatchAny([][]byte{item})
+}
+
+//MatchAny 检测是否有任意一个元素可能在集合中
+func (f *GcsFilter) MatchAny(items [][]byte) bool {
+	if f.n == 0 || len(items) == 0 {
+		return false
+	}
+	vs := make([]uint64, len(items))
+	for i, item := range items {
+		vs[i] = f.hash(item)
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		return vs[i] < vs[j]
+	})
+	r := &gcsBitReader{bytes: f.data}
+	cur := uint64(0)
+	for i := uint32(0); i < f.n; i++ {
+		d, err := r.readGolomb()
+		if err != nil {
+			return false
+		}
+		cur += d
+		for len(vs) > 0 && vs[0] < cur {
+			vs = vs[1:]
+		}
+		if len(vs) == 0 {
+			return false
+		}
+		if vs[0] == cur {
+			return true
+		}
+	}
+	return false
+}
+
+//按位写入
+type gcsBitWriter struct {
+	bytes []byte
+	nbits uint8 //最后一个字节剩余可写的位数
+}
+
+func (w *gcsBitWriter) writeBit(b bool) {
+	if w.nbits == 0 {
+		w.bytes = append(w.bytes, 0)
+		w.nbits = 8
+	}
+	w.nbits--
+	if b {
+		w.bytes[len(w.bytes)-1] |= 1 << w.nbits
+	}
+}
+
+func (w *gcsBitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(v&(1<<uint(i)) != 0)
+	}
+}
+
+//商使用一元编码,余数写入低P位
+func (w *gcsBitWriter) writeGolomb(v uint64) {
+	for q := v >> GcsFilterP; q > 0; q-- {
+		w.writeBit(true)
+	}
+	w.writeBit(false)
+	w.writeBits(v, GcsFilterP)
+}
+
+//按位读取
+type gcsBitReader struct {
+	bytes []byte
+	pos   int //已经读取的位数
+}
+
+func (r *gcsBitReader) readBit() (bool, error) {
+	if r.pos >= len(r.bytes)*8 {
+		return false, io.EOF
+	}
+	b := r.bytes[r.pos/8]&(0x80>>uint(r.pos%8)) != 0
+	r.pos++
+	return b, nil
+}
+
+func (r *gcsBitReader) readBits(n int) (uint64, error) {
+	v := uint64(0)
+	for i := 0; i < n; i++ {
+		b, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v <<= 1
+		if b {
+			v |= 1
+		}
+	}
+	return v, nil
+}
+
+//数据读完时返回io.EOF
+func (r *gcsBitReader) readGolomb() (uint64, error) {
+	q := uint64(0)
+	for {
+		b, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !b {
+			break
+		}
+		q++
+	}
+	v, err := r.readBits(GcsFilterP)
+	if err != nil {
+		return 0, err
+	}
+	return q<<GcsFilterP | v, nil
+}
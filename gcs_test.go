@@ -0,0 +1,117 @@
+package xginx
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestGcsFilter(t *testing.T) {
+	key := Hash256From([]byte("gcs key"))
+	items := [][]byte{}
+	for i := 0; i < 200; i++ {
+		items = append(items, []byte(fmt.Sprintf("item%d", i)))
+	}
+	//重复元素只保存一次
+	f := NewGcsFilter(key, append(items, items[0]))
+	if f.N() != uint32(len(items)) {
+		t.Fatalf("filter n %d error", f.N())
+	}
+	nf, err := GcsFilterFrom(key, f.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nf.Hash().Equal(f.Hash()) {
+		t.Fatal("filter decode hash error")
+	}
+	for _, item := range items {
+		if !nf.Match(item) {
+			t.Fatalf("item %s miss", item)
+		}
+	}
+	miss := 0
+	for i := 0; i < 1000; i++ {
+		if nf.Match([]byte(fmt.Sprintf("other%d", i))) {
+			miss++
+		}
+	}
+	if miss > 1 {
+		t.Fatalf("false positive %d too many", miss)
+	}
+	if !nf.MatchAny([][]byte{[]byte("other"), items[100]}) {
+		t.Fatal("match any miss")
+	}
+	//不同的key不能匹配
+	kf, err := GcsFilterFrom(Hash256From([]byte("other key")), f.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kf.MatchAny(items[:10]) {
+		t.Fatal("other key match")
+	}
+	//空集合
+	ef := NewGcsFilter(key, nil)
+	if ef.Match(items[0]) {
+		t.Fatal("empty filter match")
+	}
+	if _, err := GcsFilterFrom(key, ef.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (suite *BlockTestSuite) TestCFilter() {
+	req := suite.Require()
+	bi := suite.bi
+	bv := bi.GetBestValue()
+	pkh, err := GetTestListener(bi).MinerAddr().GetPkh()
+	req.NoError(err)
+	//过滤器头链接到第一个区块
+	prev := ZERO256
+	for h := uint32(0); h <= bv.Height; h++ {
+		cf, err := bi.LoadCFilter(h)
+		req.NoError(err)
+		req.NoError(cf.Check(prev))
+		prev = cf.Header
+	}
+	cf, err := bi.LoadCFilter(bv.Height)
+	req.NoError(err)
+	req.Equal(bv.ID, cf.BlkID)
+	match, err := cf.MatchAny(pkh[:])
+	req.NoError(err)
+	req.True(match)
+	match, err = cf.MatchAny(ZERO160[:])
+	req.NoError(err)
+	req.False(match)
+	//之前的过滤器不存在时连接区块不保存,由后台任务补全
+	blk, err := bi.LoadBlock(bv.ID)
+	req.NoError(err)
+	req.NoError(bi.UnlinkLast())
+	_, err = bi.LoadCFilter(bv.Height)
+	req.Error(err)
+	req.NoError(bi.blkdb.Index().Del(CFilterPrefix, EndianUInt32(bv.Height-1)))
+	req.NoError(bi.LinkBlk(blk))
+	_, err = bi.LoadCFilter(bv.Height)
+	req.Error(err)
+	req.NoError(bi.backfillCFilters(context.Background()))
+	nf, err := bi.LoadCFilter(bv.Height)
+	req.NoError(err)
+	req.Equal(cf.Header, nf.Header)
+	//按高度获取
+	hsg, err := bi.NewMsgCFHeaders(&MsgGetCFHeaders{Start: bv.Height - 9, Count: 20})
+	req.NoError(err)
+	w := NewWriter()
+	req.NoError(hsg.Encode(w))
+	hsg = &MsgCFHeaders{}
+	req.NoError(hsg.Decode(NewReader(w.Bytes())))
+	hs := hsg.Headers()
+	req.Equal(10, len(hs))
+	req.Equal(cf.Header, hs[9])
+	fsg := bi.NewMsgCFilters(&MsgGetCFilters{Start: bv.Height - 1, Count: 20})
+	w = NewWriter()
+	req.NoError(fsg.Encode(w))
+	fsg = &MsgCFilters{}
+	req.NoError(fsg.Decode(NewReader(w.Bytes())))
+	req.Equal(2, len(fsg.Filters))
+	req.NoError(fsg.Filters[1].Check(fsg.Filters[0].Header))
+	req.Equal(cf.Header, fsg.Filters[1].Header)
+}
@@ -7,6 +7,7 @@ require (
 	github.com/cxuhua/handler v0.2.8
 	github.com/cxuhua/lzma v0.1.2
 	github.com/functionalfoundry/graphqlws v0.0.0-20200611113535-7bc58903ce7b
+	github.com/golang/snappy v0.0.1
 	github.com/graphql-go/graphql v0.7.9
 	github.com/hashicorp/golang-lru v0.5.4
 	github.com/mgutz/ansi v0.0.0-20200706080929-d51e80ef957d // indirect
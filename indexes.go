@@ -0,0 +1,623 @@
+package xginx
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+//可选索引名称
+const (
+	//TxIndexName 交易所在区块索引,关闭后只保留还有未消费输出的交易
+	TxIndexName = "txindex"
+	//AddrIndexName 账户相关交易索引
+	AddrIndexName = "addrindex"
+)
+
+var (
+	//ErrIndexDisabled 索引没有启用
+	ErrIndexDisabled = errors.New("index disabled")
+	//ErrIndexSyncing 索引正在建立
+	ErrIndexSyncing = errors.New("index syncing")
+)
+
+//重建和删除索引时每次写入的数量
+const indexBatchNum = 10000
+
+//IsIndexEnable 索引是否启用
+func (c *Config) IsIndexEnable(name string) bool {
+	switch name {
+	case TxIndexName:
+		return !c.NoTxIndex
+	case AddrIndexName:
+		return !c.NoAddrIndex
+	}
+	return false
+}
+
+//IndexStatus 索引状态
+type IndexStatus struct {
+	Name   string //索引名称
+	Enable bool   //配置是否启用
+	Synced bool   //是否和主链同步
+	Height uint32 //已经建立索引的高度,InvalidHeight表示没有
+	Best   uint32 //主链高度
+}
+
+//索引状态key,不存在时索引和主链同步
+func indexKey(name string) []byte {
+	return GetDBKey(IndexPrefix, []byte(name))
+}
+
+//索引后台建立和删除
+type indexer struct {
+	mu     sync.Mutex //写入区块和修改索引状态时锁定
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+}
+
+func (idx *indexer) start(bi *BlockIndex) {
+	ctx, cancel := context.WithCancel(context.Background())
+	idx.cancel = cancel
+	idx.wg.Add(1)
+	go func() {
+		defer idx.wg.Done()
+		bi.syncIndexes(ctx)
+		bi.backfillStates(ctx)
+	}()
+}
+
+func (idx *indexer) stop() {
+	if idx.cancel != nil {
+		idx.cancel()
+	}
+	idx.wg.Wait()
+}
+
+//获取索引已经建立的高度,和主链同步时返回true
+func (bi *BlockIndex) indexState(name string) (uint32, bool, error) {
+	db := bi.blkdb.Index()
+	key := indexKey(name)
+	if has, err := db.Has(key); err != nil {
+		return InvalidHeight, false, err
+	} else if !has {
+		return InvalidHeight, true, nil
+	}
+	vb, err := db.Get(key)
+	if err != nil {
+		return InvalidHeight, false, err
+	}
+	if len(vb) != 4 {
+		return InvalidHeight, false, fmt.Errorf("index %s state error", name)
+	}
+	return binary.BigEndian.Uint32(vb), false, nil
+}
+
+//GetIndexStatus 获取索引状态
+func (bi *BlockIndex) GetIndexStatus(name string) (IndexStatus, error) {
+	is := IndexStatus{Name: name, Enable: conf.IsIndexEnable(name), Best: bi.BestHeight()}
+	h, synced, err := bi.indexState(name)
+	if err != nil {
+		return is, err
+	}
+	is.Height, is.Synced = h, synced
+	if synced {
+		is.Height = is.Best
+	}
+	return is, nil
+}
+
+//CheckIndex 检查索引是否可用
+func (bi *BlockIndex) CheckIndex(name string) error {
+	if !conf.IsIndexEnable(name) {
+		return fmt.Errorf("%w %s", ErrIndexDisabled, name)
+	}
+	is, err := bi.GetIndexStatus(name)
+	if err != nil {
+		return err
+	}
+	if !is.Synced {
+		return fmt.Errorf("%w %s height %d best %d", ErrIndexSyncing, name, int32(is.Height), is.Best)
+	}
+	return nil
+}
+
+//连接区块时检查是否需要写入索引,并更新索引状态
+func (bi *BlockIndex) linkIndex(bt *Batch, name string, height uint32) (bool, error) {
+	h, synced, err := bi.indexState(name)
+	if err != nil {
+		return false, err
+	}
+	key := indexKey(name)
+	if conf.IsIndexEnable(name) {
+		if synced {
+			return true, nil
+		}
+		//正好追上主链,删除状态
+		if h+1 == height {
+			bt.Del(key)
+			bt.GetRev().Put(key, EndianUInt32(h))
+			return true, nil
+		}
+		return false, nil
+	}
+	//关闭后记录索引完成的高度,断开区块时恢复为同步状态
+	if synced {
+		bt.GetBatch().Put(key, EndianUInt32(height-1))
+		bt.GetRev().Del(key)
+	}
+	return false, nil
+}
+
+//断开区块时修正索引状态,删除区块的索引并恢复被删除的交易索引
+//后台建立的索引不在回退日志中,需要根据区块数据删除
+//bt为区块回退日志
+func (bi *BlockIndex) unlinkIndex(blk *BlockInfo, bt *Batch) error {
+	height := blk.Meta.Height
+	for _, name := range []string{TxIndexName, AddrIndexName} {
+		h, synced, err := bi.indexState(name)
+		if err != nil {
+			return err
+		}
+		if !synced && h != InvalidHeight && h >= height {
+			bt.Put(indexKey(name), EndianUInt32(height-1))
+		}
+	}
+	//回退日志恢复的金额
+	rc := &revcoins{}
+	if err := bt.GetBatch().Replay(rc); err != nil {
+		return err
+	}
+	//输出对应的账户
+	pkhs := map[string]HASH160{}
+	for _, ckv := range rc.coins {
+		pkhs[coinOutKey(ckv.TxID, ckv.Index)] = ckv.CPkh
+	}
+	hb := blk.EndianHeight()
+	for _, tx := range blk.Txs {
+		id, err := tx.ID()
+		if err != nil {
+			return err
+		}
+		for idx, out := range tx.Outs {
+			pkh, err := out.Script.GetPkh()
+			if err != nil {
+				return err
+			}
+			pkhs[coinOutKey(id, VarUInt(idx))] = pkh
+		}
+	}
+	for _, tx := range blk.Txs {
+		id, err := tx.ID()
+		if err != nil {
+			return err
+		}
+		bt.Del(TxsPrefix, id[:])
+		vps := map[HASH160]bool{}
+		for _, in := range tx.Ins {
+			if pkh, has := pkhs[coinOutKey(in.OutHash, in.OutIndex)]; has {
+				vps[pkh] = true
+			}
+		}
+		for idx := range tx.Outs {
+			vps[pkhs[coinOutKey(id, VarUInt(idx))]] = true
+		}
+		for pkh := range vps {
+			bt.Del(TxpPrefix, pkh[:], hb, id[:])
+		}
+	}
+	if _, synced, err := bi.indexState(TxIndexName); err != nil || synced {
+		return err
+	}
+	db := bi.blkdb.Index()
+	for _, ckv := range rc.coins {
+		if ckv.Height.ToUInt32() >= height {
+			continue
+		}
+		if has, err := db.Has(TxsPrefix, ckv.TxID[:]); err != nil {
+			return err
+		} else if has {
+			continue
+		}
+		ele := bi.gethele(ckv.Height.ToUInt32())
+		if ele == nil {
+			return fmt.Errorf("coin %s height %d block miss", ckv.ID(), ckv.Height)
+		}
+		id, err := ele.ID()
+		if err != nil {
+			return err
+		}
+		blk, err := bi.loadblock(id)
+		if err != nil {
+			return err
+		}
+		vbys, err := blk.txValueBytes(ckv.TxID)
+		if err != nil {
+			return err
+		}
+		bt.Put(TxsPrefix, ckv.TxID[:], vbys)
+	}
+	return nil
+}
+
+//获取回退日志中恢复的金额
+type revcoins struct {
+	coins []*CoinKeyValue
+}
+
+func (rc *revcoins) Put(k, v []byte) {
+	if len(k) == 0 || k[0] != CoinsPrefix[0] {
+		return
+	}
+	ckv := &CoinKeyValue{}
+	if err := ckv.From(k, v); err != nil {
+		LogError("rev coin decode error", err)
+		return
+	}
+	rc.coins = append(rc.coins, ckv)
+}
+
+func (rc *revcoins) Delete(k []byte) {
+
+}
+
+//获取交易在区块中的位置数据
+func (blk *BlockInfo) txValueBytes(txid HASH256) ([]byte, error) {
+	bid, err := blk.ID()
+	if err != nil {
+		return nil, err
+	}
+	for idx, tx := range blk.Txs {
+		id, err := tx.ID()
+		if err != nil {
+			return nil, err
+		}
+		if id.Equal(txid) {
+			return TxValue{BlkID: bid, TxIdx: VarUInt(idx)}.Bytes()
+		}
+	}
+	return nil, fmt.Errorf("tx %v not in block %v", txid, bid)
+}
+
+//获取交易未消费的输出数量,没有记录返回false
+func (bi *BlockIndex) txUnspent(id HASH256) ([]byte, bool, error) {
+	db := bi.blkdb.Index()
+	if has, err := db.Has(TxuPrefix, id[:]); err != nil || !has {
+		return nil, false, err
+	}
+	vb, err := db.Get(TxuPrefix, id[:])
+	if err != nil {
+		return nil, false, err
+	}
+	if len(vb) != 4 {
+		return nil, false, fmt.Errorf("tx %v unspent count error", id)
+	}
+	return vb, true, nil
+}
+
+//查询交易还未消费的输出数量,升级前没有记录时使用
+//spent为本区块消费的输出
+func (bi *BlockIndex) scanTxUnspent(id HASH256, spent map[string]bool) (uint32, error) {
+	db := bi.blkdb.Index()
+	tx, err := bi.LoadTX(id)
+	if err != nil {
+		return 0, err
+	}
+	num := uint32(0)
+	for idx, out := range tx.Outs {
+		if spent[coinOutKey(id, VarUInt(idx))] {
+			continue
+		}
+		pkh, err := out.Script.GetPkh()
+		if err != nil {
+			return 0, err
+		}
+		ckv := CoinKeyValue{CPkh: pkh, TxID: id, Index: VarUInt(idx)}
+		if has, err := db.Has(ckv.MustKey()); err != nil {
+			return 0, err
+		} else if has {
+			num++
+		}
+	}
+	return num, nil
+}
+
+//不保存完整交易索引时,删除输出都已经被消费的交易索引
+//每个交易记录未消费的输出数量,消费时减少,为0时删除
+//断开区块时交易索引会根据恢复的金额重新写入,输出数量由回退日志恢复
+func (blk *BlockInfo) pruneTxsIdx(bi *BlockIndex, bt *Batch) error {
+	rt := bt.GetRev()
+	if rt == nil {
+		return fmt.Errorf("batch miss rev")
+	}
+	btxs := map[HASH256]*TX{}
+	//本区块消费的输出
+	spent := map[string]bool{}
+	//被引用的交易和消费的输出数量
+	refs := map[HASH256]uint32{}
+	for _, tx := range blk.Txs {
+		id, err := tx.ID()
+		if err != nil {
+			return err
+		}
+		btxs[id] = tx
+		for _, in := range tx.Ins {
+			if in.IsCoinBase() {
+				continue
+			}
+			spent[coinOutKey(in.OutHash, in.OutIndex)] = true
+			refs[in.OutHash]++
+		}
+	}
+	//本区块中创建的交易
+	for id, tx := range btxs {
+		num := uint32(len(tx.Outs)) - refs[id]
+		if num == 0 {
+			bt.Del(TxsPrefix, id[:])
+		} else {
+			bt.Put(TxuPrefix, id[:], EndianUInt32(num))
+		}
+	}
+	for id, sn := range refs {
+		if _, inblk := btxs[id]; inblk {
+			continue
+		}
+		vb, has, err := bi.txUnspent(id)
+		if err != nil {
+			return err
+		}
+		num := uint32(0)
+		if has {
+			if cv := binary.BigEndian.Uint32(vb); cv > sn {
+				num = cv - sn
+			}
+		} else if num, err = bi.scanTxUnspent(id, spent); err != nil {
+			return err
+		}
+		if num == 0 {
+			bt.Del(TxsPrefix, id[:])
+			bt.Del(TxuPrefix, id[:])
+		} else {
+			bt.Put(TxuPrefix, id[:], EndianUInt32(num))
+		}
+		//Put会先写入删除回退,原来的数量需要在之后恢复
+		if has {
+			rt.Put(TxuPrefix, id[:], vb)
+		}
+	}
+	return nil
+}
+
+//获取交易相关的账户
+func (tx *TX) getPkhs(bi *BlockIndex, vps map[HASH160]bool) error {
+	for _, in := range tx.Ins {
+		if in.IsCoinBase() {
+			continue
+		}
+		out, err := in.LoadTxOut(bi)
+		if err != nil {
+			return err
+		}
+		pkh, err := out.Script.GetPkh()
+		if err != nil {
+			return err
+		}
+		vps[pkh] = true
+	}
+	for _, out := range tx.Outs {
+		pkh, err := out.Script.GetPkh()
+		if err != nil {
+			return err
+		}
+		vps[pkh] = true
+	}
+	return nil
+}
+
+//建立一个区块的索引,返回false表示已经和主链同步
+func (bi *BlockIndex) buildIndexStep(name string) (bool, error) {
+	bi.idx.mu.Lock()
+	defer bi.idx.mu.Unlock()
+	h, synced, err := bi.indexState(name)
+	if err != nil || synced {
+		return false, err
+	}
+	next := h + 1
+	bi.rwm.RLock()
+	ele := bi.gethele(next)
+	bi.rwm.RUnlock()
+	if ele == nil {
+		return false, fmt.Errorf("index %s height %d block miss", name, next)
+	}
+	id, err := ele.ID()
+	if err != nil {
+		return false, err
+	}
+	blk, err := bi.LoadBlock(id)
+	if err != nil {
+		return false, err
+	}
+	db := bi.blkdb.Index()
+	bt := db.NewBatch()
+	hb := EndianUInt32(next)
+	for idx, tx := range blk.Txs {
+		tid, err := tx.ID()
+		if err != nil {
+			return false, err
+		}
+		vbys, err := TxValue{BlkID: id, TxIdx: VarUInt(idx)}.Bytes()
+		if err != nil {
+			return false, err
+		}
+		if name == TxIndexName {
+			bt.Put(TxsPrefix, tid[:], vbys)
+			continue
+		}
+		vps := map[HASH160]bool{}
+		if err := tx.getPkhs(bi, vps); err != nil {
+			return false, err
+		}
+		for pkh := range vps {
+			bt.Put(TxpPrefix, pkh[:], hb, tid[:], vbys)
+		}
+	}
+	bi.rwm.RLock()
+	defer bi.rwm.RUnlock()
+	//建立期间区块可能被断开
+	if cele := bi.gethele(next); cele == nil || !cele.Hash().Equal(ele.Hash()) {
+		return true, nil
+	}
+	if ch, _, err := bi.indexState(name); err != nil || ch != h {
+		return true, err
+	}
+	if next == bi.lastHeight() {
+		bt.Del(indexKey(name))
+	} else {
+		bt.Put(indexKey(name), EndianUInt32(next))
+	}
+	return next != bi.lastHeight(), db.Write(bt)
+}
+
+//BuildIndex 建立索引直到和主链同步,fn进度回调 0-100
+func (bi *BlockIndex) BuildIndex(ctx context.Context, name string, fn func(pv uint)) error {
+	if !conf.IsIndexEnable(name) {
+		return fmt.Errorf("%w %s", ErrIndexDisabled, name)
+	}
+	//账户索引需要查找输入引用的交易
+	if name == AddrIndexName {
+		if _, synced, err := bi.indexState(TxIndexName); err != nil {
+			return err
+		} else if !synced {
+			return fmt.Errorf("build %s need %s synced", name, TxIndexName)
+		}
+	}
+	h, _, err := bi.indexState(name)
+	if err != nil {
+		return err
+	}
+	pg := &progress{fn: fn, total: int(bi.Height() - h)}
+	for i := 1; ; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		more, err := bi.buildIndexStep(name)
+		if err != nil {
+			return err
+		}
+		if !more {
+			break
+		}
+		pg.step(i)
+	}
+	LogInfof("index %s build finished", name)
+	return nil
+}
+
+//DropIndex 删除索引数据,交易索引只保留还有未消费输出的交易
+//删除期间区块不能写入
+func (bi *BlockIndex) DropIndex(name string) error {
+	if conf.IsIndexEnable(name) {
+		return fmt.Errorf("index %s enabled, can't drop", name)
+	}
+	bi.idx.mu.Lock()
+	defer bi.idx.mu.Unlock()
+	bi.rwm.RLock()
+	defer bi.rwm.RUnlock()
+	db := bi.blkdb.Index()
+	prefixes := [][]byte{TxpPrefix}
+	//还有未消费输出的交易和未消费的输出数量
+	keep := map[HASH256]uint32{}
+	if name == TxIndexName {
+		prefixes = [][]byte{TxsPrefix, TxuPrefix}
+		iter := db.Iterator(NewPrefix(CoinsPrefix))
+		for iter.Next() {
+			ckv := &CoinKeyValue{}
+			if err := ckv.From(iter.Key(), iter.Value()); err != nil {
+				iter.Close()
+				return err
+			}
+			keep[ckv.TxID]++
+		}
+		iter.Close()
+	}
+	bt := db.NewBatch()
+	flush := func() error {
+		if bt.Len() < indexBatchNum {
+			return nil
+		}
+		if err := db.Write(bt); err != nil {
+			return err
+		}
+		bt.Reset()
+		return nil
+	}
+	for _, prefix := range prefixes {
+		iter := db.Iterator(NewPrefix(prefix))
+		for iter.Next() {
+			key := iter.Key()
+			if prefix[0] == TxsPrefix[0] && keep[NewHASH256(key[len(prefix):])] > 0 {
+				continue
+			}
+			bt.Del(append([]byte{}, key...))
+			if err := flush(); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		iter.Close()
+	}
+	//重新记录交易未消费的输出数量
+	for id, num := range keep {
+		bt.Put(TxuPrefix, id[:], EndianUInt32(num))
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	bt.Put(indexKey(name), EndianUInt32(InvalidHeight))
+	if err := db.Write(bt); err != nil {
+		return err
+	}
+	LogInfof("index %s dropped", name)
+	return nil
+}
+
+//补全升级前连接的区块没有保存的状态数据
+func (bi *BlockIndex) backfillStates(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+	if err := bi.backfillMuHash(); err != nil {
+		LogError("backfill utxo hash error", err)
+	}
+	if err := bi.backfillCFilters(ctx); err != nil && err != context.Canceled {
+		LogError("backfill block filter error", err)
+	}
+}
+
+//根据配置建立或者删除索引
+func (bi *BlockIndex) syncIndexes(ctx context.Context) {
+	for _, name := range []string{TxIndexName, AddrIndexName} {
+		h, synced, err := bi.indexState(name)
+		if err != nil {
+			LogError("get index state error", name, err)
+			continue
+		}
+		if conf.IsIndexEnable(name) && !synced {
+			err = bi.BuildIndex(ctx, name, func(pv uint) {
+				LogInfof("build index %s progress = %d%%", name, pv)
+			})
+		} else if !conf.IsIndexEnable(name) && (synced || h != InvalidHeight) {
+			err = bi.DropIndex(name)
+		}
+		if err == context.Canceled {
+			return
+		}
+		if err != nil {
+			LogError("sync index error", name, err)
+		}
+	}
+}
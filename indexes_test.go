@@ -0,0 +1,171 @@
+package xginx
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+func (suite *BlockTestSuite) TestOptionalIndexes() {
+	req := suite.Require()
+	bi := suite.bi
+	defer func() {
+		conf.NoTxIndex = false
+		conf.NoAddrIndex = false
+	}()
+	a := GetTestListener(bi).GetAccount(0)
+	aaddr, err := a.GetAddress()
+	req.NoError(err)
+
+	//关闭账户索引
+	conf.NoAddrIndex = true
+	_, err = bi.ListTxs(aaddr)
+	req.True(errors.Is(err, ErrIndexDisabled))
+	req.NoError(bi.DropIndex(AddrIndexName))
+	is, err := bi.GetIndexStatus(AddrIndexName)
+	req.NoError(err)
+	req.False(is.Synced)
+	req.Equal(InvalidHeight, is.Height)
+	//重新启用后建立索引
+	conf.NoAddrIndex = false
+	_, err = bi.ListTxs(aaddr)
+	req.True(errors.Is(err, ErrIndexSyncing))
+	req.NoError(bi.BuildIndex(context.Background(), AddrIndexName, nil))
+	req.NoError(bi.CheckIndex(AddrIndexName))
+	txs, err := bi.ListTxs(aaddr)
+	req.NoError(err)
+	req.True(len(txs) > 0)
+	req.NoError(bi.VerifyChain(nil))
+
+	//关闭完整交易索引后消费完的交易索引被删除
+	conf.NoTxIndex = true
+	coins, err := bi.ListCoins(aaddr)
+	req.NoError(err)
+	//使用只有一个输出的交易
+	var coin *CoinKeyValue
+	for _, ckv := range coins.Coins {
+		otx, err := bi.LoadTX(ckv.TxID)
+		req.NoError(err)
+		if len(otx.Outs) == 1 {
+			coin = ckv
+			break
+		}
+	}
+	req.NotNil(coin)
+	tx := NewTx(DefaultExeLimit, DefaultTxScript)
+	in, err := coin.NewTxIn(a.NewWitnessScript(DefaultInputScript))
+	req.NoError(err)
+	tx.Ins = append(tx.Ins, in)
+	out, err := aaddr.NewTxOut(coin.Value, nil, DefaultLockedScript)
+	req.NoError(err)
+	tx.Outs = append(tx.Outs, out)
+	req.NoError(tx.Sign(bi, newaccsigner(a)))
+	req.NoError(bi.GetTxPool().PushTx(bi, tx))
+	req.NoError(NewTestOneBlock())
+	_, err = bi.LoadTxValue(coin.TxID)
+	req.True(errors.Is(err, ErrIndexDisabled))
+	_, err = bi.LoadTxValue(tx.MustID())
+	req.NoError(err)
+	is, err = bi.GetIndexStatus(TxIndexName)
+	req.NoError(err)
+	req.Equal(is.Best-1, is.Height)
+	req.NoError(bi.VerifyChain(nil))
+	//断开区块后恢复
+	req.NoError(bi.UnlinkLast())
+	is, err = bi.GetIndexStatus(TxIndexName)
+	req.NoError(err)
+	req.True(is.Synced)
+	bi.GetTxPool().Del(bi, tx.MustID())
+	_, err = bi.LoadTxValue(coin.TxID)
+	req.NoError(err)
+	req.NoError(bi.DropIndex(TxIndexName))
+	req.NoError(bi.VerifyChain(nil))
+	//重新建立完整索引
+	conf.NoTxIndex = false
+	req.NoError(bi.BuildIndex(context.Background(), TxIndexName, nil))
+	req.NoError(bi.CheckIndex(TxIndexName))
+	req.NoError(bi.VerifyChain(nil))
+}
+
+//不保存完整交易索引时,断开消费了交易的区块恢复交易索引,重新连接后再次删除
+func (suite *BlockTestSuite) TestPrunedTxsReorg() {
+	req := suite.Require()
+	genesis, err := suite.bi.LoadBlock(conf.genesis)
+	req.NoError(err)
+	sn, err := NewSimNet(1, genesis)
+	req.NoError(err)
+	defer sn.Close()
+	defer func() {
+		conf.NoTxIndex = false
+	}()
+	n := sn.Nodes[0]
+	bi := n.BlockIndex()
+	db := bi.blkdb.Index()
+	_, err = n.Mine(CoinbaseMaturity + 1)
+	req.NoError(err)
+	conf.NoTxIndex = true
+	req.NoError(bi.DropIndex(TxIndexName))
+	a := n.Listener().GetAccount(0)
+	aaddr, err := a.GetAddress()
+	req.NoError(err)
+	coins, err := bi.ListCoins(aaddr)
+	req.NoError(err)
+	coin := coins.Coins[0]
+	otx, err := bi.LoadTX(coin.TxID)
+	req.NoError(err)
+	req.Equal(1, len(otx.Outs))
+	has, err := db.Has(TxuPrefix, coin.TxID[:])
+	req.NoError(err)
+	req.True(has)
+	//消费交易唯一的输出
+	tx := NewTx(DefaultExeLimit, DefaultTxScript)
+	in, err := coin.NewTxIn(a.NewWitnessScript(DefaultInputScript))
+	req.NoError(err)
+	tx.Ins = append(tx.Ins, in)
+	out, err := aaddr.NewTxOut(coin.Value, nil, DefaultLockedScript)
+	req.NoError(err)
+	tx.Outs = append(tx.Outs, out)
+	req.NoError(tx.Sign(bi, newaccsigner(a)))
+	lis := n.Listener()
+	lis.SetTime(bi.Time())
+	lis.AddTime(time.Second)
+	blk, err := bi.NewBlock(1)
+	req.NoError(err)
+	req.NoError(blk.Finish(bi))
+	blk.Txs = append(blk.Txs, tx)
+	blk.ResetHasher()
+	req.NoError(blk.SetMerkle())
+	calcbits(bi, blk)
+	req.NoError(bi.LinkBlk(blk))
+	pruned := func() {
+		has, err := db.Has(TxsPrefix, coin.TxID[:])
+		req.NoError(err)
+		req.False(has)
+		has, err = db.Has(TxuPrefix, coin.TxID[:])
+		req.NoError(err)
+		req.False(has)
+		id := tx.MustID()
+		vb, err := db.Get(TxuPrefix, id[:])
+		req.NoError(err)
+		req.Equal(EndianUInt32(1), vb)
+	}
+	pruned()
+	//断开后交易索引和未消费数量恢复
+	req.NoError(bi.UnlinkLast())
+	txv, err := bi.LoadTxValue(coin.TxID)
+	req.NoError(err)
+	cblk, err := bi.LoadBlock(txv.BlkID)
+	req.NoError(err)
+	req.Equal(coin.Height.ToUInt32(), cblk.Meta.Height)
+	vb, err := db.Get(TxuPrefix, coin.TxID[:])
+	req.NoError(err)
+	req.Equal(EndianUInt32(1), vb)
+	id := tx.MustID()
+	has, err = db.Has(TxuPrefix, id[:])
+	req.NoError(err)
+	req.False(has)
+	//重新连接后再次删除
+	req.NoError(bi.LinkBlk(blk))
+	pruned()
+	req.NoError(bi.VerifyChain(nil))
+}
@@ -0,0 +1,179 @@
+package xginx
+
+import (
+	"sync"
+	"time"
+)
+
+//库存通报参数
+const (
+	//每个连接记录的最多已知库存
+	MaxKnownInv = 10000
+	//每个通报消息最多包含的库存
+	MaxInvBatch = 1000
+	//通报随机延迟范围(毫秒),多个交易合并后一起通报
+	InvTrickleMin = 100
+	InvTrickleMax = 2000
+	//请求库存超时,超时后才会向其他连接请求相同的库存
+	InvRequestTimeout = time.Second * 30
+)
+
+//已知库存集合,超过容量时删除最早加入的
+type invSet struct {
+	mu   sync.Mutex
+	ids  map[HASH256]bool
+	ring []HASH256
+	pos  int
+}
+
+func newInvSet(max int) *invSet {
+	return &invSet{
+		ids:  map[HASH256]bool{},
+		ring: make([]HASH256, 0, max),
+	}
+}
+
+//Add 加入库存
+func (s *invSet) Add(id HASH256) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids[id] {
+		return
+	}
+	if len(s.ring) < cap(s.ring) {
+		s.ring = append(s.ring, id)
+	} else {
+		delete(s.ids, s.ring[s.pos])
+		s.ring[s.pos] = id
+		s.pos = (s.pos + 1) % len(s.ring)
+	}
+	s.ids[id] = true
+}
+
+//Has 是否已知
+func (s *invSet) Has(id HASH256) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ids[id]
+}
+
+//Len 库存数量
+func (s *invSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ids)
+}
+
+//KnownInv 记录对方已经有的库存,不会再通报给对方
+func (c *Client) KnownInv(id HASH256) {
+	c.known.Add(id)
+}
+
+//HasInv 对方是否已经有库存
+func (c *Client) HasInv(id HASH256) bool {
+	return c.known.Has(id)
+}
+
+//QueueInv 加入等待通报的库存,随机延迟后和其他库存一起通报
+func (c *Client) QueueInv(typ uint8, id HASH256) {
+	if c.HasInv(id) {
+		return
+	}
+	c.invmu.Lock()
+	defer c.invmu.Unlock()
+	c.invq = append(c.invq, Inventory{InvType: typ, InvID: id})
+	if !c.itset {
+		c.itset = true
+		c.it.Reset(time.Millisecond * time.Duration(Rand(InvTrickleMin, InvTrickleMax)))
+	}
+}
+
+//发送等待通报的库存,在连接的写线程中直接写入
+func (c *Client) flushInv() error {
+	c.invmu.Lock()
+	invs := c.invq
+	c.invq = nil
+	c.itset = false
+	c.invmu.Unlock()
+	msg := &MsgInv{}
+	for i, inv := range invs {
+		//等待期间可能已经从对方收到
+		if !c.HasInv(inv.InvID) {
+			c.KnownInv(inv.InvID)
+			msg.AddInv(inv.InvType, inv.InvID)
+		}
+		if len(msg.Invs) == 0 || (len(msg.Invs) < MaxInvBatch && i < len(invs)-1) {
+			continue
+		}
+		if err := c.WriteMsg(msg); err != nil {
+			return err
+		}
+		msg = &MsgInv{}
+	}
+	return nil
+}
+
+//RelayTx 通报交易给周围的连接,不包括skips
+//设置过滤器的连接直接发送匹配的交易,其他连接只通报库存,对方请求时才发送交易
+//旧版本节点不支持库存通报,直接发送交易
+func (s *TCPServer) RelayTx(tx *TX, skips ...*Client) int {
+	id, err := tx.ID()
+	if err != nil {
+		LogError("relay tx id error", err)
+		return 0
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	count := 0
+	for _, c := range s.cls {
+		skip := false
+		for _, cc := range skips {
+			skip = skip || cc.Equal(c)
+		}
+		if skip || c.HasInv(id) {
+			continue
+		}
+		if fm, ok := c.FilterMsg(NewMsgTx(tx)); ok {
+			if fm != nil {
+				c.KnownInv(id)
+				c.SendMsg(fm)
+				count++
+			}
+			continue
+		}
+		//旧版本节点不支持库存通报,直接发送交易
+		if !c.IsSupportMsg(NtInv) {
+			c.KnownInv(id)
+			c.SendMsg(NewMsgTx(tx))
+			count++
+			continue
+		}
+		c.QueueInv(InvTypeTx, id)
+		count++
+	}
+	return count
+}
+
+//NewMsgGetInv 收到库存通报,返回需要请求的库存
+//已经有的交易和正在向其他连接请求的交易不会重复请求
+func (s *TCPServer) NewMsgGetInv(c *Client, msg *MsgInv) *MsgGetInv {
+	bi := s.blockIndex()
+	rsg := &MsgGetInv{}
+	for _, inv := range msg.Invs {
+		c.KnownInv(inv.InvID)
+		if inv.InvType != InvTypeTx {
+			continue
+		}
+		if bi.GetTxPool().Has(inv.InvID) {
+			continue
+		}
+		if has, err := bi.HasTxValue(inv.InvID); err == nil && has {
+			continue
+		}
+		if s.pkgs.Add("I"+string(inv.InvID[:]), time.Now(), InvRequestTimeout) != nil {
+			continue
+		}
+		rsg.AddInv(inv.InvType, inv.InvID)
+	}
+	return rsg
+}
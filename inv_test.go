@@ -0,0 +1,101 @@
+package xginx
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInvSet(t *testing.T) {
+	s := newInvSet(3)
+	ids := []HASH256{}
+	for i := 0; i < 4; i++ {
+		ids = append(ids, Hash256From([]byte{byte(i)}))
+		s.Add(ids[i])
+	}
+	s.Add(ids[3])
+	if s.Len() != 3 {
+		t.Fatalf("inv set len %d error", s.Len())
+	}
+	if s.Has(ids[0]) {
+		t.Fatal("oldest inv not removed")
+	}
+	for _, id := range ids[1:] {
+		if !s.Has(id) {
+			t.Fatalf("inv %v miss", id)
+		}
+	}
+}
+
+func (suite *BlockTestSuite) TestRelayTx() {
+	req := suite.Require()
+	bi := suite.bi
+	s := NewTCPServer().(*TCPServer)
+	s.cctx, s.cfun = context.WithCancel(context.Background())
+	defer s.cfun()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	c := s.NewClientWithConn(c1)
+	c.typ = ClientIn
+	c.isopen = true
+	c.setAcked()
+	c.proto = ProtocolVersion
+	req.False(s.HasClient(1, c))
+	c.Loop()
+	peer := NewNetStream(c2)
+	readMsg := func(typ NTType) MsgIO {
+		req.NoError(c2.SetReadDeadline(time.Now().Add(time.Millisecond * (InvTrickleMax + 1000))))
+		for {
+			m, err := peer.ReadMsg()
+			req.NoError(err)
+			if m.Type() == typ {
+				return m
+			}
+		}
+	}
+	blk, err := bi.LoadBlock(bi.GetBestValue().ID)
+	req.NoError(err)
+	tx := blk.Txs[0]
+	id := tx.MustID()
+	//只通报库存
+	req.Equal(1, s.RelayTx(tx))
+	msg := readMsg(NtInv).(*MsgInv)
+	req.Equal(1, len(msg.Invs))
+	req.Equal(id, msg.Invs[0].InvID)
+	req.True(c.HasInv(id))
+	//已经通报过不再通报
+	req.Equal(0, s.RelayTx(tx))
+	//请求时才发送交易
+	gsg := &MsgGetInv{}
+	gsg.AddInv(InvTypeTx, id)
+	req.NoError(peer.WriteMsg(gsg))
+	tsg := readMsg(NtTx).(*MsgTx)
+	req.Equal(id, tsg.Txs[0].MustID())
+	//收到没有的交易库存请求数据,正在请求的不重复请求
+	nid := Hash256From([]byte("relay tx"))
+	isg := &MsgInv{}
+	isg.AddInv(InvTypeTx, nid)
+	isg.AddInv(InvTypeTx, id)
+	req.NoError(peer.WriteMsg(isg))
+	rsg := readMsg(NtGetInv).(*MsgGetInv)
+	req.Equal(1, len(rsg.Invs))
+	req.Equal(nid, rsg.Invs[0].InvID)
+	req.True(c.HasInv(nid))
+	req.Equal(0, len(s.NewMsgGetInv(c, isg).Invs))
+	//旧版本节点不支持库存通报,直接发送交易
+	c.proto = MinProtocolVersion
+	pblk, err := bi.LoadBlock(blk.Header.Prev)
+	req.NoError(err)
+	tx = pblk.Txs[0]
+	req.Equal(1, s.RelayTx(tx))
+	tsg = readMsg(NtTx).(*MsgTx)
+	req.Equal(tx.MustID(), tsg.Txs[0].MustID())
+	req.Error(c.checkSendMsg(&MsgInv{}))
+	req.Error(c.checkSendMsg(&MsgMerkleBlock{}))
+	req.NoError(c.checkSendMsg(&MsgGetInv{}))
+	//握手完成前只发送基础消息
+	c.acked = 0
+	req.Error(c.checkSendMsg(&MsgGetInv{}))
+	req.NoError(c.checkSendMsg(&MsgPing{}))
+}
@@ -0,0 +1,173 @@
+package xginx
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	//JournalKey 正在写入的区块日志key
+	JournalKey = []byte("LinkJournalKey")
+)
+
+//写入区块的步骤
+const (
+	journalBegin = iota //记录日志后
+	journalRev          //写入回退数据后
+	journalBlk          //写入区块数据后
+	journalChunk        //记录区块数据位置后
+	journalIndex        //写入索引前
+)
+
+//写入区块的每一步调用测试钩子
+func (bi *BlockIndex) journalStep(step int) {
+	if bi.jhook != nil {
+		bi.jhook(step)
+	}
+}
+
+//区块写入日志,写入数据文件前保存到索引数据库,索引写入时删除
+//启动时如果存在日志说明上次写入被中断
+type linkJournal struct {
+	ID     HASH256   //区块id
+	Height uint32    //区块高度
+	Blk    ChunkFile //写入前区块数据文件位置
+	Rev    ChunkFile //写入前回退数据文件位置
+	Chunk  BlkChunk  //写入完成后的区块数据位置,没有数据时只能回滚
+}
+
+//Encode 编码
+func (j linkJournal) Encode(w IWriter) error {
+	if err := j.ID.Encode(w); err != nil {
+		return err
+	}
+	if err := w.TWrite(j.Height); err != nil {
+		return err
+	}
+	for _, pos := range []ChunkFile{j.Blk, j.Rev} {
+		if err := w.TWrite(pos.ID); err != nil {
+			return err
+		}
+		if err := w.TWrite(pos.Size); err != nil {
+			return err
+		}
+	}
+	return j.Chunk.Encode(w)
+}
+
+//Decode 解码
+func (j *linkJournal) Decode(r IReader) error {
+	if err := j.ID.Decode(r); err != nil {
+		return err
+	}
+	if err := r.TRead(&j.Height); err != nil {
+		return err
+	}
+	for _, pos := range []*ChunkFile{&j.Blk, &j.Rev} {
+		if err := r.TRead(&pos.ID); err != nil {
+			return err
+		}
+		if err := r.TRead(&pos.Size); err != nil {
+			return err
+		}
+	}
+	return j.Chunk.Decode(r)
+}
+
+//保存日志
+func (j *linkJournal) save(bi *BlockIndex) error {
+	w := NewWriter()
+	if err := j.Encode(w); err != nil {
+		return err
+	}
+	//写入数据文件前日志必须已经保存到磁盘
+	db := bi.blkdb.Index()
+	bt := db.NewBatch()
+	bt.Put(JournalKey, w.Bytes())
+	return db.Write(bt, true)
+}
+
+//写入区块数据前记录数据文件的位置
+func (bi *BlockIndex) beginJournal(id HASH256, height uint32) (*linkJournal, error) {
+	blk, err := bi.blkdb.Blk().Tail()
+	if err != nil {
+		return nil, err
+	}
+	rev, err := bi.blkdb.Rev().Tail()
+	if err != nil {
+		return nil, err
+	}
+	j := &linkJournal{ID: id, Height: height, Blk: blk, Rev: rev}
+	if err := j.save(bi); err != nil {
+		return nil, err
+	}
+	bi.journalStep(journalBegin)
+	return j, nil
+}
+
+//回滚写入,截断数据文件并删除日志
+func (bi *BlockIndex) rollbackJournal(j *linkJournal) error {
+	LogInfof("rollback block %v height %d write", j.ID, j.Height)
+	if err := bi.blkdb.Blk().Truncate(j.Blk); err != nil {
+		return err
+	}
+	if err := bi.blkdb.Rev().Truncate(j.Rev); err != nil {
+		return err
+	}
+	return bi.blkdb.Index().Del(JournalKey)
+}
+
+//读取日志中完整写入的区块数据
+func (bi *BlockIndex) journalBlock(j *linkJournal) (*BlockInfo, error) {
+	if !j.Chunk.HasData() {
+		return nil, errors.New("journal block chunk miss")
+	}
+	bb, err := bi.blkdb.Blk().Read(j.Chunk)
+	if err != nil {
+		return nil, err
+	}
+	blk := &BlockInfo{}
+	if err := blk.Decode(NewReader(bb)); err != nil {
+		return nil, err
+	}
+	if id, err := blk.ID(); err != nil || !id.Equal(j.ID) {
+		return nil, fmt.Errorf("journal block %v id not match", j.ID)
+	}
+	chunk := j.Chunk
+	blk.blkc = &chunk
+	return blk, nil
+}
+
+//启动时恢复被中断的区块写入
+//区块数据完整写入时使用区块数据重新连接,否则截断数据文件回滚
+func (bi *BlockIndex) recoverJournal() error {
+	db := bi.blkdb.Index()
+	has, err := db.Has(JournalKey)
+	if err != nil || !has {
+		return err
+	}
+	jb, err := db.Get(JournalKey)
+	if err != nil {
+		return err
+	}
+	j := &linkJournal{}
+	if err := j.Decode(NewReader(jb)); err != nil {
+		return fmt.Errorf("decode link journal error %w", err)
+	}
+	LogInfof("found interrupted block %v height %d write", j.ID, j.Height)
+	blk, err := bi.journalBlock(j)
+	if err != nil {
+		LogError("load journal block error", err)
+		return bi.rollbackJournal(j)
+	}
+	//回退数据需要重新写入
+	if err := bi.blkdb.Rev().Truncate(j.Rev); err != nil {
+		return err
+	}
+	if err := bi.LinkBlk(blk); err != nil {
+		LogError("relink journal block error", err)
+		return bi.rollbackJournal(j)
+	}
+	LogInfof("roll forward block %v height %d write", j.ID, j.Height)
+	return nil
+}
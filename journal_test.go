@@ -0,0 +1,67 @@
+package xginx
+
+import (
+	"errors"
+)
+
+func (suite *BlockTestSuite) TestJournal() {
+	req := suite.Require()
+	bi := suite.bi
+	db := bi.blkdb.Index()
+	defer func() {
+		bi.jhook = nil
+	}()
+	errCrash := errors.New("crash")
+	steps := []int{journalBegin, journalRev, journalBlk, journalChunk, journalIndex}
+	for _, step := range steps {
+		bv := bi.GetBestValue()
+		blk, err := bi.LoadBlock(bv.ID)
+		req.NoError(err)
+		req.NoError(bi.UnlinkLast())
+		btail, err := bi.blkdb.Blk().Tail()
+		req.NoError(err)
+		rtail, err := bi.blkdb.Rev().Tail()
+		req.NoError(err)
+		//在写入的每一步模拟中断
+		cs := step
+		bi.jhook = func(s int) {
+			if s == cs {
+				panic(errCrash)
+			}
+		}
+		func() {
+			defer func() {
+				req.Equal(errCrash, recover())
+			}()
+			_ = bi.LinkBlk(blk)
+		}()
+		bi.jhook = nil
+		has, err := db.Has(JournalKey)
+		req.NoError(err)
+		req.True(has)
+		req.Equal(bv.Height-1, bi.GetBestValue().Height)
+		//启动时恢复
+		req.NoError(bi.recoverJournal())
+		has, err = db.Has(JournalKey)
+		req.NoError(err)
+		req.False(has)
+		if step >= journalChunk {
+			//区块数据完整,重新连接
+			req.Equal(bv, bi.GetBestValue())
+			req.Equal(bv.Height, bi.Height())
+		} else {
+			//回滚后数据文件恢复到写入前
+			req.Equal(bv.Height-1, bi.Height())
+			tail, err := bi.blkdb.Blk().Tail()
+			req.NoError(err)
+			req.Equal(btail, tail)
+			tail, err = bi.blkdb.Rev().Tail()
+			req.NoError(err)
+			req.Equal(rtail, tail)
+			req.NoError(bi.LinkBlk(blk))
+		}
+		req.NoError(bi.VerifyChain(nil))
+	}
+	//没有日志时不处理
+	req.NoError(bi.recoverJournal())
+}
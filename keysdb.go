@@ -1,8 +1,11 @@
 package xginx
 
 import (
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -23,6 +26,13 @@ type AccountInfo struct {
 	Pks  []string `json:"pks"`  //公钥ID
 	Desc string   `json:"desc"` //描述
 	Type int      `json:"type"` //类型 1-金额账户,2-临时账户,可能会被删除
+	//退役后金额转移到的新账户地址
+	Retired Address `json:"retired,omitempty"`
+}
+
+//IsRetired 是否已经退役
+func (ka AccountInfo) IsRetired() bool {
+	return ka.Retired != EmptyAddress
 }
 
 //创建零时账户
@@ -206,8 +216,18 @@ type IKeysDB interface {
 	DeletePrivateKey(id string) error
 	//删除账户描述
 	DeleteAccountInfo(id Address) error
+	//标记账户退役,金额已经转移到to地址
+	RetireAccount(id Address, to Address) error
 	//设置密钥ttl为过期时间
 	SetKey(key string, ttl time.Duration)
+	//锁定钱包,清除内存中的密钥
+	Lock()
+	//使用密码解锁钱包,timeout后自动锁定,0不自动锁定
+	Unlock(pass string, timeout time.Duration) error
+	//是否已锁定
+	IsLocked() bool
+	//修改密码,重新加密所有私钥和rsa私钥
+	ChangePass(old string, pass string) error
 	//列出地址
 	ListAddress(limit int, skey ...[]byte) ([]Address, []byte)
 	//列出私钥id
@@ -230,27 +250,224 @@ var (
 	accprefix = []byte{2} //账号前缀
 	conprefix = []byte{3} //配置信息key前缀
 	rsaprefix = []byte{4} //rsa私钥前缀
+	pasprefix = []byte{5} //密码校验数据
+)
+
+var (
+	//ErrKeysDBLocked 钱包已锁定
+	ErrKeysDBLocked = errors.New("keys db locked")
+	//ErrKeysDBPass 钱包密码错误
+	ErrKeysDBPass = errors.New("keys db pass error")
 )
 
 type levelkeysdb struct {
-	key []string
-	db  DBImp
-	exp time.Time //密钥过期时间
-	ttl time.Duration
+	mu     sync.RWMutex
+	key    []string
+	db     DBImp
+	locked bool
+	timer  *time.Timer //自动锁定定时器
+	gen    int         //每次解锁递增,防止过期的定时器锁定
+}
+
+//获取当前密钥,锁定时返回错误
+func (kd *levelkeysdb) getkey() ([]string, error) {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+	if kd.locked {
+		return nil, ErrKeysDBLocked
+	}
+	return kd.key, nil
+}
+
+//设置密钥并在ttl后自动锁定,调用者需要加锁
+func (kd *levelkeysdb) setkey(key string, ttl time.Duration) {
+	if kd.timer != nil {
+		kd.timer.Stop()
+		kd.timer = nil
+	}
+	kd.gen++
+	kd.key = []string{}
+	if key != "" {
+		kd.key = []string{key}
+	}
+	kd.locked = false
+	if ttl > 0 {
+		gen := kd.gen
+		kd.timer = time.AfterFunc(ttl, func() {
+			kd.mu.Lock()
+			defer kd.mu.Unlock()
+			if kd.gen == gen {
+				kd.lock()
+			}
+		})
+	}
+}
+
+//锁定并清除密钥,调用者需要加锁
+func (kd *levelkeysdb) lock() {
+	if kd.timer != nil {
+		kd.timer.Stop()
+		kd.timer = nil
+	}
+	kd.gen++
+	kd.key = nil
+	kd.locked = true
+}
+
+//使用密码加密随机数据生成密码校验数据
+func newpassdata(key ...string) ([]byte, error) {
+	rb := make([]byte, 32)
+	if _, err := rand.Read(rb); err != nil {
+		return nil, err
+	}
+	str, err := HashDump(rb, key...)
+	return []byte(str), err
+}
+
+//使用密码校验数据检测密码,没有校验数据时加载第一个私钥或者rsa私钥检测
+//没有任何可以校验的数据时拒绝
+func (kd *levelkeysdb) checkpass(pass string) error {
+	key := []string{}
+	if pass != "" {
+		key = []string{pass}
+	}
+	if has, err := kd.db.Has(pasprefix); err != nil {
+		return err
+	} else if has {
+		pd, err := kd.db.Get(pasprefix)
+		if err != nil {
+			return err
+		}
+		if _, err := HashLoad(string(pd), key...); err != nil {
+			return ErrKeysDBPass
+		}
+		return nil
+	}
+	iter := kd.db.Iterator(NewPrefix(priprefix))
+	defer iter.Close()
+	if iter.Next() {
+		if _, err := LoadPrivateKey(string(iter.Value()), key...); err != nil {
+			return ErrKeysDBPass
+		}
+		return nil
+	}
+	riter := kd.db.Iterator(NewPrefix(rsaprefix))
+	defer riter.Close()
+	if riter.Next() {
+		if _, err := LoadRSAPrivateKey(string(riter.Value()), key...); err != nil {
+			return ErrKeysDBPass
+		}
+		return nil
+	}
+	return ErrKeysDBPass
 }
 
-func (kd levelkeysdb) keyexpire() bool {
-	if kd.ttl == 0 {
-		return false
+//没有密码校验数据并且没有私钥时写入当前密码的校验数据
+func (kd *levelkeysdb) initpass() error {
+	if has, err := kd.db.Has(pasprefix); err != nil || has {
+		return err
 	}
-	if time.Now().Sub(kd.exp) >= 0 {
-		return true
+	for _, prefix := range [][]byte{priprefix, rsaprefix} {
+		iter := kd.db.Iterator(NewPrefix(prefix))
+		has := iter.Next()
+		iter.Close()
+		if has {
+			return nil
+		}
+	}
+	pd, err := newpassdata(kd.key...)
+	if err != nil {
+		return err
 	}
-	return false
+	return kd.db.Put(pasprefix, pd)
+}
+
+//Lock 锁定钱包,锁定后不能签名和加载私钥
+func (kd *levelkeysdb) Lock() {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	kd.lock()
+}
+
+//Unlock 使用密码解锁,timeout后自动锁定
+func (kd *levelkeysdb) Unlock(pass string, timeout time.Duration) error {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	if err := kd.checkpass(pass); err != nil {
+		return err
+	}
+	kd.setkey(pass, timeout)
+	return nil
+}
+
+//IsLocked 是否已锁定
+func (kd *levelkeysdb) IsLocked() bool {
+	kd.mu.RLock()
+	defer kd.mu.RUnlock()
+	return kd.locked
+}
+
+//ChangePass 修改密码,所有私钥,rsa私钥和密码校验数据使用新密码重新加密后一次写入
+func (kd *levelkeysdb) ChangePass(old string, pass string) error {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	okey, nkey := []string{}, []string{}
+	if old != "" {
+		okey = []string{old}
+	}
+	if pass != "" {
+		nkey = []string{pass}
+	}
+	if err := kd.checkpass(old); err != nil {
+		return err
+	}
+	pd, err := newpassdata(nkey...)
+	if err != nil {
+		return err
+	}
+	bt := kd.db.NewBatch()
+	bt.Put(pasprefix, pd)
+	iter := kd.db.Iterator(NewPrefix(priprefix))
+	defer iter.Close()
+	for iter.Next() {
+		pri, err := LoadPrivateKey(string(iter.Value()), okey...)
+		if err != nil {
+			return ErrKeysDBPass
+		}
+		str, err := pri.Dump(nkey...)
+		if err != nil {
+			return err
+		}
+		bt.Put(iter.Key(), []byte(str))
+	}
+	riter := kd.db.Iterator(NewPrefix(rsaprefix))
+	defer riter.Close()
+	for riter.Next() {
+		rsa, err := LoadRSAPrivateKey(string(riter.Value()), okey...)
+		if err != nil {
+			return ErrKeysDBPass
+		}
+		str, err := rsa.Dump(nkey...)
+		if err != nil {
+			return err
+		}
+		bt.Put(riter.Key(), []byte(str))
+	}
+	if err := kd.db.Write(bt, true); err != nil {
+		return err
+	}
+	if !kd.locked {
+		kd.key = nkey
+	}
+	return nil
 }
 
 //创建rsa私钥
 func (kd *levelkeysdb) NewRSA() (string, error) {
+	key, err := kd.getkey()
+	if err != nil {
+		return "", err
+	}
 	rsa, err := NewRSAPrivateKey()
 	if err != nil {
 		return "", err
@@ -259,7 +476,7 @@ func (kd *levelkeysdb) NewRSA() (string, error) {
 	if err != nil {
 		return id, err
 	}
-	dump, err := rsa.Dump(kd.key...)
+	dump, err := rsa.Dump(key...)
 	if err != nil {
 		return id, err
 	}
@@ -285,11 +502,15 @@ func (kd *levelkeysdb) ListRSA() []string {
 
 //获取配置
 func (kd *levelkeysdb) GetRSA(id string) (*RSAPrivateKey, error) {
+	key, err := kd.getkey()
+	if err != nil {
+		return nil, err
+	}
 	bb, err := kd.db.Get(rsaprefix, []byte(id))
 	if err != nil {
 		return nil, err
 	}
-	return LoadRSAPrivateKey(string(bb), kd.key...)
+	return LoadRSAPrivateKey(string(bb), key...)
 }
 
 //添加配置
@@ -324,17 +545,15 @@ func (kd *levelkeysdb) NewAccountInfo(typ int, desc string) (*AccountInfo, error
 	return ka, err
 }
 
+//SetKey 不检测密码直接设置密钥,ttl后自动锁定
 func (kd *levelkeysdb) SetKey(key string, ttl time.Duration) {
-	if ttl > 0 {
-		kd.exp = time.Now().Add(ttl)
-		kd.ttl = ttl
-	} else {
-		kd.ttl = 0
-	}
-	kd.key = []string{key}
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	kd.setkey(key, ttl)
 }
 
 func (kd *levelkeysdb) Close() {
+	kd.Lock()
 	kd.db.Close()
 }
 
@@ -404,12 +623,32 @@ func (kd *levelkeysdb) DeleteAccountInfo(id Address) error {
 	return kd.db.Del(accprefix, []byte(id))
 }
 
-//NewLockedScript 生成锁定脚本
+//RetireAccount 标记账户退役
+func (kd *levelkeysdb) RetireAccount(id Address, to Address) error {
+	ka, err := kd.LoadAccountInfo(id)
+	if err != nil {
+		return err
+	}
+	if _, err := kd.LoadAccountInfo(to); err != nil {
+		return fmt.Errorf("retire to address %s error %w", to, err)
+	}
+	ka.Retired = to
+	bb, err := ka.Encode()
+	if err != nil {
+		return err
+	}
+	return kd.db.Put(accprefix, []byte(id), bb)
+}
+
+//NewLockedScript 生成锁定脚本,退役的账户不能再接收金额
 func (kd *levelkeysdb) NewLockedScript(id Address, meta []byte, exec ...[]byte) (*LockedScript, error) {
-	_, err := kd.LoadAccountInfo(id)
+	ka, err := kd.LoadAccountInfo(id)
 	if err != nil {
 		return nil, err
 	}
+	if ka.IsRetired() {
+		return nil, fmt.Errorf("address %s retired to %s", id, ka.Retired)
+	}
 	pkh, err := id.GetPkh()
 	if err != nil {
 		return nil, err
@@ -419,6 +658,9 @@ func (kd *levelkeysdb) NewLockedScript(id Address, meta []byte, exec ...[]byte)
 
 //使用我的数据签名data并填充脚本脚本
 func (kd *levelkeysdb) SignAccount(ka *AccountInfo, data []byte, wits *WitnessScript) error {
+	if kd.IsLocked() {
+		return ErrKeysDBLocked
+	}
 	//检测数量是否匹配
 	if len(ka.Pks) != len(wits.Pks) {
 		return fmt.Errorf("pks num error")
@@ -454,6 +696,9 @@ func (kd *levelkeysdb) SignAccount(ka *AccountInfo, data []byte, wits *WitnessSc
 
 //使用我的数据签名data并填充脚本脚本
 func (kd *levelkeysdb) Sign(id Address, data []byte, wits *WitnessScript) error {
+	if kd.IsLocked() {
+		return ErrKeysDBLocked
+	}
 	ka, err := kd.LoadAccountInfo(id)
 	if err != nil {
 		return err
@@ -540,14 +785,15 @@ func (kd *levelkeysdb) SaveAccountInfo(ka *AccountInfo) (Address, error) {
 }
 
 func (kd *levelkeysdb) LoadPrivateKey(id string) (*PrivateKey, error) {
-	if kd.keyexpire() {
-		return nil, fmt.Errorf("key expire")
+	key, err := kd.getkey()
+	if err != nil {
+		return nil, err
 	}
 	bb, err := kd.db.Get(priprefix, []byte(id))
 	if err != nil {
 		return nil, err
 	}
-	return LoadPrivateKey(string(bb), kd.key...)
+	return LoadPrivateKey(string(bb), key...)
 }
 
 func (kd *levelkeysdb) Sync() {
@@ -556,8 +802,9 @@ func (kd *levelkeysdb) Sync() {
 
 //创建私钥,返回公钥hash256
 func (kd *levelkeysdb) NewPrivateKey() (string, error) {
-	if kd.keyexpire() {
-		return "", fmt.Errorf("key expire")
+	key, err := kd.getkey()
+	if err != nil {
+		return "", err
 	}
 	pri, err := NewPrivateKey()
 	if err != nil {
@@ -567,7 +814,7 @@ func (kd *levelkeysdb) NewPrivateKey() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	str, err := pri.Dump(kd.key...)
+	str, err := pri.Dump(key...)
 	if err != nil {
 		return "", err
 	}
@@ -590,5 +837,10 @@ func OpenKeysDB(dir string, key ...string) (IKeysDB, error) {
 	if len(key) > 0 && key[0] != "" {
 		ptr.key = []string{key[0]}
 	}
+	//没有私钥的数据库使用打开时的密码作为密码
+	if err := ptr.initpass(); err != nil {
+		db.Close()
+		return nil, err
+	}
 	return ptr, nil
 }
@@ -2,7 +2,9 @@ package xginx
 
 import (
 	"log"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -10,6 +12,7 @@ import (
 )
 
 func TestListDB(t *testing.T) {
+	defer checkGoroutines(t)()
 	kdb, err := OpenKeysDB(NewTempDir())
 	require.NoError(t, err)
 	defer kdb.Close()
@@ -44,6 +47,7 @@ func TestListDB(t *testing.T) {
 }
 
 func TestPrivateNewLoad(t *testing.T) {
+	defer checkGoroutines(t)()
 	kdb, err := OpenKeysDB(NewTempDir())
 	require.NoError(t, err)
 	defer kdb.Close()
@@ -62,6 +66,7 @@ func TestPrivateNewLoad(t *testing.T) {
 }
 
 func TestPrivateNewLoadWithKey(t *testing.T) {
+	defer checkGoroutines(t)()
 	kdb, err := OpenKeysDB(NewTempDir(), "11113344")
 	require.NoError(t, err)
 	defer kdb.Close()
@@ -76,6 +81,7 @@ func TestPrivateNewLoadWithKey(t *testing.T) {
 }
 
 func TestLoadAccountInfo(t *testing.T) {
+	defer checkGoroutines(t)()
 	kdb, err := OpenKeysDB(NewTempDir())
 	require.NoError(t, err)
 	defer kdb.Close()
@@ -127,3 +133,91 @@ func TestLoadAccountInfo(t *testing.T) {
 	err = acc.VerifyAll(hv, wits.Sig)
 	require.NoError(t, err)
 }
+
+func TestKeysDBLockUnlock(t *testing.T) {
+	defer checkGoroutines(t)()
+	dir := NewTempDir()
+	defer os.RemoveAll(dir)
+	kdb, err := OpenKeysDB(dir, "11113344")
+	require.NoError(t, err)
+	ka, err := kdb.NewAccountInfo(CoinAccountType, "lock")
+	require.NoError(t, err)
+	id := ka.MustAddress()
+	rid, err := kdb.NewRSA()
+	require.NoError(t, err)
+
+	//锁定后不能加载私钥和签名
+	kdb.Lock()
+	require.True(t, kdb.IsLocked())
+	_, err = kdb.LoadPrivateKey(ka.Pks[0])
+	require.Equal(t, ErrKeysDBLocked, err)
+	_, err = kdb.GetRSA(rid)
+	require.Equal(t, ErrKeysDBLocked, err)
+	wits := &WitnessScript{Pks: make([]PKBytes, 1), Sig: make([]SigBytes, 1)}
+	hv := Hash256From([]byte("keys db lock"))
+	require.Equal(t, ErrKeysDBLocked, kdb.Sign(id, hv[:], wits))
+	require.Equal(t, ErrKeysDBLocked, kdb.SignAccount(ka, hv[:], wits))
+
+	//密码错误不能解锁
+	require.Equal(t, ErrKeysDBPass, kdb.Unlock("22223344", 0))
+	require.True(t, kdb.IsLocked())
+	require.NoError(t, kdb.Unlock("11113344", time.Millisecond*50))
+	require.NoError(t, kdb.Sign(id, hv[:], wits))
+	require.True(t, wits.Sig[0].IsValid())
+	//超时后自动锁定
+	require.Eventually(t, kdb.IsLocked, time.Second, time.Millisecond*10)
+	_, err = kdb.LoadPrivateKey(ka.Pks[0])
+	require.Equal(t, ErrKeysDBLocked, err)
+
+	//修改密码后使用新密码解锁
+	require.Equal(t, ErrKeysDBPass, kdb.ChangePass("22223344", "55556677"))
+	require.NoError(t, kdb.ChangePass("11113344", "55556677"))
+	require.Equal(t, ErrKeysDBPass, kdb.Unlock("11113344", 0))
+	require.NoError(t, kdb.Unlock("55556677", 0))
+	_, err = kdb.LoadPrivateKey(ka.Pks[0])
+	require.NoError(t, err)
+	_, err = kdb.GetRSA(rid)
+	require.NoError(t, err)
+	kdb.Close()
+
+	//重新打开使用新密码
+	kdb, err = OpenKeysDB(dir, "55556677")
+	require.NoError(t, err)
+	defer kdb.Close()
+	_, err = kdb.LoadPrivateKey(ka.Pks[0])
+	require.NoError(t, err)
+}
+
+//没有私钥时也必须使用正确的密码解锁和修改密码
+func TestKeysDBEmptyPass(t *testing.T) {
+	defer checkGoroutines(t)()
+	dir := NewTempDir()
+	defer os.RemoveAll(dir)
+	kdb, err := OpenKeysDB(dir, "11113344")
+	require.NoError(t, err)
+	kdb.Lock()
+	require.Equal(t, ErrKeysDBPass, kdb.Unlock("22223344", 0))
+	require.True(t, kdb.IsLocked())
+	require.Equal(t, ErrKeysDBPass, kdb.ChangePass("22223344", "55556677"))
+	require.NoError(t, kdb.Unlock("11113344", 0))
+	require.NoError(t, kdb.ChangePass("11113344", "55556677"))
+	require.Equal(t, ErrKeysDBPass, kdb.Unlock("11113344", 0))
+	require.NoError(t, kdb.Unlock("55556677", 0))
+	//第一个私钥使用当前密码
+	id, err := kdb.NewPrivateKey()
+	require.NoError(t, err)
+	kdb.Close()
+
+	kdb, err = OpenKeysDB(dir, "55556677")
+	require.NoError(t, err)
+	defer kdb.Close()
+	require.Equal(t, ErrKeysDBPass, kdb.Unlock("11113344", 0))
+	require.NoError(t, kdb.Unlock("55556677", 0))
+	_, err = kdb.LoadPrivateKey(id)
+	require.NoError(t, err)
+	//没有校验数据和私钥时拒绝解锁
+	ldb := kdb.(*levelkeysdb)
+	require.NoError(t, ldb.db.Del(pasprefix))
+	require.NoError(t, kdb.DeletePrivateKey(id))
+	require.Equal(t, ErrKeysDBPass, kdb.Unlock("55556677", 0))
+}
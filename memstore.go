@@ -0,0 +1,239 @@
+package xginx
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+//区块存储类型
+const (
+	//LevelDBStoreType leveldb和数据文件存储,默认
+	LevelDBStoreType = "leveldb"
+	//MemStoreType 内存存储,关闭后数据丢失
+	MemStoreType = "memory"
+)
+
+//NewMemDBImp 创建内存数据库接口
+func NewMemDBImp() (DBImp, error) {
+	sdb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewDB(sdb), nil
+}
+
+//内存数据块存储,模拟按大小分割的数据文件
+type memchunkstore struct {
+	mu    sync.RWMutex
+	files [][]byte
+	size  int
+}
+
+func newMemChunkStore(maxsiz int) IChunkStore {
+	return &memchunkstore{size: maxsiz}
+}
+
+func (s *memchunkstore) Init() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files = [][]byte{{}}
+	return nil
+}
+
+func (s *memchunkstore) Read(st BlkChunk) ([]byte, error) {
+	if st.Len > MaxBlockSize+chunkHeadSize || st.Len < chunkHeadSize {
+		return nil, errors.New("data size error")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, off, l := st.ID.ToInt(), st.Off.ToInt(), st.Len.ToInt()
+	if id < 0 || id >= len(s.files) || s.files[id] == nil {
+		return nil, errors.New("chunk file miss")
+	}
+	f := s.files[id]
+	if off < 0 || off+l > len(f) {
+		return nil, errors.New("chunk range error")
+	}
+	bb := make([]byte, l)
+	copy(bb, f[off:off+l])
+	return decodeChunk(bb)
+}
+
+func (s *memchunkstore) Write(b []byte) (BlkChunk, error) {
+	if len(b) > MaxBlockSize {
+		return BlkChunk{}, errors.New("data too big")
+	}
+	//内存中不压缩
+	rb, err := encodeChunk(ChunkCodecNone, b)
+	if err != nil {
+		return BlkChunk{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		return BlkChunk{}, errors.New("chunk store closed")
+	}
+	id := len(s.files) - 1
+	fs := BlkChunk{
+		ID:  VarUInt(id),
+		Off: VarUInt(len(s.files[id])),
+		Len: VarUInt(len(rb)),
+	}
+	s.files[id] = append(s.files[id], rb...)
+	//超过大小后写入下一个文件
+	if len(s.files[id]) >= s.size {
+		s.files = append(s.files, []byte{})
+	}
+	return fs, nil
+}
+
+func (s *memchunkstore) Walk(fn func(st BlkChunk, b []byte) error) error {
+	s.mu.RLock()
+	files := make([][]byte, len(s.files))
+	copy(files, s.files)
+	s.mu.RUnlock()
+	for id, f := range files {
+		read := func(off int, b []byte) error {
+			copy(b, f[off:])
+			return nil
+		}
+		if err := walkChunks(uint32(id), 0, len(f), read, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memchunkstore) Files() ([]ChunkFile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fs := []ChunkFile{}
+	for id, f := range s.files {
+		if f == nil {
+			continue
+		}
+		fs = append(fs, ChunkFile{ID: uint32(id), Size: int64(len(f))})
+	}
+	return fs, nil
+}
+
+func (s *memchunkstore) Remove(id uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int(id) >= len(s.files)-1 {
+		return fmt.Errorf("chunk file %d in use", id)
+	}
+	s.files[id] = nil
+	return nil
+}
+
+func (s *memchunkstore) Tail() (ChunkFile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id := len(s.files) - 1
+	return ChunkFile{ID: uint32(id), Size: int64(len(s.files[id]))}, nil
+}
+
+func (s *memchunkstore) Truncate(pos ChunkFile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := int(pos.ID)
+	if id >= len(s.files) || pos.Size > int64(len(s.files[id])) {
+		return fmt.Errorf("chunk pos %d %d error", pos.ID, pos.Size)
+	}
+	s.files = s.files[:id+1]
+	s.files[id] = s.files[id][:pos.Size]
+	return nil
+}
+
+func (s *memchunkstore) Sync(id ...uint32) {
+
+}
+
+func (s *memchunkstore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files = nil
+}
+
+//内存区块存储
+type memstore struct {
+	index DBImp       //区块索引
+	blk   IChunkStore //区块存储器
+	rev   IChunkStore //回退日志
+	once  sync.Once   //
+}
+
+//NewMemStore 创建内存区块存储器,用于测试和临时节点
+func NewMemStore() IBlkStore {
+	m := &memstore{}
+	m.Init()
+	return m
+}
+
+func (ss *memstore) Sync() {
+	ss.index.Sync()
+}
+
+func (ss *memstore) Init(arg ...interface{}) {
+	ss.once.Do(func() {
+		if db, err := NewMemDBImp(); err != nil {
+			panic(err)
+		} else {
+			ss.index = db
+		}
+		ss.blk = newMemChunkStore(BlkFileMaxSize)
+		if err := ss.blk.Init(); err != nil {
+			panic(err)
+		}
+		ss.rev = newMemChunkStore(RevFileMaxSize)
+		if err := ss.rev.Init(); err != nil {
+			panic(err)
+		}
+	})
+}
+
+func (ss *memstore) Close() {
+	ss.index.Close()
+	ss.blk.Close()
+	ss.rev.Close()
+}
+
+//索引数据库
+func (ss *memstore) Index() DBImp {
+	return ss.index
+}
+
+//扩展存储
+func (ss *memstore) Blk() IChunkStore {
+	return ss.blk
+}
+
+//事物回退文件
+func (ss *memstore) Rev() IChunkStore {
+	return ss.rev
+}
+
+//NewBlkStore 根据配置创建区块存储器
+func (c *Config) NewBlkStore() IBlkStore {
+	return c.NewBlkStoreAt(c.DataDir)
+}
+
+//NewBlkStoreAt 在dir目录创建区块存储,dir为空使用配置目录
+func (c *Config) NewBlkStoreAt(dir string) IBlkStore {
+	if dir == "" {
+		dir = c.DataDir
+	}
+	switch c.Store {
+	case MemStoreType:
+		return NewMemStore()
+	case "", LevelDBStoreType:
+		return NewLevelDBStore(dir + "/blks")
+	default:
+		panic(errors.New("store type " + c.Store + " error"))
+	}
+}
@@ -0,0 +1,187 @@
+package xginx
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemStore(t *testing.T) {
+	defer checkGoroutines(t)()
+	ss := NewMemStore()
+	defer ss.Close()
+
+	//超过大小写入下一个文件
+	cs := newMemChunkStore(25)
+	require.NoError(t, cs.Init())
+	defer cs.Close()
+	c1, err := cs.Write([]byte("12345"))
+	require.NoError(t, err)
+	c2, err := cs.Write([]byte("67890"))
+	require.NoError(t, err)
+	c3, err := cs.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.Equal(t, c1.ID, c2.ID)
+	require.Equal(t, c2.ID+1, c3.ID)
+	bb, err := cs.Read(c2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("67890"), bb)
+	bb, err = cs.Read(c3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("abc"), bb)
+	_, err = cs.Read(BlkChunk{ID: c3.ID, Off: 1, Len: 5})
+	require.Error(t, err)
+	//正在写入的文件不能删除
+	require.Error(t, cs.Remove(c3.ID.ToUInt32()))
+	require.NoError(t, cs.Remove(c1.ID.ToUInt32()))
+	_, err = cs.Read(c1)
+	require.Error(t, err)
+	fs, err := cs.Files()
+	require.NoError(t, err)
+	require.Equal(t, c3.ID.ToUInt32(), fs[0].ID)
+
+	//索引支持事务
+	db := ss.Index()
+	require.NoError(t, db.Put([]byte{1}, []byte("k1"), []byte("v1")))
+	tr, err := db.Transaction()
+	require.NoError(t, err)
+	require.NoError(t, tr.Put([]byte{1}, []byte("k2"), []byte("v2")))
+	tr.Discard()
+	has, err := db.Has([]byte{1}, []byte("k2"))
+	require.NoError(t, err)
+	require.False(t, has)
+	tr, err = db.Transaction()
+	require.NoError(t, err)
+	require.NoError(t, tr.Put([]byte{1}, []byte("k2"), []byte("v2")))
+	require.NoError(t, tr.Commit())
+	v, err := db.Get([]byte{1}, []byte("k2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), v)
+	_, err = db.SizeOf([]*Range{NewPrefix([]byte{1})})
+	require.NoError(t, err)
+
+	bc, err := ss.Blk().Write([]byte("block"))
+	require.NoError(t, err)
+	bb, err = ss.Blk().Read(bc)
+	require.NoError(t, err)
+	require.Equal(t, []byte("block"), bb)
+}
+
+func TestChunkStoreWalk(t *testing.T) {
+	defer checkGoroutines(t)()
+	NewTestConfig()
+	dir := NewTempDir()
+	defer os.RemoveAll(dir)
+	ss := NewLevelDBStore(dir)
+	defer ss.Close()
+	ms := NewMemStore()
+	defer ms.Close()
+	for _, cs := range []IChunkStore{ss.Blk(), ms.Blk()} {
+		c1, err := cs.Write([]byte("12345"))
+		require.NoError(t, err)
+		c2, err := cs.Write([]byte("678"))
+		require.NoError(t, err)
+		sts := []BlkChunk{}
+		bbs := [][]byte{}
+		err = cs.Walk(func(st BlkChunk, b []byte) error {
+			sts = append(sts, st)
+			bbs = append(bbs, b)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []BlkChunk{c1, c2}, sts)
+		require.Equal(t, [][]byte{[]byte("12345"), []byte("678")}, bbs)
+	}
+}
+
+func TestChunkStoreTruncate(t *testing.T) {
+	defer checkGoroutines(t)()
+	NewTestConfig()
+	dir := NewTempDir()
+	defer os.RemoveAll(dir)
+	ss := NewLevelDBStore(dir)
+	defer ss.Close()
+	ms := NewMemStore()
+	defer ms.Close()
+	for _, cs := range []IChunkStore{ss.Blk(), ms.Blk()} {
+		c1, err := cs.Write([]byte("12345"))
+		require.NoError(t, err)
+		pos, err := cs.Tail()
+		require.NoError(t, err)
+		_, err = cs.Write([]byte("678"))
+		require.NoError(t, err)
+		//截断后删除之后写入的数据
+		require.NoError(t, cs.Truncate(pos))
+		tail, err := cs.Tail()
+		require.NoError(t, err)
+		require.Equal(t, pos, tail)
+		c3, err := cs.Write([]byte("abc"))
+		require.NoError(t, err)
+		bbs := [][]byte{}
+		err = cs.Walk(func(st BlkChunk, b []byte) error {
+			bbs = append(bbs, b)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{[]byte("12345"), []byte("abc")}, bbs)
+		bb, err := cs.Read(c3)
+		require.NoError(t, err)
+		require.Equal(t, []byte("abc"), bb)
+		bb, err = cs.Read(c1)
+		require.NoError(t, err)
+		require.Equal(t, []byte("12345"), bb)
+	}
+}
+
+//使用内存存储的链连接和断开区块
+func (suite *BlockTestSuite) TestMemStoreLink() {
+	req := suite.Require()
+	genesis, err := suite.bi.LoadBlock(conf.genesis)
+	req.NoError(err)
+	//模拟节点使用配置中的存储类型
+	store := conf.Store
+	conf.Store = MemStoreType
+	sn, err := NewSimNet(1, genesis)
+	conf.Store = store
+	req.NoError(err)
+	defer sn.Close()
+	n := sn.Nodes[0]
+	bi := n.BlockIndex()
+	_, ok := bi.blkdb.(*memstore)
+	req.True(ok)
+
+	blks, err := n.Mine(5)
+	req.NoError(err)
+	req.Equal(uint32(5), bi.Height())
+	//保存区块副本用于重新连接
+	copies := []*BlockInfo{}
+	for _, blk := range blks[2:] {
+		w := NewWriter()
+		req.NoError(blk.Encode(w))
+		cp := &BlockInfo{}
+		req.NoError(cp.Decode(NewReader(w.Bytes())))
+		copies = append(copies, cp)
+	}
+	//断开后在高度2分叉
+	req.NoError(bi.UnlinkTo(blks[1].MustID()))
+	req.Equal(blks[1].MustID(), bi.GetBestValue().ID)
+	fork, err := n.Mine(2)
+	req.NoError(err)
+	req.Equal(uint32(4), bi.Height())
+	_, err = bi.LoadBlock(fork[1].MustID())
+	req.NoError(err)
+	//回退分叉重新连接原来的区块
+	req.NoError(bi.UnlinkLast())
+	req.NoError(bi.UnlinkLast())
+	req.Equal(uint32(2), bi.Height())
+	for _, blk := range copies {
+		req.NoError(bi.LinkBlk(blk))
+	}
+	bv := bi.GetBestValue()
+	req.Equal(uint32(5), bv.Height)
+	req.Equal(blks[4].MustID(), bv.ID)
+	blk, err := bi.LoadBlock(blks[3].MustID())
+	req.NoError(err)
+	req.Equal(uint32(4), blk.Meta.Height)
+}
@@ -0,0 +1,215 @@
+package xginx
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+//MigrateKey 数据文件迁移标记,存在时索引已经更新,数据文件没有移动完成
+var MigrateKey = []byte("MigrateChunkKey")
+
+//旧格式数据文件读取
+type legacyreader struct {
+	dir   string
+	files map[string]*os.File
+}
+
+func (lr *legacyreader) read(ext string, st BlkChunk) ([]byte, error) {
+	if st.Len > MaxBlockSize {
+		return nil, fmt.Errorf("legacy chunk %d too big", st.Len)
+	}
+	file := fmt.Sprintf("%s%s%06d%s", lr.dir, Separator, st.ID, ext)
+	f, has := lr.files[file]
+	if !has {
+		fp, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		lr.files[file] = fp
+		f = fp
+	}
+	bb := make([]byte, st.Len)
+	if _, err := f.ReadAt(bb, int64(st.Off)); err != nil {
+		return nil, err
+	}
+	return bb, nil
+}
+
+func (lr *legacyreader) close() {
+	for _, f := range lr.files {
+		_ = f.Close()
+	}
+}
+
+//获取目录下的数据文件,返回旧格式文件和新格式文件
+func listChunkFiles(dir string) ([]string, []string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	hbytes := sfileHeaderBytes()
+	olds, news := []string{}, []string{}
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		if ext := path.Ext(fi.Name()); ext != ".blk" && ext != ".rev" {
+			continue
+		}
+		bb := make([]byte, len(hbytes))
+		f, err := os.Open(dir + Separator + fi.Name())
+		if err != nil {
+			return nil, nil, err
+		}
+		n, _ := f.Read(bb)
+		_ = f.Close()
+		if n == len(hbytes) && bytes.Equal(bb[len(bb)-len(chunkFileMagic):], chunkFileMagic) {
+			news = append(news, fi.Name())
+		} else {
+			olds = append(olds, fi.Name())
+		}
+	}
+	sort.Strings(olds)
+	return olds, news, nil
+}
+
+//MigrateBlkStore 升级旧格式的区块和回退数据文件,迁移前必须停止节点
+//dir为区块存储目录,根据索引中的区块头读取所有区块和回退数据,使用新格式和codec压缩方式重新写入
+//并更新索引中的数据位置,旧文件移动到dir/legacy目录,没有被索引的数据不迁移
+//索引和迁移标记一起写入后再移动文件,中断后重新执行继续移动文件
+func MigrateBlkStore(dir string, codec uint8) error {
+	db, err := NewDBImp(dir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	//上次迁移索引已经更新,继续移动文件
+	if has, err := db.Has(MigrateKey); err != nil {
+		return err
+	} else if has {
+		LogInfo("chunk files migrate interrupted, continue move files")
+		return finishMigrate(db, dir)
+	}
+	olds, news, err := listChunkFiles(dir)
+	if err != nil {
+		return err
+	}
+	if len(olds) == 0 {
+		LogInfo("chunk files not need migrate")
+		return nil
+	}
+	if len(news) > 0 {
+		return fmt.Errorf("chunk files format mixed, new files %v", news)
+	}
+	tmp := dir + Separator + "migrate"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, os.ModePerm); err != nil {
+		return err
+	}
+	newstore := func(ext string, siz int64) *sstore {
+		return &sstore{ext: ext, files: map[uint32]*sfile{}, size: siz, dir: tmp, codec: codec}
+	}
+	nblk := newstore(".blk", BlkFileMaxSize)
+	nrev := newstore(".rev", RevFileMaxSize)
+	if err := nblk.Init(); err != nil {
+		return err
+	}
+	if err := nrev.Init(); err != nil {
+		return err
+	}
+	lr := &legacyreader{dir: dir, files: map[string]*os.File{}}
+	defer lr.close()
+	bt := db.NewBatch()
+	num := 0
+	iter := db.Iterator(NewPrefix(BlockPrefix))
+	for iter.Next() {
+		meta := &TBMeta{}
+		if err := meta.Decode(NewReader(iter.Value())); err != nil {
+			iter.Close()
+			return err
+		}
+		if meta.HasBlk() {
+			bb, err := lr.read(".blk", meta.Blk)
+			if err == nil {
+				meta.Blk, err = nblk.Write(bb)
+			}
+			if err != nil {
+				iter.Close()
+				return fmt.Errorf("migrate block %v error %w", meta, err)
+			}
+		}
+		if meta.HasRev() {
+			bb, err := lr.read(".rev", meta.Rev)
+			if err == nil {
+				meta.Rev, err = nrev.Write(bb)
+			}
+			if err != nil {
+				iter.Close()
+				return fmt.Errorf("migrate block %v rev error %w", meta, err)
+			}
+		}
+		hbs, err := meta.Bytes()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		bt.Put(append([]byte{}, iter.Key()...), hbs)
+		num++
+	}
+	iter.Close()
+	nblk.Sync()
+	nrev.Sync()
+	nblk.Close()
+	nrev.Close()
+	//新的数据位置和迁移标记一起写入,之后中断可以继续移动文件
+	bt.Put(MigrateKey, []byte{1})
+	if err := db.Write(bt, true); err != nil {
+		return err
+	}
+	LogInfof("migrate %d blocks chunk files index success", num)
+	return finishMigrate(db, dir)
+}
+
+//移动迁移后的文件,旧文件移动到备份目录,新文件移动到存储目录,完成后删除迁移标记
+//已经移动的文件不再移动,可以重复执行
+func finishMigrate(db DBImp, dir string) error {
+	tmp := dir + Separator + "migrate"
+	bak := dir + Separator + "legacy"
+	if err := os.MkdirAll(bak, os.ModePerm); err != nil {
+		return err
+	}
+	olds, _, err := listChunkFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range olds {
+		if err := os.Rename(dir+Separator+name, bak+Separator+name); err != nil {
+			return err
+		}
+	}
+	_, migs, err := listChunkFiles(tmp)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range migs {
+		if err := os.Rename(tmp+Separator+name, dir+Separator+name); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	bt := db.NewBatch()
+	bt.Del(MigrateKey)
+	if err := db.Write(bt, true); err != nil {
+		return err
+	}
+	LogInfof("migrate chunk files success, legacy files move to %s", bak)
+	return nil
+}
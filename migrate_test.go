@@ -0,0 +1,109 @@
+package xginx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkChecksum(t *testing.T) {
+	NewTestConfig()
+	data := bytes.Repeat([]byte("chunk checksum data"), 100)
+	for _, codec := range []uint8{ChunkCodecNone, ChunkCodecLzma, ChunkCodecSnappy} {
+		dir := NewTempDir()
+		require.NoError(t, os.MkdirAll(dir, os.ModePerm))
+		cs := &sstore{ext: ".blk", files: map[uint32]*sfile{}, size: BlkFileMaxSize, dir: dir, codec: codec}
+		require.NoError(t, cs.Init())
+		st, err := cs.Write(data)
+		require.NoError(t, err)
+		if codec != ChunkCodecNone {
+			require.True(t, st.Len.ToInt() < len(data))
+		}
+		bb, err := cs.Read(st)
+		require.NoError(t, err)
+		require.Equal(t, data, bb)
+		//修改文件中的数据后校验失败
+		f, err := os.OpenFile(cs.fileIDPath(st.ID.ToUInt32()), os.O_WRONLY, 0644)
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte{0xff}, int64(st.Off+st.Len-1))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		_, err = cs.Read(st)
+		require.Equal(t, ErrChunkChecksum, err)
+		cs.Close()
+		require.NoError(t, os.RemoveAll(dir))
+	}
+}
+
+func TestMigrateBlkStore(t *testing.T) {
+	defer checkGoroutines(t)()
+	NewTestConfig()
+	dir := NewTempDir()
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.MkdirAll(dir, os.ModePerm))
+	//创建旧格式的数据文件和索引
+	hb := sfileLegacyHeaderBytes()
+	blkdata := bytes.Repeat([]byte("legacy block"), 50)
+	revdata := []byte("legacy rev")
+	require.NoError(t, ioutil.WriteFile(dir+Separator+"000000.blk", append(append([]byte{}, hb...), blkdata...), 0644))
+	require.NoError(t, ioutil.WriteFile(dir+Separator+"000000.rev", append(append([]byte{}, hb...), revdata...), 0644))
+	meta := &TBMeta{}
+	meta.Txs = 1
+	meta.Blk = BlkChunk{ID: 0, Off: VarUInt(len(hb)), Len: VarUInt(len(blkdata))}
+	meta.Rev = BlkChunk{ID: 0, Off: VarUInt(len(hb)), Len: VarUInt(len(revdata))}
+	id, err := meta.ID()
+	require.NoError(t, err)
+	hbs, err := meta.Bytes()
+	require.NoError(t, err)
+	db, err := NewDBImp(dir)
+	require.NoError(t, err)
+	require.NoError(t, db.Put(BlockPrefix, id[:], hbs))
+	db.Close()
+
+	//旧格式文件需要迁移
+	ss := NewLevelDBStore(dir)
+	_, err = ss.Blk().Read(meta.Blk)
+	require.Equal(t, ErrChunkNeedMigrate, err)
+	ss.Close()
+
+	require.NoError(t, MigrateBlkStore(dir, ChunkCodecSnappy))
+	_, err = os.Stat(dir + Separator + "legacy" + Separator + "000000.blk")
+	require.NoError(t, err)
+	//已经迁移的不再迁移
+	require.NoError(t, MigrateBlkStore(dir, ChunkCodecSnappy))
+
+	//模拟索引更新后文件移动中断,重新执行继续移动文件
+	tmp := dir + Separator + "migrate"
+	require.NoError(t, os.MkdirAll(tmp, os.ModePerm))
+	require.NoError(t, os.Rename(dir+Separator+"000000.blk", tmp+Separator+"000000.blk"))
+	require.NoError(t, os.Rename(dir+Separator+"000000.rev", tmp+Separator+"000000.rev"))
+	require.NoError(t, os.Rename(dir+Separator+"legacy"+Separator+"000000.blk", dir+Separator+"000000.blk"))
+	db, err = NewDBImp(dir)
+	require.NoError(t, err)
+	require.NoError(t, db.Put(MigrateKey, []byte{1}))
+	db.Close()
+	require.NoError(t, MigrateBlkStore(dir, ChunkCodecSnappy))
+	_, err = os.Stat(tmp)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dir + Separator + "legacy" + Separator + "000000.blk")
+	require.NoError(t, err)
+
+	ss = NewLevelDBStore(dir)
+	defer ss.Close()
+	hbs, err = ss.Index().Get(BlockPrefix, id[:])
+	require.NoError(t, err)
+	nmeta := &TBMeta{}
+	require.NoError(t, nmeta.Decode(NewReader(hbs)))
+	bb, err := ss.Blk().Read(nmeta.Blk)
+	require.NoError(t, err)
+	require.Equal(t, blkdata, bb)
+	bb, err = ss.Rev().Read(nmeta.Rev)
+	require.NoError(t, err)
+	require.Equal(t, revdata, bb)
+	has, err := ss.Index().Has(MigrateKey)
+	require.NoError(t, err)
+	require.False(t, has)
+}
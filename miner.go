@@ -16,10 +16,14 @@ const (
 	NewMinerActTopic = "NewMinerAct"
 	//更新了一个区块数据 BlockInfo
 	NewLinkBlockTopic = "NewLinkBlock"
+	//断开了一个区块 UnlinkBlockEvent
+	UnlinkBlockTopic = "UnlinkBlock"
 	//接收的广播区块
 	NewRecvBlockTopic = "NewRecvBlock"
 	//当交易池中的交易被移除时 txid
 	TxPoolDelTxTopic = "TxPoolDelTx"
+	//当交易进入交易池时 TX
+	TxPoolAddTxTopic = "TxPoolAddTx"
 	//每隔多少秒打印挖掘状态
 	MinerLogSeconds = 5
 )
@@ -317,8 +321,6 @@ loop:
 		LogError("link new block error", err)
 		return err
 	}
-	//广播更新了区块数据
-	ps.Pub(blk, NewLinkBlockTopic)
 	//广播区块数据
 	msg := NewMsgBlock(blk)
 	//设置标记为新区块
@@ -0,0 +1,159 @@
+package xginx
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+//消息长度和数量限制
+const (
+	//MaxPackageSize 网络数据包和可变数据最大长度
+	MaxPackageSize = 1024 * 1024 * 5
+	//MaxSmallMsgSize 固定结构小消息最大长度
+	MaxSmallMsgSize = 1024
+	//MaxTextMsgSize 错误和通知消息最大长度
+	MaxTextMsgSize = 1024 * 64
+	//MaxHeadersCount 区块头消息最多包含的区块头数量
+	MaxHeadersCount = MaxGetHeaders
+	//MaxInvCount 库存消息最多包含的数量
+	MaxInvCount = 50000
+	//MaxAddrsCount 地址消息最多包含的地址数量
+	MaxAddrsCount = 2000
+	//MaxTxsCount 交易消息和交易池消息最多包含的交易数量
+	MaxTxsCount = MaxTxPoolSize
+	//MaxMerkleHashs merkle验证hash最大数量
+	MaxMerkleHashs = 64
+	//MaxBlockMsgSize 区块消息最大长度,区块最大长度加上消息头
+	MaxBlockMsgSize = MaxBlockSize + MaxSmallMsgSize
+	//MaxTxMsgSize 交易消息最大长度,交易最大长度和MaxSweepTxSize一致
+	MaxTxMsgSize = MaxSweepTxSize + MaxSmallMsgSize
+	//压缩数据头,4字节原始长度和5字节参数
+	lzmaHeadSize = 9
+)
+
+//消息解码错误
+var (
+	//ErrMsgTooLarge 消息数据超过限制
+	ErrMsgTooLarge = errors.New("message too large")
+	//ErrMsgTooMany 消息元素数量超过限制
+	ErrMsgTooMany = errors.New("message too many elements")
+	//ErrMsgTrailing 严格模式下消息解码后有多余数据
+	ErrMsgTrailing = errors.New("message trailing bytes")
+	//ErrMsgMalformed 消息格式错误
+	ErrMsgMalformed = errors.New("message malformed")
+)
+
+//MsgMaxSizes 每种消息解压后数据的最大长度,不在列表中的消息被拒绝
+var MsgMaxSizes = map[NTType]int{
+	NtVersion:      MaxSmallMsgSize,
+	NtVerAck:       MaxSmallMsgSize,
+	NtPing:         MaxSmallMsgSize,
+	NtPong:         MaxSmallMsgSize,
+	NtGetAddrs:     MaxSmallMsgSize,
+	NtAddrs:        MaxAddrsCount*18 + 16,
+	NtInv:          MaxInvCount*33 + 16,
+	NtGetInv:       MaxInvCount*33 + 16,
+	NtTx:           MaxTxMsgSize,
+	NtBlock:        MaxBlockMsgSize,
+	NtGetBlock:     MaxSmallMsgSize,
+	NtHeaders:      MaxHeadersCount*80 + MaxSmallMsgSize,
+	NtGetHeaders:   MaxSmallMsgSize,
+	NtError:        MaxTextMsgSize,
+	NtAlert:        MaxTextMsgSize,
+	NtFilterLoad:   MaxBloomFilterSize + MaxSmallMsgSize,
+	NtFilterAdd:    MaxSmallMsgSize,
+	NtFilterClear:  MaxSmallMsgSize,
+	NtGetMerkle:    MaxSmallMsgSize,
+	NtTxMerkle:     MaxMerkleHashs*32 + MaxSmallMsgSize,
+	NtGetTxPool:    MaxTxsCount*32 + 16,
+	NtTxPool:       MaxBlockMsgSize,
+	NtMerkleBlock:  MaxBlockMsgSize,
+	NtGetCFHeaders: MaxSmallMsgSize,
+	NtCFHeaders:    MaxGetCFHeaders*32 + MaxSmallMsgSize,
+	NtGetCFilters:  MaxSmallMsgSize,
+	NtCFilters:     MaxPackageSize,
+	NtBroadPkg:     MaxSmallMsgSize,
+	NtBroadAck:     MaxSmallMsgSize,
+}
+
+//MsgMaxSize 获取消息数据最大长度,未知消息返回0
+func MsgMaxSize(typ NTType) int {
+	return MsgMaxSizes[typ]
+}
+
+//MsgZipMaxSize 获取压缩消息数据最大长度,未知消息返回0
+func MsgZipMaxSize(typ NTType) int {
+	max := MsgMaxSize(typ)
+	if max <= 0 {
+		return 0
+	}
+	return zipMaxSize(max)
+}
+
+//压缩后的数据可能比原始数据大
+func zipMaxSize(max int) int {
+	return max + max/10 + lzmaHeadSize + 16
+}
+
+//检查解码出的元素数量,每个元素至少占用一个字节,不能超过剩余数据
+func checkCount(r IReader, num uint64, max int) error {
+	if num > uint64(max) {
+		return fmt.Errorf("%w num=%d max=%d", ErrMsgTooMany, num, max)
+	}
+	if l := remainLen(r); l >= 0 && num > uint64(l) {
+		return fmt.Errorf("%w num=%d remain=%d", ErrMsgMalformed, num, l)
+	}
+	return nil
+}
+
+//获取内存读取流中剩余的数据长度,网络流等无法获取返回-1
+func remainLen(r IReader) int {
+	switch rv := r.(type) {
+	case *reader:
+		return rv.Len()
+	case *readwriter:
+		return rv.Len()
+	}
+	return -1
+}
+
+//压缩数据中记录的原始数据长度
+func lzmaDataLen(zv []byte) (int, error) {
+	if len(zv) < lzmaHeadSize {
+		return 0, ErrMsgMalformed
+	}
+	l := int32(binary.LittleEndian.Uint32(zv))
+	if l <= 0 {
+		return 0, ErrMsgMalformed
+	}
+	return int(l), nil
+}
+
+//DecodeMsg 解码消息数据,strict=true时拒绝解码后有多余数据的消息
+func DecodeMsg(typ NTType, b []byte, strict bool) (MsgIO, error) {
+	m := NewMsgIO(typ)
+	if m == nil {
+		return nil, fmt.Errorf("message not create instance type=%v", typ)
+	}
+	if max := MsgMaxSize(typ); len(b) > max {
+		return nil, fmt.Errorf("%w type=%v len=%d max=%d", ErrMsgTooLarge, typ, len(b), max)
+	}
+	buf := NewReader(b)
+	if err := m.Decode(buf); err != nil {
+		return nil, fmt.Errorf("message type=%v decode error %w", typ, err)
+	}
+	if l := remainLen(buf); strict && l > 0 {
+		return nil, fmt.Errorf("%w type=%v remain=%d", ErrMsgTrailing, typ, l)
+	}
+	return m, nil
+}
+
+//编码消息数据
+func encodeMsg(m MsgIO) ([]byte, error) {
+	buf := NewWriter()
+	if err := m.Encode(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,194 @@
+package xginx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+//解码消息,解码成功的消息重新编码后再解码必须得到相同的数据
+//返回是否解码成功,不一致时返回错误
+func recodeMsg(typ NTType, data []byte) (bool, error) {
+	m, err := DecodeMsg(typ, data, true)
+	if err != nil {
+		return false, nil
+	}
+	b1, err := encodeMsg(m)
+	if err != nil {
+		return false, nil
+	}
+	m2, err := DecodeMsg(typ, b1, true)
+	if err != nil {
+		return true, fmt.Errorf("type=%v decode encoded error %w", typ, err)
+	}
+	b2, err := encodeMsg(m2)
+	if err != nil {
+		return true, fmt.Errorf("type=%v encode decoded error %w", typ, err)
+	}
+	if !bytes.Equal(b1, b2) {
+		return true, fmt.Errorf("type=%v encode not equal", typ)
+	}
+	return true, nil
+}
+
+//解码网络数据包和其中的消息
+func decodePackage(data []byte) bool {
+	pd := &NetPackage{}
+	if err := pd.Decode(NewReader(data)); err != nil {
+		return false
+	}
+	_, err := DecodeMsg(pd.Type, pd.Bytes, true)
+	return err == nil
+}
+
+func (suite *BlockTestSuite) TestMsgLimits() {
+	req := suite.Require()
+	//元素数量超过限制
+	buf := NewWriter()
+	req.NoError(VarUInt(MaxHeadersCount + 1).Encode(buf))
+	_, err := DecodeMsg(NtHeaders, buf.Bytes(), false)
+	req.True(errors.Is(err, ErrMsgTooMany))
+	//数量超过剩余数据
+	buf = NewWriter()
+	req.NoError(VarInt(100).Encode(buf))
+	_, err = DecodeMsg(NtInv, buf.Bytes(), false)
+	req.True(errors.Is(err, ErrMsgMalformed))
+	//负数数量
+	buf = NewWriter()
+	req.NoError(VarInt(-1).Encode(buf))
+	_, err = DecodeMsg(NtAddrs, buf.Bytes(), false)
+	req.True(errors.Is(err, ErrMsgTooMany))
+	//严格模式拒绝多余数据
+	bb, err := encodeMsg(&MsgPing{Time: 1, Height: 2})
+	req.NoError(err)
+	bb = append(bb, 0)
+	_, err = DecodeMsg(NtPing, bb, false)
+	req.NoError(err)
+	_, err = DecodeMsg(NtPing, bb, true)
+	req.True(errors.Is(err, ErrMsgTrailing))
+	//消息长度超过类型限制
+	_, err = DecodeMsg(NtPing, make([]byte, MaxSmallMsgSize+1), false)
+	req.True(errors.Is(err, ErrMsgTooLarge))
+	_, err = DecodeMsg(NTType(0x80), nil, false)
+	req.Error(err)
+	pd := &NetPackage{Flags: conf.flags, Type: NtPing, Bytes: make([]byte, MaxSmallMsgSize+1)}
+	buf = NewWriter()
+	req.NoError(pd.Encode(buf))
+	err = (&NetPackage{}).Decode(NewReader(buf.Bytes()))
+	req.True(errors.Is(err, ErrMsgTooLarge))
+	//压缩数据解压后超过限制
+	pd.Attr = PackageAttrZip
+	buf = NewWriter()
+	req.NoError(pd.Encode(buf))
+	err = (&NetPackage{}).Decode(NewReader(buf.Bytes()))
+	req.True(errors.Is(err, ErrMsgTooLarge))
+	//正常的压缩数据
+	pd = &NetPackage{Flags: conf.flags, Type: NtPing, Attr: PackageAttrZip}
+	pd.Bytes, err = encodeMsg(&MsgPing{Time: 1, Height: 2})
+	req.NoError(err)
+	buf = NewWriter()
+	req.NoError(pd.Encode(buf))
+	bb = buf.Bytes()
+	req.True(decodePackage(bb))
+	//区块和交易消息的限制来自共识规则
+	req.True(MsgMaxSize(NtBlock) > MaxBlockSize)
+	req.True(MsgMaxSize(NtMerkleBlock) > MaxBlockSize)
+	req.Equal(MaxTxMsgSize, MsgMaxSize(NtTx))
+	req.True(MsgZipMaxSize(NtBlock) > MsgMaxSize(NtBlock))
+	//超过MaxPackageSize但未超过区块限制的压缩数据可以解压
+	pd = &NetPackage{Flags: conf.flags, Type: NtBlock, Attr: PackageAttrZip, Bytes: make([]byte, MaxPackageSize+1)}
+	buf = NewWriter()
+	req.NoError(pd.Encode(buf))
+	pd2 := &NetPackage{}
+	req.NoError(pd2.Decode(NewReader(buf.Bytes())))
+	req.Equal(MaxPackageSize+1, len(pd2.Bytes))
+	//压缩头中的原始长度错误
+	pd = &NetPackage{Flags: conf.flags, Type: NtPing, Attr: PackageAttrZip}
+	pd.Bytes, err = encodeMsg(&MsgPing{Time: 1, Height: 2})
+	req.NoError(err)
+	buf = NewWriter()
+	req.NoError(pd.Encode(buf))
+	bb = buf.Bytes()
+	copy(bb[7:], []byte{0xff, 0xff, 0xff, 0xff})
+	err = (&NetPackage{}).Decode(NewReader(bb))
+	req.True(errors.Is(err, ErrMsgMalformed))
+	//地址消息最多MaxAddrsCount个
+	msg := &MsgAddrs{}
+	for i := 0; i <= MaxAddrsCount; i++ {
+		full := msg.Add(NetAddr{ip: []byte{8, 8, byte(i >> 8), byte(i)}, port: 9333})
+		req.Equal(i == MaxAddrsCount, full)
+	}
+	req.Equal(MaxAddrsCount, len(msg.Addrs))
+}
+
+func (suite *BlockTestSuite) TestMsgFuzz() {
+	req := suite.Require()
+	blk, err := suite.bi.LoadBlock(conf.genesis)
+	req.NoError(err)
+	seeds := map[NTType][]MsgIO{}
+	for typ := range MsgMaxSizes {
+		m := NewMsgIO(typ)
+		req.NotNil(m, "type=%v", typ)
+		req.Equal(typ, m.Type())
+		seeds[typ] = append(seeds[typ], m)
+	}
+	bmsg := suite.bi.NewMsgGetBlock(blk.MustID())
+	req.Equal(NtBlock, bmsg.Type())
+	ver := suite.bi.NewMsgVersion()
+	inv := &MsgInv{}
+	inv.AddInv(InvTypeBlock, blk.MustID())
+	inv.AddInv(InvTypeTx, blk.Txs[0].MustID())
+	hs := &MsgHeaders{Info: MsgGetBlock{Next: 1, Count: 2}}
+	hs.Headers.Add(blk.Header)
+	hs.Headers.Add(blk.Header)
+	addrs := &MsgAddrs{}
+	addrs.Add(NetAddrForm("8.8.8.8:9333"))
+	//有效的消息解码后重新编码必须一致
+	for _, m := range []MsgIO{ver, inv, NewMsgBlock(blk), bmsg, NewMsgTx(blk.Txs[0]), hs, addrs, NewMsgAlert("test", nil)} {
+		bb, err := encodeMsg(m)
+		req.NoError(err)
+		ok, err := recodeMsg(m.Type(), bb)
+		req.NoError(err)
+		req.True(ok, "type=%v", m.Type())
+		seeds[m.Type()] = append(seeds[m.Type()], m)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for typ, ms := range seeds {
+		for _, m := range ms {
+			//空消息可能无法编码
+			bb, err := encodeMsg(m)
+			if err != nil {
+				continue
+			}
+			//随机修改,截断和追加数据不能引起panic
+			for i := 0; i < 200; i++ {
+				cb := append([]byte{}, bb...)
+				switch i % 3 {
+				case 0:
+					if len(cb) > 0 {
+						cb[rnd.Intn(len(cb))] = byte(rnd.Intn(256))
+					}
+				case 1:
+					if len(cb) > 0 {
+						cb = cb[:rnd.Intn(len(cb))]
+					}
+				case 2:
+					rb := make([]byte, rnd.Intn(16))
+					rnd.Read(rb)
+					cb = append(cb, rb...)
+				}
+				_, err = recodeMsg(typ, cb)
+				req.NoError(err)
+			}
+		}
+		//完全随机的数据
+		for i := 0; i < 50; i++ {
+			rb := make([]byte, rnd.Intn(64))
+			rnd.Read(rb)
+			_, err := recodeMsg(typ, rb)
+			req.NoError(err)
+			decodePackage(append(conf.flags[:], rb...))
+		}
+	}
+}
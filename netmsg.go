@@ -3,16 +3,21 @@ package xginx
 import (
 	"crypto/md5"
 	"errors"
-	"fmt"
 )
 
-//ToMsgIO 转为类型
+//ToMsgIO 转为类型,配置StrictMsg时使用严格模式解码
 func (v NetPackage) ToMsgIO() (MsgIO, error) {
+	return DecodeMsg(v.Type, v.Bytes, conf.StrictMsg)
+}
+
+//NewMsgIO 创建消息类型对应的空消息,未知类型返回nil
+func NewMsgIO(typ NTType) MsgIO {
 	var m MsgIO = nil
-	buf := NewReader(v.Bytes)
-	switch v.Type {
+	switch typ {
 	case NtVersion:
 		m = &MsgVersion{}
+	case NtVerAck:
+		m = &MsgVerAck{}
 	case NtPing:
 		m = &MsgPing{}
 	case NtPong:
@@ -33,6 +38,18 @@ func (v NetPackage) ToMsgIO() (MsgIO, error) {
 		m = &MsgGetBlock{}
 	case NtHeaders:
 		m = &MsgHeaders{}
+	case NtGetHeaders:
+		m = &MsgGetHeaders{}
+	case NtMerkleBlock:
+		m = &MsgMerkleBlock{}
+	case NtGetCFHeaders:
+		m = &MsgGetCFHeaders{}
+	case NtCFHeaders:
+		m = &MsgCFHeaders{}
+	case NtGetCFilters:
+		m = &MsgGetCFilters{}
+	case NtCFilters:
+		m = &MsgCFilters{}
 	case NtError:
 		m = &MsgError{}
 	case NtAlert:
@@ -56,13 +73,7 @@ func (v NetPackage) ToMsgIO() (MsgIO, error) {
 	case NtBroadPkg:
 		m = &MsgBroadPkg{}
 	}
-	if m == nil {
-		return nil, fmt.Errorf("message not create instance type=%v", v.Type)
-	}
-	if err := m.Decode(buf); err != nil {
-		return nil, fmt.Errorf("message type=%v decode error %w", v.Type, err)
-	}
-	return m, nil
+	return m
 }
 
 //MsgGetAddrs 获取节点记录的其他节点地址
@@ -183,12 +194,12 @@ func (m MsgAddrs) Encode(w IWriter) error {
 	return nil
 }
 
-//Add 最多放2000个
+//Add 最多放MaxAddrsCount个
 func (m *MsgAddrs) Add(a NetAddr) bool {
 	if !a.IsGlobalUnicast() {
 		return false
 	}
-	if len(m.Addrs) > 2000 {
+	if len(m.Addrs) >= MaxAddrsCount {
 		return true
 	}
 	m.Addrs = append(m.Addrs, a)
@@ -201,6 +212,9 @@ func (m *MsgAddrs) Decode(r IReader) error {
 	if err := num.Decode(r); err != nil {
 		return err
 	}
+	if err := checkCount(r, uint64(num), MaxAddrsCount); err != nil {
+		return err
+	}
 	m.Addrs = make([]NetAddr, num)
 	for i := 0; i < num.ToInt(); i++ {
 		err := m.Addrs[i].Decode(r)
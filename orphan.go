@@ -0,0 +1,372 @@
+package xginx
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//孤儿池参数
+const (
+	//最多保存的孤儿交易
+	MaxOrphanTxs = 200
+	//每个连接最多保存的孤儿交易
+	MaxPeerOrphanTxs = 20
+	//孤儿交易过期时间
+	OrphanTxExpire = time.Minute * 20
+	//最多保存的孤儿区块
+	MaxOrphanBlocks = 32
+	//每个连接最多保存的孤儿区块
+	MaxPeerOrphanBlocks = 8
+	//孤儿区块过期时间
+	OrphanBlockExpire = time.Minute * 10
+)
+
+//错误定义
+var (
+	//ErrOrphanTx 交易引用的交易还没有收到
+	ErrOrphanTx = errors.New("orphan tx")
+	//ErrOrphanBlock 区块的上一个区块还没有收到
+	ErrOrphanBlock = errors.New("orphan block")
+	//ErrOrphanPeerLimit 连接保存的孤儿数量超过限制
+	ErrOrphanPeerLimit = errors.New("orphan peer limit")
+)
+
+//孤儿数据
+type orphanEntry struct {
+	id     HASH256
+	prevs  []HASH256 //缺少的父数据
+	peer   uint64    //来自哪个连接
+	expire time.Time
+	value  interface{}
+}
+
+//OrphanPool 孤儿池,保存缺少父数据的交易或者区块
+//父数据到达后取出等待的孤儿重新处理
+type OrphanPool struct {
+	mu      sync.Mutex
+	max     int
+	peerMax int
+	ttl     time.Duration
+	items   map[HASH256]*orphanEntry
+	prevs   map[HASH256]map[HASH256]bool //父id -> 等待的孤儿id
+	peers   map[uint64]int               //每个连接保存的孤儿数量
+}
+
+//NewOrphanPool 创建孤儿池
+func NewOrphanPool(max int, peerMax int, ttl time.Duration) *OrphanPool {
+	return &OrphanPool{
+		max:     max,
+		peerMax: peerMax,
+		ttl:     ttl,
+		items:   map[HASH256]*orphanEntry{},
+		prevs:   map[HASH256]map[HASH256]bool{},
+		peers:   map[uint64]int{},
+	}
+}
+
+func (p *OrphanPool) remove(id HASH256) *orphanEntry {
+	ent, has := p.items[id]
+	if !has {
+		return nil
+	}
+	delete(p.items, id)
+	for _, prev := range ent.prevs {
+		ids := p.prevs[prev]
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(p.prevs, prev)
+		}
+	}
+	if p.peers[ent.peer]--; p.peers[ent.peer] <= 0 {
+		delete(p.peers, ent.peer)
+	}
+	return ent
+}
+
+//池满时删除一个过期的或者最早过期的孤儿
+func (p *OrphanPool) evict(now time.Time) {
+	var old *orphanEntry
+	for _, ent := range p.items {
+		if old == nil || ent.expire.Before(old.expire) {
+			old = ent
+		}
+		if now.After(ent.expire) {
+			break
+		}
+	}
+	if old != nil {
+		p.remove(old.id)
+	}
+}
+
+//Add 加入孤儿,prevs为缺少的父数据id,peer为来源连接
+func (p *OrphanPool) Add(id HASH256, prevs []HASH256, peer uint64, v interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, has := p.items[id]; has {
+		return nil
+	}
+	if p.peers[peer] >= p.peerMax {
+		return fmt.Errorf("%w peer = %d", ErrOrphanPeerLimit, peer)
+	}
+	now := time.Now()
+	for len(p.items) >= p.max {
+		p.evict(now)
+	}
+	ent := &orphanEntry{
+		id:     id,
+		prevs:  prevs,
+		peer:   peer,
+		expire: now.Add(p.ttl),
+		value:  v,
+	}
+	p.items[id] = ent
+	for _, prev := range prevs {
+		ids, has := p.prevs[prev]
+		if !has {
+			ids = map[HASH256]bool{}
+			p.prevs[prev] = ids
+		}
+		ids[id] = true
+	}
+	p.peers[peer]++
+	return nil
+}
+
+//Has 是否有孤儿
+func (p *OrphanPool) Has(id HASH256) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, has := p.items[id]
+	return has
+}
+
+//Len 孤儿数量
+func (p *OrphanPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.items)
+}
+
+//取出等待prev的孤儿,取出后从池中删除
+func (p *OrphanPool) take(prev HASH256) []*orphanEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ents := []*orphanEntry{}
+	for id := range p.prevs[prev] {
+		if ent := p.remove(id); ent != nil {
+			ents = append(ents, ent)
+		}
+	}
+	return ents
+}
+
+//Take 取出等待prev的孤儿,取出后从池中删除
+func (p *OrphanPool) Take(prev HASH256) []interface{} {
+	vs := []interface{}{}
+	for _, ent := range p.take(prev) {
+		vs = append(vs, ent.value)
+	}
+	return vs
+}
+
+//Expire 删除过期的孤儿,返回删除的数量
+func (p *OrphanPool) Expire() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	num := 0
+	for id, ent := range p.items {
+		if now.After(ent.expire) {
+			p.remove(id)
+			num++
+		}
+	}
+	return num
+}
+
+//RemovePeer 删除来自连接的所有孤儿
+func (p *OrphanPool) RemovePeer(peer uint64) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	num := 0
+	for id, ent := range p.items {
+		if ent.peer == peer {
+			p.remove(id)
+			num++
+		}
+	}
+	return num
+}
+
+//MissTxs 获取交易引用的还没有在区块和交易池中的交易
+//引用交易池中交易的不是孤儿交易,由交易检测决定是否接受
+func (pool *TxPool) MissTxs(bi *BlockIndex, tx *TX) []HASH256 {
+	ids := []HASH256{}
+	if tx.IsCoinBase() {
+		return ids
+	}
+	for _, in := range tx.Ins {
+		if pool.Has(in.OutHash) {
+			continue
+		}
+		if has, err := bi.HasTxValue(in.OutHash); err != nil || has {
+			continue
+		}
+		dup := false
+		for _, id := range ids {
+			dup = dup || id.Equal(in.OutHash)
+		}
+		if !dup {
+			ids = append(ids, in.OutHash)
+		}
+	}
+	return ids
+}
+
+//保存孤儿交易并向c请求缺少的交易
+func (s *TCPServer) addOrphanTx(c *Client, tx *TX, miss []HASH256) error {
+	id, err := tx.ID()
+	if err != nil {
+		return err
+	}
+	if err := s.otxs.Add(id, miss, c.id, tx); err != nil {
+		return err
+	}
+	LogInfof("add orphan tx %v miss %d txs, orphan size = %d", id, len(miss), s.otxs.Len())
+	txp := s.blockIndex().GetTxPool()
+	msg := &MsgGetInv{}
+	for _, mid := range miss {
+		//已经在交易池中的等待区块确认
+		if txp.Has(mid) {
+			continue
+		}
+		if s.pkgs.Add("I"+string(mid[:]), time.Now(), InvRequestTimeout) != nil {
+			continue
+		}
+		msg.AddInv(InvTypeTx, mid)
+	}
+	if len(msg.Invs) > 0 {
+		c.SendMsg(msg)
+	}
+	return nil
+}
+
+//区块连接后,处理等待区块中交易的孤儿交易
+func (s *TCPServer) acceptOrphanTxs(blk *BlockInfo) {
+	bi := s.blockIndex()
+	txp := bi.GetTxPool()
+	for _, btx := range blk.Txs {
+		for _, ent := range s.otxs.take(btx.MustID()) {
+			tx := ent.value.(*TX)
+			if miss := txp.MissTxs(bi, tx); len(miss) > 0 {
+				//还缺少其他交易,等待其他交易到达
+				if err := s.otxs.Add(ent.id, miss, ent.peer, tx); err != nil {
+					LogError("readd orphan tx error", err)
+				}
+				continue
+			}
+			if err := txp.PushTx(bi, tx); err != nil {
+				LogError("push orphan tx error", err)
+				continue
+			}
+			LogInfo("accept orphan tx =", tx, " txpool size =", txp.Len())
+			s.RelayTx(tx)
+		}
+	}
+}
+
+//接收区块连接通知放入队列,不阻塞发布者
+//处理孤儿交易时放入交易池会发布消息,直接处理时发布者和订阅者可能互相等待
+func (s *TCPServer) orphanLoop(ch chan interface{}) {
+	defer s.recoverError()
+	s.wg.Add(1)
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.cctx.Done():
+			return
+		case cv, ok := <-ch:
+			//取消订阅后通道关闭
+			if !ok {
+				return
+			}
+			s.oqmu.Lock()
+			s.oqueue = append(s.oqueue, cv)
+			s.oqmu.Unlock()
+			select {
+			case s.oqch <- true:
+			default:
+			}
+		}
+	}
+}
+
+//处理队列中的区块连接通知,接受等待区块中交易的孤儿交易
+func (s *TCPServer) orphanExec() {
+	defer s.recoverError()
+	s.wg.Add(1)
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.cctx.Done():
+			return
+		case <-s.oqch:
+			s.oqmu.Lock()
+			cvs := s.oqueue
+			s.oqueue = nil
+			s.oqmu.Unlock()
+			for _, cv := range cvs {
+				if blk, ok := cv.(*BlockInfo); ok {
+					s.acceptOrphanTxs(blk)
+				}
+			}
+		}
+	}
+}
+
+//保存孤儿区块并向c请求上一个区块
+func (s *TCPServer) addOrphanBlock(c *Client, msg *MsgBlock) error {
+	id, err := msg.Blk.ID()
+	if err != nil {
+		return err
+	}
+	prev := msg.Blk.Header.Prev
+	if err := s.oblks.Add(id, []HASH256{prev}, c.id, msg); err != nil {
+		return err
+	}
+	LogInfof("add orphan block %v miss prev %v, orphan size = %d", id, prev, s.oblks.Len())
+	if s.pkgs.Add("B"+string(prev[:]), time.Now(), InvRequestTimeout) != nil {
+		return nil
+	}
+	gsg := &MsgGetInv{}
+	gsg.AddInv(InvTypeBlock, prev)
+	c.SendMsg(gsg)
+	return nil
+}
+
+//区块连接后,连接等待这个区块的孤儿区块
+func (s *TCPServer) linkOrphanBlocks(blk *BlockInfo) {
+	bi := s.blockIndex()
+	ps := bi.GetPubSub()
+	blks := []*BlockInfo{blk}
+	for len(blks) > 0 {
+		cur := blks[0]
+		blks = blks[1:]
+		for _, v := range s.oblks.Take(cur.MustID()) {
+			msg := v.(*MsgBlock)
+			if err := bi.LinkBlk(msg.Blk); err != nil {
+				LogError("link orphan block error", err)
+				continue
+			}
+			LogInfo("link orphan block ", msg.Blk, "height =", msg.Blk.Meta.Height)
+			if msg.IsNewBlock() {
+				s.BroadMsg(msg)
+			}
+			ps.Pub(msg.Blk, NewRecvBlockTopic)
+			blks = append(blks, msg.Blk)
+		}
+	}
+}
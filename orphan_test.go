@@ -0,0 +1,182 @@
+package xginx
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOrphanPool(t *testing.T) {
+	p := NewOrphanPool(3, 2, time.Minute)
+	prev := Hash256From([]byte("prev"))
+	ids := []HASH256{}
+	for i := 0; i < 4; i++ {
+		ids = append(ids, Hash256From([]byte{byte(i)}))
+	}
+	if err := p.Add(ids[0], []HASH256{prev}, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Add(ids[1], []HASH256{prev}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	//每个连接的数量限制
+	if err := p.Add(ids[2], []HASH256{prev}, 1, 2); !errors.Is(err, ErrOrphanPeerLimit) {
+		t.Fatalf("peer limit error %v", err)
+	}
+	//池满时删除最早的
+	if err := p.Add(ids[2], []HASH256{ids[0]}, 2, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Add(ids[3], []HASH256{ids[0]}, 3, 3); err != nil {
+		t.Fatal(err)
+	}
+	if p.Len() != 3 || p.Has(ids[0]) {
+		t.Fatal("orphan pool evict error")
+	}
+	//取出等待的孤儿
+	vs := p.Take(prev)
+	if len(vs) != 1 || vs[0].(int) != 1 || p.Has(ids[1]) {
+		t.Fatalf("take orphan error %v", vs)
+	}
+	if len(p.Take(prev)) != 0 {
+		t.Fatal("take orphan twice")
+	}
+	if p.RemovePeer(2) != 1 || p.Has(ids[2]) {
+		t.Fatal("remove peer orphan error")
+	}
+	p.ttl = -time.Second
+	if err := p.Add(ids[0], []HASH256{prev}, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if p.Expire() != 1 || p.Len() != 1 {
+		t.Fatal("expire orphan error")
+	}
+}
+
+func (suite *BlockTestSuite) TestOrphanBlock() {
+	req := suite.Require()
+	bi := suite.bi
+	s := NewTCPServer().(*TCPServer)
+	s.cctx, s.cfun = context.WithCancel(context.Background())
+	defer s.cfun()
+	c := s.NewClient()
+	c.setAcked()
+	c.proto = ProtocolVersion
+	bv := bi.GetBestValue()
+	b2, err := bi.LoadBlock(bv.ID)
+	req.NoError(err)
+	b1, err := bi.LoadBlock(b2.Header.Prev)
+	req.NoError(err)
+	req.NoError(bi.UnlinkLast())
+	req.NoError(bi.UnlinkLast())
+	//上一个区块没有收到,保存并请求上一个区块
+	req.True(errors.Is(bi.LinkBlk(b2), ErrOrphanBlock))
+	req.NoError(s.recvMsgBlock(c, NewMsgBlock(b2)))
+	req.True(s.oblks.Has(bv.ID))
+	gsg := (<-c.wc).(*MsgGetInv)
+	req.Equal(1, len(gsg.Invs))
+	req.Equal(InvTypeBlock, gsg.Invs[0].InvType)
+	req.Equal(b2.Header.Prev, gsg.Invs[0].InvID)
+	//收到上一个区块后自动连接
+	req.NoError(s.recvMsgBlock(c, NewMsgBlock(b1)))
+	req.Equal(0, s.oblks.Len())
+	req.Equal(bv.ID, bi.GetBestValue().ID)
+}
+
+func (suite *BlockTestSuite) TestOrphanTx() {
+	req := suite.Require()
+	bi := suite.bi
+	txp := bi.GetTxPool()
+	s := NewTCPServer().(*TCPServer)
+	s.cctx, s.cfun = context.WithCancel(context.Background())
+	defer s.cfun()
+	c := s.NewClient()
+	c.setAcked()
+	c.proto = ProtocolVersion
+	script, err := GetTestListener(bi).GetAccount(0).NewWitnessScript(DefaultInputScript).ToScript()
+	req.NoError(err)
+	newTx := func(ids ...HASH256) *TX {
+		tx := NewTx(DefaultExeLimit, DefaultTxScript)
+		for _, id := range ids {
+			tx.Ins = append(tx.Ins, &TxIn{OutHash: id, Script: script, Sequence: FinalSequence})
+		}
+		return tx
+	}
+	bv := bi.GetBestValue()
+	blk, err := bi.LoadBlock(bv.ID)
+	req.NoError(err)
+	cid := blk.Txs[0].MustID()
+	req.NoError(bi.UnlinkLast())
+	//引用的交易所在区块还没有连接
+	tx1 := newTx(cid)
+	id1 := tx1.MustID()
+	req.Equal([]HASH256{cid}, txp.MissTxs(bi, tx1))
+	req.True(errors.Is(txp.PushTx(bi, tx1), ErrOrphanTx))
+	//保存孤儿交易并请求缺少的交易
+	req.NoError(s.recvMsgTx(c, NewMsgTx(tx1)))
+	req.True(s.otxs.Has(id1))
+	gsg := (<-c.wc).(*MsgGetInv)
+	req.Equal(1, len(gsg.Invs))
+	req.Equal(InvTypeTx, gsg.Invs[0].InvType)
+	req.Equal(cid, gsg.Invs[0].InvID)
+	//还缺少其他交易的继续等待
+	oid := Hash256From([]byte("orphan parent"))
+	tx2 := newTx(cid, oid)
+	id2 := tx2.MustID()
+	req.NoError(s.recvMsgTx(c, NewMsgTx(tx2)))
+	req.Equal(2, s.otxs.Len())
+	req.NoError(bi.LinkBlk(blk))
+	s.acceptOrphanTxs(blk)
+	req.False(s.otxs.Has(id1))
+	req.True(s.otxs.Has(id2))
+	req.Equal([]HASH256{oid}, txp.MissTxs(bi, tx2))
+	//引用coinbase且没有签名,不能进入交易池
+	req.False(txp.Has(id1))
+	req.Equal(1, s.otxs.RemovePeer(c.id))
+	//引用的交易在交易池中时不是孤儿交易,交易池中的输出不能消费
+	acc := GetTestListener(bi).GetAccount(0)
+	aaddr, err := acc.GetAddress()
+	req.NoError(err)
+	coins, err := bi.ListCoins(aaddr)
+	req.NoError(err)
+	ptx := NewTx(DefaultExeLimit, DefaultTxScript)
+	in, err := coins.Coins[0].NewTxIn(acc.NewWitnessScript(DefaultInputScript))
+	req.NoError(err)
+	ptx.Ins = append(ptx.Ins, in)
+	out, err := aaddr.NewTxOut(Coin, nil, DefaultLockedScript)
+	req.NoError(err)
+	ptx.Outs = append(ptx.Outs, out)
+	req.NoError(ptx.Sign(bi, newaccsigner(acc)))
+	req.NoError(txp.PushTx(bi, ptx))
+	defer txp.Del(bi, ptx.MustID())
+	tx3 := newTx(ptx.MustID())
+	req.Equal(0, len(txp.MissTxs(bi, tx3)))
+	err = txp.PushTx(bi, tx3)
+	req.Error(err)
+	req.False(errors.Is(err, ErrOrphanTx))
+	req.NoError(s.recvMsgTx(c, NewMsgTx(tx3)))
+	req.False(s.otxs.Has(tx3.MustID()))
+}
+
+//订阅通道关闭后停止接收区块连接通知
+func TestOrphanLoopClosed(t *testing.T) {
+	s := NewTCPServer().(*TCPServer)
+	s.cctx, s.cfun = context.WithCancel(context.Background())
+	defer s.cfun()
+	ch := make(chan interface{})
+	done := make(chan bool)
+	go func() {
+		s.orphanLoop(ch)
+		close(done)
+	}()
+	close(ch)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("orphan loop not return after channel closed")
+	}
+	if len(s.oqueue) != 0 {
+		t.Fatal("closed channel value queued")
+	}
+}
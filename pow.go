@@ -29,6 +29,18 @@ func GetMinPowBits() uint32 {
 	return NewUINT256(conf.PowLimit).Compact(false)
 }
 
+//CalcWork 计算难度对应的工作量,2^256/(target+1)
+func CalcWork(bits uint32) UINT256 {
+	h := UINT256{}
+	n, o := h.SetCompact(bits)
+	if n || o || h.IsZero() {
+		return UINT256{}
+	}
+	one := NewUINT256(1)
+	//2^256/(target+1) = ~target/(target+1)+1
+	return h.Neg().Sub(one).Div(h.Add(one)).Add(one)
+}
+
 //CheckProofOfWorkBits 检测难度值是否正确
 func CheckProofOfWorkBits(bits uint32) bool {
 	h := UINT256{}
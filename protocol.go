@@ -11,6 +11,7 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/cxuhua/lzma"
@@ -65,6 +66,20 @@ func (t NTType) String() string {
 		return "NT_BROAD_ACK"
 	case NtHeaders:
 		return "NT_HEADERS"
+	case NtGetHeaders:
+		return "NT_GET_HEADERS"
+	case NtMerkleBlock:
+		return "NT_MERKLE_BLOCK"
+	case NtGetCFHeaders:
+		return "NT_GET_CFHEADERS"
+	case NtCFHeaders:
+		return "NT_CFHEADERS"
+	case NtGetCFilters:
+		return "NT_GET_CFILTERS"
+	case NtCFilters:
+		return "NT_CFILTERS"
+	case NtVerAck:
+		return "NT_VERACK"
 	default:
 		return "NT_UNKNOW"
 	}
@@ -106,6 +121,17 @@ const (
 	//获取内存交易池
 	NtGetTxPool = NTType(19)
 	NtTxPool    = NTType(20)
+	//轻节点按高度获取区块头
+	NtGetHeaders = NTType(21)
+	//发送给设置过滤器连接的区块
+	NtMerkleBlock = NTType(22)
+	//区块过滤器头和区块过滤器
+	NtGetCFHeaders = NTType(23)
+	NtCFHeaders    = NTType(24)
+	NtGetCFilters  = NTType(25)
+	NtCFilters     = NTType(26)
+	//收到版本信息后确认,握手完成
+	NtVerAck = NTType(27)
 	//广播包头和响应,当广播消息时只发送广播包头，收到包头如果确定无需要收取数据再请求包数据
 	NtBroadPkg = NTType(0xf0)
 	NtBroadAck = NTType(0xf1)
@@ -249,6 +275,9 @@ const (
 	ErrCodeTxMerkle   = 100005
 	ErrCodeBlockMiss  = 100006
 	ErrCodeHeaders    = 100007
+	ErrCodeCFilter    = 100008
+	ErrCodeVersion    = 100009
+	ErrCodeService    = 100010
 )
 
 //MsgError 错误消息
@@ -388,7 +417,7 @@ func (c NetAddr) Encode(w IWriter) error {
 //Decode 解码网络地址
 func (c *NetAddr) Decode(r IReader) error {
 	ip6 := make([]byte, net.IPv6len)
-	if _, err := r.Read(ip6); err != nil {
+	if err := r.ReadFull(ip6); err != nil {
 		return err
 	}
 	c.ip = ip6
@@ -497,8 +526,21 @@ func (v *MsgPong) Decode(r IReader) error {
 const (
 	//全节点
 	FullNodeFlag = 1 << 0
+	//支持布隆过滤器,发送merkle区块和交易merkle树
+	FilterNodeFlag = 1 << 1
+	//支持区块过滤器
+	CFilterNodeFlag = 1 << 2
+	//支持紧凑区块
+	CompactBlockFlag = 1 << 3
+	//只保存最近的区块
+	PrunedNodeFlag = 1 << 4
+	//支持加密传输
+	EncryptNodeFlag = 1 << 5
 )
 
+//DefaultServices 全节点提供的服务
+const DefaultServices = FullNodeFlag | FilterNodeFlag | CFilterNodeFlag
+
 //MsgVersion 版本消息包
 type MsgVersion struct {
 	Ver     uint32  //版本
@@ -507,6 +549,7 @@ type MsgVersion struct {
 	Height  uint32  //节点区块高度
 	NodeID  uint64  //节点id
 	Tps     VarUInt //交易池数量
+	Proto   uint32  //协议版本,旧版本节点没有
 }
 
 //NewMsgVersion 在链上生成一个版本数据包
@@ -515,12 +558,21 @@ func (bi *BlockIndex) NewMsgVersion() *MsgVersion {
 	m.Ver = conf.Ver
 	m.Addr = conf.GetNetAddr()
 	m.Height = bi.BestHeight()
-	m.Service = FullNodeFlag
+	m.Service = DefaultServices
 	m.NodeID = conf.nodeid
 	m.Tps = VarUInt(bi.txp.Len())
+	m.Proto = ProtocolVersion
 	return m
 }
 
+//ProtoVer 节点的协议版本,旧版本节点作为最低协议版本
+func (v MsgVersion) ProtoVer() uint32 {
+	if v.Proto == 0 {
+		return MinProtocolVersion
+	}
+	return v.Proto
+}
+
 //ID 消息ID
 func (v MsgVersion) ID() (MsgID, error) {
 	return ErrMsgID, ErrNotID
@@ -551,6 +603,9 @@ func (v MsgVersion) Encode(w IWriter) error {
 	if err := v.Tps.Encode(w); err != nil {
 		return err
 	}
+	if err := w.TWrite(v.Proto); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -574,6 +629,12 @@ func (v *MsgVersion) Decode(r IReader) error {
 	if err := v.Tps.Decode(r); err != nil {
 		return err
 	}
+	//旧版本节点没有协议版本
+	if err := r.TRead(&v.Proto); err == io.EOF {
+		v.Proto = 0
+	} else if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -587,8 +648,10 @@ type INetStream interface {
 
 //NetStream 网络读写流
 type NetStream struct {
-	len   int    //收发到的数据总数
-	bytes []byte //最后收到的数据包
+	rbytes uint64 //连接上收到的字节数
+	wbytes uint64 //连接上发送的字节数
+	len    int    //收发到的数据总数
+	bytes  []byte //最后收到的数据包
 	net.Conn
 }
 
@@ -613,6 +676,20 @@ func (s *NetStream) Len() int {
 	return s.len
 }
 
+//Read 读取并记录收到的字节数
+func (s *NetStream) Read(b []byte) (int, error) {
+	n, err := s.Conn.Read(b)
+	atomic.AddUint64(&s.rbytes, uint64(n))
+	return n, err
+}
+
+//Write 写入并记录发送的字节数
+func (s *NetStream) Write(b []byte) (int, error) {
+	n, err := s.Conn.Write(b)
+	atomic.AddUint64(&s.wbytes, uint64(n))
+	return n, err
+}
+
 //WriteFull 完整写入
 func (s *NetStream) WriteFull(dp []byte) error {
 	return WriteFull(s, dp)
@@ -655,6 +732,10 @@ func (s *NetStream) WriteMsg(m MsgIO, attrs ...uint8) error {
 	if err := m.Encode(buf); err != nil {
 		return err
 	}
+	//超过限制的消息对方会拒绝
+	if max := MsgMaxSize(m.Type()); buf.Len() > max {
+		return fmt.Errorf("%w type=%v len=%d max=%d", ErrMsgTooLarge, m.Type(), buf.Len(), max)
+	}
 	attr := uint8(0)
 	for _, av := range attrs {
 		attr |= av
@@ -776,6 +857,11 @@ func (v *NetPackage) Decode(r IReader) error {
 		return err
 	}
 	v.Type = NTType(typ)
+	//未知消息没有长度限制直接拒绝
+	max := MsgMaxSize(v.Type)
+	if max <= 0 {
+		return fmt.Errorf("message type=%v unknown", v.Type)
+	}
 	//attr
 	attr, err := r.ReadByte()
 	if err != nil {
@@ -784,9 +870,9 @@ func (v *NetPackage) Decode(r IReader) error {
 	//bytes
 	v.Attr = attr
 	if v.IsZip() {
-		err = v.Bytes.Uncompress(r)
+		err = v.Bytes.UncompressLimit(r, MsgZipMaxSize(v.Type), max)
 	} else {
-		err = v.Bytes.Decode(r)
+		err = v.Bytes.DecodeLimit(r, max)
 	}
 	if err != nil {
 		return err
@@ -1050,11 +1136,24 @@ func (v VarBytes) Compress(w IWriter) error {
 
 //Uncompress 解压解码解码可变数据
 func (v *VarBytes) Uncompress(r IReader) error {
+	return v.UncompressLimit(r, zipMaxSize(MaxPackageSize), MaxPackageSize)
+}
+
+//UncompressLimit 解压解码可变数据,压缩数据长度不能超过zmax,解压后长度不能超过max
+func (v *VarBytes) UncompressLimit(r IReader, zmax int, max int) error {
 	zv := VarBytes{}
-	err := zv.Decode(r)
+	err := zv.DecodeLimit(r, zmax)
 	if err != nil {
 		return err
 	}
+	//解压前检查头中记录的原始长度
+	l, err := lzmaDataLen(zv)
+	if err != nil {
+		return err
+	}
+	if l > max {
+		return fmt.Errorf("%w uncompress len=%d max=%d", ErrMsgTooLarge, l, max)
+	}
 	vv, err := lzma.Uncompress(zv)
 	if err != nil {
 		return err
@@ -1082,6 +1181,11 @@ func (v VarBytes) Encode(w IWriter) error {
 
 //Decode 解码可变数据
 func (v *VarBytes) Decode(r IReader) error {
+	return v.DecodeLimit(r, MaxPackageSize)
+}
+
+//DecodeLimit 解码可变数据,长度不能超过max
+func (v *VarBytes) DecodeLimit(r IReader, max int) error {
 	l, err := binary.ReadUvarint(r)
 	if err != nil {
 		return err
@@ -1089,8 +1193,11 @@ func (v *VarBytes) Decode(r IReader) error {
 	if l == 0 {
 		return nil
 	}
-	if l > 1024*1024*5 {
-		return errors.New("bytes length too long")
+	if l > uint64(max) {
+		return fmt.Errorf("%w len=%d max=%d", ErrMsgTooLarge, l, max)
+	}
+	if rl := remainLen(r); rl >= 0 && l > uint64(rl) {
+		return fmt.Errorf("%w len=%d remain=%d", ErrMsgMalformed, l, rl)
 	}
 	*v = make([]byte, l)
 	if err := r.ReadFull(*v); err != nil {
@@ -0,0 +1,169 @@
+package xginx
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	sentinel "github.com/alibaba/sentinel-golang/api"
+	"github.com/alibaba/sentinel-golang/core/base"
+	"github.com/alibaba/sentinel-golang/core/flow"
+	"github.com/alibaba/sentinel-golang/core/hotspot"
+)
+
+//限流参数
+const (
+	//限流资源名称前缀,后面是消息名称
+	RateLimitPrefix = "xginx.net."
+	//统计超过限制次数的时间窗口
+	RateViolateWindow = time.Minute
+)
+
+//DefaultRateLimits 默认所有连接每种消息每秒最多处理的数量
+var DefaultRateLimits = map[string]float64{
+	NtGetBlock.String():     500,
+	NtGetMerkle.String():    500,
+	NtTx.String():           2000,
+	NtGetHeaders.String():   50,
+	NtGetCFHeaders.String(): 50,
+	NtGetCFilters.String():  200,
+	NtGetInv.String():       1000,
+	NtGetTxPool.String():    20,
+	NtGetAddrs.String():     20,
+}
+
+//DefaultPeerLimits 默认每个连接每种消息每秒最多处理的数量
+var DefaultPeerLimits = map[string]float64{
+	NtGetBlock.String():     50,
+	NtGetMerkle.String():    50,
+	NtTx.String():           200,
+	NtGetHeaders.String():   5,
+	NtGetCFHeaders.String(): 5,
+	NtGetCFilters.String():  20,
+	NtGetInv.String():       100,
+	NtGetTxPool.String():    2,
+	NtGetAddrs.String():     2,
+}
+
+//限流的消息,加载规则后设置
+var ratetypes atomic.Value
+
+//LoadRateLimits 加载限流规则
+//global为所有连接每种消息每秒最多处理的数量,peer为每个连接的数量,键为消息名称
+func LoadRateLimits(global map[string]float64, peer map[string]float64) error {
+	types := map[NTType]bool{}
+	names := map[string]NTType{}
+	for t := NTType(1); t < 0xff; t++ {
+		if s := t.String(); s != "NT_UNKNOW" {
+			names[s] = t
+		}
+	}
+	frs := []*flow.FlowRule{}
+	for name, count := range global {
+		t, has := names[name]
+		if !has {
+			return fmt.Errorf("rate limit msg %s unknow", name)
+		}
+		frs = append(frs, &flow.FlowRule{
+			Resource:        RateLimitPrefix + name,
+			MetricType:      flow.QPS,
+			Count:           count,
+			ControlBehavior: flow.Reject,
+		})
+		types[t] = true
+	}
+	hrs := []*hotspot.Rule{}
+	for name, count := range peer {
+		t, has := names[name]
+		if !has {
+			return fmt.Errorf("peer limit msg %s unknow", name)
+		}
+		//按连接id分别统计
+		hrs = append(hrs, &hotspot.Rule{
+			Resource:        RateLimitPrefix + name,
+			MetricType:      hotspot.QPS,
+			ControlBehavior: hotspot.Reject,
+			ParamIndex:      0,
+			Threshold:       count,
+			DurationInSec:   1,
+		})
+		types[t] = true
+	}
+	if _, err := flow.LoadRules(frs); err != nil {
+		return err
+	}
+	if _, err := hotspot.LoadRules(hrs); err != nil {
+		return err
+	}
+	ratetypes.Store(types)
+	return nil
+}
+
+//是否需要限流的消息
+func isRateLimit(t NTType) bool {
+	types, ok := ratetypes.Load().(map[NTType]bool)
+	return ok && types[t]
+}
+
+//GetRateLimits 获取限流配置,没有配置使用默认值
+func (c *Config) GetRateLimits() (map[string]float64, map[string]float64) {
+	global := c.RateLimits
+	if global == nil {
+		global = DefaultRateLimits
+	}
+	peer := c.PeerLimits
+	if peer == nil {
+		peer = DefaultPeerLimits
+	}
+	return global, peer
+}
+
+//检测消息是否超过限制,超过返回错误,消息会被丢弃
+//窗口时间内超过限制的次数大于conf.MaxViolate时断开连接
+func (c *Client) checkRate(m MsgIO) error {
+	typ := m.Type()
+	if !isRateLimit(typ) {
+		return nil
+	}
+	e, b := sentinel.Entry(RateLimitPrefix+typ.String(),
+		sentinel.WithTrafficType(base.Inbound),
+		sentinel.WithArgs(c.id),
+	)
+	if b == nil {
+		e.Exit()
+		return nil
+	}
+	now := time.Now()
+	if now.Sub(c.vtime) > RateViolateWindow {
+		c.vtime = now
+		atomic.StoreInt32(&c.violate, 0)
+	}
+	num := atomic.AddInt32(&c.violate, 1)
+	atomic.AddInt32(&c.dropped, 1)
+	if conf.MaxViolate > 0 && int(num) > conf.MaxViolate {
+		c.Close()
+		return fmt.Errorf("msg %v rate limit violate %d, closed", typ, num)
+	}
+	return fmt.Errorf("msg %v rate limit %v", typ, b.BlockType())
+}
+
+//RecvBytes 从连接收到的字节数
+func (c *Client) RecvBytes() uint64 {
+	if c.NetStream == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.rbytes)
+}
+
+//SendBytes 发送到连接的字节数
+func (c *Client) SendBytes() uint64 {
+	if c.NetStream == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.wbytes)
+}
+
+//Dropped 超过限制丢弃的消息数量
+func (c *Client) Dropped() int {
+	return int(atomic.LoadInt32(&c.dropped))
+}
@@ -0,0 +1,57 @@
+package xginx
+
+import (
+	"context"
+	"net"
+)
+
+func (suite *BlockTestSuite) TestRateLimit() {
+	req := suite.Require()
+	s := NewTCPServer().(*TCPServer)
+	s.cctx, s.cfun = context.WithCancel(context.Background())
+	defer s.cfun()
+	req.Error(LoadRateLimits(map[string]float64{"NT_NONE": 1}, nil))
+	req.NoError(LoadRateLimits(map[string]float64{NtGetAddrs.String(): 100}, map[string]float64{NtGetAddrs.String(): 2}))
+	defer func() {
+		req.NoError(LoadRateLimits(nil, nil))
+	}()
+	c1 := s.NewClient()
+	c1.id = 1
+	c2 := s.NewClient()
+	c2.id = 2
+	//没有限制的消息
+	for i := 0; i < 10; i++ {
+		req.NoError(c1.checkRate(&MsgPing{}))
+	}
+	//每个连接分别限制
+	req.NoError(c1.checkRate(&MsgGetAddrs{}))
+	req.NoError(c1.checkRate(&MsgGetAddrs{}))
+	req.Error(c1.checkRate(&MsgGetAddrs{}))
+	req.NoError(c2.checkRate(&MsgGetAddrs{}))
+	req.Equal(1, c1.Dropped())
+	req.Equal(0, c2.Dropped())
+	//超过限制次数断开连接
+	max := conf.MaxViolate
+	conf.MaxViolate = 2
+	defer func() {
+		conf.MaxViolate = max
+	}()
+	req.Error(c1.checkRate(&MsgGetAddrs{}))
+	req.NoError(c1.cctx.Err())
+	req.Error(c1.checkRate(&MsgGetAddrs{}))
+	req.Error(c1.cctx.Err())
+	//收发字节数
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	c1.NetStream = NewNetStream(p1)
+	peer := NewNetStream(p2)
+	go func() {
+		_ = peer.WriteMsg(&MsgGetAddrs{})
+	}()
+	_, err := c1.ReadMsg()
+	req.NoError(err)
+	req.NotZero(c1.RecvBytes())
+	req.Zero(c1.SendBytes())
+	req.Zero(c2.RecvBytes())
+}
@@ -0,0 +1,475 @@
+package xginx
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+//重建索引时每次删除的索引数量
+const reindexDelBatch = 10000
+
+//计算进度并回调
+type progress struct {
+	fn    func(pv uint)
+	total int
+	pv    uint
+}
+
+func (p *progress) step(i int) {
+	if p.fn == nil || p.total <= 0 {
+		return
+	}
+	cv := uint(i * 100 / p.total)
+	if cv == p.pv || cv == 0 {
+		return
+	}
+	p.pv = cv
+	p.fn(cv)
+}
+
+//金额输出点key
+func coinOutKey(id HASH256, idx VarUInt) string {
+	return string(id[:]) + string(idx.Bytes())
+}
+
+//按高度查找主链区块中的交易,调用者需要持有读锁
+func (bi *BlockIndex) verifyLoadTx(h uint32, id HASH256) (*TX, error) {
+	ele := bi.gethele(h)
+	if ele == nil {
+		return nil, fmt.Errorf("height %d block miss", h)
+	}
+	bid, err := ele.ID()
+	if err != nil {
+		return nil, err
+	}
+	blk, err := bi.loadblock(bid)
+	if err != nil {
+		return nil, err
+	}
+	for _, tx := range blk.Txs {
+		if tid, err := tx.ID(); err == nil && tid.Equal(id) {
+			return tx, nil
+		}
+	}
+	return nil, fmt.Errorf("tx %v not in height %d block", id, h)
+}
+
+//获取交易输出对应的金额
+func verifyOutCoin(tx *TX, idx int, h uint32) (*CoinKeyValue, error) {
+	if idx < 0 || idx >= len(tx.Outs) {
+		return nil, fmt.Errorf("outindex out of bound")
+	}
+	tid, err := tx.ID()
+	if err != nil {
+		return nil, err
+	}
+	out := tx.Outs[idx]
+	pkh, err := out.Script.GetPkh()
+	if err != nil {
+		return nil, err
+	}
+	coin := &CoinKeyValue{
+		CPkh:   pkh,
+		TxID:   tid,
+		Index:  VarUInt(idx),
+		Value:  out.Value,
+		Height: VarUInt(h),
+	}
+	if tx.IsCoinBase() {
+		coin.Base = 1
+	}
+	return coin, nil
+}
+
+//通过交易索引获取输入消费的金额,调用者需要持有读锁
+func (bi *BlockIndex) verifySpentCoin(in *TxIn) (*CoinKeyValue, error) {
+	txv, err := bi.LoadTxValue(in.OutHash)
+	if err != nil {
+		return nil, err
+	}
+	ele, has := bi.imap[txv.BlkID]
+	if !has {
+		return nil, fmt.Errorf("block %v miss", txv.BlkID)
+	}
+	h := ele.Value.(*TBEle).Height
+	tx, err := bi.verifyLoadTx(h, in.OutHash)
+	if err != nil {
+		return nil, err
+	}
+	return verifyOutCoin(tx, in.OutIndex.ToInt(), h)
+}
+
+//VerifyChain 检查区块链索引和区块数据是否一致
+//检查区块头,区块数据,回退日志,交易索引,逐个检查数据库中的金额和账户交易索引
+//遍历数据库数据时按需加载区块,不在内存中重放整个金额集合
+//fn进度回调 0-100
+func (bi *BlockIndex) VerifyChain(fn func(pv uint)) error {
+	bi.rwm.RLock()
+	defer bi.rwm.RUnlock()
+	db := bi.blkdb.Index()
+	//输出数量和消费的输入数量
+	outn, inn := 0, 0
+	//账户相关的交易索引数量
+	txpn := 0
+	txn := 0
+	//可选索引是否完整
+	_, txfull, err := bi.indexState(TxIndexName)
+	if err != nil {
+		return err
+	}
+	_, addrfull, err := bi.indexState(AddrIndexName)
+	if err != nil {
+		return err
+	}
+	var last *TBEle
+	pg := &progress{fn: fn, total: bi.lis.Len()}
+	for i, ele := 0, bi.lis.Front(); ele != nil; i, ele = i+1, ele.Next() {
+		meta := ele.Value.(*TBEle)
+		//没有区块数据的区块头不检查
+		if !meta.HasBlk() {
+			break
+		}
+		id, err := meta.ID()
+		if err != nil {
+			return err
+		}
+		hb, err := db.Get(BlockPrefix, id[:])
+		if err != nil {
+			return fmt.Errorf("block %v height %d meta miss %w", id, meta.Height, err)
+		}
+		smeta := &TBMeta{}
+		if err := smeta.Decode(NewReader(hb)); err != nil {
+			return fmt.Errorf("block %v height %d meta decode error %w", id, meta.Height, err)
+		}
+		if !smeta.Hash().Equal(meta.Hash()) {
+			return fmt.Errorf("block %v height %d meta not match", id, meta.Height)
+		}
+		bb, err := bi.blkdb.Blk().Read(smeta.Blk)
+		if err != nil {
+			return fmt.Errorf("block %v height %d data read error %w", id, meta.Height, err)
+		}
+		blk := &BlockInfo{}
+		if err := blk.Decode(NewReader(bb)); err != nil {
+			return fmt.Errorf("block %v height %d data decode error %w", id, meta.Height, err)
+		}
+		if bid, err := blk.ID(); err != nil || !bid.Equal(id) {
+			return fmt.Errorf("block %v height %d data id not match", id, meta.Height)
+		}
+		if merkle, err := blk.GetMerkle(); err != nil || !merkle.Equal(blk.Header.Merkle) {
+			return fmt.Errorf("block %v height %d merkle error", id, meta.Height)
+		}
+		if smeta.Txs.ToInt() != len(blk.Txs) {
+			return fmt.Errorf("block %v height %d txs num error", id, meta.Height)
+		}
+		if smeta.HasRev() {
+			rb, err := bi.blkdb.Rev().Read(smeta.Rev)
+			//超过最大回退深度的回退数据可能已经删除
+			if err != nil && !bi.revPrunable(meta.Height) {
+				return fmt.Errorf("block %v height %d rev read error %w", id, meta.Height, err)
+			}
+			if err == nil {
+				if _, err := db.LoadBatch(rb); err != nil {
+					return fmt.Errorf("block %v height %d rev load error %w", id, meta.Height, err)
+				}
+			}
+		}
+		hv := EndianUInt32(meta.Height)
+		for idx, tx := range blk.Txs {
+			tid, err := tx.ID()
+			if err != nil {
+				return err
+			}
+			if txfull {
+				txv, err := bi.LoadTxValue(tid)
+				if err != nil {
+					return fmt.Errorf("tx %v index miss %w", tid, err)
+				}
+				if !txv.BlkID.Equal(id) || txv.TxIdx.ToInt() != idx {
+					return fmt.Errorf("tx %v index not match", tid)
+				}
+			}
+			txn++
+			vps := map[HASH160]bool{}
+			for _, in := range tx.Ins {
+				if in.IsCoinBase() {
+					continue
+				}
+				inn++
+				//没有完整的交易索引时无法找到消费的金额,只检查数量
+				if !txfull {
+					continue
+				}
+				coin, err := bi.verifySpentCoin(in)
+				if err != nil {
+					return fmt.Errorf("tx %v ref coin %v %d miss %w", tid, in.OutHash, in.OutIndex, err)
+				}
+				if coin.Height.ToUInt32() > meta.Height {
+					return fmt.Errorf("tx %v ref coin %v %d after block", tid, in.OutHash, in.OutIndex)
+				}
+				//已经消费的金额不能存在
+				if has, err := db.Has(coin.MustKey()); err != nil {
+					return err
+				} else if has {
+					return fmt.Errorf("tx %v spent coin %s exists", tid, coin.ID())
+				}
+				vps[coin.CPkh] = true
+			}
+			for _, out := range tx.Outs {
+				pkh, err := out.Script.GetPkh()
+				if err != nil {
+					return err
+				}
+				vps[pkh] = true
+				outn++
+			}
+			//没有完整的交易索引时输入相关的账户无法获取
+			if !addrfull || !txfull {
+				continue
+			}
+			for pkh := range vps {
+				if has, err := db.Has(TxpPrefix, pkh[:], hv, tid[:]); err != nil {
+					return err
+				} else if !has {
+					return fmt.Errorf("tx %v pkh %v index miss", tid, pkh)
+				}
+				txpn++
+			}
+		}
+		last = meta
+		pg.step(i + 1)
+	}
+	if last == nil {
+		return nil
+	}
+	//最高区块
+	bv := bi.GetBestValue()
+	if lid, err := last.ID(); err != nil || !bv.ID.Equal(lid) || bv.Height != last.Height {
+		return fmt.Errorf("best value %v height %d not match last block", bv.ID, bv.Height)
+	}
+	//数据库中的每个金额必须和区块中的输出一致
+	num := 0
+	mh := NewMuHash()
+	iter := db.Iterator(NewPrefix(CoinsPrefix))
+	defer iter.Close()
+	for iter.Next() {
+		ckv := &CoinKeyValue{}
+		if err := ckv.From(iter.Key(), iter.Value()); err != nil {
+			return err
+		}
+		tx, err := bi.verifyLoadTx(ckv.Height.ToUInt32(), ckv.TxID)
+		if err != nil {
+			return fmt.Errorf("coin %s tx miss %w", ckv.ID(), err)
+		}
+		coin, err := verifyOutCoin(tx, ckv.Index.ToInt(), ckv.Height.ToUInt32())
+		if err != nil || !bytes.Equal(coin.MustKey(), ckv.MustKey()) || !bytes.Equal(coin.MustValue(), ckv.MustValue()) {
+			return fmt.Errorf("coin %s not match", ckv.ID())
+		}
+		mh.Add(append(coin.MustKey(), coin.MustValue()...))
+		num++
+	}
+	//未消费的输出都必须存在
+	if num != outn-inn {
+		return fmt.Errorf("coins num %d miss, expect %d", num, outn-inn)
+	}
+	//金额集合哈希必须和保存的一致,升级前连接的区块没有保存
+	if hv, err := bi.UtxoHash(bv.Height); err == nil && !hv.Equal(mh.Hash()) {
+		return fmt.Errorf("utxo hash %v not match, expect %v", hv, mh.Hash())
+	}
+	//交易索引数量
+	num = 0
+	titer := db.Iterator(NewPrefix(TxsPrefix))
+	defer titer.Close()
+	for titer.Next() {
+		num++
+	}
+	if txfull && num != txn {
+		return fmt.Errorf("txs index num %d error, expect %d", num, txn)
+	}
+	if !addrfull {
+		return nil
+	}
+	//账户交易索引 prefix_pkh_height_txid,交易必须在对应高度的区块中
+	num = 0
+	kl := len(TxpPrefix) + len(ZERO160) + 4 + len(ZERO256)
+	piter := db.Iterator(NewPrefix(TxpPrefix))
+	defer piter.Close()
+	for piter.Next() {
+		key := piter.Key()
+		if len(key) != kl {
+			return fmt.Errorf("tx index %x length error", key)
+		}
+		off := len(TxpPrefix) + len(ZERO160)
+		h := binary.BigEndian.Uint32(key[off:])
+		tid := HASH256{}
+		copy(tid[:], key[off+4:])
+		if _, err := bi.verifyLoadTx(h, tid); err != nil {
+			return fmt.Errorf("tx index %x not match %w", key, err)
+		}
+		num++
+	}
+	if txfull && num != txpn {
+		return fmt.Errorf("tx index num %d miss, expect %d", num, txpn)
+	}
+	return nil
+}
+
+//区块数据文件中的区块
+type reidxblk struct {
+	id     HASH256
+	prev   HASH256
+	bits   uint32
+	chunk  BlkChunk
+	seq    int
+	height uint32
+	work   UINT256 //从创世区块开始的累计工作量
+}
+
+//扫描区块数据文件中的所有区块
+func (bi *BlockIndex) scanBlks() (map[HASH256]*reidxblk, error) {
+	blks := map[HASH256]*reidxblk{}
+	seq := 0
+	err := bi.blkdb.Blk().Walk(func(st BlkChunk, bb []byte) error {
+		blk := &BlockInfo{}
+		if err := blk.Decode(NewReader(bb)); err != nil {
+			LogErrorf("reindex decode block file %d offset %d error %v", st.ID, st.Off, err)
+			return nil
+		}
+		id, err := blk.ID()
+		if err != nil {
+			return err
+		}
+		//重复的区块使用最后写入的
+		blks[id] = &reidxblk{
+			id:    id,
+			prev:  blk.Header.Prev,
+			bits:  blk.Header.Bits,
+			chunk: st,
+			seq:   seq,
+		}
+		seq++
+		return nil
+	})
+	return blks, err
+}
+
+//从创世区块开始选择累计工作量最大的链,相同工作量优先使用best,其次使用最后写入的区块
+func (bi *BlockIndex) bestBlks(blks map[HASH256]*reidxblk, best HASH256) ([]*reidxblk, error) {
+	var root *reidxblk
+	nexts := map[HASH256][]*reidxblk{}
+	for _, rb := range blks {
+		if rb.prev.IsZero() {
+			if conf.IsGenesisID(rb.id) {
+				root = rb
+			}
+			continue
+		}
+		nexts[rb.prev] = append(nexts[rb.prev], rb)
+	}
+	if root == nil {
+		return nil, errors.New("genesis block miss")
+	}
+	root.work = CalcWork(root.bits)
+	tip := root
+	cur := []*reidxblk{root}
+	for len(cur) > 0 {
+		next := []*reidxblk{}
+		for _, rb := range cur {
+			for _, nb := range nexts[rb.id] {
+				nb.height = rb.height + 1
+				nb.work = rb.work.Add(CalcWork(nb.bits))
+				next = append(next, nb)
+				cmp := nb.work.Cmp(tip.work)
+				if cmp > 0 || (cmp == 0 && !tip.id.Equal(best) && (nb.id.Equal(best) || nb.seq > tip.seq)) {
+					tip = nb
+				}
+			}
+		}
+		cur = next
+	}
+	res := make([]*reidxblk, tip.height+1)
+	for rb := tip; ; rb = blks[rb.prev] {
+		res[rb.height] = rb
+		if rb == root {
+			break
+		}
+	}
+	return res, nil
+}
+
+//清空索引数据库和内存中的区块头
+func (bi *BlockIndex) cleanIndex() error {
+	bi.rwm.Lock()
+	defer bi.rwm.Unlock()
+	bi.lis.Init()
+	bi.hmap = map[uint32]*list.Element{}
+	bi.imap = map[HASH256]*list.Element{}
+	bi.lru.Purge()
+	db := bi.blkdb.Index()
+	for {
+		bt := db.NewBatch()
+		iter := db.Iterator()
+		for iter.Next() && bt.Len() < reindexDelBatch {
+			bt.Del(iter.Key())
+		}
+		iter.Close()
+		if bt.Len() == 0 {
+			return nil
+		}
+		if err := db.Write(bt); err != nil {
+			return err
+		}
+	}
+}
+
+//删除所有回退数据,重建索引时重新写入
+func (bi *BlockIndex) cleanRev() error {
+	fs, err := bi.blkdb.Rev().Files()
+	if err != nil || len(fs) == 0 {
+		return err
+	}
+	return bi.blkdb.Rev().Truncate(ChunkFile{ID: fs[0].ID})
+}
+
+//Reindex 清空索引数据库,使用区块数据文件中的区块重建索引
+//从创世区块开始选择累计工作量最大的链,使用LinkBlk重新连接每个区块
+//fn进度回调 0-100
+func (bi *BlockIndex) Reindex(fn func(pv uint)) error {
+	blks, err := bi.scanBlks()
+	if err != nil {
+		return err
+	}
+	LogInfof("reindex found %d blocks in block data files", len(blks))
+	chain, err := bi.bestBlks(blks, bi.GetBestValue().ID)
+	if err != nil {
+		return err
+	}
+	if err := bi.cleanIndex(); err != nil {
+		return err
+	}
+	if err := bi.cleanRev(); err != nil {
+		return err
+	}
+	pg := &progress{fn: fn, total: len(chain)}
+	for i, rb := range chain {
+		bb, err := bi.blkdb.Blk().Read(rb.chunk)
+		if err != nil {
+			return err
+		}
+		blk := &BlockInfo{}
+		if err := blk.Decode(NewReader(bb)); err != nil {
+			return err
+		}
+		chunk := rb.chunk
+		blk.blkc = &chunk
+		if err := bi.LinkBlk(blk); err != nil {
+			return fmt.Errorf("reindex block %v height %d error %w", rb.id, i, err)
+		}
+		pg.step(i + 1)
+	}
+	bv := bi.GetBestValue()
+	LogInfof("reindex finished, best height=%d,best id=%v", bv.Height, bv.ID)
+	return nil
+}
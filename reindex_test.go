@@ -0,0 +1,108 @@
+package xginx
+
+func (suite *BlockTestSuite) TestVerifyReindex() {
+	req := suite.Require()
+	bi := suite.bi
+	//断开后连接新的区块,数据文件中存在分叉的区块
+	for i := 0; i < 3; i++ {
+		req.NoError(bi.UnlinkLast())
+	}
+	for i := 0; i < 3; i++ {
+		suite.newLinkBlock()
+	}
+	req.NoError(bi.VerifyChain(nil))
+	bv := bi.GetBestValue()
+	addr, err := GetTestListener(bi).GetAccount(0).GetAddress()
+	req.NoError(err)
+	coins, err := bi.ListCoins(addr)
+	req.NoError(err)
+
+	//删除一个金额索引
+	coin := coins.Coins[0]
+	req.NoError(bi.blkdb.Index().Del(coin.MustKey()))
+	req.Error(bi.VerifyChain(nil))
+
+	//重建索引
+	blks, err := bi.scanBlks()
+	req.NoError(err)
+	revs, err := bi.blkdb.Rev().Files()
+	req.NoError(err)
+	pvs := []uint{}
+	err = bi.Reindex(func(pv uint) {
+		pvs = append(pvs, pv)
+	})
+	req.NoError(err)
+	req.Equal(uint(100), pvs[len(pvs)-1])
+	req.NoError(bi.VerifyChain(nil))
+	//区块数据没有重复写入
+	nblks, err := bi.scanBlks()
+	req.NoError(err)
+	req.Equal(len(blks), len(nblks))
+	req.Equal(bv, bi.GetBestValue())
+	req.Equal(bv.Height, bi.Height())
+	ncoins, err := bi.ListCoins(addr)
+	req.NoError(err)
+	req.Equal(coins.All.Balance(), ncoins.All.Balance())
+	req.Equal(len(coins.All), len(ncoins.All))
+	//回退数据重新写入,不包含断开的区块
+	nrevs, err := bi.blkdb.Rev().Files()
+	req.NoError(err)
+	req.True(revSize(nrevs) < revSize(revs))
+	req.NoError(bi.Reindex(nil))
+	req.NoError(bi.VerifyChain(nil))
+	frevs, err := bi.blkdb.Rev().Files()
+	req.NoError(err)
+	req.Equal(revSize(nrevs), revSize(frevs))
+}
+
+//回退数据文件的总长度
+func revSize(fs []ChunkFile) int64 {
+	size := int64(0)
+	for _, f := range fs {
+		size += f.Size
+	}
+	return size
+}
+
+//重建索引时选择累计工作量最大的链
+func (suite *BlockTestSuite) TestReindexBestWork() {
+	req := suite.Require()
+	bi := suite.bi
+	genesis, err := bi.LoadBlock(conf.genesis)
+	req.NoError(err)
+	easy := genesis.Header.Bits
+	//指数减一,难度增加256倍
+	hard := easy - 0x01000000
+	req.True(CalcWork(hard).Cmp(CalcWork(easy)) > 0)
+	blks := map[HASH256]*reidxblk{}
+	add := func(name string, prev HASH256, bits uint32, seq int) HASH256 {
+		id := Hash256From([]byte(name))
+		blks[id] = &reidxblk{id: id, prev: prev, bits: bits, seq: seq}
+		return id
+	}
+	root := &reidxblk{id: conf.genesis, bits: easy}
+	blks[root.id] = root
+	//更长但是工作量更小的链
+	a1 := add("a1", root.id, easy, 1)
+	a2 := add("a2", a1, easy, 2)
+	a3 := add("a3", a2, easy, 3)
+	b1 := add("b1", root.id, hard, 4)
+	b2 := add("b2", b1, easy, 5)
+	res, err := bi.bestBlks(blks, a3)
+	req.NoError(err)
+	req.Equal(3, len(res))
+	req.Equal(b2, res[2].id)
+	req.Equal(b1, res[1].id)
+	//工作量相同时优先使用best
+	delete(blks, b1)
+	delete(blks, b2)
+	c1 := add("c1", root.id, easy, 6)
+	c2 := add("c2", c1, easy, 7)
+	c3 := add("c3", c2, easy, 8)
+	res, err = bi.bestBlks(blks, a3)
+	req.NoError(err)
+	req.Equal(a3, res[3].id)
+	res, err = bi.bestBlks(blks, ZERO256)
+	req.NoError(err)
+	req.Equal(c3, res[3].id)
+}
@@ -0,0 +1,78 @@
+package xginx
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	//ErrReorgTooDeep 回退的区块数量超过最大回退深度
+	ErrReorgTooDeep = errors.New("reorg too deep")
+)
+
+//检查回退count个区块是否超过最大回退深度
+func (bi *BlockIndex) checkReorg(count uint32) error {
+	if conf.MaxReorg == 0 || count <= conf.MaxReorg {
+		return nil
+	}
+	return fmt.Errorf("%w unlink %d blocks max %d", ErrReorgTooDeep, count, conf.MaxReorg)
+}
+
+//高度h的区块回退数据是否超过最大回退深度,可能已经被删除
+func (bi *BlockIndex) revPrunable(h uint32) bool {
+	lh := bi.lastHeight()
+	return conf.MaxReorg > 0 && lh != InvalidHeight && h+conf.MaxReorg <= lh
+}
+
+//获取最大回退深度内区块使用的最小回退文件id,不超过floor
+//区块没有全部加载时返回false
+func (bi *BlockIndex) revFloor(floor uint32) (uint32, bool) {
+	num := uint32(0)
+	ele := bi.lis.Back()
+	for ; ele != nil && num < conf.MaxReorg; ele = ele.Prev() {
+		meta := ele.Value.(*TBEle)
+		//只有区块头的不需要回退数据
+		if !meta.HasBlk() {
+			continue
+		}
+		if meta.HasRev() && meta.Rev.ID.ToUInt32() < floor {
+			floor = meta.Rev.ID.ToUInt32()
+		}
+		num++
+	}
+	//不足最大回退深度时必须包含第一个区块
+	if num < conf.MaxReorg && bi.lis.Len() > 0 && bi.first().Height != 0 {
+		return 0, false
+	}
+	return floor, true
+}
+
+//PruneRev 删除只包含超过最大回退深度区块的回退数据文件,返回删除的文件数量
+func (bi *BlockIndex) PruneRev() (int, error) {
+	if conf.MaxReorg == 0 {
+		return 0, errors.New("max reorg not set")
+	}
+	bi.rwm.RLock()
+	defer bi.rwm.RUnlock()
+	fs, err := bi.blkdb.Rev().Files()
+	if err != nil || len(fs) == 0 {
+		return 0, err
+	}
+	//最后一个文件可能正在写入
+	floor, ok := bi.revFloor(fs[len(fs)-1].ID)
+	if !ok {
+		return 0, nil
+	}
+	num := 0
+	for _, f := range fs {
+		if f.ID >= floor {
+			continue
+		}
+		if err := bi.blkdb.Rev().Remove(f.ID); err != nil {
+			return num, err
+		}
+		LogInfof("remove rev data file %d size %d", f.ID, f.Size)
+		num++
+	}
+	return num, nil
+}
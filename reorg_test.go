@@ -0,0 +1,36 @@
+package xginx
+
+import (
+	"errors"
+)
+
+func (suite *BlockTestSuite) TestMaxReorg() {
+	req := suite.Require()
+	bi := suite.bi
+	conf.MaxReorg = 1
+	defer func() {
+		conf.MaxReorg = 0
+	}()
+	base := bi.Last()
+	bid, err := base.ID()
+	req.NoError(err)
+	req.NoError(NewTestOneBlock())
+	//回退到base之前需要断开两个区块,超过最大回退深度
+	err = bi.UnlinkTo(base.Prev)
+	req.True(errors.Is(err, ErrReorgTooDeep))
+	req.Equal(base.Height+1, bi.Height())
+	//证据区块头分叉太深
+	prev := bi.gethele(base.Height - 1)
+	fork := base.BlockHeader
+	fork.Nonce++
+	fork.hasher.Reset()
+	err = bi.Unlink(Headers{prev.BlockHeader, fork, fork, fork})
+	req.True(errors.Is(err, ErrReorgTooDeep))
+	//最大回退深度内的回退数据不会删除
+	num, err := bi.PruneRev()
+	req.NoError(err)
+	req.Equal(0, num)
+	req.NoError(bi.VerifyChain(nil))
+	req.NoError(bi.UnlinkTo(bid))
+	req.Equal(base.Height, bi.Height())
+}
@@ -0,0 +1,239 @@
+package xginx
+
+import (
+	"errors"
+	"fmt"
+)
+
+//MaxSweepTxSize 转移交易默认最大字节数,保留区块头和coinbase交易的空间
+const MaxSweepTxSize = MaxBlockSize - 1024*64
+
+//Rotation 账户轮换
+//共同签名者离开或者私钥可能泄露时,创建新的替换账户,把原账户的所有可用金额转移到新账户
+//并标记原账户为退役
+type Rotation struct {
+	bi      *BlockIndex
+	kdb     IKeysDB
+	Src     Address //原账户地址
+	Fee     Amount  //每个转移交易的交易费
+	MaxSize int     //每个转移交易的最大字节数,不能超过MaxBlockSize
+}
+
+//NewRotation 创建账户轮换对象
+func (bi *BlockIndex) NewRotation(kdb IKeysDB, src Address) *Rotation {
+	return &Rotation{
+		bi:      bi,
+		kdb:     kdb,
+		Src:     src,
+		Fee:     0,
+		MaxSize: MaxSweepTxSize,
+	}
+}
+
+//NewAccountInfo 创建并保存替换账户
+//pks为空时使用原账户的公钥集合,只修改签名数量
+func (r *Rotation) NewAccountInfo(pks []string, less int, arb bool) (*AccountInfo, error) {
+	ka, err := r.kdb.LoadAccountInfo(r.Src)
+	if err != nil {
+		return nil, err
+	}
+	if ka.IsRetired() {
+		return nil, fmt.Errorf("address %s retired", r.Src)
+	}
+	if len(pks) == 0 {
+		pks = ka.Pks
+	}
+	na := &AccountInfo{
+		Num:  len(pks),
+		Less: less,
+		Arb:  arb,
+		Pks:  pks,
+		Desc: ka.Desc,
+		Type: ka.Type,
+	}
+	if err := na.Check(); err != nil {
+		return nil, err
+	}
+	id, err := na.ID()
+	if err != nil {
+		return nil, err
+	}
+	if id == r.Src {
+		return nil, errors.New("rotation account not changed")
+	}
+	_, err = r.kdb.SaveAccountInfo(na)
+	if err != nil {
+		return nil, err
+	}
+	return na, nil
+}
+
+//SignTx 使用密钥数据库签名转移交易的输入
+func (r *Rotation) SignTx(signer ISigner, pass ...string) error {
+	_, in, out, _ := signer.GetObjs()
+	hash, err := signer.GetSigHash()
+	if err != nil {
+		return err
+	}
+	wits, err := in.Script.ToWitness()
+	if err != nil {
+		return err
+	}
+	addr, err := out.Script.GetAddress()
+	if err != nil {
+		return err
+	}
+	err = r.kdb.Sign(addr, hash, wits)
+	if err != nil {
+		return err
+	}
+	script, err := wits.Final()
+	if err != nil {
+		return err
+	}
+	in.Script = script
+	return nil
+}
+
+//获取数据编码后的长度
+func encodeSize(v interface{ Encode(w IWriter) error }) (int, error) {
+	buf := NewWriter()
+	if err := v.Encode(buf); err != nil {
+		return 0, err
+	}
+	return buf.Len(), nil
+}
+
+//创建一个转移交易,所有输入转到dst
+func (r *Rotation) newSweepTx(dst Address, ins []*TxIn, sum Amount, exeLimit uint32, execs ...[]byte) (*TX, error) {
+	amt := sum - r.Fee
+	if amt <= 0 || !amt.IsRange() {
+		return nil, fmt.Errorf("sweep amount %d less fee %d", sum, r.Fee)
+	}
+	out, err := dst.NewTxOut(amt, nil, DefaultLockedScript)
+	if err != nil {
+		return nil, err
+	}
+	tx := NewTx(exeLimit, execs...)
+	tx.Ins = ins
+	tx.Outs = append(tx.Outs, out)
+	err = tx.Sign(r.bi, r)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+//Sweep 生成把原账户所有可用金额转到dst的已签名交易,不放入交易池
+//每个交易的大小不超过MaxSize,超过时分成多个交易,原账户没有金额时返回空列表
+func (r *Rotation) Sweep(dst Address, exeLimit uint32, execs ...[]byte) ([]*TX, error) {
+	if r.MaxSize <= 0 || r.MaxSize > MaxBlockSize {
+		return nil, fmt.Errorf("max size %d error", r.MaxSize)
+	}
+	if !r.Fee.IsRange() {
+		return nil, fmt.Errorf("fee %d error", r.Fee)
+	}
+	pkh, err := r.Src.GetPkh()
+	if err != nil {
+		return nil, err
+	}
+	coins, err := r.bi.ListCoinsWithID(pkh)
+	if err != nil {
+		return nil, err
+	}
+	if len(coins) == 0 {
+		return []*TX{}, nil
+	}
+	//只能转移成熟的金额
+	coins = coins.State(r.bi.NextHeight()).Coins
+	if len(coins) == 0 {
+		return nil, errors.New("sweep coins immature")
+	}
+	//没有输入的交易大小,预留输入数量变长编码的空间
+	out, err := dst.NewTxOut(0, nil, DefaultLockedScript)
+	if err != nil {
+		return nil, err
+	}
+	empty := NewTx(exeLimit, execs...)
+	empty.Outs = append(empty.Outs, out)
+	base, err := encodeSize(empty)
+	if err != nil {
+		return nil, err
+	}
+	base += 8
+	txs := []*TX{}
+	ins := []*TxIn{}
+	size, sum := base, Amount(0)
+	for _, ckv := range coins {
+		wits, err := r.kdb.NewWitnessScript(r.Src, DefaultInputScript)
+		if err != nil {
+			return nil, err
+		}
+		//未签名的脚本包含所有签名位置,签名后的大小不会超过未签名的大小
+		in, err := ckv.NewTxIn(wits)
+		if err != nil {
+			return nil, err
+		}
+		isize, err := encodeSize(in)
+		if err != nil {
+			return nil, err
+		}
+		if base+isize > r.MaxSize {
+			return nil, fmt.Errorf("coin %s input size %d too large", ckv.ID(), isize)
+		}
+		if size+isize > r.MaxSize {
+			tx, err := r.newSweepTx(dst, ins, sum, exeLimit, execs...)
+			if err != nil {
+				return nil, err
+			}
+			txs = append(txs, tx)
+			ins = []*TxIn{}
+			size, sum = base, 0
+		}
+		ins = append(ins, in)
+		size += isize
+		sum += ckv.Value
+	}
+	tx, err := r.newSweepTx(dst, ins, sum, exeLimit, execs...)
+	if err != nil {
+		return nil, err
+	}
+	txs = append(txs, tx)
+	return txs, nil
+}
+
+//Rotate 创建替换账户,生成转移交易放入交易池并广播,全部成功后标记原账户退役
+//原账户没有金额时不需要转移交易直接退役
+//放入交易池失败时原账户不退役,返回已经放入交易池的交易,没有交易放入时删除替换账户
+func (r *Rotation) Rotate(pks []string, less int, arb bool, exeLimit uint32, execs ...[]byte) (*AccountInfo, []*TX, error) {
+	na, err := r.NewAccountInfo(pks, less, arb)
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := na.ID()
+	if err != nil {
+		return nil, nil, err
+	}
+	txs, err := r.Sweep(dst, exeLimit, execs...)
+	if err != nil {
+		_ = r.kdb.DeleteAccountInfo(dst)
+		return nil, nil, err
+	}
+	txp := r.bi.GetTxPool()
+	ps := r.bi.GetPubSub()
+	for i, tx := range txs {
+		if err := txp.PushTx(r.bi, tx); err != nil {
+			if i == 0 {
+				_ = r.kdb.DeleteAccountInfo(dst)
+				return nil, nil, err
+			}
+			return na, txs[:i], err
+		}
+		ps.Pub(tx, NewTxTopic)
+	}
+	err = r.kdb.RetireAccount(r.Src, dst)
+	if err != nil {
+		return na, txs, err
+	}
+	return na, txs, nil
+}
@@ -0,0 +1,114 @@
+package xginx
+
+import (
+	"errors"
+	"os"
+)
+
+//拒绝所有交易进入交易池
+type rejectTxLis struct {
+	*TestLis
+}
+
+func (lis *rejectTxLis) OnTxPool(tx *TX) error {
+	return errors.New("reject tx")
+}
+
+func (suite *BlockTestSuite) TestRotateAccount() {
+	req := suite.Require()
+	bi := suite.bi
+
+	dir := NewTempDir()
+	defer os.RemoveAll(dir)
+	kdb, err := OpenKeysDB(dir)
+	req.NoError(err)
+	defer kdb.Close()
+	ka, err := kdb.NewAccountInfo(CoinAccountType, "rotate")
+	req.NoError(err)
+	src := ka.MustAddress()
+
+	//矿工转3笔金额到原账户
+	a := GetTestListener(bi).GetAccount(0)
+	aaddr, err := a.GetAddress()
+	req.NoError(err)
+	coins, err := bi.ListCoins(aaddr)
+	req.NoError(err)
+	coin := coins.Coins[0]
+	tx := NewTx(DefaultExeLimit, DefaultTxScript)
+	in, err := coin.NewTxIn(a.NewWitnessScript(DefaultInputScript))
+	req.NoError(err)
+	tx.Ins = append(tx.Ins, in)
+	for i := 0; i < 3; i++ {
+		out, err := src.NewTxOut(Coin, nil, DefaultLockedScript)
+		req.NoError(err)
+		tx.Outs = append(tx.Outs, out)
+	}
+	req.NoError(tx.Sign(bi, newaccsigner(a)))
+	req.NoError(bi.GetTxPool().PushTx(bi, tx))
+	req.NoError(NewTestOneBlock())
+	defer func() {
+		req.NoError(bi.UnlinkLast())
+		bi.GetTxPool().Del(bi, tx.MustID())
+	}()
+
+	//默认大小时一个交易转移所有金额
+	r := bi.NewRotation(kdb, src)
+	r.Fee = 10
+	txs, err := r.Sweep(aaddr, DefaultExeLimit, DefaultTxScript)
+	req.NoError(err)
+	req.Equal(1, len(txs))
+	req.Equal(3, len(txs[0].Ins))
+	req.Equal(3*Coin-10, txs[0].Outs[0].Value)
+
+	//替换为新的私钥
+	pid, err := kdb.NewPrivateKey()
+	req.NoError(err)
+	//转移交易不能进入交易池时原账户不退役
+	lis := bi.lptr
+	bi.lptr = &rejectTxLis{TestLis: GetTestListener(bi)}
+	_, _, err = r.Rotate([]string{pid}, 1, false, DefaultExeLimit, DefaultTxScript)
+	bi.lptr = lis
+	req.Error(err)
+	oa, err := kdb.LoadAccountInfo(src)
+	req.NoError(err)
+	req.False(oa.IsRetired())
+	//限制大小每个交易只包含一个输入,交易已经放入交易池
+	r.MaxSize = 500
+	na, txs, err := r.Rotate([]string{pid}, 1, false, DefaultExeLimit, DefaultTxScript)
+	req.NoError(err)
+	req.Equal(3, len(txs))
+	dst := na.MustAddress()
+	for _, tx := range txs {
+		req.Equal(1, len(tx.Ins))
+		req.True(bi.GetTxPool().Has(tx.MustID()))
+	}
+	coins, err = bi.ListCoins(dst)
+	req.NoError(err)
+	req.Equal(3*(Coin-10), coins.All.Balance())
+	for _, tx := range txs {
+		bi.GetTxPool().Del(bi, tx.MustID())
+	}
+
+	//原账户已退役,不能再用来收款或者轮换
+	oa, err = kdb.LoadAccountInfo(src)
+	req.NoError(err)
+	req.True(oa.IsRetired())
+	req.Equal(dst, oa.Retired)
+	_, err = kdb.NewLockedScript(src, nil, DefaultLockedScript)
+	req.Error(err)
+	_, err = r.NewAccountInfo(nil, 1, false)
+	req.Error(err)
+
+	//没有金额的账户不需要转移交易直接退役
+	eka, err := kdb.NewAccountInfo(CoinAccountType, "empty")
+	req.NoError(err)
+	er := bi.NewRotation(kdb, eka.MustAddress())
+	eid, err := kdb.NewPrivateKey()
+	req.NoError(err)
+	ena, txs, err := er.Rotate([]string{eid}, 1, false, DefaultExeLimit, DefaultTxScript)
+	req.NoError(err)
+	req.Equal(0, len(txs))
+	oa, err = kdb.LoadAccountInfo(eka.MustAddress())
+	req.NoError(err)
+	req.Equal(ena.MustAddress(), oa.Retired)
+}
@@ -0,0 +1,598 @@
+package xginx
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//种子服务,通过MsgGetAddrs/MsgAddrs爬取网络中的节点
+//保存最近可以连接的全节点,通过dns A/AAAA记录返回节点地址
+
+//种子服务参数
+const (
+	//DefaultSeedDomain 默认种子域名,直接向种子服务查询时使用
+	DefaultSeedDomain = "seed.xginx.com"
+	//DefaultSeederAddr 默认dns服务地址
+	DefaultSeederAddr = ":53"
+	//SeederCrawlInterval 每个节点的检测间隔
+	SeederCrawlInterval = time.Minute * 10
+	//SeederStaleTime 超过这个时间没有连接成功的节点不返回
+	SeederStaleTime = time.Hour * 2
+	//SeederMaxFails 连续失败次数超过后删除节点
+	SeederMaxFails = 8
+	//SeederTimeout 连接节点和dns查询超时时间
+	SeederTimeout = time.Second * 10
+	//SeederMaxProbes 同时检测的节点数量
+	SeederMaxProbes = 16
+	//SeederMaxNodes 最多保存的节点数量
+	SeederMaxNodes = 10000
+	//SeederMaxAnswers 每次查询最多返回的地址数量
+	SeederMaxAnswers = 16
+	//SeederTTL dns记录的有效时间(秒)
+	SeederTTL = 60
+)
+
+//dns协议常量
+const (
+	dnsHeaderSize = 12
+	dnsMaxSize    = 512 //udp应答最大长度
+	dnsTypeA      = 1
+	dnsTypeAAAA   = 28
+	dnsTypeANY    = 255
+	dnsClassIN    = 1
+	dnsFlagQR     = 1 << 15
+	dnsFlagAA     = 1 << 10
+	dnsFlagRD     = 1 << 8
+	dnsCodeOK     = 0
+	dnsCodeFormat = 1
+	dnsCodeName   = 3
+	dnsCodeNotImp = 4
+	dnsCodeRefuse = 5
+)
+
+//SeedNode 种子服务保存的节点
+type SeedNode struct {
+	Addr     NetAddr
+	Service  uint32    //节点提供的服务
+	Height   uint32    //节点区块高度
+	Proto    uint32    //节点协议版本
+	LastSeen time.Time //最后连接成功时间
+	LastTry  time.Time //最后检测时间
+	Fails    int       //连续失败次数
+}
+
+//IsHealthy 最近连接成功的全节点
+func (n SeedNode) IsHealthy(now time.Time) bool {
+	if n.Fails > 0 || n.LastSeen.IsZero() {
+		return false
+	}
+	if n.Service&FullNodeFlag == 0 {
+		return false
+	}
+	return now.Sub(n.LastSeen) < SeederStaleTime
+}
+
+//Seeder 种子服务
+type Seeder struct {
+	Domain string //服务的域名,为空返回所有查询
+	Port   uint16 //只返回这个端口的节点
+	mu     sync.RWMutex
+	nodes  map[string]*SeedNode
+	nodeid uint64
+}
+
+//NewSeeder 创建种子服务
+func NewSeeder(domain string) *Seeder {
+	return &Seeder{
+		Domain: strings.TrimSuffix(domain, "."),
+		Port:   DefaultPort,
+		nodes:  map[string]*SeedNode{},
+		nodeid: conf.GenUInt64(),
+	}
+}
+
+//AddAddr 添加需要检测的地址,已经存在返回false
+func (s *Seeder) AddAddr(addr NetAddr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := addr.String()
+	if _, has := s.nodes[key]; has {
+		return false
+	}
+	if len(s.nodes) >= SeederMaxNodes {
+		return false
+	}
+	s.nodes[key] = &SeedNode{Addr: addr}
+	return true
+}
+
+//Nodes 获取保存的节点
+func (s *Seeder) Nodes() []SeedNode {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ns := []SeedNode{}
+	for _, v := range s.nodes {
+		ns = append(ns, *v)
+	}
+	return ns
+}
+
+//Healthy 随机获取最多max个可用节点的ip,ipv6为true获取ipv6地址
+func (s *Seeder) Healthy(ipv6 bool, max int) []net.IP {
+	now := time.Now()
+	ips := []net.IP{}
+	for _, n := range s.Nodes() {
+		if !n.IsHealthy(now) || n.Addr.port != s.Port {
+			continue
+		}
+		ip4 := n.Addr.ip.To4()
+		if ipv6 && ip4 == nil {
+			ips = append(ips, n.Addr.ip.To16())
+		} else if !ipv6 && ip4 != nil {
+			ips = append(ips, ip4)
+		}
+	}
+	rand.Shuffle(len(ips), func(i, j int) {
+		ips[i], ips[j] = ips[j], ips[i]
+	})
+	if len(ips) > max {
+		ips = ips[:max]
+	}
+	return ips
+}
+
+//版本信息,种子服务不提供服务
+func (s *Seeder) newMsgVersion() *MsgVersion {
+	return &MsgVersion{
+		Ver:    conf.Ver,
+		Addr:   NetAddr{ip: net.IPv4zero},
+		NodeID: s.nodeid,
+		Proto:  ProtocolVersion,
+	}
+}
+
+//Probe 连接节点完成握手并获取节点保存的地址
+func (s *Seeder) Probe(ctx context.Context, addr NetAddr) (*MsgVersion, []NetAddr, error) {
+	dialer := net.Dialer{Timeout: SeederTimeout}
+	conn, err := dialer.DialContext(ctx, addr.Network(), addr.Addr())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(SeederTimeout)); err != nil {
+		return nil, nil, err
+	}
+	ns := NewNetStream(conn)
+	if err := ns.WriteMsg(s.newMsgVersion()); err != nil {
+		return nil, nil, err
+	}
+	var ver *MsgVersion
+	for {
+		m, err := ns.ReadMsg()
+		if err != nil {
+			return ver, nil, err
+		}
+		switch m.Type() {
+		case NtVersion:
+			ver = m.(*MsgVersion)
+			//新版本节点回复确认后才能请求地址
+			if ver.ProtoVer() >= VerAckVersion {
+				if err := ns.WriteMsg(&MsgVerAck{}); err != nil {
+					return ver, nil, err
+				}
+			}
+			if err := ns.WriteMsg(&MsgGetAddrs{}); err != nil {
+				return ver, nil, err
+			}
+		case NtAddrs:
+			if ver == nil {
+				return nil, nil, errors.New("recv addrs before version")
+			}
+			return ver, m.(*MsgAddrs).Addrs, nil
+		case NtError:
+			return ver, nil, fmt.Errorf("peer error %s", string(m.(*MsgError).Error))
+		}
+	}
+}
+
+//检测一个节点并保存获取到的地址
+func (s *Seeder) probe(ctx context.Context, addr NetAddr) {
+	ver, addrs, err := s.Probe(ctx, addr)
+	s.mu.Lock()
+	n := s.nodes[addr.String()]
+	if n == nil {
+		s.mu.Unlock()
+		return
+	}
+	n.LastTry = time.Now()
+	if ver != nil {
+		n.Service = ver.Service
+		n.Height = ver.Height
+		n.Proto = ver.ProtoVer()
+	}
+	if err != nil {
+		n.Fails++
+		if n.Fails > SeederMaxFails {
+			delete(s.nodes, addr.String())
+		}
+	} else {
+		n.Fails = 0
+		n.LastSeen = n.LastTry
+	}
+	s.mu.Unlock()
+	if err != nil {
+		LogError("seeder probe", addr, "error", err)
+		return
+	}
+	num := 0
+	for _, v := range addrs {
+		if v.IsGlobalUnicast() && s.AddAddr(v) {
+			num++
+		}
+	}
+	LogInfof("seeder probe %v height = %d, new addrs %d/%d", addr, ver.Height, num, len(addrs))
+}
+
+//CrawlOnce 检测所有到达检测时间的节点
+func (s *Seeder) CrawlOnce(ctx context.Context) {
+	now := time.Now()
+	addrs := []NetAddr{}
+	s.mu.RLock()
+	for _, v := range s.nodes {
+		if now.Sub(v.LastTry) >= SeederCrawlInterval {
+			addrs = append(addrs, v.Addr)
+		}
+	}
+	s.mu.RUnlock()
+	sem := make(chan bool, SeederMaxProbes)
+	wg := sync.WaitGroup{}
+	for _, addr := range addrs {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case sem <- true:
+		}
+		wg.Add(1)
+		go func(addr NetAddr) {
+			defer wg.Done()
+			s.probe(ctx, addr)
+			<-sem
+		}(addr)
+	}
+	wg.Wait()
+}
+
+//Crawl 定时检测节点直到ctx结束
+func (s *Seeder) Crawl(ctx context.Context) {
+	for {
+		s.CrawlOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * 10):
+		}
+	}
+}
+
+//解析查询中的域名,返回域名和结束位置
+func dnsReadName(b []byte, off int) (string, int, error) {
+	labels := []string{}
+	for {
+		if off >= len(b) {
+			return "", 0, errors.New("dns name overflow")
+		}
+		l := int(b[off])
+		off++
+		if l == 0 {
+			break
+		}
+		if l&0xC0 != 0 {
+			return "", 0, errors.New("dns name pointer not support")
+		}
+		if off+l > len(b) {
+			return "", 0, errors.New("dns label overflow")
+		}
+		labels = append(labels, string(b[off:off+l]))
+		off += l
+	}
+	return strings.Join(labels, "."), off, nil
+}
+
+//跳过应答中的域名,支持压缩指针
+func dnsSkipName(b []byte, off int) (int, error) {
+	for {
+		if off >= len(b) {
+			return 0, errors.New("dns name overflow")
+		}
+		l := int(b[off])
+		if l == 0 {
+			return off + 1, nil
+		}
+		if l&0xC0 == 0xC0 {
+			return off + 2, nil
+		}
+		off += l + 1
+	}
+}
+
+//编码查询域名
+func dnsAppendName(b []byte, name string) ([]byte, error) {
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(l) == 0 || len(l) > 63 {
+			return nil, fmt.Errorf("dns name %s error", name)
+		}
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0), nil
+}
+
+//是否是服务的域名
+func (s *Seeder) isDomain(name string) bool {
+	return s.Domain == "" || strings.EqualFold(name, s.Domain)
+}
+
+//HandleQuery 处理dns查询,返回应答数据
+func (s *Seeder) HandleQuery(req []byte) ([]byte, error) {
+	if len(req) < dnsHeaderSize {
+		return nil, errors.New("dns query too short")
+	}
+	id := binary.BigEndian.Uint16(req[0:])
+	flags := binary.BigEndian.Uint16(req[2:])
+	if flags&dnsFlagQR != 0 {
+		return nil, errors.New("dns query is response")
+	}
+	res := make([]byte, dnsHeaderSize, dnsMaxSize)
+	reply := func(code uint16, qend int, answers int) []byte {
+		binary.BigEndian.PutUint16(res[0:], id)
+		binary.BigEndian.PutUint16(res[2:], dnsFlagQR|dnsFlagAA|flags&(0xF<<11)|flags&dnsFlagRD|code)
+		if qend > 0 {
+			binary.BigEndian.PutUint16(res[4:], 1)
+		}
+		binary.BigEndian.PutUint16(res[6:], uint16(answers))
+		return res
+	}
+	//只支持标准查询
+	if flags&(0xF<<11) != 0 {
+		return reply(dnsCodeNotImp, 0, 0), nil
+	}
+	if binary.BigEndian.Uint16(req[4:]) != 1 {
+		return reply(dnsCodeFormat, 0, 0), nil
+	}
+	name, off, err := dnsReadName(req, dnsHeaderSize)
+	if err != nil || off+4 > len(req) {
+		return reply(dnsCodeFormat, 0, 0), nil
+	}
+	qtype := binary.BigEndian.Uint16(req[off:])
+	qclass := binary.BigEndian.Uint16(req[off+2:])
+	qend := off + 4
+	res = append(res, req[dnsHeaderSize:qend]...)
+	//区域内的其他域名不存在,区域外的拒绝
+	if !s.isDomain(name) {
+		if strings.HasSuffix(strings.ToLower(name), "."+strings.ToLower(s.Domain)) {
+			return reply(dnsCodeName, qend, 0), nil
+		}
+		return reply(dnsCodeRefuse, qend, 0), nil
+	}
+	if qclass != dnsClassIN {
+		return reply(dnsCodeOK, qend, 0), nil
+	}
+	//ANY查询两种地址各返回一半
+	max := SeederMaxAnswers
+	if qtype == dnsTypeANY {
+		max /= 2
+	}
+	ips := []net.IP{}
+	if qtype == dnsTypeA || qtype == dnsTypeANY {
+		ips = append(ips, s.Healthy(false, max)...)
+	}
+	if qtype == dnsTypeAAAA || qtype == dnsTypeANY {
+		ips = append(ips, s.Healthy(true, max)...)
+	}
+	num := 0
+	for _, ip := range ips {
+		typ := uint16(dnsTypeAAAA)
+		if len(ip) == net.IPv4len {
+			typ = dnsTypeA
+		}
+		//应答不能超过udp最大长度,超过的地址不返回
+		if len(res)+12+len(ip) > dnsMaxSize {
+			continue
+		}
+		num++
+		//名称使用指向问题的压缩指针
+		res = append(res, 0xC0, dnsHeaderSize)
+		res = append(res, byte(typ>>8), byte(typ), 0, dnsClassIN)
+		res = append(res, 0, 0, 0, 0, byte(len(ip)>>8), byte(len(ip)))
+		binary.BigEndian.PutUint32(res[len(res)-6:], SeederTTL)
+		res = append(res, ip...)
+	}
+	return reply(dnsCodeOK, qend, num), nil
+}
+
+//Serve 在conn上处理dns查询直到ctx结束
+func (s *Seeder) Serve(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	buf := make([]byte, dnsMaxSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		res, err := s.HandleQuery(buf[:n])
+		if err != nil {
+			LogError("seeder dns query from", addr, "error", err)
+			continue
+		}
+		if _, err := conn.WriteTo(res, addr); err != nil {
+			LogError("seeder dns reply to", addr, "error", err)
+		}
+	}
+}
+
+//ListenAndServe 监听udp地址处理dns查询
+func (s *Seeder) ListenAndServe(ctx context.Context, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	LogInfo("seeder dns listen", conn.LocalAddr(), "domain", s.Domain)
+	return s.Serve(ctx, conn)
+}
+
+//GetSeedDomain 获取直接查询种子服务使用的域名,没有配置使用默认值
+func (c *Config) GetSeedDomain() string {
+	if c.SeedDomain == "" {
+		return DefaultSeedDomain
+	}
+	return c.SeedDomain
+}
+
+//LookupSeeder 直接向addr的种子服务查询name的A和AAAA记录
+func LookupSeeder(addr string, name string) ([]net.IP, error) {
+	conn, err := net.DialTimeout("udp", addr, SeederTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(SeederTimeout)); err != nil {
+		return nil, err
+	}
+	ips := []net.IP{}
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		vs, err := dnsQuery(conn, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, vs...)
+	}
+	return ips, nil
+}
+
+//发送一个查询并解析应答中的地址
+func dnsQuery(conn net.Conn, name string, qtype uint16) ([]net.IP, error) {
+	id := uint16(rand.Uint32())
+	req := make([]byte, dnsHeaderSize)
+	binary.BigEndian.PutUint16(req[0:], id)
+	binary.BigEndian.PutUint16(req[2:], dnsFlagRD)
+	binary.BigEndian.PutUint16(req[4:], 1)
+	req, err := dnsAppendName(req, name)
+	if err != nil {
+		return nil, err
+	}
+	req = append(req, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	res := make([]byte, 1500)
+	n, err := conn.Read(res)
+	if err != nil {
+		return nil, err
+	}
+	res = res[:n]
+	if n < dnsHeaderSize || binary.BigEndian.Uint16(res[0:]) != id {
+		return nil, errors.New("dns response id error")
+	}
+	flags := binary.BigEndian.Uint16(res[2:])
+	if code := flags & 0xF; code != dnsCodeOK {
+		return nil, fmt.Errorf("dns query %s response code %d", name, code)
+	}
+	qd := int(binary.BigEndian.Uint16(res[4:]))
+	an := int(binary.BigEndian.Uint16(res[6:]))
+	off := dnsHeaderSize
+	for i := 0; i < qd; i++ {
+		if off, err = dnsSkipName(res, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+	ips := []net.IP{}
+	for i := 0; i < an; i++ {
+		if off, err = dnsSkipName(res, off); err != nil {
+			return nil, err
+		}
+		if off+10 > n {
+			return nil, errors.New("dns answer overflow")
+		}
+		typ := binary.BigEndian.Uint16(res[off:])
+		size := int(binary.BigEndian.Uint16(res[off+8:]))
+		off += 10
+		if off+size > n {
+			return nil, errors.New("dns answer data overflow")
+		}
+		if (typ == dnsTypeA && size == net.IPv4len) || (typ == dnsTypeAAAA && size == net.IPv6len) {
+			ips = append(ips, net.IP(append([]byte{}, res[off:off+size]...)))
+		}
+		off += size
+	}
+	return ips, nil
+}
+
+//LookupSeed 解析种子地址
+//host:port格式直接向种子服务查询配置的种子域名,否则使用系统dns解析
+func LookupSeed(seed string) ([]net.IP, error) {
+	if _, _, err := net.SplitHostPort(seed); err == nil {
+		return LookupSeeder(seed, conf.GetSeedDomain())
+	}
+	return net.LookupIP(seed)
+}
+
+//RunSeeder 启动种子服务,从配置的节点和种子开始爬取网络
+func RunSeeder(addr string, domain string) {
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	conf := InitConfig()
+	defer conf.Close()
+	s := NewSeeder(domain)
+	for _, v := range conf.Nodes {
+		naddr := NetAddr{}
+		if err := naddr.From(v); err == nil {
+			s.AddAddr(naddr)
+		}
+	}
+	for _, v := range conf.Seeds {
+		ips, err := LookupSeed(v)
+		if err != nil {
+			LogError("lookup seed", v, "error", err)
+			continue
+		}
+		for _, ip := range ips {
+			s.AddAddr(NetAddr{ip: ip, port: DefaultPort})
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Crawl(ctx)
+	go func() {
+		if err := s.ListenAndServe(ctx, addr); err != nil {
+			LogError("seeder dns serve error", err)
+			cancel()
+		}
+	}()
+	csig := make(chan os.Signal, 1)
+	signal.Notify(csig, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case sig := <-csig:
+		LogInfo("recv sig :", sig, ",seeder exit")
+	case <-ctx.Done():
+	}
+}
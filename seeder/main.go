@@ -0,0 +1,17 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/cxuhua/xginx"
+)
+
+var (
+	addr   = flag.String("dns", xginx.DefaultSeederAddr, "dns listen address")
+	domain = flag.String("domain", xginx.DefaultSeedDomain, "seed domain name, empty answer all names")
+)
+
+func main() {
+	flag.Parse()
+	xginx.RunSeeder(*addr, *domain)
+}
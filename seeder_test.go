@@ -0,0 +1,100 @@
+package xginx
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+func (suite *BlockTestSuite) TestSeeder() {
+	req := suite.Require()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	//被爬取的节点
+	s := NewTCPServer().(*TCPServer)
+	s.cctx, s.cfun = context.WithCancel(ctx)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	req.NoError(err)
+	defer lis.Close()
+	go ListenerLoopAccept(lis, s.acceptConn, func(err error) {})
+	known := NetAddr{ip: net.ParseIP("10.1.2.3"), port: DefaultPort}
+	s.addrs.Set(known)
+	domain := "seed.xginx.test"
+	sd := NewSeeder(domain)
+	naddr := NetAddr{}
+	req.NoError(naddr.From(lis.Addr().String()))
+	req.True(sd.AddAddr(naddr))
+	req.False(sd.AddAddr(naddr))
+	sd.CrawlOnce(ctx)
+	nodes := map[string]SeedNode{}
+	for _, n := range sd.Nodes() {
+		nodes[n.Addr.String()] = n
+	}
+	node := nodes[naddr.String()]
+	req.Equal(0, node.Fails)
+	req.True(node.IsHealthy(time.Now()))
+	req.Equal(suite.bi.BestHeight(), node.Height)
+	req.Equal(ProtocolVersion, node.Proto)
+	//获取到节点保存的地址
+	req.Contains(nodes, known.String())
+	req.False(nodes[known.String()].IsHealthy(time.Now()))
+	//只返回默认端口的可用节点
+	ip6 := NetAddr{ip: net.ParseIP("2001:db8::1"), port: DefaultPort}
+	req.True(sd.AddAddr(ip6))
+	sd.mu.Lock()
+	for _, a := range []NetAddr{known, ip6} {
+		n := sd.nodes[a.String()]
+		n.Service = DefaultServices
+		n.LastSeen = time.Now()
+	}
+	sd.mu.Unlock()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	req.NoError(err)
+	go func() {
+		_ = sd.Serve(ctx, pc)
+	}()
+	dns := pc.LocalAddr().String()
+	ips, err := LookupSeeder(dns, domain)
+	req.NoError(err)
+	req.Equal(2, len(ips))
+	req.True(ips[0].Equal(known.ip))
+	req.True(ips[1].Equal(ip6.ip))
+	_, err = LookupSeeder(dns, "a."+domain)
+	req.Error(err)
+	_, err = LookupSeeder(dns, "other.test")
+	req.Error(err)
+	//节点使用host:port格式的种子,查询配置的种子域名
+	seeds, nodes2, sdomain := conf.Seeds, conf.Nodes, conf.SeedDomain
+	conf.Seeds, conf.Nodes = []string{dns}, nil
+	defer func() {
+		conf.Seeds, conf.Nodes, conf.SeedDomain = seeds, nodes2, sdomain
+	}()
+	conf.SeedDomain = ""
+	_, err = LookupSeed(dns)
+	req.Error(err)
+	conf.SeedDomain = domain
+	s2 := NewTCPServer().(*TCPServer)
+	s2.loadIPS()
+	req.True(s2.addrs.Has(known))
+	req.True(s2.addrs.Has(ip6))
+	//ANY查询的应答不超过udp最大长度
+	sd.mu.Lock()
+	for i := 0; i < SeederMaxAnswers*2; i++ {
+		for _, ip := range []net.IP{{10, 2, 0, byte(i)}, net.ParseIP(fmt.Sprintf("2001:db8::%x", i+2))} {
+			a := NetAddr{ip: ip, port: DefaultPort}
+			sd.nodes[a.String()] = &SeedNode{Addr: a, Service: DefaultServices, LastSeen: time.Now()}
+		}
+	}
+	sd.mu.Unlock()
+	q := make([]byte, dnsHeaderSize)
+	q[5] = 1
+	q, err = dnsAppendName(q, domain)
+	req.NoError(err)
+	q = append(q, 0, dnsTypeANY, 0, dnsClassIN)
+	res, err := sd.HandleQuery(q)
+	req.NoError(err)
+	req.True(len(res) <= dnsMaxSize)
+	req.Equal(SeederMaxAnswers, int(binary.BigEndian.Uint16(res[6:])))
+}
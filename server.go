@@ -2,6 +2,7 @@ package xginx
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
@@ -16,6 +17,10 @@ const (
 	NewTxTopic = "NewTx"
 	//默认端口
 	DefaultPort = uint16(9333)
+	//ReorgPenalty 发送过深分叉的节点增加的错误次数
+	ReorgPenalty = 12
+	//AssumeHeadersTimeout 等待assume-valid区块头的最长时间
+	AssumeHeadersTimeout = time.Second * 10
 )
 
 //AddrNode 地址节点
@@ -56,6 +61,16 @@ func (m *AddrMap) IncErr(a NetAddr) {
 	}
 }
 
+//Penalty 惩罚地址,增加n次错误,延长重新连接的时间
+func (m *AddrMap) Penalty(a NetAddr, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v := m.addrs[a.String()]
+	if v != nil {
+		v.connErr += n
+	}
+}
+
 //Has 是否存在
 func (m *AddrMap) Has(a NetAddr) bool {
 	m.mu.RLock()
@@ -99,6 +114,8 @@ type IServer interface {
 	BroadMsg(m MsgIO, skips ...*Client) int
 	//直接广播数据,不处理包ID
 	Broadcast(m MsgIO, skips ...*Client) int
+	//通报交易库存
+	RelayTx(tx *TX, skips ...*Client) int
 	//
 	DoOpt(opt int)
 	Clients() []*Client
@@ -126,7 +143,35 @@ type TCPServer struct {
 	dopt   chan int //获取线程做一些操作
 	dt     *time.Timer
 	pt     *time.Timer
-	pkgs   *Cache //包数据缓存
+	pkgs   *Cache      //包数据缓存
+	otxs   *OrphanPool //孤儿交易
+	oblks  *OrphanPool //孤儿区块
+	oqmu   sync.Mutex
+	oqueue []interface{} //等待处理的区块连接通知
+	oqch   chan bool
+	avhs   Headers     //正在获取的assume-valid区块头链
+	avnext uint32      //等待的区块头开始高度,0表示没有请求
+	avtime time.Time   //请求区块头的时间
+	avstop bool        //获取失败后不再获取,连接区块时完整验证
+	bi     *BlockIndex //使用的区块链,为空使用全局
+	nodeid uint64      //节点id,为0使用配置
+}
+
+//使用的区块链,没有单独设置使用全局
+func (s *TCPServer) blockIndex() *BlockIndex {
+	if s.bi != nil {
+		return s.bi
+	}
+	return GetBlockIndex()
+}
+
+//NewMsgVersion 生成服务器的版本数据包
+func (s *TCPServer) NewMsgVersion() *MsgVersion {
+	msg := s.blockIndex().NewMsgVersion()
+	if s.nodeid != 0 {
+		msg.NodeID = s.nodeid
+	}
+	return msg
 }
 
 //DoOpt 操作通道
@@ -230,6 +275,14 @@ func (s *TCPServer) BroadMsg(m MsgIO, skips ...*Client) int {
 		if skip(c) {
 			continue
 		}
+		//设置过滤器的连接直接发送过滤后的数据
+		if fm, ok := c.FilterMsg(m); ok {
+			if fm != nil {
+				c.SendMsg(fm)
+				count++
+			}
+			continue
+		}
 		//发送给周围的节点有id这个数据包
 		msg := &MsgBroadPkg{MsgID: id}
 		//如果有meta信息设置信息
@@ -271,6 +324,9 @@ func (s *TCPServer) DelClient(id uint64, c *Client) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	delete(s.cls, id)
+	//断开连接后删除来自连接的孤儿
+	s.otxs.RemovePeer(id)
+	s.oblks.RemovePeer(id)
 }
 
 //Stop 地址服务
@@ -303,6 +359,9 @@ func (s *TCPServer) NewClient() *Client {
 	c.rc = make(chan MsgIO, 4)
 	c.pt = time.NewTimer(time.Second * time.Duration(Rand(40, 60)))
 	c.vt = time.NewTimer(time.Second * 10) //10秒内不应答MsgVersion将关闭
+	c.it = time.NewTimer(time.Hour)
+	c.it.Stop()
+	c.known = newInvSet(MaxKnownInv)
 	c.vmap = &sync.Map{}
 	return c
 }
@@ -359,21 +418,30 @@ func (s *TCPServer) recoverError() {
 }
 
 func (s *TCPServer) recvMsgTx(c *Client, msg *MsgTx) error {
-	bi := GetBlockIndex()
+	bi := s.blockIndex()
 	txp := bi.GetTxPool()
-	rsg := &MsgTx{}
 	for _, tx := range msg.Txs {
+		id, err := tx.ID()
+		if err != nil {
+			return err
+		}
+		//发送方已经有这个交易
+		c.KnownInv(id)
 		//放入交易池
-		err := txp.PushTx(bi, tx)
+		err = txp.PushTx(bi, tx)
+		if errors.Is(err, ErrOrphanTx) {
+			//保存孤儿交易,请求缺少的交易
+			if err := s.addOrphanTx(c, tx, txp.MissTxs(bi, tx)); err != nil {
+				LogError("add orphan tx error", err)
+			}
+			continue
+		}
 		if err != nil {
 			continue
 		}
-		rsg.Add(tx)
 		LogInfo("recv new tx =", tx, " txpool size =", txp.Len())
-	}
-	//广播到周围节点,不包括c
-	if len(rsg.Txs) > 0 {
-		s.BroadMsg(rsg, c)
+		//通报到周围节点,不包括c
+		s.RelayTx(tx, c)
 	}
 	return nil
 }
@@ -397,11 +465,74 @@ func (s *TCPServer) findBlockClient(h uint32) *Client {
 	return nil
 }
 
+//请求assume-valid区块头链的数量
+func assumeHeadersCount(next uint32) uint32 {
+	num := conf.assumeh - next + 1
+	if num > MaxGetHeaders {
+		num = MaxGetHeaders
+	}
+	return num
+}
+
+//初始同步时先获取到assume-valid区块的区块头链,之后连接的祖先区块跳过签名检查
+//正在获取区块头时返回true,调用者需要持有single锁
+func (s *TCPServer) reqAssumeHeaders(bi *BlockIndex) bool {
+	next, need := bi.NeedAssumeHeaders()
+	if !need || s.avstop {
+		s.avhs, s.avnext = nil, 0
+		return false
+	}
+	if s.avnext != 0 {
+		if time.Since(s.avtime) < AssumeHeadersTimeout {
+			return true
+		}
+		//超时后不再等待,区块使用完整验证
+		LogError("request assume headers timeout")
+		s.avhs, s.avnext, s.avstop = nil, 0, true
+		return false
+	}
+	c := s.findBlockClient(conf.assumeh)
+	if c == nil || !c.IsSupportMsg(NtGetHeaders) {
+		return false
+	}
+	s.avhs, s.avnext, s.avtime = nil, next, time.Now()
+	c.SendMsg(&MsgGetHeaders{Next: next, Count: assumeHeadersCount(next)})
+	return true
+}
+
+//收到assume-valid区块头链,没有到达assume-valid区块时继续请求
+func (s *TCPServer) recvAssumeHeaders(c *Client, msg *MsgHeaders) error {
+	if len(msg.Headers) == 0 {
+		s.avhs, s.avnext, s.avstop = nil, 0, true
+		return errors.New("assume headers empty")
+	}
+	s.avhs = append(s.avhs, msg.Headers...)
+	next := s.avnext + uint32(len(msg.Headers))
+	if next <= conf.assumeh {
+		s.avnext, s.avtime = next, time.Now()
+		c.SendMsg(&MsgGetHeaders{Next: next, Count: assumeHeadersCount(next)})
+		return nil
+	}
+	hs := s.avhs[:len(s.avhs)-int(next-1-conf.assumeh)]
+	s.avhs, s.avnext = nil, 0
+	s.dt.Reset(time.Microsecond * 300)
+	if err := s.blockIndex().AddAssumeHeaders(hs); err != nil {
+		LogError("peer", c.Addr, "assume headers error", err)
+		s.avstop = true
+		return err
+	}
+	return nil
+}
+
 //收到区块头列表
 func (s *TCPServer) recvMsgHeaders(c *Client, msg *MsgHeaders) error {
 	s.single.Lock()
 	defer s.single.Unlock()
-	bi := GetBlockIndex()
+	//请求assume-valid区块头链的回复
+	if s.avnext != 0 && msg.Info.Last.IsZero() && msg.Info.Next == s.avnext {
+		return s.recvAssumeHeaders(c, msg)
+	}
+	bi := s.blockIndex()
 	err := bi.Unlink(msg.Headers)
 	//所有区块都不在此链中扩大范围
 	if err == ErrHeadersScope {
@@ -416,6 +547,12 @@ func (s *TCPServer) recvMsgHeaders(c *Client, msg *MsgHeaders) error {
 		s.dt.Reset(time.Second * 15)
 		return nil
 	}
+	//分叉太深的节点增加错误次数并断开
+	if errors.Is(err, ErrReorgTooDeep) || errors.Is(err, ErrCheckpointFork) {
+		LogError("peer", c.Addr, "headers rejected", err)
+		s.addrs.Penalty(c.Addr, ReorgPenalty)
+		c.Close()
+	}
 	s.dt.Reset(time.Second * 5)
 	return err
 }
@@ -424,10 +561,15 @@ func (s *TCPServer) recvMsgHeaders(c *Client, msg *MsgHeaders) error {
 func (s *TCPServer) recvMsgBlock(c *Client, msg *MsgBlock) error {
 	s.single.Lock()
 	defer s.single.Unlock()
-	ps := GetPubSub()
-	bi := GetBlockIndex()
+	bi := s.blockIndex()
+	ps := bi.GetPubSub()
 	//尝试更新区块数据
-	if err := bi.LinkBlk(msg.Blk); err != nil {
+	err := bi.LinkBlk(msg.Blk)
+	if errors.Is(err, ErrOrphanBlock) {
+		//保存孤儿区块,请求上一个区块
+		return s.addOrphanBlock(c, msg)
+	}
+	if err != nil {
 		LogError("link block error", err)
 		s.dt.Reset(time.Second * 30)
 		return err
@@ -441,6 +583,8 @@ func (s *TCPServer) recvMsgBlock(c *Client, msg *MsgBlock) error {
 	}
 	//如果区块合法,发送新区块通知
 	ps.Pub(msg.Blk, NewRecvBlockTopic)
+	//连接等待这个区块的孤儿区块
+	s.linkOrphanBlocks(msg.Blk)
 	return nil
 }
 
@@ -448,7 +592,10 @@ func (s *TCPServer) recvMsgBlock(c *Client, msg *MsgBlock) error {
 func (s *TCPServer) reqMsgGetBlock() {
 	s.single.Lock()
 	defer s.single.Unlock()
-	bi := GetBlockIndex()
+	bi := s.blockIndex()
+	if s.reqAssumeHeaders(bi) {
+		return
+	}
 	bv := bi.GetBestValue()
 	c := s.findBlockClient(bv.Next())
 	if c != nil {
@@ -513,12 +660,14 @@ func (s *TCPServer) dispatch(idx int, ch chan interface{}) {
 				LogInfo(opt)
 			}
 		case <-s.cctx.Done():
-			_ = s.tcplis.Close()
+			if s.tcplis != nil {
+				_ = s.tcplis.Close()
+			}
 			return
 		case cv := <-ch:
 			//收到交易信息
 			if tx, ok := cv.(*TX); ok {
-				s.BroadMsg(NewMsgTx(tx))
+				s.RelayTx(tx)
 				break
 			}
 			//收到客户端信息
@@ -563,6 +712,9 @@ func (s *TCPServer) dispatch(idx int, ch chan interface{}) {
 			if s.ConnNum() < conf.MaxConn {
 				s.tryConnect()
 			}
+			//删除过期的孤儿
+			s.otxs.Expire()
+			s.oblks.Expire()
 			s.pt.Reset(time.Second * 10)
 		}
 	}
@@ -593,7 +745,7 @@ func (s *TCPServer) loadIPS() {
 	lipc = 0
 	sipc = 0
 	for _, v := range conf.Seeds {
-		ips, err := net.LookupIP(v)
+		ips, err := LookupSeed(v)
 		if err != nil {
 			continue
 		}
@@ -651,27 +803,39 @@ func (s *TCPServer) run() {
 	defer s.recoverError()
 	s.wg.Add(1)
 	defer s.wg.Done()
-	ch := GetPubSub().Sub(NetMsgTopic, NewTxTopic)
-	for i := 0; i < 4; i++ {
-		go s.dispatch(i, ch)
-	}
+	s.startDispatch()
 	s.dopt <- 1 //load seed ip
-	ListenerLoopAccept(s.tcplis, func(conn net.Conn) error {
-		if s.ConnNum() >= conf.MaxConn {
-			LogError("conn arrive max,close conn ", conn)
-			return conn.Close()
-		}
-		c := s.NewClientWithConn(conn)
-		c.typ = ClientIn
-		c.isopen = true
-		c.loop()
-		return nil
-	}, func(err error) {
+	ListenerLoopAccept(s.tcplis, s.acceptConn, func(err error) {
 		s.err = err
 		s.cfun()
 	})
 }
 
+//启动消息处理
+func (s *TCPServer) startDispatch() {
+	ps := s.blockIndex().GetPubSub()
+	ch := ps.Sub(NetMsgTopic, NewTxTopic)
+	for i := 0; i < 4; i++ {
+		go s.dispatch(i, ch)
+	}
+	//区块连接通知单独处理,处理消息时会发布这个消息
+	go s.orphanLoop(ps.Sub(NewLinkBlockTopic))
+	go s.orphanExec()
+}
+
+//处理连入的连接
+func (s *TCPServer) acceptConn(conn net.Conn) error {
+	if s.ConnNum() >= conf.MaxConn {
+		LogError("conn arrive max,close conn ", conn)
+		return conn.Close()
+	}
+	c := s.NewClientWithConn(conn)
+	c.typ = ClientIn
+	c.isopen = true
+	c.Loop()
+	return nil
+}
+
 //GetPkg 获取广播数据包
 func (s *TCPServer) GetPkg(id string) (MsgIO, bool) {
 	msg, has := s.pkgs.Get(id)
@@ -699,6 +863,9 @@ func (s *TCPServer) HasPkg(id string) bool {
 func (s *TCPServer) Start(ctx context.Context, lptr IListener) {
 	s.lptr = lptr
 	s.cctx, s.cfun = context.WithCancel(ctx)
+	if err := LoadRateLimits(conf.GetRateLimits()); err != nil {
+		panic(err)
+	}
 	s.addr = conf.GetTCPListenAddr().ToTCPAddr()
 	tcplis, err := net.ListenTCP(s.addr.Network(), s.addr)
 	if err != nil {
@@ -718,5 +885,8 @@ func NewTCPServer() IServer {
 	s.dt = time.NewTimer(time.Second)
 	//默认过期5分钟，每10秒检测过期
 	s.pkgs = NewCache(time.Minute*5, time.Second*10)
+	s.otxs = NewOrphanPool(MaxOrphanTxs, MaxPeerOrphanTxs, OrphanTxExpire)
+	s.oblks = NewOrphanPool(MaxOrphanBlocks, MaxPeerOrphanBlocks, OrphanBlockExpire)
+	s.oqch = make(chan bool, 1)
 	return s
 }
@@ -0,0 +1,478 @@
+package xginx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//集成测试用的多节点网络模拟
+//所有节点在同一个进程中运行,通过内存管道连接
+
+//模拟参数
+const (
+	//SimWaitTimeout 停止节点等待后台任务结束的最长时间
+	SimWaitTimeout = time.Second * 5
+	//SimPollInterval 检测节点是否收敛的间隔
+	SimPollInterval = time.Millisecond * 50
+	//SimQueueSize 连接写入队列长度
+	SimQueueSize = 1024
+)
+
+//SimLis 模拟节点监听器,时间由测试控制
+type SimLis struct {
+	*TestLis
+	now uint32
+}
+
+//TimeNow 返回模拟时间
+func (lis *SimLis) TimeNow() uint32 {
+	return atomic.LoadUint32(&lis.now)
+}
+
+//SetTime 设置模拟时间
+func (lis *SimLis) SetTime(t uint32) {
+	atomic.StoreUint32(&lis.now, t)
+}
+
+//AddTime 模拟时间前进d
+func (lis *SimLis) AddTime(d time.Duration) {
+	atomic.AddUint32(&lis.now, uint32(d/time.Second))
+}
+
+//OnInit 新节点数据目录为空,不需要清除数据
+func (lis *SimLis) OnInit(bi *BlockIndex) error {
+	return nil
+}
+
+//模拟连接,写入的数据先进入队列,延迟后由后台写入
+//net.Pipe没有缓冲,双方同时写入时会互相等待
+type simConn struct {
+	net.Conn
+	link *simLink
+	wq   chan simData
+	done chan bool
+	once sync.Once
+}
+
+//等待写入的数据
+type simData struct {
+	b []byte
+	t time.Time //写入时间
+}
+
+func newSimConn(conn net.Conn, link *simLink) *simConn {
+	c := &simConn{
+		Conn: conn,
+		link: link,
+		wq:   make(chan simData, SimQueueSize),
+		done: make(chan bool),
+	}
+	go c.flush()
+	return c
+}
+
+func (c *simConn) flush() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case d := <-c.wq:
+			if w := time.Until(d.t.Add(c.link.Latency())); w > 0 {
+				time.Sleep(w)
+			}
+			if _, err := c.Conn.Write(d.b); err != nil {
+				_ = c.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *simConn) Write(b []byte) (int, error) {
+	d := simData{b: append([]byte{}, b...), t: time.Now()}
+	select {
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	case c.wq <- d:
+		return len(b), nil
+	}
+}
+
+func (c *simConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
+
+//两个节点之间的连接
+type simLink struct {
+	latency int64
+	conns   [2]net.Conn
+}
+
+//Latency 连接延迟
+func (l *simLink) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.latency))
+}
+
+func (l *simLink) close() {
+	for _, conn := range l.conns {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}
+}
+
+//SimNode 模拟节点,有单独的区块链,数据目录和发布订阅
+type SimNode struct {
+	Index int
+	Addr  NetAddr
+	lis   *SimLis
+	bi    *BlockIndex
+	srv   *TCPServer
+	ps    *PubSub
+	dir   string
+}
+
+//BlockIndex 节点的区块链
+func (n *SimNode) BlockIndex() *BlockIndex {
+	return n.bi
+}
+
+//Server 节点的服务
+func (n *SimNode) Server() *TCPServer {
+	return n.srv
+}
+
+//Listener 节点的监听器,可以控制节点时间
+func (n *SimNode) Listener() *SimLis {
+	return n.lis
+}
+
+//Best 节点的最高区块
+func (n *SimNode) Best() BestValue {
+	return n.bi.GetBestValue()
+}
+
+//Sync 通过ping更新连接的区块高度,并向更高的节点请求区块
+func (n *SimNode) Sync() {
+	h := n.bi.BestHeight()
+	for _, c := range n.srv.Clients() {
+		c.SendMsg(NewMsgPing(h))
+	}
+	n.srv.reqMsgGetBlock()
+}
+
+//Mine 在节点上创建num个区块并广播
+func (n *SimNode) Mine(num int) ([]*BlockInfo, error) {
+	n.srv.single.Lock()
+	defer n.srv.single.Unlock()
+	blks := []*BlockInfo{}
+	for i := 0; i < num; i++ {
+		//区块时间必须比上一个区块大
+		if t := n.bi.Time(); n.lis.TimeNow() < t {
+			n.lis.SetTime(t)
+		}
+		n.lis.AddTime(time.Second)
+		blk, err := n.bi.NewBlock(1)
+		if err != nil {
+			return nil, err
+		}
+		if err := blk.Finish(n.bi); err != nil {
+			return nil, err
+		}
+		calcbits(n.bi, blk)
+		if err := n.bi.LinkBlk(blk); err != nil {
+			return nil, err
+		}
+		msg := NewMsgBlock(blk)
+		msg.AddFlags(MsgBlockNewFlags)
+		n.srv.BroadMsg(msg)
+		blks = append(blks, blk)
+	}
+	return blks, nil
+}
+
+func (n *SimNode) close() {
+	n.srv.cfun()
+	done := make(chan bool)
+	go func() {
+		n.srv.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(SimWaitTimeout):
+		LogError("sim node", n.Index, "stop timeout")
+	}
+	n.bi.Close()
+	n.ps.Shutdown()
+	_ = os.RemoveAll(n.dir)
+}
+
+//SimNet 模拟网络
+type SimNet struct {
+	Nodes []*SimNode
+	mu    sync.Mutex
+	links map[[2]int]*simLink
+	cctx  context.Context
+	cfun  context.CancelFunc
+}
+
+//NewSimNet 创建num个节点的模拟网络,节点之间没有连接
+//所有节点从同一个创世区块开始
+func NewSimNet(num int, genesis *BlockInfo) (*SimNet, error) {
+	if conf == nil {
+		return nil, errors.New("config not init")
+	}
+	if !conf.IsGenesisID(genesis.MustID()) {
+		return nil, errors.New("block not config genesis")
+	}
+	sn := &SimNet{
+		links: map[[2]int]*simLink{},
+	}
+	sn.cctx, sn.cfun = context.WithCancel(context.Background())
+	for i := 0; i < num; i++ {
+		n, err := sn.newNode(i, genesis)
+		if err != nil {
+			sn.Close()
+			return nil, err
+		}
+		sn.Nodes = append(sn.Nodes, n)
+	}
+	return sn, nil
+}
+
+func (sn *SimNet) newNode(idx int, genesis *BlockInfo) (*SimNode, error) {
+	n := &SimNode{
+		Index: idx,
+		Addr:  NetAddr{ip: net.IPv4(127, 0, 1, byte(idx+1)), port: DefaultPort},
+		lis:   &SimLis{TestLis: newTestLis(1), now: genesis.Header.Time},
+		dir:   NewTempDir(),
+		ps:    NewPubSub(10),
+	}
+	if err := os.MkdirAll(n.dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	n.bi = newBlockIndex(n.lis, n.dir)
+	n.bi.ps = n.ps
+	//每个节点使用创世区块的副本
+	w := NewWriter()
+	if err := genesis.Encode(w); err != nil {
+		return nil, err
+	}
+	blk := &BlockInfo{}
+	if err := blk.Decode(NewReader(w.Bytes())); err != nil {
+		return nil, err
+	}
+	if err := n.bi.LinkBlk(blk); err != nil {
+		return nil, err
+	}
+	n.bi.idx.start(n.bi)
+	n.srv = NewTCPServer().(*TCPServer)
+	n.srv.bi = n.bi
+	n.srv.nodeid = conf.GenUInt64()
+	n.srv.lptr = n.lis
+	n.srv.cctx, n.srv.cfun = context.WithCancel(sn.cctx)
+	n.srv.startDispatch()
+	return n, nil
+}
+
+func simLinkKey(i, j int) [2]int {
+	if i > j {
+		i, j = j, i
+	}
+	return [2]int{i, j}
+}
+
+//Connect 连接节点i到节点j,已经连接时忽略
+func (sn *SimNet) Connect(i, j int) error {
+	if i == j {
+		return errors.New("can't connect self")
+	}
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	key := simLinkKey(i, j)
+	if _, has := sn.links[key]; has {
+		return nil
+	}
+	a, b := sn.Nodes[i], sn.Nodes[j]
+	link := &simLink{}
+	c1, c2 := net.Pipe()
+	link.conns[0] = newSimConn(c1, link)
+	link.conns[1] = newSimConn(c2, link)
+	//j作为连入的连接
+	if err := b.srv.acceptConn(link.conns[1]); err != nil {
+		link.close()
+		return err
+	}
+	//i作为连出的连接,主动发送第一个包
+	c := a.srv.NewClientWithConn(link.conns[0])
+	c.typ = ClientOut
+	c.isopen = true
+	c.Addr = b.Addr
+	c.SendMsg(a.srv.NewMsgVersion())
+	c.Loop()
+	sn.links[key] = link
+	//等待双方握手完成
+	deadline := time.Now().Add(SimWaitTimeout)
+	for !simAcked(a.srv, b.srv) || !simAcked(b.srv, a.srv) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("node %d and %d handshake timeout", i, j)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+//a到b的连接是否握手完成
+func simAcked(a *TCPServer, b *TCPServer) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	c, has := a.cls[b.nodeid]
+	return has && c.IsAcked()
+}
+
+//Disconnect 断开节点i和节点j之间的连接,等待双方移除连接
+func (sn *SimNet) Disconnect(i, j int) {
+	sn.mu.Lock()
+	key := simLinkKey(i, j)
+	link, has := sn.links[key]
+	delete(sn.links, key)
+	sn.mu.Unlock()
+	if !has {
+		return
+	}
+	link.close()
+	a, b := sn.Nodes[i].srv, sn.Nodes[j].srv
+	deadline := time.Now().Add(SimWaitTimeout)
+	for a.IsOpen(b.nodeid) || b.IsOpen(a.nodeid) {
+		if time.Now().After(deadline) {
+			LogError("sim node", i, j, "disconnect timeout")
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+//ConnectAll 连接所有节点
+func (sn *SimNet) ConnectAll() error {
+	for i := 0; i < len(sn.Nodes); i++ {
+		for j := i + 1; j < len(sn.Nodes); j++ {
+			if err := sn.Connect(i, j); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//Partition 分割网络,断开不同组节点之间的连接
+func (sn *SimNet) Partition(groups ...[]int) {
+	group := map[int]int{}
+	for g, idxs := range groups {
+		for _, i := range idxs {
+			group[i] = g
+		}
+	}
+	for i := 0; i < len(sn.Nodes); i++ {
+		for j := i + 1; j < len(sn.Nodes); j++ {
+			if group[i] != group[j] {
+				sn.Disconnect(i, j)
+			}
+		}
+	}
+}
+
+//Heal 恢复分割的网络,重新连接所有节点
+func (sn *SimNet) Heal() error {
+	return sn.ConnectAll()
+}
+
+//SetLatency 设置节点i和节点j之间连接的延迟
+func (sn *SimNet) SetLatency(i, j int, d time.Duration) error {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	link, has := sn.links[simLinkKey(i, j)]
+	if !has {
+		return fmt.Errorf("node %d and %d not connected", i, j)
+	}
+	atomic.StoreInt64(&link.latency, int64(d))
+	return nil
+}
+
+//获取指定的节点,没有指定返回所有节点
+func (sn *SimNet) nodes(idxs ...int) []*SimNode {
+	if len(idxs) == 0 {
+		return sn.Nodes
+	}
+	ns := []*SimNode{}
+	for _, i := range idxs {
+		ns = append(ns, sn.Nodes[i])
+	}
+	return ns
+}
+
+//IsConverged 节点是否有相同的最高区块,没有指定节点检测所有节点
+func (sn *SimNet) IsConverged(idxs ...int) bool {
+	ns := sn.nodes(idxs...)
+	if len(ns) == 0 {
+		return true
+	}
+	id := ns[0].Best().ID
+	for _, n := range ns[1:] {
+		if !n.Best().ID.Equal(id) {
+			return false
+		}
+	}
+	return true
+}
+
+//WaitConverge 等待节点有相同的最高区块,超时返回错误
+//没有指定节点等待所有节点
+func (sn *SimNet) WaitConverge(timeout time.Duration, idxs ...int) error {
+	deadline := time.Now().Add(timeout)
+	for !sn.IsConverged(idxs...) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("sim net not converge, %s", sn)
+		}
+		for _, n := range sn.nodes(idxs...) {
+			n.Sync()
+		}
+		time.Sleep(SimPollInterval)
+	}
+	return nil
+}
+
+//String 所有节点的最高区块
+func (sn *SimNet) String() string {
+	ss := []string{}
+	for _, n := range sn.Nodes {
+		bv := n.Best()
+		ss = append(ss, fmt.Sprintf("node%d=%d:%v", n.Index, bv.Height, bv.ID))
+	}
+	return strings.Join(ss, " ")
+}
+
+//Close 关闭所有节点并删除数据目录
+func (sn *SimNet) Close() {
+	sn.mu.Lock()
+	for key, link := range sn.links {
+		link.close()
+		delete(sn.links, key)
+	}
+	sn.mu.Unlock()
+	for _, n := range sn.Nodes {
+		n.close()
+	}
+	sn.cfun()
+}
@@ -0,0 +1,53 @@
+package xginx
+
+import (
+	"time"
+)
+
+func (suite *BlockTestSuite) TestSimNet() {
+	req := suite.Require()
+	//分叉时按确认数请求区块头
+	confirms := conf.Confirms
+	conf.Confirms = 6
+	defer func() {
+		conf.Confirms = confirms
+	}()
+	bv := suite.bi.GetBestValue()
+	genesis, err := suite.bi.LoadBlock(conf.genesis)
+	req.NoError(err)
+	sn, err := NewSimNet(3, genesis)
+	req.NoError(err)
+	defer sn.Close()
+	req.NoError(sn.ConnectAll())
+	req.NoError(sn.SetLatency(0, 1, time.Millisecond*5))
+	//新区块广播到所有节点
+	_, err = sn.Nodes[0].Mine(2)
+	req.NoError(err)
+	req.NoError(sn.WaitConverge(time.Second * 20))
+	req.Equal(uint32(2), sn.Nodes[2].Best().Height)
+	//分割网络后两边分别创建区块
+	sn.Partition([]int{0, 1}, []int{2})
+	blks, err := sn.Nodes[1].Mine(3)
+	req.NoError(err)
+	_, err = sn.Nodes[2].Mine(1)
+	req.NoError(err)
+	req.NoError(sn.WaitConverge(time.Second*20, 0, 1))
+	req.False(sn.IsConverged())
+	req.Equal(uint32(3), sn.Nodes[2].Best().Height)
+	//恢复后切换到更长的链
+	req.NoError(sn.Heal())
+	req.NoError(sn.WaitConverge(time.Second * 30))
+	best := sn.Nodes[2].Best()
+	req.Equal(uint32(5), best.Height)
+	req.Equal(blks[2].MustID(), best.ID)
+	//节点时间由测试控制
+	lis := sn.Nodes[0].Listener()
+	now := lis.TimeNow()
+	lis.AddTime(time.Hour)
+	blks, err = sn.Nodes[0].Mine(1)
+	req.NoError(err)
+	req.Equal(now+3601, blks[0].Header.Time)
+	req.NoError(sn.WaitConverge(time.Second * 20))
+	//模拟节点不影响主链
+	req.Equal(bv.ID, suite.bi.GetBestValue().ID)
+}
@@ -0,0 +1,691 @@
+package xginx
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+//轻节点参数
+const (
+	//定时同步区块头间隔
+	SpvSyncInterval = time.Second * 30
+	//布隆过滤器误判率
+	SpvFilterRate = 0.0001
+)
+
+//SpvPayment 轻节点验证通过的交易
+type SpvPayment struct {
+	TxID   HASH256
+	Tx     *TX     //通过过滤器收到的交易,只监视id时为nil
+	BlkID  HASH256 //交易所在区块
+	Height uint32  //交易所在区块高度
+}
+
+//SpvClient 轻节点客户端
+//只同步和验证区块头,加载钱包地址的布隆过滤器接收相关交易
+//交易使用merkle树验证在区块中后才报告确认
+type SpvClient struct {
+	mu      sync.RWMutex
+	lis     *list.List                //区块头列表
+	hmap    map[uint32]*list.Element  //按高度缓存
+	imap    map[HASH256]*list.Element //按id缓存
+	pkhs    map[HASH160]bool          //钱包地址
+	pending map[HASH256]*TX           //等待区块确认的交易
+	pays    map[HASH256]*SpvPayment   //已经确认的交易
+	syncing bool                      //正在等待区块头返回
+	next    uint32                    //请求区块头的开始高度
+	nodeid  uint64                    //节点随机id
+	wmu     sync.Mutex
+	wq      []MsgIO       //待发送的消息
+	wn      chan struct{} //有消息待发送
+	//OnPayment 交易验证在区块中时调用
+	OnPayment func(p *SpvPayment)
+}
+
+//NewSpvClient 创建轻节点客户端
+func NewSpvClient() *SpvClient {
+	return &SpvClient{
+		lis:     list.New(),
+		hmap:    map[uint32]*list.Element{},
+		imap:    map[HASH256]*list.Element{},
+		pkhs:    map[HASH160]bool{},
+		pending: map[HASH256]*TX{},
+		pays:    map[HASH256]*SpvPayment{},
+		nodeid:  conf.GenUInt64(),
+		wn:      make(chan struct{}, 1),
+	}
+}
+
+//GetBlockHeader 获取区块头,用于验证交易merkle树
+func (sc *SpvClient) GetBlockHeader(id HASH256) (*TBEle, error) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	ele, has := sc.imap[id]
+	if !has {
+		return nil, errors.New("not found")
+	}
+	return ele.Value.(*TBEle), nil
+}
+
+func (sc *SpvClient) last() *TBEle {
+	ele := sc.lis.Back()
+	if ele == nil {
+		return nil
+	}
+	return ele.Value.(*TBEle)
+}
+
+//下个区块头的高度
+func (sc *SpvClient) nextHeight() uint32 {
+	if last := sc.last(); last != nil {
+		return last.Height + 1
+	}
+	return 0
+}
+
+//Height 获取区块头高度,没有区块头返回InvalidHeight
+func (sc *SpvClient) Height() uint32 {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	if last := sc.last(); last != nil {
+		return last.Height
+	}
+	return InvalidHeight
+}
+
+//Len 区块头数量
+func (sc *SpvClient) Len() int {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.lis.Len()
+}
+
+//AddAddress 添加钱包地址,连接后重新加载过滤器
+func (sc *SpvClient) AddAddress(addrs ...Address) error {
+	sc.mu.Lock()
+	for _, addr := range addrs {
+		pkh, err := addr.GetPkh()
+		if err != nil {
+			sc.mu.Unlock()
+			return err
+		}
+		sc.pkhs[pkh] = true
+	}
+	sc.mu.Unlock()
+	return sc.loadFilter()
+}
+
+//Watch 监视指定交易,同步区块头后验证是否在区块中
+func (sc *SpvClient) Watch(id HASH256) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, has := sc.pays[id]; has {
+		return
+	}
+	if _, has := sc.pending[id]; !has {
+		sc.pending[id] = nil
+	}
+	sc.SendMsg(&MsgGetMerkle{TxID: id})
+}
+
+//Payment 获取已经确认的交易和确认数
+func (sc *SpvClient) Payment(id HASH256) (*SpvPayment, int, bool) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	pay, has := sc.pays[id]
+	if !has {
+		return nil, 0, false
+	}
+	last := sc.last()
+	if last == nil || last.Height < pay.Height {
+		return pay, 0, true
+	}
+	return pay, int(last.Height-pay.Height) + 1, true
+}
+
+//IsPending 交易是否在等待区块确认
+func (sc *SpvClient) IsPending(id HASH256) bool {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	_, has := sc.pending[id]
+	return has
+}
+
+//SendMsg 发送消息,连接后按顺序发送
+func (sc *SpvClient) SendMsg(m MsgIO) {
+	sc.wmu.Lock()
+	sc.wq = append(sc.wq, m)
+	sc.wmu.Unlock()
+	select {
+	case sc.wn <- struct{}{}:
+	default:
+	}
+}
+
+//取出所有待发送的消息
+func (sc *SpvClient) takeMsgs() []MsgIO {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	ms := sc.wq
+	sc.wq = nil
+	return ms
+}
+
+//根据钱包地址创建过滤器
+func (sc *SpvClient) newFilter() (*BloomFilter, error) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	num := len(sc.pkhs)
+	if num < 10 {
+		num = 10
+	}
+	size, funcs := CalcBloomFilterSize(num, SpvFilterRate)
+	blm, err := NewBloomFilter(funcs, uint32(conf.GenUInt64()), make([]byte, size))
+	if err != nil {
+		return nil, err
+	}
+	for pkh := range sc.pkhs {
+		blm.Add(pkh[:])
+	}
+	return blm, nil
+}
+
+//对方节点只在没有过滤器时才加载,需要先清除
+func (sc *SpvClient) loadFilter() error {
+	blm, err := sc.newFilter()
+	if err != nil {
+		return err
+	}
+	sc.SendMsg(&MsgFilterClear{})
+	sc.SendMsg(blm.NewMsgFilterLoad())
+	return nil
+}
+
+//NewMsgVersion 轻节点版本信息,不提供全节点服务
+func (sc *SpvClient) NewMsgVersion() *MsgVersion {
+	m := &MsgVersion{}
+	m.Ver = conf.Ver
+	//不接受连入,使用空地址
+	m.Addr = NetAddr{ip: net.IPv4zero}
+	m.Height = sc.Height()
+	m.NodeID = sc.nodeid
+	m.Proto = ProtocolVersion
+	return m
+}
+
+//计算高度对应的难度,和BlockIndex.calcBits一致
+func (sc *SpvClient) calcBits(height uint32) (uint32, error) {
+	last := sc.last()
+	if last == nil || height == 0 {
+		return GetMinPowBits(), nil
+	}
+	if height%conf.PowSpan != 0 {
+		return last.Bits, nil
+	}
+	ele, has := sc.hmap[height-conf.PowSpan]
+	if !has {
+		return 0, fmt.Errorf("prev height %d header miss", height-conf.PowSpan)
+	}
+	return CalculateWorkRequired(last.Time, ele.Value.(*TBEle).Time, last.Bits), nil
+}
+
+//检测并连接区块头到最后
+func (sc *SpvClient) linkHeader(bh BlockHeader) error {
+	id, err := bh.ResetID()
+	if err != nil {
+		return err
+	}
+	height := sc.nextHeight()
+	if last := sc.last(); last == nil {
+		if !conf.IsGenesisID(id) {
+			return errors.New("first header must is genesis")
+		}
+	} else if !bh.Prev.Equal(last.MustID()) {
+		return fmt.Errorf("header %v can't link to last", id)
+	}
+	if bh.Merkle.IsZero() {
+		return errors.New("merkle id error")
+	}
+	bits, err := sc.calcBits(height)
+	if err != nil {
+		return err
+	}
+	if bh.Bits != bits {
+		return errors.New("header bits error")
+	}
+	if !CheckProofOfWork(id, bh.Bits) {
+		return errors.New("header bits check error")
+	}
+	//必须和检查点一致
+	if err := conf.CheckPoint(height, id); err != nil {
+		return err
+	}
+	ele := NewTBEle(&TBMeta{BlockHeader: bh}, height, nil)
+	le := sc.lis.PushBack(ele)
+	sc.hmap[height] = le
+	sc.imap[id] = le
+	return nil
+}
+
+//回退num个区块头,在回退区块中确认的交易重新等待确认
+//返回回退的区块头,按高度从高到低
+func (sc *SpvClient) unlinkHeaders(num uint32) Headers {
+	hs := Headers{}
+	for ; num > 0 && sc.lis.Len() > 0; num-- {
+		le := sc.lis.Back()
+		ele := le.Value.(*TBEle)
+		id := ele.MustID()
+		for tid, pay := range sc.pays {
+			if pay.BlkID.Equal(id) {
+				sc.pending[tid] = pay.Tx
+				delete(sc.pays, tid)
+			}
+		}
+		delete(sc.hmap, ele.Height)
+		delete(sc.imap, id)
+		sc.lis.Remove(le)
+		hs.Add(ele.BlockHeader)
+	}
+	return hs
+}
+
+//从height开始的区块头工作量之和
+func (sc *SpvClient) chainWork(height uint32) UINT256 {
+	work := UINT256{}
+	for le := sc.hmap[height]; le != nil; le = le.Next() {
+		work = work.Add(CalcWork(le.Value.(*TBEle).Bits))
+	}
+	return work
+}
+
+//分叉的区块头工作量更大时切换到分叉链,连接失败恢复原来的区块头
+func (sc *SpvClient) switchHeaders(height uint32, hs Headers) (bool, error) {
+	work := UINT256{}
+	for _, bh := range hs {
+		work = work.Add(CalcWork(bh.Bits))
+	}
+	if work.Cmp(sc.chainWork(height)) <= 0 {
+		return false, nil
+	}
+	olds := sc.unlinkHeaders(sc.nextHeight() - height)
+	for i, bh := range hs {
+		err := sc.linkHeader(bh)
+		if err == nil {
+			continue
+		}
+		sc.unlinkHeaders(uint32(i))
+		olds.Reverse()
+		for _, ob := range olds {
+			if lerr := sc.linkHeader(ob); lerr != nil {
+				return false, lerr
+			}
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+//请求后续的区块头
+func (sc *SpvClient) reqHeaders() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.reqHeadersFrom(sc.nextHeight())
+}
+
+//从next高度开始请求区块头,分叉时从更低的高度开始
+func (sc *SpvClient) reqHeadersFrom(next uint32) {
+	if sc.syncing {
+		return
+	}
+	sc.syncing = true
+	sc.next = next
+	sc.SendMsg(&MsgGetHeaders{Next: next, Count: MaxGetHeaders})
+}
+
+//请求所有等待确认交易的merkle树
+func (sc *SpvClient) reqMerkles() {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	for id := range sc.pending {
+		sc.SendMsg(&MsgGetMerkle{TxID: id})
+	}
+}
+
+//收到区块头
+func (sc *SpvClient) recvHeaders(msg *MsgHeaders) error {
+	sc.mu.Lock()
+	sc.syncing = false
+	//不是最后请求的区块头
+	if msg.Info.Next != sc.next {
+		sc.mu.Unlock()
+		return nil
+	}
+	//跳过本地已有的区块头
+	hs, height := msg.Headers, msg.Info.Next
+	for len(hs) > 0 {
+		le, has := sc.hmap[height]
+		if !has {
+			break
+		}
+		id, err := hs[0].ID()
+		if err != nil {
+			sc.mu.Unlock()
+			return err
+		}
+		if !id.Equal(le.Value.(*TBEle).MustID()) {
+			break
+		}
+		hs, height = hs[1:], height+1
+	}
+	//已经同步到最新
+	if len(hs) == 0 {
+		sc.mu.Unlock()
+		sc.reqMerkles()
+		return nil
+	}
+	//分叉点在请求的高度之前,从更低的高度重新请求
+	if pe, has := sc.hmap[height-1]; height > 0 && has && !hs[0].Prev.Equal(pe.Value.(*TBEle).MustID()) {
+		if height != msg.Info.Next {
+			sc.mu.Unlock()
+			return fmt.Errorf("headers at height %d can't link", height)
+		}
+		next := uint32(0)
+		if height > conf.Confirms {
+			next = height - conf.Confirms
+		}
+		LogInfof("spv headers fork before height %d, request from %d", height, next)
+		sc.reqHeadersFrom(next)
+		sc.mu.Unlock()
+		return nil
+	}
+	//和对方的链分叉,工作量更大时才切换
+	if height < sc.nextHeight() {
+		ok, err := sc.switchHeaders(height, hs)
+		if err != nil {
+			sc.mu.Unlock()
+			return err
+		}
+		if !ok {
+			LogInfof("spv headers fork at height %d, work not greater, ignore", height)
+			sc.mu.Unlock()
+			sc.reqMerkles()
+			return nil
+		}
+		LogInfof("spv headers fork at height %d, switch to %d headers", height, len(hs))
+	} else {
+		for _, bh := range hs {
+			if err := sc.linkHeader(bh); err != nil {
+				sc.mu.Unlock()
+				return err
+			}
+		}
+	}
+	sc.mu.Unlock()
+	//可能还有更多区块头
+	if len(msg.Headers) >= MaxGetHeaders {
+		sc.reqHeaders()
+	} else {
+		sc.reqMerkles()
+	}
+	return nil
+}
+
+//是否是钱包相关的交易,输出到钱包地址或者花费钱包的交易输出
+func (sc *SpvClient) isWalletTx(tx *TX) bool {
+	for _, out := range tx.Outs {
+		pkh, err := out.Script.GetPkh()
+		if err != nil {
+			continue
+		}
+		if sc.pkhs[pkh] {
+			return true
+		}
+	}
+	if tx.IsCoinBase() {
+		return false
+	}
+	for _, in := range tx.Ins {
+		if _, has := sc.pays[in.OutHash]; has {
+			return true
+		}
+		if _, has := sc.pending[in.OutHash]; has {
+			return true
+		}
+	}
+	return false
+}
+
+//收到交易,过滤器可能误判需要再次检测
+func (sc *SpvClient) recvTx(msg *MsgTx) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, tx := range msg.Txs {
+		if !sc.isWalletTx(tx) {
+			continue
+		}
+		id, err := tx.ID()
+		if err != nil {
+			LogError("spv tx id error", err)
+			continue
+		}
+		if _, has := sc.pays[id]; has {
+			continue
+		}
+		sc.pending[id] = tx
+		sc.SendMsg(&MsgGetMerkle{TxID: id})
+	}
+}
+
+//确认交易在区块ele中
+func (sc *SpvClient) confirm(id HASH256, tx *TX, ele *TBEle) *SpvPayment {
+	pay := &SpvPayment{
+		TxID:   id,
+		Tx:     tx,
+		BlkID:  ele.MustID(),
+		Height: ele.Height,
+	}
+	delete(sc.pending, id)
+	sc.pays[id] = pay
+	return pay
+}
+
+//通知确认的交易
+func (sc *SpvClient) notify(pays ...*SpvPayment) {
+	for _, pay := range pays {
+		LogInfof("spv tx %v confirmed in block %v height %d", pay.TxID, pay.BlkID, pay.Height)
+		if sc.OnPayment != nil {
+			sc.OnPayment(pay)
+		}
+	}
+}
+
+//收到交易merkle树,验证通过后确认交易
+func (sc *SpvClient) recvTxMerkle(msg *MsgTxMerkle) error {
+	if err := msg.Verify(sc); err != nil {
+		return fmt.Errorf("verify tx %v merkle error %w", msg.TxID, err)
+	}
+	sc.mu.Lock()
+	tx, has := sc.pending[msg.TxID]
+	le, hash := sc.imap[msg.BlkID]
+	if !has || !hash {
+		sc.mu.Unlock()
+		return nil
+	}
+	pay := sc.confirm(msg.TxID, tx, le.Value.(*TBEle))
+	sc.mu.Unlock()
+	sc.notify(pay)
+	return nil
+}
+
+//收到新区块的merkle区块,连接区块头并确认其中的钱包交易
+//区块头不能连接时先同步区块头,交易等待确认
+func (sc *SpvClient) recvMerkleBlock(msg *MsgMerkleBlock) error {
+	if err := msg.Verify(); err != nil {
+		return err
+	}
+	id, err := msg.Header.ID()
+	if err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	le, has := sc.imap[id]
+	if last := sc.last(); !has && last != nil && msg.Header.Prev.Equal(last.MustID()) {
+		if err := sc.linkHeader(msg.Header); err != nil {
+			sc.mu.Unlock()
+			return err
+		}
+		le, has = sc.imap[id]
+	}
+	pays := []*SpvPayment{}
+	for _, tx := range msg.Txs {
+		tid, err := tx.ID()
+		if err != nil {
+			sc.mu.Unlock()
+			return err
+		}
+		if _, ok := sc.pending[tid]; !ok && !sc.isWalletTx(tx) {
+			continue
+		}
+		if _, ok := sc.pays[tid]; ok {
+			continue
+		}
+		if !has {
+			sc.pending[tid] = tx
+			continue
+		}
+		pays = append(pays, sc.confirm(tid, tx, le.Value.(*TBEle)))
+	}
+	sc.mu.Unlock()
+	if !has {
+		sc.reqHeaders()
+	}
+	sc.notify(pays...)
+	return nil
+}
+
+func (sc *SpvClient) processMsg(m MsgIO) error {
+	switch m.Type() {
+	case NtVersion:
+		msg := m.(*MsgVersion)
+		pv := msg.ProtoVer()
+		if pv < conf.GetMinProto() {
+			return fmt.Errorf("protocol version %d < min version %d", pv, conf.GetMinProto())
+		}
+		//旧版本节点不支持区块头同步,交易merkle树也没有区块id,无法验证
+		if pv < VerAckVersion {
+			return fmt.Errorf("node protocol version %d not support spv", pv)
+		}
+		//必须提供过滤器服务,并回复确认
+		if msg.Service&FilterNodeFlag == 0 {
+			return fmt.Errorf("node service %x not support filter", msg.Service)
+		}
+		sc.SendMsg(&MsgVerAck{})
+		//握手后加载过滤器并开始同步区块头
+		if err := sc.loadFilter(); err != nil {
+			return err
+		}
+		sc.reqHeaders()
+	case NtPing:
+		msg := m.(*MsgPing)
+		sc.SendMsg(msg.NewPong(sc.Height()))
+		if h := sc.Height(); h == InvalidHeight || msg.Height > h {
+			sc.reqHeaders()
+		}
+	case NtBroadPkg:
+		//设置过滤器后交易和区块直接发送,只有其他消息使用广播
+		msg := m.(*MsgBroadPkg)
+		sc.SendMsg(&MsgBroadAck{MsgID: msg.MsgID})
+	case NtBlock:
+		//有新区块只同步区块头
+		sc.reqHeaders()
+	case NtMerkleBlock:
+		return sc.recvMerkleBlock(m.(*MsgMerkleBlock))
+	case NtHeaders:
+		return sc.recvHeaders(m.(*MsgHeaders))
+	case NtTx:
+		sc.recvTx(m.(*MsgTx))
+	case NtTxMerkle:
+		msg := m.(*MsgTxMerkle)
+		if err := sc.recvTxMerkle(msg); err != nil {
+			LogError(err)
+		}
+	case NtError:
+		msg := m.(*MsgError)
+		//交易还没有进入区块
+		if msg.Code == ErrCodeTxMerkle {
+			break
+		}
+		LogError("spv recv error msg code =", msg.Code, "error =", string(msg.Error))
+	}
+	return nil
+}
+
+//Connect 连接到全节点并开始同步,直到连接断开或ctx取消
+func (sc *SpvClient) Connect(ctx context.Context, addr NetAddr) error {
+	conn, err := net.DialTimeout(addr.Network(), addr.Addr(), time.Second*10)
+	if err != nil {
+		return err
+	}
+	LogInfo("spv connect to", addr, "success")
+	return sc.Serve(ctx, conn)
+}
+
+//Serve 使用已经建立的连接同步,直到连接断开或ctx取消
+func (sc *SpvClient) Serve(ctx context.Context, conn net.Conn) error {
+	ns := NewNetStream(conn)
+	defer ns.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sc.mu.Lock()
+	sc.syncing = false
+	sc.mu.Unlock()
+	rc := make(chan MsgIO, 4)
+	ec := make(chan error, 1)
+	go func() {
+		for {
+			m, err := ns.ReadMsg()
+			if err != nil {
+				ec <- err
+				return
+			}
+			select {
+			case rc <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	//连接后只发送版本信息,之前的消息丢弃
+	sc.takeMsgs()
+	sc.SendMsg(sc.NewMsgVersion())
+	st := time.NewTicker(SpvSyncInterval)
+	defer st.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-ec:
+			return err
+		case <-sc.wn:
+			for _, m := range sc.takeMsgs() {
+				if err := ns.WriteMsg(m); err != nil {
+					return fmt.Errorf("write msg error %w", err)
+				}
+			}
+		case m := <-rc:
+			if err := sc.processMsg(m); err != nil {
+				return fmt.Errorf("process msg %v error %w", m.Type(), err)
+			}
+		case <-st.C:
+			sc.mu.Lock()
+			sc.syncing = false
+			sc.mu.Unlock()
+			sc.reqHeaders()
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package xginx
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+func (suite *BlockTestSuite) TestSpvClient() {
+	req := suite.Require()
+	bi := suite.bi
+	//全节点端连接
+	s := NewTCPServer().(*TCPServer)
+	s.cctx, s.cfun = context.WithCancel(context.Background())
+	defer s.cfun()
+	c1, c2 := net.Pipe()
+	c := s.NewClientWithConn(c1)
+	c.typ = ClientIn
+	c.isopen = true
+	c.Loop()
+	//最后一个区块的coinbase交易先作为未确认交易
+	bv := bi.GetBestValue()
+	blk, err := bi.LoadBlock(bv.ID)
+	req.NoError(err)
+	cb := blk.Txs[0]
+	cid, err := cb.ID()
+	req.NoError(err)
+	req.NoError(bi.UnlinkLast())
+	defer func() {
+		if bi.Height() != bv.Height {
+			req.NoError(bi.LinkBlk(blk))
+		}
+	}()
+	sc := NewSpvClient()
+	req.NoError(sc.AddAddress(GetTestListener(bi).MinerAddr()))
+	pc := make(chan *SpvPayment, 1)
+	sc.OnPayment = func(p *SpvPayment) {
+		pc <- p
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = sc.Serve(ctx, c2)
+	}()
+	waitHeight := func(h uint32) {
+		for i := 0; i < 100 && sc.Height() != h; i++ {
+			time.Sleep(time.Millisecond * 50)
+		}
+		req.Equal(h, sc.Height())
+	}
+	waitHeight(bv.Height - 1)
+	//收到钱包相关的交易,还没有在区块中
+	c.SendMsg(NewMsgTx(cb))
+	for i := 0; i < 100 && !sc.IsPending(cid); i++ {
+		time.Sleep(time.Millisecond * 50)
+	}
+	req.True(sc.IsPending(cid))
+	//区块连接后通过ping通知高度
+	req.NoError(bi.LinkBlk(blk))
+	c.SendMsg(NewMsgPing(bi.Height()))
+	select {
+	case pay := <-pc:
+		req.Equal(cid, pay.TxID)
+		req.Equal(bv.ID, pay.BlkID)
+		req.Equal(bv.Height, pay.Height)
+	case <-time.After(time.Second * 5):
+		req.Fail("spv payment timeout")
+	}
+	waitHeight(bv.Height)
+	_, confirms, has := sc.Payment(cid)
+	req.True(has)
+	req.Equal(1, confirms)
+	//merkle树必须和区块头一致
+	msg, err := bi.NewMsgTxMerkle(cid)
+	req.NoError(err)
+	req.NoError(msg.Verify(sc))
+	req.NoError(msg.Verify(bi))
+	//旧版本节点的消息没有区块id
+	w := NewWriter()
+	req.NoError(msg.Encode(w))
+	bb := w.Bytes()
+	old := &MsgTxMerkle{}
+	req.NoError(old.Decode(NewReader(bb[:len(bb)-len(ZERO256)])))
+	req.True(old.BlkID.IsZero())
+	req.Equal(msg.Hashs, old.Hashs)
+	msg.BlkID = blk.Header.Prev
+	req.Error(msg.Verify(sc))
+	msg, err = bi.NewMsgTxMerkle(blk.Txs[len(blk.Txs)-1].MustID())
+	req.NoError(err)
+	msg.TxID = ZERO256
+	req.Error(msg.Verify(sc))
+	//区块头回退后交易重新等待确认
+	sc.mu.Lock()
+	sc.unlinkHeaders(1)
+	sc.mu.Unlock()
+	req.True(sc.IsPending(cid))
+	_, _, has = sc.Payment(cid)
+	req.False(has)
+	//新区块通过过滤器转为merkle区块发送
+	fm, ok := c.FilterMsg(&MsgBlock{Blk: blk})
+	req.True(ok)
+	c.SendMsg(fm)
+	select {
+	case pay := <-pc:
+		req.Equal(cid, pay.TxID)
+		req.Equal(bv.ID, pay.BlkID)
+	case <-time.After(time.Second * 5):
+		req.Fail("spv merkle block timeout")
+	}
+	waitHeight(bv.Height)
+}
+
+func (suite *BlockTestSuite) TestSpvFork() {
+	req := suite.Require()
+	bi := suite.bi
+	sc := NewSpvClient()
+	recv := func(next uint32, hs Headers) error {
+		sc.mu.Lock()
+		sc.syncing, sc.next = true, next
+		sc.mu.Unlock()
+		return sc.recvHeaders(&MsgHeaders{Info: MsgGetBlock{Next: next}, Headers: hs})
+	}
+	req.NoError(recv(0, bi.NewMsgHeadersFrom(&MsgGetHeaders{Next: 0, Count: MaxGetHeaders}).Headers))
+	last := bi.Last()
+	req.Equal(last.Height, sc.Height())
+	//同高度的分叉区块头工作量相同,不切换
+	fork := &BlockInfo{Header: last.BlockHeader}
+	fork.Header.Time++
+	calcbits(bi, fork)
+	req.NoError(recv(last.Height, Headers{fork.Header}))
+	_, err := sc.GetBlockHeader(last.MustID())
+	req.NoError(err)
+	//分叉链工作量更大时切换
+	next := &BlockInfo{Header: fork.Header}
+	next.Header.Prev = fork.Header.MustID()
+	calcbits(bi, next)
+	req.NoError(recv(last.Height, Headers{fork.Header, next.Header}))
+	req.Equal(last.Height+1, sc.Height())
+	_, err = sc.GetBlockHeader(last.MustID())
+	req.Error(err)
+	//连接失败时恢复原来的区块头
+	bad := &BlockInfo{Header: next.Header}
+	bad.Header.Prev = next.Header.MustID()
+	calcbits(bi, bad)
+	req.Error(recv(last.Height, Headers{last.BlockHeader, bad.Header, bad.Header}))
+	req.Equal(last.Height+1, sc.Height())
+	_, err = sc.GetBlockHeader(next.Header.MustID())
+	req.NoError(err)
+	//分叉点在请求高度之前,从更低的高度重新请求
+	sc.takeMsgs()
+	req.NoError(recv(last.Height+2, Headers{last.BlockHeader}))
+	ms := sc.takeMsgs()
+	req.Len(ms, 1)
+	req.Equal(last.Height+2-conf.Confirms, ms[0].(*MsgGetHeaders).Next)
+	req.Equal(last.Height+1, sc.Height())
+	//计算难度缺少区块头时返回错误
+	sc.mu.Lock()
+	_, err = sc.calcBits(conf.PowSpan * 2)
+	sc.mu.Unlock()
+	req.Error(err)
+}
+
+//旧版本节点不能提供区块头和带区块id的merkle树
+func (suite *BlockTestSuite) TestSpvOldPeer() {
+	req := suite.Require()
+	sc := NewSpvClient()
+	err := sc.processMsg(&MsgVersion{Service: DefaultServices})
+	req.Error(err)
+	err = sc.processMsg(&MsgVersion{Service: DefaultServices, Proto: ProtocolVersion})
+	req.NoError(err)
+	//没有区块头时查询确认的交易
+	id := conf.genesis
+	sc.pays[id] = &SpvPayment{TxID: id}
+	pay, num, has := sc.Payment(id)
+	req.True(has)
+	req.Equal(id, pay.TxID)
+	req.Equal(0, num)
+}
@@ -0,0 +1,295 @@
+package xginx
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//StoreStatsMaxAge 存储统计缓存时间
+const StoreStatsMaxAge = time.Minute * 10
+
+//索引数据库中的数据前缀
+var storePrefixes = []struct {
+	name   string
+	prefix []byte
+}{
+	{"block", BlockPrefix},
+	{"txs", TxsPrefix},
+	{"coins", CoinsPrefix},
+	{"txp", TxpPrefix},
+	{"index", IndexPrefix},
+	{"utxo", UtxoPrefix},
+	{"cfilter", CFilterPrefix},
+	{"txu", TxuPrefix},
+}
+
+//获取前缀对应的名称
+func storePrefixName(k []byte) string {
+	for _, sp := range storePrefixes {
+		if len(k) > 0 && k[0] == sp.prefix[0] {
+			return sp.name
+		}
+	}
+	return "other"
+}
+
+//获取名称对应的前缀范围,名称为空返回所有数据
+func storePrefixRange(name string) (*Range, error) {
+	if name == "" {
+		return NewRange(nil, nil), nil
+	}
+	for _, sp := range storePrefixes {
+		if sp.name == name {
+			return NewPrefix(sp.prefix), nil
+		}
+	}
+	return nil, fmt.Errorf("store prefix %s not found", name)
+}
+
+//PrefixStats 索引数据库前缀统计
+type PrefixStats struct {
+	Name  string `json:"name"`  //前缀名称
+	Count int    `json:"count"` //key数量
+	Size  int64  `json:"size"`  //key和value总长度
+	Disk  int64  `json:"disk"`  //估算的磁盘占用
+}
+
+//ChunkStats 数据文件统计
+type ChunkStats struct {
+	Files []ChunkFile `json:"files"` //数据文件
+	Total int64       `json:"total"` //数据文件总长度
+	Used  int64       `json:"used"`  //所有区块头(包括分叉)引用的数据长度
+	Count int         `json:"count"` //所有区块头(包括分叉)引用的记录数量
+}
+
+//StoreStats 区块存储统计
+type StoreStats struct {
+	Prefixes []PrefixStats `json:"prefixes"`
+	Blk      ChunkStats    `json:"blk"`  //区块数据
+	Rev      ChunkStats    `json:"rev"`  //回退数据
+	Time     time.Time     `json:"time"` //统计时间
+}
+
+func (cs *ChunkStats) load(s IChunkStore) error {
+	fs, err := s.Files()
+	if err != nil {
+		return err
+	}
+	cs.Files = fs
+	for _, f := range fs {
+		cs.Total += f.Size
+	}
+	return nil
+}
+
+//GetStoreStats 获取缓存的存储统计,超过maxage重新统计
+func (bi *BlockIndex) GetStoreStats(maxage time.Duration) (*StoreStats, error) {
+	bi.cpt.mu.Lock()
+	ss := bi.cpt.stats
+	bi.cpt.mu.Unlock()
+	if ss != nil && time.Since(ss.Time) < maxage {
+		return ss, nil
+	}
+	return bi.StoreStats()
+}
+
+//StoreStats 统计索引数据库每个前缀的数据和数据文件的使用情况
+//需要遍历索引数据库,统计结果会被缓存
+func (bi *BlockIndex) StoreStats() (*StoreStats, error) {
+	db := bi.blkdb.Index()
+	ss := &StoreStats{Time: time.Now()}
+	pss := map[string]*PrefixStats{}
+	for _, sp := range storePrefixes {
+		pss[sp.name] = &PrefixStats{Name: sp.name}
+	}
+	pss["other"] = &PrefixStats{Name: "other"}
+	iter := db.Iterator()
+	for iter.Next() {
+		ps := pss[storePrefixName(iter.Key())]
+		ps.Count++
+		ps.Size += int64(len(iter.Key()) + len(iter.Value()))
+		//统计被引用的数据
+		if ps.Name != "block" {
+			continue
+		}
+		meta := &TBMeta{}
+		if err := meta.Decode(NewReader(iter.Value())); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		if meta.HasBlk() {
+			ss.Blk.Used += int64(meta.Blk.Len)
+			ss.Blk.Count++
+		}
+		if meta.HasRev() {
+			ss.Rev.Used += int64(meta.Rev.Len)
+			ss.Rev.Count++
+		}
+	}
+	iter.Close()
+	rgs := []*Range{}
+	for _, sp := range storePrefixes {
+		rgs = append(rgs, NewPrefix(sp.prefix))
+	}
+	sizes, err := db.SizeOf(rgs)
+	if err != nil {
+		return nil, err
+	}
+	for i, sp := range storePrefixes {
+		pss[sp.name].Disk = sizes[i]
+		ss.Prefixes = append(ss.Prefixes, *pss[sp.name])
+	}
+	ss.Prefixes = append(ss.Prefixes, *pss["other"])
+	if err := ss.Blk.load(bi.blkdb.Blk()); err != nil {
+		return nil, err
+	}
+	if err := ss.Rev.load(bi.blkdb.Rev()); err != nil {
+		return nil, err
+	}
+	bi.cpt.mu.Lock()
+	bi.cpt.stats = ss
+	bi.cpt.mu.Unlock()
+	return ss, nil
+}
+
+//LogStoreStats 输出存储统计到日志
+func (bi *BlockIndex) LogStoreStats() {
+	ss, err := bi.StoreStats()
+	if err != nil {
+		LogError("get store stats error", err)
+		return
+	}
+	for _, ps := range ss.Prefixes {
+		LogInfof("store prefix %s count=%d size=%d disk=%d", ps.Name, ps.Count, ps.Size, ps.Disk)
+	}
+	LogInfof("store blk files=%d total=%d used=%d count=%d", len(ss.Blk.Files), ss.Blk.Total, ss.Blk.Used, ss.Blk.Count)
+	LogInfof("store rev files=%d total=%d used=%d count=%d", len(ss.Rev.Files), ss.Rev.Total, ss.Rev.Used, ss.Rev.Count)
+}
+
+//Compact 合并索引数据库中名称对应前缀的数据,名称为空合并所有数据
+func (bi *BlockIndex) Compact(name string) error {
+	rg, err := storePrefixRange(name)
+	if err != nil {
+		return err
+	}
+	return bi.cpt.compact(bi, name, rg)
+}
+
+//CompactStatus 数据库合并状态
+type CompactStatus struct {
+	Running bool          `json:"running"` //后台合并是否启动
+	Name    string        `json:"name"`    //最后合并的前缀
+	Last    time.Time     `json:"last"`    //最后合并时间
+	Cost    time.Duration `json:"cost"`    //最后合并用时
+	Count   int           `json:"count"`   //合并次数
+}
+
+//GetCompactStatus 获取数据库合并状态
+func (bi *BlockIndex) GetCompactStatus() CompactStatus {
+	bi.cpt.mu.Lock()
+	defer bi.cpt.mu.Unlock()
+	return bi.cpt.status
+}
+
+//空闲时合并索引数据库
+type compactor struct {
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+	status CompactStatus
+	stats  *StoreStats //最后一次的存储统计
+	active int64       //最后写入区块的时间
+	dirty  int32       //写入区块后是否需要合并
+	next   int         //下次合并的前缀
+}
+
+//记录写入区块的时间
+func (c *compactor) touch() {
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	atomic.StoreInt32(&c.dirty, 1)
+}
+
+func (c *compactor) compact(bi *BlockIndex, name string, rg *Range) error {
+	now := time.Now()
+	if err := bi.blkdb.Index().Compact(rg); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status.Name = name
+	c.status.Last = now
+	c.status.Cost = time.Since(now)
+	c.status.Count++
+	LogInfof("compact store prefix %s cost %v", name, c.status.Cost)
+	return nil
+}
+
+//空闲时按顺序合并一个前缀,所有前缀合并完成后等待新的区块写入
+func (c *compactor) step(bi *BlockIndex, idle time.Duration) {
+	if atomic.LoadInt32(&c.dirty) == 0 {
+		return
+	}
+	if time.Since(time.Unix(0, atomic.LoadInt64(&c.active))) < idle {
+		return
+	}
+	sp := storePrefixes[c.next]
+	if err := c.compact(bi, sp.name, NewPrefix(sp.prefix)); err != nil {
+		LogError("compact store error", sp.name, err)
+		return
+	}
+	c.next = (c.next + 1) % len(storePrefixes)
+	if c.next == 0 {
+		atomic.StoreInt32(&c.dirty, 0)
+		bi.LogStoreStats()
+	}
+}
+
+func (c *compactor) start(ctx context.Context, bi *BlockIndex, idle time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status.Running || idle <= 0 {
+		return
+	}
+	c.status.Running = true
+	atomic.StoreInt32(&c.dirty, 1)
+	ctx, c.cancel = context.WithCancel(ctx)
+	//检查间隔
+	itv := idle
+	if itv > time.Minute {
+		itv = time.Minute
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		timer := time.NewTicker(itv)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				c.step(bi, idle)
+			}
+		}
+	}()
+}
+
+func (c *compactor) stop() {
+	c.mu.Lock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.mu.Unlock()
+	c.wg.Wait()
+	c.mu.Lock()
+	c.status.Running = false
+	c.mu.Unlock()
+}
+
+//StartCompactor 启动后台合并,写入区块后空闲超过idle时间开始合并索引数据库
+func (bi *BlockIndex) StartCompactor(ctx context.Context, idle time.Duration) {
+	bi.cpt.start(ctx, bi, idle)
+}
@@ -0,0 +1,51 @@
+package xginx
+
+import (
+	"context"
+	"time"
+)
+
+func (suite *BlockTestSuite) TestStoreStats() {
+	req := suite.Require()
+	bi := suite.bi
+	ss, err := bi.StoreStats()
+	req.NoError(err)
+	pss := map[string]PrefixStats{}
+	for _, ps := range ss.Prefixes {
+		pss[ps.Name] = ps
+	}
+	req.Equal(bi.Len(), pss["block"].Count)
+	req.True(pss["coins"].Count > 0)
+	req.Equal(1, pss["other"].Count)
+	req.Equal(bi.Len(), ss.Blk.Count)
+	req.True(ss.Blk.Used > 0 && ss.Blk.Used <= ss.Blk.Total)
+	req.True(ss.Rev.Used > 0 && ss.Rev.Used <= ss.Rev.Total)
+	req.True(len(ss.Blk.Files) > 0)
+	//使用缓存的统计
+	cs1, err := bi.GetStoreStats(time.Hour)
+	req.NoError(err)
+	req.True(cs1 == ss)
+	cs2, err := bi.GetStoreStats(0)
+	req.NoError(err)
+	req.False(cs2 == ss)
+
+	req.NoError(bi.Compact("coins"))
+	req.NoError(bi.Compact(""))
+	req.Error(bi.Compact("miss"))
+	cs := bi.GetCompactStatus()
+	req.Equal(2, cs.Count)
+	req.False(cs.Running)
+
+	//空闲后合并所有前缀
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bi.StartCompactor(ctx, time.Millisecond*10)
+	req.True(bi.GetCompactStatus().Running)
+	for i := 0; i < 100 && bi.GetCompactStatus().Count < 2+len(storePrefixes); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	bi.cpt.stop()
+	cs = bi.GetCompactStatus()
+	req.False(cs.Running)
+	req.Equal(2+len(storePrefixes), cs.Count)
+}
@@ -17,8 +17,32 @@ type IChunkStore interface {
 	Close()
 	Init() error
 	Sync(id ...uint32)
+	//按文件顺序遍历所有数据记录
+	Walk(fn func(st BlkChunk, b []byte) error) error
+	//获取所有数据文件
+	Files() ([]ChunkFile, error)
+	//删除数据文件,不能删除正在写入的文件
+	Remove(id uint32) error
+	//获取当前写入位置
+	Tail() (ChunkFile, error)
+	//截断到写入位置,删除之后写入的数据
+	Truncate(pos ChunkFile) error
 }
 
+//ChunkFile 数据文件信息
+type ChunkFile struct {
+	ID   uint32 `json:"id"`   //文件id
+	Size int64  `json:"size"` //文件长度
+}
+
+//数据文件大小
+const (
+	//BlkFileMaxSize 区块数据文件最大长度
+	BlkFileMaxSize = 1024 * 1024 * 256
+	//RevFileMaxSize 回退数据文件最大长度
+	RevFileMaxSize = 1024 * 1024 * 64
+)
+
 //IBlkStore 区块存储
 type IBlkStore interface {
 	//同步数据
@@ -95,10 +119,14 @@ type DBImp interface {
 
 //数据前缀定义
 var (
-	BlockPrefix = []byte{1} //块头信息前缀 ->blkmeta
-	TxsPrefix   = []byte{2} //tx 所在区块前缀 ->blkid+txidx
-	CoinsPrefix = []byte{3} //账户可用金额存储 pkh_txid_idx -> amount
-	TxpPrefix   = []byte{4} //账户相关交易索引 按高度排序  pkh_height(big endian)_txid -> blkid+txidx
+	BlockPrefix   = []byte{1} //块头信息前缀 ->blkmeta
+	TxsPrefix     = []byte{2} //tx 所在区块前缀 ->blkid+txidx
+	CoinsPrefix   = []byte{3} //账户可用金额存储 pkh_txid_idx -> amount
+	TxpPrefix     = []byte{4} //账户相关交易索引 按高度排序  pkh_height(big endian)_txid -> blkid+txidx
+	IndexPrefix   = []byte{5} //可选索引状态 name -> height
+	UtxoPrefix    = []byte{6} //金额集合哈希状态 height(big endian) -> muhash
+	CFilterPrefix = []byte{7} //区块过滤器 height(big endian) -> blkid+filter header+filter
+	TxuPrefix     = []byte{8} //不保存完整交易索引时交易未消费的输出数量 txid -> count
 )
 
 //GetDBKey 获取存储key
@@ -241,8 +241,11 @@ func GetTestListener(bi *BlockIndex) *TestLis {
 }
 
 //NewTestBlockIndex 创建一个测试用区块索引
-//num创建num个区块
-func NewTestBlockIndex(num int) *BlockIndex {
+//num创建num个区块,store指定区块存储类型,默认使用配置中的类型
+func NewTestBlockIndex(num int, store ...string) *BlockIndex {
+	if len(store) > 0 {
+		conf.Store = store[0]
+	}
 	//测试配置文件
 	lis := newTestLis(5)
 	//测试区块索引
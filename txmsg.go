@@ -3,6 +3,7 @@ package xginx
 import (
 	"crypto/md5"
 	"errors"
+	"io"
 )
 
 //MsgGetMerkle 获取交易验证merkle树
@@ -37,6 +38,12 @@ type MsgTxMerkle struct {
 	Trans VarInt    //交易锁在块的交易数量
 	Hashs []HASH256 //基于merkle树的验证hash
 	Bits  VarBytes  //
+	BlkID HASH256   //交易所在区块id,旧版本节点没有
+}
+
+//IHeaderIndex 区块头查询,全节点和轻节点都可以用来验证交易merkle树
+type IHeaderIndex interface {
+	GetBlockHeader(id HASH256) (*TBEle, error)
 }
 
 //Type 消息类型
@@ -49,19 +56,23 @@ func (m MsgTxMerkle) ID() (MsgID, error) {
 	return ErrMsgID, ErrNotID
 }
 
-//Verify 验证数据
-func (m MsgTxMerkle) Verify(bi *BlockIndex) error {
+//Verify 验证交易在区块中,只需要区块头
+func (m MsgTxMerkle) Verify(hi IHeaderIndex) error {
 	bits := BitSetFrom(m.Bits)
 	nt := GetMerkleTree(m.Trans.ToInt(), m.Hashs, bits)
-	merkle, err := nt.ExtractRoot()
-	if err != nil {
-		return err
+	//导出失败时ids为空
+	merkle, ids, _ := nt.Extract()
+	has := false
+	for _, id := range ids {
+		if id.Equal(m.TxID) {
+			has = true
+			break
+		}
 	}
-	txv, err := bi.LoadTxValue(m.TxID)
-	if err != nil {
-		return err
+	if !has {
+		return errors.New("merkle tree miss txid")
 	}
-	bh, err := bi.GetBlockHeader(txv.BlkID)
+	bh, err := hi.GetBlockHeader(m.BlkID)
 	if err != nil {
 		return err
 	}
@@ -91,6 +102,10 @@ func (m MsgTxMerkle) Encode(w IWriter) error {
 	if err := m.Bits.Encode(w); err != nil {
 		return err
 	}
+	//区块id放在最后,旧版本节点忽略
+	if err := m.BlkID.Encode(w); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -106,6 +121,9 @@ func (m *MsgTxMerkle) Decode(r IReader) error {
 	if err := num.Decode(r); err != nil {
 		return err
 	}
+	if err := checkCount(r, uint64(num), MaxMerkleHashs); err != nil {
+		return err
+	}
 	m.Hashs = make([]HASH256, num.ToInt())
 	for i := range m.Hashs {
 		v := HASH256{}
@@ -118,6 +136,12 @@ func (m *MsgTxMerkle) Decode(r IReader) error {
 	if err := m.Bits.Decode(r); err != nil {
 		return err
 	}
+	//旧版本节点没有区块id
+	if err := m.BlkID.Decode(r); err == io.EOF {
+		m.BlkID = ZERO256
+	} else if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -168,6 +192,7 @@ func (bi *BlockIndex) GetMsgGetInv(msg *MsgGetInv, c *Client) {
 			if err != nil {
 				continue
 			}
+			c.KnownInv(inv.InvID)
 			c.SendMsg(NewMsgTx(tx))
 		} else if inv.InvType == InvTypeBlock {
 			blk, err := bi.LoadBlock(inv.InvID)
@@ -221,6 +246,9 @@ func (m *MsgGetInv) Decode(r IReader) error {
 	if err := num.Decode(r); err != nil {
 		return err
 	}
+	if err := checkCount(r, uint64(num), MaxInvCount); err != nil {
+		return err
+	}
 	m.Invs = make([]Inventory, num.ToInt())
 	for i := range m.Invs {
 		v := Inventory{}
@@ -275,6 +303,9 @@ func (m *MsgInv) Decode(r IReader) error {
 	if err := num.Decode(r); err != nil {
 		return err
 	}
+	if err := checkCount(r, uint64(num), MaxInvCount); err != nil {
+		return err
+	}
 	m.Invs = make([]Inventory, num.ToInt())
 	for i := range m.Invs {
 		v := Inventory{}
@@ -337,6 +368,9 @@ func (m *MsgGetTxPool) Decode(r IReader) error {
 	if err := num.Decode(r); err != nil {
 		return err
 	}
+	if err := checkCount(r, uint64(num), MaxTxsCount); err != nil {
+		return err
+	}
 	m.Skip = make([]HASH256, num.ToInt())
 	for i := range m.Skip {
 		id := HASH256{}
@@ -389,6 +423,9 @@ func (m *MsgTxPool) Decode(r IReader) error {
 	if err := num.Decode(r); err != nil {
 		return err
 	}
+	if err := checkCount(r, uint64(num), MaxTxsCount); err != nil {
+		return err
+	}
 	m.Txs = make([]*TX, num.ToInt())
 	for i := range m.Txs {
 		tx := &TX{}
@@ -456,6 +493,9 @@ func (m *MsgTx) Decode(r IReader) error {
 	if err := num.Decode(r); err != nil {
 		return err
 	}
+	if err := checkCount(r, uint64(num), MaxTxsCount); err != nil {
+		return err
+	}
 	m.Txs = make([]*TX, num.ToInt())
 	for i := range m.Txs {
 		tx := &TX{}
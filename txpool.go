@@ -30,6 +30,22 @@ type txpoolin struct {
 	in *TxIn
 }
 
+//TxEntry 交易进入交易池时的信息
+type TxEntry struct {
+	TxID   HASH256 //交易id
+	Height uint32  //进入时的区块高度
+	Size   int     //交易大小
+	Fee    Amount  //交易费
+}
+
+//FeeRate 每千字节交易费
+func (e TxEntry) FeeRate() Amount {
+	if e.Size <= 0 {
+		return 0
+	}
+	return e.Fee * 1000 / Amount(e.Size)
+}
+
 //TxPool 交易池，存放签名成功，未确认的交易
 //当区块连接后需要把区块中的交易从这个池子删除
 //交易池加入交易后会记录消费输出，也会记录交易池中可用的金额
@@ -38,7 +54,9 @@ type TxPool struct {
 	tlis *list.List
 	tmap map[HASH256]*list.Element //按交易id存储
 	imap map[HASH256]txpoolin      //输入引用的交易，txin -> tx 索引
+	emap map[HASH256]TxEntry       //交易进入时的信息
 	mdb  *memdb.DB
+	file string //关闭时保存数据的文件,为空保存到TxPoolFile
 }
 
 //NewTxPool 创建交易池
@@ -47,13 +65,23 @@ func NewTxPool() *TxPool {
 		tlis: list.New(),
 		tmap: map[HASH256]*list.Element{},
 		imap: map[HASH256]txpoolin{},
+		emap: map[HASH256]TxEntry{},
 		mdb:  memdb.New(comparer.DefaultComparer, MaxTxPoolSize),
 	}
 }
 
+//SetFile 设置关闭时保存数据的文件
+func (pool *TxPool) SetFile(file string) {
+	pool.file = file
+}
+
 //Close 关闭交易池
 func (pool *TxPool) Close() {
-	_ = pool.Dump(TxPoolFile)
+	file := pool.file
+	if file == "" {
+		file = TxPoolFile
+	}
+	_ = pool.Dump(file)
 	pool.mdb.Reset()
 }
 
@@ -105,12 +133,23 @@ func (pool *TxPool) NewMsgTxPool(m *MsgGetTxPool) *MsgTxPool {
 	pool.mu.RLock()
 	defer pool.mu.RUnlock()
 	msg := &MsgTxPool{}
+	size := 0
+	buf := NewWriter()
 	for cur := pool.tlis.Front(); cur != nil; cur = cur.Next() {
 		tx := cur.Value.(*TX)
 		//忽略对方有的
 		if m.Has(tx.MustID()) {
 			continue
 		}
+		//消息长度不能超过限制
+		buf.Reset()
+		if err := tx.Encode(buf); err != nil {
+			continue
+		}
+		if size+buf.Len() > MaxBlockSize {
+			break
+		}
+		size += buf.Len()
 		msg.Add(tx)
 	}
 	return msg
@@ -224,7 +263,7 @@ func (pool *TxPool) setMemIdx(bi *BlockIndex, tx *TX, add bool) error {
 
 //移除一个元素
 func (pool *TxPool) removeEle(bi *BlockIndex, refs *[]*TX, ele *list.Element) {
-	ps := GetPubSub()
+	ps := bi.GetPubSub()
 	tx, ok := ele.Value.(*TX)
 	if !ok {
 		panic(errors.New("txpool save type error"))
@@ -237,6 +276,7 @@ func (pool *TxPool) removeEle(bi *BlockIndex, refs *[]*TX, ele *list.Element) {
 	}
 	pool.tlis.Remove(ele)
 	delete(pool.tmap, id)
+	delete(pool.emap, id)
 	//广播交易从内存池移除
 	ps.Pub(id, TxPoolDelTxTopic)
 	LogInfof("remove tx %v success from txpool len=%d", id, pool.tlis.Len())
@@ -438,6 +478,26 @@ func (pool *TxPool) Get(id HASH256) (*TX, error) {
 	return pool.get(id)
 }
 
+//Entry 获取交易进入交易池时的信息
+func (pool *TxPool) Entry(id HASH256) (TxEntry, bool) {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	ent, has := pool.emap[id]
+	return ent, has
+}
+
+//Entries 获取所有交易进入交易池时的信息
+func (pool *TxPool) Entries() []TxEntry {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	ents := []TxEntry{}
+	for cur := pool.tlis.Front(); cur != nil; cur = cur.Next() {
+		tx := cur.Value.(*TX)
+		ents = append(ents, pool.emap[tx.MustID()])
+	}
+	return ents
+}
+
 //Len 获取交易池交易数量
 func (pool *TxPool) Len() int {
 	pool.mu.RLock()
@@ -569,10 +629,24 @@ func (pool *TxPool) PushTx(bi *BlockIndex, tx *TX) error {
 	if tx.IsCoinBase() {
 		return errors.New("coinbase push to txpool error")
 	}
+	//引用的交易还没有收到
+	if miss := pool.MissTxs(bi, tx); len(miss) > 0 {
+		return fmt.Errorf("%w miss %d txs", ErrOrphanTx, len(miss))
+	}
 	//检测交易是否合法
 	if err := tx.Check(bi, true); err != nil {
 		return err
 	}
+	//记录交易费和大小用于估算交易费
+	fee, err := tx.GetFeeAmount(bi)
+	if err != nil {
+		return err
+	}
+	buf := NewWriter()
+	if err := tx.Encode(buf); err != nil {
+		return err
+	}
+	ent := TxEntry{TxID: id, Height: bi.Height(), Size: buf.Len(), Fee: fee}
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 	if pool.tlis.Len() >= MaxTxPoolSize {
@@ -592,5 +666,8 @@ func (pool *TxPool) PushTx(bi *BlockIndex, tx *TX) error {
 	}
 	ele := pool.tlis.PushBack(tx)
 	pool.tmap[id] = ele
+	pool.emap[id] = ent
+	//广播交易进入交易池
+	bi.GetPubSub().Pub(tx, TxPoolAddTxTopic)
 	return nil
 }
@@ -8,12 +8,28 @@ import (
 	"encoding/hex"
 	"log"
 	"math/big"
+	"runtime"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+//记录测试开始时的协程数量,返回的函数等待测试启动的协程全部退出
+//使用 defer checkGoroutines(t)() 在其他defer关闭资源后检测
+func checkGoroutines(t *testing.T) func() {
+	start := runtime.NumGoroutine()
+	return func() {
+		deadline := time.Now().Add(time.Second * 5)
+		for runtime.NumGoroutine() > start {
+			if time.Now().After(deadline) {
+				t.Fatalf("goroutine leak start=%d current=%d", start, runtime.NumGoroutine())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
 func TestUUID(t *testing.T) {
 	id1 := NewDocumentID(1)
 	id2 := id1.To(2)
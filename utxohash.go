@@ -0,0 +1,173 @@
+package xginx
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+//MuHash 元素长度
+const (
+	MuHashSize = 384
+)
+
+var (
+	//MuHash使用的素数 2^3072 - 1103717
+	muHashPrime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), MuHashSize*8), big.NewInt(1103717))
+	//ErrUtxoHashMiss 高度对应的金额集合哈希不存在
+	ErrUtxoHashMiss = errors.New("utxo hash miss")
+)
+
+//MuHash 乘法集合哈希,元素可以任意顺序加入和删除
+//集合相同时得到的哈希相同,用于比较不同节点的金额集合
+type MuHash struct {
+	num *big.Int //加入的元素乘积
+	den *big.Int //删除的元素乘积
+}
+
+//NewMuHash 创建空集合哈希
+func NewMuHash() *MuHash {
+	return &MuHash{
+		num: big.NewInt(1),
+		den: big.NewInt(1),
+	}
+}
+
+//把数据扩展到3072位后转换为小于素数的数
+func muHashElement(b []byte) *big.Int {
+	bb := make([]byte, 0, MuHashSize)
+	hv := sha256.Sum256(b)
+	for i := byte(0); len(bb) < MuHashSize; i++ {
+		sv := sha256.Sum256(append(hv[:], i))
+		bb = append(bb, sv[:]...)
+	}
+	v := new(big.Int).SetBytes(bb)
+	return v.Mod(v, muHashPrime)
+}
+
+//Add 加入元素
+func (m *MuHash) Add(b []byte) {
+	m.num.Mul(m.num, muHashElement(b))
+	m.num.Mod(m.num, muHashPrime)
+}
+
+//Remove 删除元素
+func (m *MuHash) Remove(b []byte) {
+	m.den.Mul(m.den, muHashElement(b))
+	m.den.Mod(m.den, muHashPrime)
+}
+
+//合并分子分母
+func (m *MuHash) normalize() *big.Int {
+	if m.den.Cmp(big.NewInt(1)) != 0 {
+		m.num.Mul(m.num, new(big.Int).ModInverse(m.den, muHashPrime))
+		m.num.Mod(m.num, muHashPrime)
+		m.den.SetInt64(1)
+	}
+	return m.num
+}
+
+//Bytes 编码集合状态用于存储
+func (m *MuHash) Bytes() []byte {
+	return m.normalize().FillBytes(make([]byte, MuHashSize))
+}
+
+//From 从存储的集合状态恢复
+func (m *MuHash) From(b []byte) error {
+	if len(b) != MuHashSize {
+		return fmt.Errorf("muhash size %d error", len(b))
+	}
+	m.num = new(big.Int).SetBytes(b)
+	m.den = big.NewInt(1)
+	return nil
+}
+
+//Hash 获取集合哈希
+func (m *MuHash) Hash() HASH256 {
+	return Hash256From(m.Bytes())
+}
+
+//扫描数据库中的金额计算集合哈希
+func (bi *BlockIndex) scanMuHash() *MuHash {
+	mh := NewMuHash()
+	iter := bi.blkdb.Index().Iterator(NewPrefix(CoinsPrefix))
+	defer iter.Close()
+	for iter.Next() {
+		kv := append([]byte{}, iter.Key()...)
+		mh.Add(append(kv, iter.Value()...))
+	}
+	return mh
+}
+
+//获取连接高度h区块之前的金额集合状态
+//升级前连接的区块没有保存时返回nil,由后台任务补全后再保存之后区块的状态
+func (bi *BlockIndex) prevMuHash(h uint32) (*MuHash, error) {
+	if h == 0 {
+		return NewMuHash(), nil
+	}
+	db := bi.blkdb.Index()
+	hb := EndianUInt32(h - 1)
+	has, err := db.Has(UtxoPrefix, hb)
+	if err != nil || !has {
+		return nil, err
+	}
+	bb, err := db.Get(UtxoPrefix, hb)
+	if err != nil {
+		return nil, err
+	}
+	mh := &MuHash{}
+	return mh, mh.From(bb)
+}
+
+//补全最高区块的金额集合状态,升级前连接的区块没有保存,使用当前金额计算
+func (bi *BlockIndex) backfillMuHash() error {
+	//连接和断开区块时金额不能改变
+	bi.idx.mu.Lock()
+	defer bi.idx.mu.Unlock()
+	bi.rwm.RLock()
+	defer bi.rwm.RUnlock()
+	bv := bi.GetBestValue()
+	if !bv.IsValid() {
+		return nil
+	}
+	db := bi.blkdb.Index()
+	hb := EndianUInt32(bv.Height)
+	if has, err := db.Has(UtxoPrefix, hb); err != nil || has {
+		return err
+	}
+	LogInfof("utxo hash height %d miss, rebuild from coins", bv.Height)
+	return db.Put(UtxoPrefix, hb, bi.scanMuHash().Bytes())
+}
+
+//UtxoHash 获取高度h区块连接后的金额集合哈希
+func (bi *BlockIndex) UtxoHash(h uint32) (HASH256, error) {
+	bb, err := bi.blkdb.Index().Get(UtxoPrefix, EndianUInt32(h))
+	if err != nil {
+		return ZERO256, fmt.Errorf("%w height %d", ErrUtxoHashMiss, h)
+	}
+	mh := &MuHash{}
+	if err := mh.From(bb); err != nil {
+		return ZERO256, err
+	}
+	return mh.Hash(), nil
+}
+
+//BestUtxoHash 获取最高区块和对应的金额集合哈希
+func (bi *BlockIndex) BestUtxoHash() (BestValue, HASH256, error) {
+	bi.rwm.RLock()
+	defer bi.rwm.RUnlock()
+	bv := bi.GetBestValue()
+	if !bv.IsValid() {
+		return bv, ZERO256, ErrEmptyBlockChain
+	}
+	hv, err := bi.UtxoHash(bv.Height)
+	return bv, hv, err
+}
+
+//ComputeUtxoHash 扫描当前所有金额计算集合哈希
+func (bi *BlockIndex) ComputeUtxoHash() HASH256 {
+	bi.rwm.RLock()
+	defer bi.rwm.RUnlock()
+	return bi.scanMuHash().Hash()
+}
@@ -0,0 +1,71 @@
+package xginx
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMuHash(t *testing.T) {
+	//元素顺序无关
+	m1 := NewMuHash()
+	m1.Add([]byte("a"))
+	m1.Add([]byte("b"))
+	m2 := NewMuHash()
+	m2.Add([]byte("b"))
+	m2.Add([]byte("c"))
+	m2.Add([]byte("a"))
+	require.NotEqual(t, m1.Hash(), m2.Hash())
+	m2.Remove([]byte("c"))
+	require.Equal(t, m1.Hash(), m2.Hash())
+	require.Equal(t, NewMuHash().Hash(), func() HASH256 {
+		m1.Remove([]byte("a"))
+		m1.Remove([]byte("b"))
+		return m1.Hash()
+	}())
+	//存储后恢复
+	m3 := &MuHash{}
+	require.NoError(t, m3.From(m2.Bytes()))
+	m3.Add([]byte("c"))
+	m2.Add([]byte("c"))
+	require.Equal(t, m2.Hash(), m3.Hash())
+	require.Error(t, m3.From([]byte("c")))
+}
+
+func (suite *BlockTestSuite) TestUtxoHash() {
+	req := suite.Require()
+	bi := suite.bi
+	bv, hv, err := bi.BestUtxoHash()
+	req.NoError(err)
+	req.Equal(bi.ComputeUtxoHash(), hv)
+	blk, err := bi.LoadBlock(bv.ID)
+	req.NoError(err)
+	//断开区块后恢复
+	req.NoError(bi.UnlinkLast())
+	_, err = bi.UtxoHash(bv.Height)
+	req.True(errors.Is(err, ErrUtxoHashMiss))
+	pv, phv, err := bi.BestUtxoHash()
+	req.NoError(err)
+	req.Equal(bv.Height-1, pv.Height)
+	req.NotEqual(hv, phv)
+	req.Equal(bi.ComputeUtxoHash(), phv)
+	//重新连接后更新
+	req.NoError(bi.LinkBlk(blk))
+	_, nhv, err := bi.BestUtxoHash()
+	req.NoError(err)
+	req.Equal(hv, nhv)
+	req.Equal(bi.ComputeUtxoHash(), nhv)
+	req.NoError(bi.VerifyChain(nil))
+	//之前的状态不存在时连接区块不保存,由后台任务补全
+	req.NoError(bi.UnlinkLast())
+	req.NoError(bi.blkdb.Index().Del(UtxoPrefix, EndianUInt32(bv.Height-1)))
+	req.NoError(bi.LinkBlk(blk))
+	_, err = bi.UtxoHash(bv.Height)
+	req.True(errors.Is(err, ErrUtxoHashMiss))
+	req.NoError(bi.backfillMuHash())
+	_, nhv, err = bi.BestUtxoHash()
+	req.NoError(err)
+	req.Equal(hv, nhv)
+	req.NoError(bi.VerifyChain(nil))
+}
@@ -0,0 +1,168 @@
+package xginx
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+//协议版本
+const (
+	//ProtocolVersion 当前协议版本
+	ProtocolVersion = uint32(10001)
+	//MinProtocolVersion 最低支持的协议版本,没有协议版本的旧节点作为这个版本
+	MinProtocolVersion = uint32(10000)
+	//VerAckVersion 从这个版本开始收到版本信息后需要回复verack
+	VerAckVersion = uint32(10001)
+)
+
+//MsgVerAck 收到版本信息后确认
+type MsgVerAck struct {
+}
+
+//ID 消息ID
+func (m MsgVerAck) ID() (MsgID, error) {
+	return ErrMsgID, ErrNotID
+}
+
+//Type 消息类型
+func (m MsgVerAck) Type() NTType {
+	return NtVerAck
+}
+
+//Encode 编码
+func (m MsgVerAck) Encode(w IWriter) error {
+	return nil
+}
+
+//Decode 解码
+func (m *MsgVerAck) Decode(r IReader) error {
+	return nil
+}
+
+//请求消息需要对方提供的服务
+var msgServices = map[NTType]uint32{
+	NtGetBlock:     FullNodeFlag,
+	NtGetHeaders:   FullNodeFlag,
+	NtGetTxPool:    FullNodeFlag,
+	NtFilterLoad:   FilterNodeFlag,
+	NtFilterAdd:    FilterNodeFlag,
+	NtFilterClear:  FilterNodeFlag,
+	NtGetMerkle:    FilterNodeFlag,
+	NtGetCFHeaders: CFilterNodeFlag,
+	NtGetCFilters:  CFilterNodeFlag,
+}
+
+//旧版本节点不支持的消息和需要的最低协议版本
+var msgVersions = map[NTType]uint32{
+	NtVerAck:       VerAckVersion,
+	NtInv:          VerAckVersion,
+	NtGetHeaders:   VerAckVersion,
+	NtMerkleBlock:  VerAckVersion,
+	NtGetCFHeaders: VerAckVersion,
+	NtCFHeaders:    VerAckVersion,
+	NtGetCFilters:  VerAckVersion,
+	NtCFilters:     VerAckVersion,
+}
+
+//IsBasicMsg 握手完成前可以收发的消息
+func IsBasicMsg(t NTType) bool {
+	switch t {
+	case NtVersion, NtVerAck, NtPing, NtPong, NtError:
+		return true
+	}
+	return false
+}
+
+//GetMinProto 获取最低协议版本,没有配置使用默认值
+func (c *Config) GetMinProto() uint32 {
+	if c.MinProto == 0 {
+		return MinProtocolVersion
+	}
+	return c.MinProto
+}
+
+//HasService 对方是否提供服务
+func (c *Client) HasService(f uint32) bool {
+	return c.Service&f == f
+}
+
+//HasFeature 双方是否都支持功能
+func (c *Client) HasFeature(f uint32) bool {
+	return c.HasService(f) && DefaultServices&f == f
+}
+
+//IsAcked 握手是否完成
+func (c *Client) IsAcked() bool {
+	return atomic.LoadInt32(&c.acked) != 0
+}
+
+func (c *Client) setAcked() {
+	atomic.StoreInt32(&c.acked, 1)
+}
+
+//ProtoVer 双方使用的协议版本
+func (c *Client) ProtoVer() uint32 {
+	return atomic.LoadUint32(&c.proto)
+}
+
+//收到版本信息,检测协议版本并确定双方使用的版本
+//旧版本节点不回复verack,收到版本信息后握手完成
+func (c *Client) recvVersion(msg *MsgVersion) error {
+	pv := msg.ProtoVer()
+	if pv < conf.GetMinProto() {
+		err := fmt.Errorf("protocol version %d < min version %d", pv, conf.GetMinProto())
+		_ = c.WriteMsg(NewMsgError(ErrCodeVersion, err))
+		c.Close()
+		return err
+	}
+	if pv > ProtocolVersion {
+		pv = ProtocolVersion
+	}
+	atomic.StoreUint32(&c.proto, pv)
+	//服务在握手完成前保存,握手完成后其他线程才会读取
+	c.Service = msg.Service
+	if pv < VerAckVersion {
+		c.setAcked()
+	}
+	return nil
+}
+
+//检测收到的消息,握手完成前只处理基础消息,请求的服务自己必须提供
+func (c *Client) checkRecvMsg(m MsgIO) error {
+	typ := m.Type()
+	if IsBasicMsg(typ) {
+		return nil
+	}
+	if !c.IsAcked() {
+		return fmt.Errorf("msg %v recv before handshake", typ)
+	}
+	if f := msgServices[typ]; DefaultServices&f != f {
+		err := fmt.Errorf("msg %v service %x not support", typ, f)
+		c.SendMsg(NewMsgError(ErrCodeService, err))
+		return err
+	}
+	return nil
+}
+
+//IsSupportMsg 对方协议版本是否支持消息
+func (c *Client) IsSupportMsg(t NTType) bool {
+	return c.ProtoVer() >= msgVersions[t]
+}
+
+//检测发送的消息,握手完成前只发送基础消息,请求的服务对方必须提供,对方不支持的消息不发送
+func (c *Client) checkSendMsg(m MsgIO) error {
+	typ := m.Type()
+	if !c.IsSupportMsg(typ) {
+		return fmt.Errorf("msg %v peer protocol version %d not support", typ, c.ProtoVer())
+	}
+	if IsBasicMsg(typ) {
+		return nil
+	}
+	if !c.IsAcked() {
+		return fmt.Errorf("msg %v send before handshake", typ)
+	}
+	if f := msgServices[typ]; !c.HasService(f) {
+		return fmt.Errorf("msg %v peer service %x miss", typ, f)
+	}
+	return nil
+}
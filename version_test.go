@@ -0,0 +1,88 @@
+package xginx
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMsgVersionProto(t *testing.T) {
+	msg := &MsgVersion{Ver: 1, Service: DefaultServices, Addr: NetAddr{ip: net.IPv4zero}, Proto: ProtocolVersion}
+	w := NewWriter()
+	if err := msg.Encode(w); err != nil {
+		t.Fatal(err)
+	}
+	nsg := &MsgVersion{}
+	if err := nsg.Decode(NewReader(w.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if nsg.ProtoVer() != ProtocolVersion || nsg.Service != DefaultServices {
+		t.Fatalf("decode version %d service %x error", nsg.Proto, nsg.Service)
+	}
+	//旧版本节点没有协议版本
+	bb := w.Bytes()
+	osg := &MsgVersion{}
+	if err := osg.Decode(NewReader(bb[:len(bb)-4])); err != nil {
+		t.Fatal(err)
+	}
+	if osg.Proto != 0 || osg.ProtoVer() != MinProtocolVersion {
+		t.Fatalf("old version proto %d error", osg.Proto)
+	}
+}
+
+func (suite *BlockTestSuite) TestVersionHandshake() {
+	req := suite.Require()
+	s := NewTCPServer().(*TCPServer)
+	s.cctx, s.cfun = context.WithCancel(context.Background())
+	defer s.cfun()
+	open := func() (*Client, *NetStream) {
+		c1, c2 := net.Pipe()
+		c := s.NewClientWithConn(c1)
+		c.typ = ClientIn
+		c.isopen = true
+		c.Loop()
+		return c, NewNetStream(c2)
+	}
+	readMsg := func(peer *NetStream) MsgIO {
+		req.NoError(peer.SetReadDeadline(time.Now().Add(time.Second * 5)))
+		m, err := peer.ReadMsg()
+		req.NoError(err)
+		return m
+	}
+	c, peer := open()
+	defer peer.Close()
+	//握手前的消息丢弃
+	req.NoError(peer.WriteMsg(&MsgGetAddrs{}))
+	vsg := &MsgVersion{Service: FullNodeFlag, Addr: NetAddr{ip: net.IPv4zero}, NodeID: 1, Proto: ProtocolVersion}
+	req.NoError(peer.WriteMsg(vsg))
+	rsg := readMsg(peer).(*MsgVersion)
+	req.Equal(ProtocolVersion, rsg.Proto)
+	req.Equal(uint32(DefaultServices), rsg.Service)
+	req.Equal(NtVerAck, readMsg(peer).Type())
+	req.False(c.IsAcked())
+	req.NoError(peer.WriteMsg(&MsgVerAck{}))
+	req.NoError(peer.WriteMsg(&MsgGetAddrs{}))
+	req.Equal(NtAddrs, readMsg(peer).Type())
+	req.True(c.IsAcked())
+	req.Equal(ProtocolVersion, c.ProtoVer())
+	//对方没有提供的服务不请求
+	req.NoError(c.checkSendMsg(&MsgGetBlock{}))
+	req.Error(c.checkSendMsg(&MsgGetCFilters{}))
+	req.True(c.HasFeature(FullNodeFlag))
+	req.False(c.HasFeature(CompactBlockFlag))
+	//低于最低协议版本断开
+	min := conf.MinProto
+	conf.MinProto = ProtocolVersion + 1
+	defer func() {
+		conf.MinProto = min
+	}()
+	c, peer = open()
+	defer peer.Close()
+	vsg.NodeID = 2
+	req.NoError(peer.WriteMsg(vsg))
+	esg := readMsg(peer).(*MsgError)
+	req.Equal(int32(ErrCodeVersion), esg.Code)
+	<-c.cctx.Done()
+	req.Equal(uint64(0), c.ID())
+}
@@ -0,0 +1,962 @@
+package xginx
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+//钱包订阅消息类型
+const (
+	//钱包交易状态改变(确认,冲突,回退) WalletTx
+	WalletTxTopic = "WalletTx"
+)
+
+//ErrWalletBlockGap 区块和钱包最后处理的区块不连续
+var ErrWalletBlockGap = errors.New("wallet block not continuous")
+
+//WalletTxState 钱包交易状态
+type WalletTxState uint8
+
+//钱包交易状态定义
+const (
+	//在交易池中等待确认
+	WalletTxPending WalletTxState = 1
+	//已经打包进区块
+	WalletTxConfirmed WalletTxState = 2
+	//和已确认的交易冲突,不会再被确认
+	WalletTxConflicted WalletTxState = 3
+	//所在区块被断开,等待重新确认
+	WalletTxReverted WalletTxState = 4
+)
+
+func (s WalletTxState) String() string {
+	switch s {
+	case WalletTxPending:
+		return "pending"
+	case WalletTxConfirmed:
+		return "confirmed"
+	case WalletTxConflicted:
+		return "conflicted"
+	case WalletTxReverted:
+		return "reverted"
+	}
+	return fmt.Sprintf("unknow(%d)", s)
+}
+
+//钱包数据前缀
+var (
+	waddrprefix  = []byte{1} //钱包地址 pkh -> nil
+	wtxprefix    = []byte{2} //钱包交易 txid -> WalletTx
+	whisprefix   = []byte{3} //地址交易历史 pkh+txid -> recv+sent
+	wcoinprefix  = []byte{4} //钱包金额 txid+idx -> WalletCoin
+	wspentprefix = []byte{5} //输出被哪个交易消费 outkey -> txid
+	wblockprefix = []byte{6} //已处理的区块 height -> blkid+txids
+	wbestkey     = []byte{7} //最后处理的区块高度
+)
+
+//WalletTx 钱包相关的交易
+type WalletTx struct {
+	Tx     *TX           //交易
+	State  WalletTxState //状态
+	BlkID  HASH256       //所在区块,未确认为零
+	Height uint32        //所在区块高度
+}
+
+//ID 交易id
+func (wtx WalletTx) ID() HASH256 {
+	return wtx.Tx.MustID()
+}
+
+//IsConfirmed 是否已经确认
+func (wtx WalletTx) IsConfirmed() bool {
+	return wtx.State == WalletTxConfirmed
+}
+
+//Encode 编码
+func (wtx WalletTx) Encode(w IWriter) error {
+	if err := w.TWrite(wtx.State); err != nil {
+		return err
+	}
+	if err := wtx.BlkID.Encode(w); err != nil {
+		return err
+	}
+	if err := w.TWrite(wtx.Height); err != nil {
+		return err
+	}
+	return wtx.Tx.Encode(w)
+}
+
+//Decode 解码
+func (wtx *WalletTx) Decode(r IReader) error {
+	if err := r.TRead(&wtx.State); err != nil {
+		return err
+	}
+	if err := wtx.BlkID.Decode(r); err != nil {
+		return err
+	}
+	if err := r.TRead(&wtx.Height); err != nil {
+		return err
+	}
+	wtx.Tx = &TX{}
+	return wtx.Tx.Decode(r)
+}
+
+//WalletHistory 地址相关的交易记录
+type WalletHistory struct {
+	*WalletTx
+	Pkh     HASH160 //地址公钥hash
+	Recv    Amount  //地址收到的金额
+	Sent    Amount  //地址消费的金额
+	Confirm uint32  //确认数,未确认为0
+}
+
+//WalletCoin 钱包中的一笔金额
+type WalletCoin struct {
+	Pkh   HASH160 //所属地址
+	TxID  HASH256 //所在交易
+	Index VarUInt //输出索引
+	Value Amount  //金额
+	Spent HASH256 //消费这笔金额的交易,未消费为零
+}
+
+//IsSpent 是否被消费(包括未确认的消费)
+func (c WalletCoin) IsSpent() bool {
+	return !c.Spent.IsZero()
+}
+
+func (c WalletCoin) key() []byte {
+	return GetDBKey(wcoinprefix, c.TxID[:], c.Index.Bytes())
+}
+
+func (c WalletCoin) value() []byte {
+	w := NewWriter()
+	if err := c.Pkh.Encode(w); err != nil {
+		panic(err)
+	}
+	if err := c.Value.Encode(w); err != nil {
+		panic(err)
+	}
+	if err := c.Spent.Encode(w); err != nil {
+		panic(err)
+	}
+	return w.Bytes()
+}
+
+func (c *WalletCoin) decode(b []byte) error {
+	r := NewReader(b)
+	if err := c.Pkh.Decode(r); err != nil {
+		return err
+	}
+	if err := c.Value.Decode(r); err != nil {
+		return err
+	}
+	return c.Spent.Decode(r)
+}
+
+//WalletBalance 钱包余额
+type WalletBalance struct {
+	Confirmed   Amount //已确认可用
+	Unconfirmed Amount //交易池中或者区块被断开未确认的
+	Immature    Amount //未成熟的coinbase
+}
+
+func (b WalletBalance) String() string {
+	return fmt.Sprintf("confirmed = %d, unconfirmed = %d, immature = %d", b.Confirmed, b.Unconfirmed, b.Immature)
+}
+
+//已处理的区块,用来回退
+type walletblock struct {
+	ID  HASH256
+	Txs []HASH256
+}
+
+func (wb walletblock) Bytes() []byte {
+	w := NewWriter()
+	if err := wb.ID.Encode(w); err != nil {
+		panic(err)
+	}
+	if err := VarUInt(len(wb.Txs)).Encode(w); err != nil {
+		panic(err)
+	}
+	for _, id := range wb.Txs {
+		if err := id.Encode(w); err != nil {
+			panic(err)
+		}
+	}
+	return w.Bytes()
+}
+
+func (wb *walletblock) decode(b []byte) error {
+	r := NewReader(b)
+	if err := wb.ID.Decode(r); err != nil {
+		return err
+	}
+	num := VarUInt(0)
+	if err := num.Decode(r); err != nil {
+		return err
+	}
+	wb.Txs = make([]HASH256, num.ToInt())
+	for i := range wb.Txs {
+		if err := wb.Txs[i].Decode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func heightkey(h uint32) []byte {
+	hb := []byte{0, 0, 0, 0}
+	binary.BigEndian.PutUint32(hb, h)
+	return hb
+}
+
+//Wallet 钱包,保存地址相关的交易历史和余额
+//订阅区块连接断开和交易池事件更新数据,交易状态改变时发布 WalletTxTopic
+type Wallet struct {
+	mu     sync.RWMutex
+	db     DBImp
+	addrs  map[HASH160]bool
+	best   uint32           //最后处理的区块高度
+	drops  map[HASH256]bool //从交易池移除的交易,下个区块中不存在将标记为冲突
+	tr     TRImp            //当前写入事务,一个区块的修改一起提交
+	pubs   []*WalletTx      //事务提交后发布的交易
+	qmu    sync.Mutex
+	queue  []interface{}
+	qch    chan bool
+	sch    chan interface{}
+	ps     *PubSub //订阅和发布事件使用的订阅器,来自启动时的区块链
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+//OpenWallet 打开钱包数据库
+func OpenWallet(dir string) (*Wallet, error) {
+	db, err := NewDBImp(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &Wallet{
+		db:    db,
+		addrs: map[HASH160]bool{},
+		best:  InvalidHeight,
+		drops: map[HASH256]bool{},
+		qch:   make(chan bool, 1),
+	}
+	iter := db.Iterator(NewPrefix(waddrprefix))
+	defer iter.Close()
+	for iter.Next() {
+		w.addrs[NewHASH160(iter.Key()[len(waddrprefix):])] = true
+	}
+	if bb, err := db.Get(wbestkey); err == nil && len(bb) == 4 {
+		w.best = binary.BigEndian.Uint32(bb)
+	}
+	return w, nil
+}
+
+//AddAddress 添加钱包地址,添加后需要调用 Sync 加载历史交易
+func (w *Wallet) AddAddress(addr Address) error {
+	pkh, err := addr.GetPkh()
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err = w.db.Put(waddrprefix, pkh[:], []byte{})
+	if err != nil {
+		return err
+	}
+	w.addrs[pkh] = true
+	return nil
+}
+
+//HasAddress 地址是否属于钱包
+func (w *Wallet) HasAddress(addr Address) bool {
+	pkh, err := addr.GetPkh()
+	if err != nil {
+		return false
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.addrs[pkh]
+}
+
+//BestHeight 钱包最后处理的区块高度,没有返回 InvalidHeight
+func (w *Wallet) BestHeight() uint32 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.best
+}
+
+//Start 订阅事件,同步区块链后在后台更新钱包
+//先订阅再同步,同步期间收到的事件缓存在队列中
+func (w *Wallet) Start(ctx context.Context, bi *BlockIndex) {
+	ctx, w.cancel = context.WithCancel(ctx)
+	w.ps = bi.GetPubSub()
+	w.sch = w.ps.Sub(NewLinkBlockTopic, UnlinkBlockTopic, TxPoolAddTxTopic, TxPoolDelTxTopic)
+	w.wg.Add(2)
+	go w.recvLoop(w.sch)
+	go w.execLoop(ctx, bi)
+}
+
+//Stop 停止后台更新
+func (w *Wallet) Stop() {
+	if w.cancel == nil {
+		return
+	}
+	w.ps.Unsub(w.sch)
+	w.cancel()
+	w.wg.Wait()
+	w.cancel = nil
+}
+
+//Close 关闭钱包
+func (w *Wallet) Close() {
+	w.Stop()
+	w.db.Close()
+}
+
+//接收订阅的消息放入队列,不阻塞发布者
+func (w *Wallet) recvLoop(ch chan interface{}) {
+	defer w.wg.Done()
+	for msg := range ch {
+		w.qmu.Lock()
+		w.queue = append(w.queue, msg)
+		w.qmu.Unlock()
+		select {
+		case w.qch <- true:
+		default:
+		}
+	}
+}
+
+func (w *Wallet) execLoop(ctx context.Context, bi *BlockIndex) {
+	defer w.wg.Done()
+	if err := w.Sync(bi); err != nil {
+		LogError("wallet sync error", err)
+	}
+	for {
+		select {
+		case <-w.qch:
+			w.qmu.Lock()
+			msgs := w.queue
+			w.queue = nil
+			w.qmu.Unlock()
+			for _, msg := range msgs {
+				err := w.dispatch(msg)
+				//错过了区块事件,重新和区块链同步
+				if errors.Is(err, ErrWalletBlockGap) {
+					err = w.Sync(bi)
+				}
+				if err != nil {
+					LogError("wallet process event error", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Wallet) dispatch(msg interface{}) error {
+	switch v := msg.(type) {
+	case *BlockInfo:
+		return w.OnLinkBlock(v)
+	case *UnlinkBlockEvent:
+		return w.OnUnlinkBlock(v.Blk)
+	case *TX:
+		return w.OnTxPool(v)
+	case HASH256:
+		w.OnTxPoolDel(v)
+	}
+	return nil
+}
+
+//Sync 和区块链同步,回退分叉的区块后加载新区块和交易池中的交易
+func (w *Wallet) Sync(bi *BlockIndex) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	//回退不在主链上的区块
+	for w.best != InvalidHeight {
+		wb, err := w.getBlock(w.best)
+		if err != nil {
+			return err
+		}
+		if blk, err := bi.LoadBlockWithH(int(w.best)); err == nil && blk.MustID().Equal(wb.ID) {
+			break
+		}
+		if err := w.revert(w.best, wb); err != nil {
+			return err
+		}
+	}
+	next := w.best + 1
+	if bi.Len() == 0 {
+		return nil
+	}
+	for h := next; h <= bi.Height(); h++ {
+		blk, err := bi.LoadBlockWithH(int(h))
+		if err != nil {
+			return err
+		}
+		if err := w.link(blk); err != nil {
+			return err
+		}
+	}
+	for _, tx := range bi.GetTxPool().AllTxs() {
+		if err := w.pushTx(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//OnLinkBlock 区块连接到主链,区块必须和钱包最后处理的区块连续
+func (w *Wallet) OnLinkBlock(blk *BlockInfo) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.link(blk)
+}
+
+//OnUnlinkBlock 区块从主链断开
+func (w *Wallet) OnUnlinkBlock(blk *BlockInfo) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if blk.Meta == nil || blk.Meta.Height != w.best {
+		return nil
+	}
+	wb, err := w.getBlock(w.best)
+	if err != nil {
+		return err
+	}
+	if !wb.ID.Equal(blk.MustID()) {
+		return nil
+	}
+	return w.revert(w.best, wb)
+}
+
+//OnTxPool 交易进入交易池
+func (w *Wallet) OnTxPool(tx *TX) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pushTx(tx)
+}
+
+//OnTxPoolDel 交易从交易池移除
+//如果下个区块没有包含这个交易将标记为冲突
+func (w *Wallet) OnTxPoolDel(id HASH256) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if wtx, err := w.getTx(id); err == nil && wtx.State == WalletTxPending {
+		w.drops[id] = true
+	}
+}
+
+//GetTx 获取钱包交易
+func (w *Wallet) GetTx(id HASH256) (*WalletTx, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.getTx(id)
+}
+
+//Confirm 获取交易确认数,未确认返回0
+func (w *Wallet) Confirm(wtx *WalletTx) uint32 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.confirm(wtx)
+}
+
+func (w *Wallet) confirm(wtx *WalletTx) uint32 {
+	if !wtx.IsConfirmed() || w.best == InvalidHeight || wtx.Height > w.best {
+		return 0
+	}
+	return w.best - wtx.Height + 1
+}
+
+//History 获取地址相关的交易记录,未确认的在前,然后按高度倒序
+//limit <= 0 获取所有
+func (w *Wallet) History(addr Address, limit int) ([]*WalletHistory, error) {
+	pkh, err := addr.GetPkh()
+	if err != nil {
+		return nil, err
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	prefix := GetDBKey(whisprefix, pkh[:])
+	iter := w.db.Iterator(NewPrefix(prefix))
+	defer iter.Close()
+	hs := []*WalletHistory{}
+	for iter.Next() {
+		id := NewHASH256(iter.Key()[len(prefix):])
+		wtx, err := w.getTx(id)
+		if err != nil {
+			return nil, err
+		}
+		wh := &WalletHistory{WalletTx: wtx, Pkh: pkh}
+		r := NewReader(iter.Value())
+		if err := wh.Recv.Decode(r); err != nil {
+			return nil, err
+		}
+		if err := wh.Sent.Decode(r); err != nil {
+			return nil, err
+		}
+		wh.Confirm = w.confirm(wtx)
+		hs = append(hs, wh)
+	}
+	sort.SliceStable(hs, func(i, j int) bool {
+		ci, cj := hs[i].IsConfirmed(), hs[j].IsConfirmed()
+		if ci != cj {
+			return !ci
+		}
+		return hs[i].Height > hs[j].Height
+	})
+	if limit > 0 && len(hs) > limit {
+		hs = hs[:limit]
+	}
+	return hs, nil
+}
+
+//Balance 获取地址余额,不指定地址获取整个钱包的余额
+//交易池中已经消费的金额不计算在内
+func (w *Wallet) Balance(addrs ...Address) (*WalletBalance, error) {
+	pkhs := map[HASH160]bool{}
+	for _, addr := range addrs {
+		pkh, err := addr.GetPkh()
+		if err != nil {
+			return nil, err
+		}
+		pkhs[pkh] = true
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	wtxs := map[HASH256]*WalletTx{}
+	bv := &WalletBalance{}
+	iter := w.db.Iterator(NewPrefix(wcoinprefix))
+	defer iter.Close()
+	for iter.Next() {
+		coin := &WalletCoin{}
+		if err := coin.decode(iter.Value()); err != nil {
+			return nil, err
+		}
+		if coin.IsSpent() || (len(pkhs) > 0 && !pkhs[coin.Pkh]) {
+			continue
+		}
+		copy(coin.TxID[:], iter.Key()[len(wcoinprefix):])
+		wtx, has := wtxs[coin.TxID]
+		if !has {
+			v, err := w.getTx(coin.TxID)
+			if err != nil {
+				return nil, err
+			}
+			wtx = v
+			wtxs[coin.TxID] = wtx
+		}
+		base := wtx.Tx.IsCoinBase()
+		switch wtx.State {
+		case WalletTxConfirmed:
+			if base && w.best+1-wtx.Height < CoinbaseMaturity {
+				bv.Immature += coin.Value
+			} else {
+				bv.Confirmed += coin.Value
+			}
+		case WalletTxPending, WalletTxReverted:
+			//被断开的coinbase不会再有效
+			if !base {
+				bv.Unconfirmed += coin.Value
+			}
+		}
+	}
+	return bv, nil
+}
+
+//交易是否和钱包相关
+func (w *Wallet) isMine(tx *TX) bool {
+	for _, out := range tx.Outs {
+		if pkh, err := out.Script.GetPkh(); err == nil && w.addrs[pkh] {
+			return true
+		}
+	}
+	if tx.IsCoinBase() {
+		return false
+	}
+	for _, in := range tx.Ins {
+		if has, err := w.store().Has(wcoinprefix, in.OutHash[:], in.OutIndex.Bytes()); err == nil && has {
+			return true
+		}
+	}
+	return false
+}
+
+//在一个事务中执行fn,成功后提交并发布交易状态,失败恢复内存状态
+func (w *Wallet) batch(fn func() error) error {
+	tr, err := w.db.Transaction()
+	if err != nil {
+		return err
+	}
+	best := w.best
+	drops := map[HASH256]bool{}
+	for id := range w.drops {
+		drops[id] = true
+	}
+	w.tr, w.pubs = tr, nil
+	defer func() {
+		w.tr, w.pubs = nil, nil
+	}()
+	if err = fn(); err == nil {
+		err = tr.Commit()
+	}
+	if err != nil {
+		tr.Discard()
+		w.best, w.drops = best, drops
+		return err
+	}
+	for _, wtx := range w.pubs {
+		w.pubsub().Pub(wtx, WalletTxTopic)
+	}
+	return nil
+}
+
+//当前写入的数据库,在事务中使用事务
+func (w *Wallet) store() TRImp {
+	if w.tr != nil {
+		return w.tr
+	}
+	return walletdb{w.db}
+}
+
+//发布交易状态改变,在事务中提交后发布
+func (w *Wallet) publish(wtx *WalletTx) {
+	if w.tr != nil {
+		w.pubs = append(w.pubs, wtx)
+		return
+	}
+	w.pubsub().Pub(wtx, WalletTxTopic)
+}
+
+//发布消息使用的订阅器,没有启动时使用全局订阅器
+func (w *Wallet) pubsub() *PubSub {
+	if w.ps != nil {
+		return w.ps
+	}
+	return GetPubSub()
+}
+
+//没有事务时直接写入数据库
+type walletdb struct {
+	DBImp
+}
+
+func (db walletdb) Commit() error {
+	return nil
+}
+
+func (db walletdb) Discard() {
+}
+
+func (w *Wallet) pushTx(tx *TX) error {
+	return w.batch(func() error {
+		return w.pushTxTr(tx)
+	})
+}
+
+func (w *Wallet) pushTxTr(tx *TX) error {
+	id, err := tx.ID()
+	if err != nil {
+		return err
+	}
+	delete(w.drops, id)
+	if wtx, err := w.getTx(id); err == nil {
+		if wtx.State == WalletTxReverted {
+			wtx.State = WalletTxPending
+			return w.putTx(wtx)
+		}
+		return nil
+	}
+	if !w.isMine(tx) {
+		return nil
+	}
+	if err := w.conflicts(tx, id); err != nil {
+		return err
+	}
+	return w.record(&WalletTx{Tx: tx, State: WalletTxPending})
+}
+
+func (w *Wallet) link(blk *BlockInfo) error {
+	if blk.Meta == nil {
+		return errors.New("block meta miss")
+	}
+	height := blk.Meta.Height
+	//已经处理过
+	if w.best != InvalidHeight && height <= w.best {
+		return nil
+	}
+	//必须连接在最后处理的区块之后
+	if w.best == InvalidHeight && height != 0 {
+		return fmt.Errorf("%w height=%d best=none", ErrWalletBlockGap, height)
+	}
+	if w.best != InvalidHeight {
+		last, err := w.getBlock(w.best)
+		if err != nil {
+			return err
+		}
+		if height != w.best+1 || !blk.Meta.Prev.Equal(last.ID) {
+			return fmt.Errorf("%w height=%d best=%d", ErrWalletBlockGap, height, w.best)
+		}
+	}
+	return w.batch(func() error {
+		return w.linkTr(blk)
+	})
+}
+
+func (w *Wallet) linkTr(blk *BlockInfo) error {
+	bid, err := blk.ID()
+	if err != nil {
+		return err
+	}
+	height := blk.Meta.Height
+	wb := walletblock{ID: bid}
+	for _, tx := range blk.Txs {
+		id, err := tx.ID()
+		if err != nil {
+			return err
+		}
+		delete(w.drops, id)
+		if err := w.conflicts(tx, id); err != nil {
+			return err
+		}
+		wtx, err := w.getTx(id)
+		if err == nil {
+			wtx.State = WalletTxConfirmed
+			wtx.BlkID = bid
+			wtx.Height = height
+			err = w.putTx(wtx)
+		} else if w.isMine(tx) {
+			wtx = &WalletTx{Tx: tx, State: WalletTxConfirmed, BlkID: bid, Height: height}
+			err = w.record(wtx)
+		} else {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		wb.Txs = append(wb.Txs, id)
+		w.publish(wtx)
+	}
+	//从交易池移除但没有进入区块的交易
+	for id := range w.drops {
+		if err := w.conflict(id); err != nil {
+			return err
+		}
+	}
+	w.drops = map[HASH256]bool{}
+	if err := w.store().Put(wblockprefix, heightkey(height), wb.Bytes()); err != nil {
+		return err
+	}
+	return w.setBest(height)
+}
+
+//回退高度h的区块
+func (w *Wallet) revert(h uint32, wb *walletblock) error {
+	return w.batch(func() error {
+		return w.revertTr(h, wb)
+	})
+}
+
+func (w *Wallet) revertTr(h uint32, wb *walletblock) error {
+	for i := len(wb.Txs) - 1; i >= 0; i-- {
+		wtx, err := w.getTx(wb.Txs[i])
+		if err != nil {
+			return err
+		}
+		if !wtx.IsConfirmed() {
+			continue
+		}
+		wtx.State = WalletTxReverted
+		wtx.BlkID = ZERO256
+		wtx.Height = 0
+		if err := w.putTx(wtx); err != nil {
+			return err
+		}
+		w.publish(wtx)
+	}
+	if err := w.store().Del(wblockprefix, heightkey(h)); err != nil {
+		return err
+	}
+	if h == 0 {
+		return w.setBest(InvalidHeight)
+	}
+	return w.setBest(h - 1)
+}
+
+//检测tx的输入是否和钱包中未确认的交易冲突
+func (w *Wallet) conflicts(tx *TX, id HASH256) error {
+	if tx.IsCoinBase() {
+		return nil
+	}
+	for _, in := range tx.Ins {
+		okey := in.OutKey()
+		bb, err := w.store().Get(wspentprefix, okey[:])
+		if err != nil {
+			continue
+		}
+		if sid := NewHASH256(bb); !sid.Equal(id) {
+			if err := w.conflict(sid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//标记交易冲突,恢复消费的金额,引用这个交易输出的交易也将冲突
+func (w *Wallet) conflict(id HASH256) error {
+	wtx, err := w.getTx(id)
+	if err != nil || wtx.IsConfirmed() || wtx.State == WalletTxConflicted {
+		return nil
+	}
+	wtx.State = WalletTxConflicted
+	if err := w.putTx(wtx); err != nil {
+		return err
+	}
+	delete(w.drops, id)
+	for _, in := range wtx.Tx.Ins {
+		okey := in.OutKey()
+		if bb, err := w.store().Get(wspentprefix, okey[:]); err == nil && NewHASH256(bb).Equal(id) {
+			if err := w.store().Del(wspentprefix, okey[:]); err != nil {
+				return err
+			}
+		}
+		coin, err := w.getCoin(in.OutHash, in.OutIndex)
+		if err != nil || !coin.Spent.Equal(id) {
+			continue
+		}
+		coin.Spent = ZERO256
+		if err := w.store().Put(coin.key(), coin.value()); err != nil {
+			return err
+		}
+	}
+	for idx := range wtx.Tx.Outs {
+		coin, err := w.getCoin(id, VarUInt(idx))
+		if err != nil {
+			continue
+		}
+		if coin.IsSpent() {
+			if err := w.conflict(coin.Spent); err != nil {
+				return err
+			}
+		}
+		if err := w.store().Del(coin.key()); err != nil {
+			return err
+		}
+	}
+	w.publish(wtx)
+	return nil
+}
+
+//记录新交易,更新金额和地址历史
+func (w *Wallet) record(wtx *WalletTx) error {
+	tx := wtx.Tx
+	id, err := tx.ID()
+	if err != nil {
+		return err
+	}
+	if err := w.putTx(wtx); err != nil {
+		return err
+	}
+	recv := map[HASH160]Amount{}
+	sent := map[HASH160]Amount{}
+	if !tx.IsCoinBase() {
+		for _, in := range tx.Ins {
+			okey := in.OutKey()
+			if err := w.store().Put(wspentprefix, okey[:], id[:]); err != nil {
+				return err
+			}
+			coin, err := w.getCoin(in.OutHash, in.OutIndex)
+			if err != nil {
+				continue
+			}
+			coin.Spent = id
+			if err := w.store().Put(coin.key(), coin.value()); err != nil {
+				return err
+			}
+			sent[coin.Pkh] += coin.Value
+		}
+	}
+	for idx, out := range tx.Outs {
+		pkh, err := out.Script.GetPkh()
+		if err != nil || !w.addrs[pkh] {
+			continue
+		}
+		coin := &WalletCoin{Pkh: pkh, TxID: id, Index: VarUInt(idx), Value: out.Value}
+		if err := w.store().Put(coin.key(), coin.value()); err != nil {
+			return err
+		}
+		recv[pkh] += out.Value
+	}
+	pkhs := map[HASH160]bool{}
+	for pkh := range recv {
+		pkhs[pkh] = true
+	}
+	for pkh := range sent {
+		pkhs[pkh] = true
+	}
+	for pkh := range pkhs {
+		buf := NewWriter()
+		if err := recv[pkh].Encode(buf); err != nil {
+			return err
+		}
+		if err := sent[pkh].Encode(buf); err != nil {
+			return err
+		}
+		if err := w.store().Put(whisprefix, pkh[:], id[:], buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Wallet) getTx(id HASH256) (*WalletTx, error) {
+	bb, err := w.store().Get(wtxprefix, id[:])
+	if err != nil {
+		return nil, err
+	}
+	wtx := &WalletTx{}
+	return wtx, wtx.Decode(NewReader(bb))
+}
+
+func (w *Wallet) putTx(wtx *WalletTx) error {
+	id, err := wtx.Tx.ID()
+	if err != nil {
+		return err
+	}
+	buf := NewWriter()
+	if err := wtx.Encode(buf); err != nil {
+		return err
+	}
+	return w.store().Put(wtxprefix, id[:], buf.Bytes())
+}
+
+func (w *Wallet) getCoin(id HASH256, idx VarUInt) (*WalletCoin, error) {
+	coin := &WalletCoin{TxID: id, Index: idx}
+	bb, err := w.store().Get(coin.key())
+	if err != nil {
+		return nil, err
+	}
+	return coin, coin.decode(bb)
+}
+
+func (w *Wallet) getBlock(h uint32) (*walletblock, error) {
+	bb, err := w.store().Get(wblockprefix, heightkey(h))
+	if err != nil {
+		return nil, fmt.Errorf("wallet block %d miss %w", h, err)
+	}
+	wb := &walletblock{}
+	return wb, wb.decode(bb)
+}
+
+func (w *Wallet) setBest(h uint32) error {
+	w.best = h
+	return w.store().Put(wbestkey, heightkey(h))
+}
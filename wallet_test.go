@@ -0,0 +1,206 @@
+package xginx
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+//创建a转账v给b的交易
+func newWalletTestTx(t *testing.T, bi *BlockIndex, a *Account, b *Account, coin *CoinKeyValue, v Amount) *TX {
+	tx := NewTx(DefaultExeLimit, DefaultTxScript)
+	in := &TxIn{}
+	in.OutHash = coin.TxID
+	in.OutIndex = coin.Index
+	sa, err := a.NewWitnessScript(DefaultInputScript).ToScript()
+	require.NoError(t, err)
+	in.Script = sa
+	in.Sequence = FinalSequence
+	out := &TxOut{}
+	out.Value = v
+	sb, err := b.NewLockedScript(nil, DefaultLockedScript)
+	require.NoError(t, err)
+	out.Script = sb
+	tx.Ins = append(tx.Ins, in)
+	tx.Outs = append(tx.Outs, out)
+	err = tx.Sign(bi, newaccsigner(a))
+	require.NoError(t, err)
+	return tx
+}
+
+//等待交易状态改变事件
+func waitWalletTx(t *testing.T, ch chan interface{}, id HASH256, state WalletTxState) {
+	timer := time.NewTimer(time.Second * 5)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-ch:
+			wtx, ok := msg.(*WalletTx)
+			if ok && wtx.ID().Equal(id) && wtx.State == state {
+				return
+			}
+		case <-timer.C:
+			t.Fatalf("wait wallet tx %v %v timeout", id, state)
+		}
+	}
+}
+
+//区块链测试中共用一个链
+func (suite *BlockTestSuite) TestWalletReorg() {
+	t := suite.T()
+	req := suite.Require()
+	bi := suite.bi
+
+	dir := NewTempDir()
+	defer os.RemoveAll(dir)
+	w, err := OpenWallet(dir)
+	req.NoError(err)
+	defer w.Close()
+
+	lis := GetTestListener(bi)
+	//矿工账户
+	a := lis.GetAccount(0)
+	//其他测试没有使用的账户
+	b := lis.GetAccount(2)
+	aaddr, err := a.GetAddress()
+	req.NoError(err)
+	baddr, err := b.GetAddress()
+	req.NoError(err)
+	req.NoError(w.AddAddress(aaddr))
+	req.NoError(w.AddAddress(baddr))
+
+	//同步历史区块,和链上的金额一致
+	req.NoError(w.Sync(bi))
+	req.Equal(bi.Height(), w.BestHeight())
+	coins, err := bi.ListCoins(aaddr)
+	req.NoError(err)
+	bv, err := w.Balance(aaddr)
+	req.NoError(err)
+	req.Equal(coins.Coins.Balance(), bv.Confirmed)
+	req.Equal(coins.Locks.Balance(), bv.Immature+bv.Unconfirmed)
+	hs, err := w.History(aaddr, 0)
+	req.NoError(err)
+	req.Equal(uint32(1), hs[0].Confirm)
+	req.Equal(bi.Height()+1, hs[len(hs)-1].Confirm)
+	//不连续的区块被拒绝
+	last, err := bi.LoadBlockWithH(int(bi.Height()))
+	req.NoError(err)
+	meta := *last.Meta
+	meta.Height++
+	gap := *last
+	gap.Meta = &meta
+	req.True(errors.Is(w.OnLinkBlock(&gap), ErrWalletBlockGap))
+	req.Equal(bi.Height(), w.BestHeight())
+
+	ps := bi.GetPubSub()
+	ch := ps.Sub(WalletTxTopic)
+	defer ps.Unsub(ch)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.Start(ctx, bi)
+
+	//进入交易池
+	coin := coins.Coins[0]
+	tx1 := newWalletTestTx(t, bi, a, b, coin, 2*Coin)
+	req.NoError(bi.GetTxPool().PushTx(bi, tx1))
+	id1 := tx1.MustID()
+	req.Eventually(func() bool {
+		wtx, err := w.GetTx(id1)
+		return err == nil && wtx.State == WalletTxPending
+	}, time.Second*5, time.Millisecond*10)
+	bv, err = w.Balance(baddr)
+	req.NoError(err)
+	req.Equal(2*Coin, bv.Unconfirmed)
+
+	//打包进区块
+	req.NoError(NewTestOneBlock())
+	waitWalletTx(t, ch, id1, WalletTxConfirmed)
+	bv, err = w.Balance(baddr)
+	req.NoError(err)
+	req.Equal(2*Coin, bv.Confirmed)
+	req.Equal(Amount(0), bv.Unconfirmed)
+	hs, err = w.History(baddr, 1)
+	req.NoError(err)
+	req.Equal(1, len(hs))
+	req.Equal(uint32(1), hs[0].Confirm)
+	req.Equal(2*Coin, hs[0].Recv)
+
+	//区块断开
+	req.NoError(bi.UnlinkLast())
+	waitWalletTx(t, ch, id1, WalletTxReverted)
+	bv, err = w.Balance(baddr)
+	req.NoError(err)
+	req.Equal(Amount(0), bv.Confirmed)
+	req.Equal(2*Coin, bv.Unconfirmed)
+
+	//同一笔金额被其他交易消费
+	tx2 := newWalletTestTx(t, bi, a, b, coin, 3*Coin)
+	req.NoError(bi.GetTxPool().PushTx(bi, tx2))
+	waitWalletTx(t, ch, id1, WalletTxConflicted)
+	bv, err = w.Balance(baddr)
+	req.NoError(err)
+	req.Equal(3*Coin, bv.Unconfirmed)
+	bi.GetTxPool().Del(bi, tx2.MustID())
+}
+
+//断开的区块数量超过订阅缓存时,订阅者读取链不能死锁
+func (suite *BlockTestSuite) TestWalletUnlinkMany() {
+	req := suite.Require()
+	genesis, err := suite.bi.LoadBlock(conf.genesis)
+	req.NoError(err)
+	sn, err := NewSimNet(1, genesis)
+	req.NoError(err)
+	defer sn.Close()
+	n := sn.Nodes[0]
+	bi := n.BlockIndex()
+	blks, err := n.Mine(15)
+	req.NoError(err)
+
+	dir := NewTempDir()
+	defer os.RemoveAll(dir)
+	w, err := OpenWallet(dir)
+	req.NoError(err)
+	defer w.Close()
+	addr, err := n.Listener().GetAccount(0).GetAddress()
+	req.NoError(err)
+	req.NoError(w.AddAddress(addr))
+
+	//订阅者处理每个事件时都需要读取链
+	ps := bi.GetPubSub()
+	ch := ps.Sub(UnlinkBlockTopic)
+	defer ps.Unsub(ch)
+	num := int32(0)
+	go func() {
+		for range ch {
+			bi.Height()
+			atomic.AddInt32(&num, 1)
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.Start(ctx, bi)
+	req.Eventually(func() bool {
+		return w.BestHeight() == bi.Height()
+	}, time.Second*5, time.Millisecond*10)
+
+	//回退到高度2,断开13个区块
+	done := make(chan error, 1)
+	go func() {
+		done <- bi.UnlinkTo(blks[1].MustID())
+	}()
+	select {
+	case err := <-done:
+		req.NoError(err)
+	case <-time.After(time.Second * 10):
+		req.FailNow("unlink blocks timeout")
+	}
+	req.Equal(uint32(2), bi.Height())
+	req.Eventually(func() bool {
+		return w.BestHeight() == 2 && atomic.LoadInt32(&num) == 13
+	}, time.Second*5, time.Millisecond*10)
+}
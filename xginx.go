@@ -28,11 +28,83 @@ func Run(lis IListener) {
 
 	LogInfof("xginx run config name = %s", conf.Name)
 
+	//升级旧格式的区块数据文件
+	if *IsMigrateStore {
+		codec, err := ParseChunkCodec(conf.Compress)
+		if err == nil {
+			err = MigrateBlkStore(conf.DataDir+"/blks", codec)
+		}
+		if err != nil {
+			LogError("migrate block store error", err)
+		}
+		conf.Close()
+		return
+	}
+
 	ps := GetPubSub()
 	defer ps.Shutdown()
 
 	bi := InitBlockIndex(lis)
 
+	//导出区块到引导文件
+	if *ExportFile != "" {
+		num, err := bi.ExportBootstrap(*ExportFile, func(pv uint) {
+			LogInfof("export block progress = %d%%", pv)
+		})
+		if err != nil {
+			LogError("export bootstrap file error", err)
+		} else {
+			LogInfof("export %d blocks to %s", num, *ExportFile)
+		}
+		bi.Close()
+		conf.Close()
+		return
+	}
+
+	//从引导文件导入区块,中断后再次导入会跳过已经存在的区块
+	if *ImportFile != "" {
+		_, err := bi.ImportBootstrap(*ImportFile, func(pv uint) {
+			LogInfof("import block progress = %d%%", pv)
+		})
+		if err != nil {
+			LogError("import bootstrap file error", err)
+		}
+	}
+
+	//输出存储统计
+	if *IsStoreStats {
+		bi.LogStoreStats()
+		bi.Close()
+		conf.Close()
+		return
+	}
+	//删除回退数据
+	if *IsPruneRev {
+		if num, err := bi.PruneRev(); err != nil {
+			LogError("prune rev data error", err)
+		} else {
+			LogInfof("prune rev data files %d", num)
+		}
+		bi.Close()
+		conf.Close()
+		return
+	}
+
+	//只检查区块链数据
+	if *IsVerifyChain {
+		err := bi.VerifyChain(func(pv uint) {
+			LogInfof("verify block main chain progress = %d%%", pv)
+		})
+		if err != nil {
+			LogError("verify block chain error", err)
+		} else {
+			LogInfo("verify block chain success")
+		}
+		bi.Close()
+		conf.Close()
+		return
+	}
+
 	csig := make(chan os.Signal)
 	xctx, xcancel = context.WithCancel(context.Background())
 	defer xcancel()
@@ -41,6 +113,9 @@ func Run(lis IListener) {
 
 	Miner.Start(xctx, lis)
 
+	//空闲时合并索引数据库
+	bi.StartCompactor(xctx, time.Second*time.Duration(conf.CompactIdle))
+
 	//延迟回调
 	time.Sleep(time.Millisecond * 300)
 	lis.OnStart()
@@ -140,6 +140,7 @@ var query = graphql.NewObject(graphql.ObjectConfig{
 	Name: "Query",
 	Fields: graphql.Fields{
 		"statusInfo":     statusInfo,
+		"estimateFee":    estimateFee,
 		"listCoin":       listCoin,
 		"blockInfo":      blockInfo,
 		"loadTxInfo":     loadTxInfo,
@@ -163,6 +164,7 @@ var matation = graphql.NewObject(graphql.ObjectConfig{
 		"newBlock":         newBlock,
 		"createTxMeta":     createTxMeta,
 		"sellProduct":      sellProduct,
+		"compactStore":     compactStore,
 	},
 	Description: "数据更新接口",
 })
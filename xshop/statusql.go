@@ -50,6 +50,38 @@ var ClientType = graphql.NewObject(graphql.ObjectConfig{
 			},
 			Description: "对端版本",
 		},
+		"proto": {
+			Type: graphql.Int,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				cli := p.Source.(*xginx.Client)
+				return cli.ProtoVer(), nil
+			},
+			Description: "双方使用的协议版本",
+		},
+		"recvBytes": {
+			Type: graphql.Float,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				cli := p.Source.(*xginx.Client)
+				return cli.RecvBytes(), nil
+			},
+			Description: "收到的字节数",
+		},
+		"sendBytes": {
+			Type: graphql.Float,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				cli := p.Source.(*xginx.Client)
+				return cli.SendBytes(), nil
+			},
+			Description: "发送的字节数",
+		},
+		"dropped": {
+			Type: graphql.Int,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				cli := p.Source.(*xginx.Client)
+				return cli.Dropped(), nil
+			},
+			Description: "超过限制丢弃的消息数量",
+		},
 	},
 	IsTypeOf: func(p graphql.IsTypeOfParams) bool {
 		_, ok := p.Value.(*xginx.Client)
@@ -58,6 +90,170 @@ var ClientType = graphql.NewObject(graphql.ObjectConfig{
 	Description: "链接信息",
 })
 
+var PrefixStatsType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "PrefixStats",
+	Fields: graphql.Fields{
+		"name": {
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				ps := p.Source.(xginx.PrefixStats)
+				return ps.Name, nil
+			},
+			Description: "前缀名称",
+		},
+		"count": {
+			Type: graphql.Int,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				ps := p.Source.(xginx.PrefixStats)
+				return ps.Count, nil
+			},
+			Description: "key数量",
+		},
+		"size": {
+			Type: graphql.Float,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				ps := p.Source.(xginx.PrefixStats)
+				return ps.Size, nil
+			},
+			Description: "key和value总长度",
+		},
+		"disk": {
+			Type: graphql.Float,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				ps := p.Source.(xginx.PrefixStats)
+				return ps.Disk, nil
+			},
+			Description: "估算的磁盘占用",
+		},
+	},
+	Description: "索引数据库前缀统计",
+})
+
+var ChunkStatsType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "ChunkStats",
+	Fields: graphql.Fields{
+		"files": {
+			Type: graphql.Int,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				cs := p.Source.(xginx.ChunkStats)
+				return len(cs.Files), nil
+			},
+			Description: "数据文件数量",
+		},
+		"total": {
+			Type: graphql.Float,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				cs := p.Source.(xginx.ChunkStats)
+				return cs.Total, nil
+			},
+			Description: "数据文件总长度",
+		},
+		"used": {
+			Type: graphql.Float,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				cs := p.Source.(xginx.ChunkStats)
+				return cs.Used, nil
+			},
+			Description: "所有区块头(包括分叉)引用的数据长度",
+		},
+		"count": {
+			Type: graphql.Int,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				cs := p.Source.(xginx.ChunkStats)
+				return cs.Count, nil
+			},
+			Description: "所有区块头(包括分叉)引用的记录数量",
+		},
+	},
+	Description: "数据文件统计",
+})
+
+var StoreStatsType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "StoreStats",
+	Fields: graphql.Fields{
+		"prefixes": {
+			Type: graphql.NewList(graphql.NewNonNull(PrefixStatsType)),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				ss := p.Source.(*xginx.StoreStats)
+				return ss.Prefixes, nil
+			},
+			Description: "索引数据库前缀统计",
+		},
+		"blk": {
+			Type: ChunkStatsType,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				ss := p.Source.(*xginx.StoreStats)
+				return ss.Blk, nil
+			},
+			Description: "区块数据文件",
+		},
+		"rev": {
+			Type: ChunkStatsType,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				ss := p.Source.(*xginx.StoreStats)
+				return ss.Rev, nil
+			},
+			Description: "回退数据文件",
+		},
+		"time": {
+			Type: graphql.DateTime,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				ss := p.Source.(*xginx.StoreStats)
+				return ss.Time, nil
+			},
+			Description: "统计时间",
+		},
+	},
+	Description: "区块存储统计",
+})
+
+var CompactStatusType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "CompactStatus",
+	Fields: graphql.Fields{
+		"running": {
+			Type: graphql.Boolean,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				cs := p.Source.(xginx.CompactStatus)
+				return cs.Running, nil
+			},
+			Description: "后台合并是否启动",
+		},
+		"name": {
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				cs := p.Source.(xginx.CompactStatus)
+				return cs.Name, nil
+			},
+			Description: "最后合并的前缀",
+		},
+		"last": {
+			Type: graphql.DateTime,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				cs := p.Source.(xginx.CompactStatus)
+				return cs.Last, nil
+			},
+			Description: "最后合并时间",
+		},
+		"cost": {
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				cs := p.Source.(xginx.CompactStatus)
+				return cs.Cost.String(), nil
+			},
+			Description: "最后合并用时",
+		},
+		"count": {
+			Type: graphql.Int,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				cs := p.Source.(xginx.CompactStatus)
+				return cs.Count, nil
+			},
+			Description: "合并次数",
+		},
+	},
+	Description: "数据库合并状态",
+})
+
 var statusInfo = &graphql.Field{
 	Type: graphql.NewObject(graphql.ObjectConfig{
 		Name: "StatusInfo",
@@ -86,6 +282,37 @@ var statusInfo = &graphql.Field{
 					return bi.CacheSize(), nil
 				},
 			},
+			"store": {
+				Type: StoreStatsType,
+				Args: graphql.FieldConfigArgument{
+					"refresh": {
+						Type:         graphql.Boolean,
+						DefaultValue: false,
+						Description:  "是否重新统计",
+					},
+				},
+				Description: "区块存储统计,默认返回缓存的结果,重新统计需要遍历索引数据库",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					bi := p.Source.(*xginx.BlockIndex)
+					maxage := xginx.StoreStatsMaxAge
+					if p.Args["refresh"].(bool) {
+						maxage = 0
+					}
+					ss, err := bi.GetStoreStats(maxage)
+					if err != nil {
+						return NewError(1, err)
+					}
+					return ss, nil
+				},
+			},
+			"compact": {
+				Type:        CompactStatusType,
+				Description: "索引数据库合并状态",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					bi := p.Source.(*xginx.BlockIndex)
+					return bi.GetCompactStatus(), nil
+				},
+			},
 			"clients": {
 				Type:        graphql.NewList(graphql.NewNonNull(ClientType)),
 				Description: "链接客户端",
@@ -101,3 +328,61 @@ var statusInfo = &graphql.Field{
 		return objs.BlockIndex(), nil
 	},
 }
+
+var compactStore = &graphql.Field{
+	Name: "CompactStore",
+	Args: graphql.FieldConfigArgument{
+		"name": {
+			Type:         graphql.String,
+			DefaultValue: "",
+			Description:  "合并的前缀名称,为空合并所有数据",
+		},
+	},
+	Type:        CompactStatusType,
+	Description: "合并索引数据库",
+	Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+		objs := GetObjects(p)
+		bi := objs.BlockIndex()
+		name := p.Args["name"].(string)
+		if err := bi.Compact(name); err != nil {
+			return NewError(1, err)
+		}
+		return bi.GetCompactStatus(), nil
+	},
+}
+
+var estimateFee = &graphql.Field{
+	Name: "EstimateFee",
+	Args: graphql.FieldConfigArgument{
+		"target": {
+			Type:         graphql.Int,
+			DefaultValue: 6,
+			Description:  "期望在多少个区块内确认",
+		},
+		"size": {
+			Type:         graphql.Int,
+			DefaultValue: 0,
+			Description:  "交易大小,为0时返回每千字节费率",
+		},
+	},
+	Type:        graphql.NewNonNull(AmountType),
+	Description: "根据最近区块和交易池数据估算交易费",
+	Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+		objs := GetObjects(p)
+		fe := objs.BlockIndex().GetFeeEstimator()
+		target := p.Args["target"].(int)
+		size := p.Args["size"].(int)
+		if size > 0 {
+			fee, err := fe.EstimateTxFee(target, size)
+			if err != nil {
+				return NewError(1, err)
+			}
+			return fee, nil
+		}
+		fee, err := fe.EstimateFee(target)
+		if err != nil {
+			return NewError(1, err)
+		}
+		return fee, nil
+	},
+}